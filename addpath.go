@@ -0,0 +1,251 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+// https://datatracker.ietf.org/doc/html/rfc7911 - Advertisement of Multiple Paths in BGP
+
+import (
+	"errors"
+	"net/netip"
+)
+
+const (
+	ADD_PATH = 69 // capability code
+
+	ADD_PATH_RECEIVE = 1
+	ADD_PATH_SEND    = 2
+)
+
+// AFI[2], SAFI[1], Send/Receive[1] for each family
+func addPath(mode byte, families []family) capability {
+	var v []byte
+	for _, f := range families {
+		afi := htons(f.afi)
+		v = append(v, afi[0], afi[1], f.safi, mode)
+	}
+	return capability{code: ADD_PATH, value: v}
+}
+
+// Families for which the peer is able to receive multiple paths
+func peerAddPathReceive(caps []capability) (ipv4, ipv6 bool) {
+	for _, c := range caps {
+		if c.code != ADD_PATH {
+			continue
+		}
+		for v := c.value; len(v) >= 4; v = v[4:] {
+			f := family{afi: uint16(v[0])<<8 | uint16(v[1]), safi: v[2]}
+			if v[3]&ADD_PATH_RECEIVE != 0 {
+				ipv4 = ipv4 || f == IPV4_UNICAST
+				ipv6 = ipv6 || f == IPV6_UNICAST
+			}
+		}
+	}
+	return
+}
+
+// Path Identifier[4], Length[1], Prefix[...]
+func nlriPathID(in []netip.Addr, id uint32, ipv4, ipv6 bool) (v4, v6 []byte) {
+	i := htonl(id)
+	for _, a := range in {
+		n4, n6 := nlriByVersion([]netip.Addr{a})
+		if ipv4 && len(n4) > 0 {
+			n4 = append(i[:], n4...)
+		}
+		if ipv6 && len(n6) > 0 {
+			n6 = append(i[:], n6...)
+		}
+		v4 = append(v4, n4...)
+		v6 = append(v6, n6...)
+	}
+	return
+}
+
+// The path identifier used for our own originated routes - those
+// passed to Session.AddPaths are allocated from 2 upwards
+const ORIGINATED_PATH_ID = 1
+
+// Up to n paths from the candidates, in order of preference
+func bestPaths(n int, candidates []ReceivedRoute) (paths []ReceivedRoute) {
+
+	c := append([]ReceivedRoute{}, candidates...)
+
+	for len(paths) < n {
+		i := BestPath(c)
+
+		if i < 0 {
+			break
+		}
+
+		paths = append(paths, c[i])
+		c = append(c[:i], c[i+1:]...)
+	}
+
+	return
+}
+
+// A path is identified by where it came from and where it goes
+type pathKey struct {
+	peer    netip.Addr
+	nextHop netip.Addr
+}
+
+// Path identifiers for each prefix, so that a path keeps the same
+// identifier for as long as it is advertised
+type pathIDs map[netip.Prefix]map[pathKey]uint32
+
+// Returns the identifier for each path, and those of any previously
+// advertised paths which are no longer present (to be withdrawn)
+func (p pathIDs) allocate(prefix netip.Prefix, paths []ReceivedRoute) (ids []uint32, withdrawn []uint32) {
+
+	old := p[prefix]
+	cur := map[pathKey]uint32{}
+	used := map[uint32]bool{}
+
+	for _, r := range paths {
+		if id, ok := old[pathKey{r.Peer, r.NextHop}]; ok {
+			used[id] = true
+		}
+	}
+
+	next := uint32(ORIGINATED_PATH_ID + 1)
+
+	for _, r := range paths {
+		k := pathKey{r.Peer, r.NextHop}
+		id, ok := old[k]
+
+		if !ok {
+			for used[next] {
+				next++
+			}
+			id = next
+			used[id] = true
+		}
+
+		cur[k] = id
+		ids = append(ids, id)
+	}
+
+	for k, id := range old {
+		if _, ok := cur[k]; !ok {
+			withdrawn = append(withdrawn, id)
+		}
+	}
+
+	if len(cur) > 0 {
+		p[prefix] = cur
+	} else {
+		delete(p, prefix)
+	}
+
+	return
+}
+
+// UPDATEs advertising up to n of the candidate paths for a host
+// prefix, each with its own path identifier and attributes, and
+// withdrawing any paths which are no longer selected
+func (a *advert) addPathUpdates(ids pathIDs, n int, prefix netip.Prefix, candidates []ReceivedRoute) ([]message, error) {
+
+	if !prefix.IsSingleIP() {
+		return nil, errors.New("Only host prefixes may be advertised: " + prefix.String())
+	}
+
+	ip := prefix.Addr()
+
+	if (ip.Is4() && !a.addPath4) || (ip.Is6() && !a.addPath6) {
+		return nil, nil // not negotiated for the family
+	}
+
+	var permitted []ReceivedRoute
+
+	for _, r := range candidates {
+		if a.originated(r.Route) && a.advertisable(r.Attributes) {
+			permitted = append(permitted, r)
+		}
+	}
+
+	paths := bestPaths(n, permitted)
+	add, del := ids.allocate(prefix, paths)
+
+	var updates []message
+
+	for _, id := range del {
+		w := *a
+		w.pathID = id
+		m, err := w.message(map[netip.Addr]bool{ip: false})
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, &m)
+	}
+
+	for i, r := range paths {
+		u := a.relay(r.Attributes)
+		u.pathID = add[i]
+		if a.external() {
+			u.MED = a.egressMED(ip, r.Attributes)
+		}
+		m, err := u.message(map[netip.Addr]bool{ip: true})
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, &m)
+	}
+
+	return updates, nil
+}
+
+type addPaths struct {
+	prefix     netip.Prefix
+	candidates []ReceivedRoute
+}
+
+// Advertise up to Parameters.AddPathSendCount of the candidate paths
+// (chosen by BestPath) for a host prefix to a peer which has
+// negotiated ADD-PATH. The prefix should not also be in the RIB.
+// Passing no candidates withdraws all paths for the prefix.
+func (s *Session) AddPaths(prefix netip.Prefix, candidates []ReceivedRoute) {
+	s.mutex.Lock()
+	if s.paths == nil {
+		s.paths = map[netip.Prefix][]ReceivedRoute{}
+	}
+	if len(candidates) > 0 {
+		s.paths[prefix] = candidates
+	} else {
+		delete(s.paths, prefix)
+	}
+	s.mutex.Unlock()
+
+	u := s.ribUpdate(nil)
+	u.paths = &addPaths{prefix: prefix, candidates: candidates}
+	s.c <- u
+}
+
+// Candidate paths to be advertised when a session is established -
+// none if they have been withdrawn (see WithdrawAll)
+func (s *Session) allPaths(withdrawn bool) (paths []addPaths) {
+	if withdrawn {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for p, c := range s.paths {
+		paths = append(paths, addPaths{prefix: p, candidates: c})
+	}
+	return
+}
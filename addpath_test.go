@@ -0,0 +1,328 @@
+package bgp
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// Path identifier and next hop of the single IPv4 NLRI in an UPDATE
+// sent with ADD-PATH, and whether it was withdrawn
+func addPathNLRI(t *testing.T, m message) (id uint32, nh netip.Addr, withdrawn bool) {
+	b := m.Body()
+
+	wl := int(b[0])<<8 | int(b[1])
+	w := b[2 : 2+wl]
+	al := int(b[2+wl])<<8 | int(b[3+wl])
+	n := b[4+wl+al:]
+
+	if len(w) > 0 {
+		n, withdrawn = w, true
+	} else {
+		nh, _ = netip.AddrFromSlice(findAttribute(b, NEXT_HOP)[0])
+	}
+
+	if len(n) != 9 || n[4] != 32 {
+		t.Fatalf("Unexpected NLRI: %v", n)
+	}
+
+	return uint32(n[0])<<24 | uint32(n[1])<<16 | uint32(n[2])<<8 | uint32(n[3]), nh, withdrawn
+}
+
+func TestAddPathSend(t *testing.T) {
+
+	prefix := hostRoute(ipv4_0)
+
+	route := func(peer, nh string, lp uint32) ReceivedRoute {
+		return ReceivedRoute{
+			Route: Route{Prefix: prefix, Attributes: Attributes{NextHop: netip.MustParseAddr(nh), LocalPref: lp}},
+			Peer:  netip.MustParseAddr(peer),
+		}
+	}
+
+	x := route("10.0.0.1", "10.1.1.1", 200)
+	y := route("10.0.0.2", "10.1.1.2", 150)
+	z := route("10.0.0.3", "10.1.1.3", 100)
+
+	a := advert{ASNumber: 65000, PeerASNumber: 65000, addPath4: true}
+	ids := pathIDs{}
+
+	updates, err := a.addPathUpdates(ids, 2, prefix, []ReceivedRoute{z, y, x})
+
+	if err != nil || len(updates) != 2 {
+		t.Fatalf("Expected two paths: %v %v", updates, err)
+	}
+
+	id1, nh1, _ := addPathNLRI(t, updates[0])
+	id2, nh2, _ := addPathNLRI(t, updates[1])
+
+	if nh1 != x.NextHop || nh2 != y.NextHop {
+		t.Fatalf("Best two paths not advertised: %v %v", nh1, nh2)
+	}
+
+	if id1 == id2 || id1 == ORIGINATED_PATH_ID || id2 == ORIGINATED_PATH_ID {
+		t.Fatalf("Path identifiers should be distinct: %d %d", id1, id2)
+	}
+
+	// refresh with the same paths in a different order - identifiers are unchanged
+	updates, _ = a.addPathUpdates(ids, 2, prefix, []ReceivedRoute{y, x, z})
+
+	if len(updates) != 2 {
+		t.Fatalf("Expected two paths: %v", updates)
+	}
+
+	if id, _, _ := addPathNLRI(t, updates[0]); id != id1 {
+		t.Errorf("Path identifier changed: %d %d", id, id1)
+	}
+
+	if id, _, _ := addPathNLRI(t, updates[1]); id != id2 {
+		t.Errorf("Path identifier changed: %d %d", id, id2)
+	}
+
+	// y is no longer selected, so is withdrawn
+	z.LocalPref = 175
+	updates, _ = a.addPathUpdates(ids, 2, prefix, []ReceivedRoute{y, x, z})
+
+	if len(updates) != 3 {
+		t.Fatalf("Expected a withdrawal and two paths: %v", updates)
+	}
+
+	if id, _, w := addPathNLRI(t, updates[0]); !w || id != id2 {
+		t.Errorf("Path %d should be withdrawn: %d %v", id2, id, w)
+	}
+
+	if id, nh, _ := addPathNLRI(t, updates[1]); id != id1 || nh != x.NextHop {
+		t.Errorf("Best path should keep its identifier: %d %v", id, nh)
+	}
+
+	if _, nh, _ := addPathNLRI(t, updates[2]); nh != z.NextHop {
+		t.Errorf("Second best path not advertised: %v", nh)
+	}
+
+	// not negotiated
+	a.addPath4 = false
+
+	if updates, _ = a.addPathUpdates(pathIDs{}, 2, prefix, []ReceivedRoute{x, y}); len(updates) != 0 {
+		t.Errorf("Paths should not be sent unless ADD-PATH is negotiated: %v", updates)
+	}
+}
+
+func TestAddPathCapability(t *testing.T) {
+
+	c := addPath(ADD_PATH_SEND|ADD_PATH_RECEIVE, []family{IPV4_UNICAST, IPV6_UNICAST})
+
+	if ipv4, ipv6 := peerAddPathReceive([]capability{c}); !ipv4 || !ipv6 {
+		t.Error("Peer should be able to receive:", c)
+	}
+
+	c = addPath(ADD_PATH_SEND, []family{IPV4_UNICAST})
+
+	if ipv4, ipv6 := peerAddPathReceive([]capability{c}); ipv4 || ipv6 {
+		t.Error("Peer should not be able to receive:", c)
+	}
+}
+
+func TestAddPathNoExport(t *testing.T) {
+
+	prefix := hostRoute(ipv4_0)
+
+	route := func(nh string, c ...Community) ReceivedRoute {
+		return ReceivedRoute{Route: Route{Prefix: prefix, Attributes: Attributes{NextHop: netip.MustParseAddr(nh), Communities: c}}}
+	}
+
+	x := route("10.1.1.1", NO_EXPORT)
+	y := route("10.1.1.2", NO_ADVERTISE)
+
+	internal := advert{ASNumber: 65000, PeerASNumber: 65000, addPath4: true}
+	external := advert{ASNumber: 65000, PeerASNumber: 65001, addPath4: true}
+
+	updates, err := internal.addPathUpdates(pathIDs{}, 2, prefix, []ReceivedRoute{x, y})
+
+	if err != nil || len(updates) != 1 {
+		t.Fatalf("Expected only the NO_EXPORT path to be advertised to iBGP: %v %v", updates, err)
+	}
+
+	if _, nh, _ := addPathNLRI(t, updates[0]); nh != x.NextHop {
+		t.Error("Wrong path advertised:", nh)
+	}
+
+	if updates, err = external.addPathUpdates(pathIDs{}, 2, prefix, []ReceivedRoute{x, y}); err != nil || len(updates) != 0 {
+		t.Errorf("No paths should be advertised to eBGP: %v %v", updates, err)
+	}
+}
+
+func TestAddPathMED(t *testing.T) {
+
+	prefix := hostRoute(ipv4_0)
+
+	x := ReceivedRoute{Route: Route{Prefix: prefix, Attributes: Attributes{NextHop: netip.MustParseAddr("10.1.1.1"), MED: 50}}}
+
+	med := func(a advert) []byte {
+		updates, err := a.addPathUpdates(pathIDs{}, 1, prefix, []ReceivedRoute{x})
+		if err != nil || len(updates) != 1 {
+			t.Fatalf("Expected one UPDATE: %v %v", updates, err)
+		}
+		if m := findAttribute(updates[0].Body(), MULTI_EXIT_DISC); len(m) > 0 {
+			return m[0]
+		}
+		return nil
+	}
+
+	internal := advert{ASNumber: 65000, PeerASNumber: 65000, addPath4: true}
+	external := advert{ASNumber: 65000, PeerASNumber: 65001, addPath4: true}
+
+	if m := med(internal); !bytes.Equal(m, []byte{0, 0, 0, 50}) {
+		t.Error("Received MED should be preserved to iBGP:", m)
+	}
+
+	if m := med(external); m != nil {
+		t.Error("Received MED should not be sent to eBGP:", m)
+	}
+
+	external.export = []PolicyRule{{Set: PolicySet{MED: 20}}}
+
+	if m := med(external); !bytes.Equal(m, []byte{0, 0, 0, 20}) {
+		t.Error("Export policy MED should be sent to eBGP:", m)
+	}
+}
+
+func TestAddPathNextHop(t *testing.T) {
+
+	prefix := hostRoute(ipv4_0)
+
+	x := ReceivedRoute{Route: Route{Prefix: prefix, Attributes: Attributes{NextHop: netip.MustParseAddr("10.1.1.1")}}}
+
+	nextHop := func(a advert) netip.Addr {
+		updates, err := a.addPathUpdates(pathIDs{}, 1, prefix, []ReceivedRoute{x})
+		if err != nil || len(updates) != 1 {
+			t.Fatalf("Expected one UPDATE: %v %v", updates, err)
+		}
+		_, nh, _ := addPathNLRI(t, updates[0])
+		return nh
+	}
+
+	self := netip.MustParseAddr("10.9.9.9")
+
+	internal := advert{ASNumber: 65000, PeerASNumber: 65000, addPath4: true, NextHop: self.As4()}
+	external := advert{ASNumber: 65000, PeerASNumber: 65001, addPath4: true, NextHop: self.As4()}
+
+	if nh := nextHop(internal); nh != x.NextHop {
+		t.Error("Received next hop should be kept for iBGP:", nh)
+	}
+
+	if nh := nextHop(external); nh != self {
+		t.Error("Next hop should be rewritten for eBGP by default:", nh)
+	}
+
+	external.nextHopMode4 = NEXT_HOP_UNCHANGED
+
+	if nh := nextHop(external); nh != x.NextHop {
+		t.Error("Received next hop should be kept for eBGP if unchanged:", nh)
+	}
+}
+
+func TestAdvertiseSelfOnly(t *testing.T) {
+
+	learned := ReceivedRoute{Route: Route{Prefix: hostRoute(ipv4_1), Attributes: Attributes{NextHop: netip.MustParseAddr("10.1.1.1")}, Learned: true}}
+
+	// prefixes in the first UPDATE after a mixed RIB is populated
+	advertised := func(p Parameters) map[netip.Prefix]bool {
+		p.ASNumber = 65000
+		p.AddPathSendCount = 1
+
+		s, peer := newTestSession(t, p, nil, nil)
+
+		if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+			t.Fatalf("Expected OPEN: %v", m)
+		}
+
+		peer.open(65001, addPath(ADD_PATH_RECEIVE, []family{IPV4_UNICAST}))
+
+		peer.next(time.Second) // initial (empty) advertisement
+
+		s.LocRIB([]netip.Addr{ipv4_0})
+		s.AddPaths(learned.Prefix, []ReceivedRoute{learned})
+
+		r := map[netip.Prefix]bool{}
+
+		for m := peer.next(time.Second); m != nil; m = peer.next(200 * time.Millisecond) {
+			if m.Type() != M_UPDATE {
+				t.Fatalf("Expected UPDATE: %v", m)
+			}
+			b := m.Body()
+			wl := int(b[0])<<8 | int(b[1])
+			al := int(b[2+wl])<<8 | int(b[3+wl])
+			for n := b[4+wl+al:]; len(n) >= 9; n = n[9:] {
+				r[netip.PrefixFrom(netip.AddrFrom4([4]byte{n[5], n[6], n[7], n[8]}), int(n[4]))] = true
+			}
+		}
+
+		return r
+	}
+
+	if r := advertised(Parameters{}); len(r) != 2 {
+		t.Error("Originated and learned prefixes should be advertised:", r)
+	}
+
+	if r := advertised(Parameters{AdvertiseSelfOnly: true}); len(r) != 1 || !r[hostRoute(ipv4_0)] {
+		t.Error("Only the originated prefix should be advertised:", r)
+	}
+
+	if r := advertised(Parameters{AdvertiseLearnedOnly: true}); len(r) != 1 || !r[learned.Prefix] {
+		t.Error("Only the learned prefix should be advertised:", r)
+	}
+}
+
+func TestWithdrawAllPaths(t *testing.T) {
+
+	learned := ReceivedRoute{Route: Route{Prefix: hostRoute(ipv4_1), Attributes: Attributes{NextHop: netip.MustParseAddr("10.1.1.1")}, Learned: true}}
+
+	p := Parameters{ASNumber: 65000, AddPathSendCount: 1, RouteRefresh: ROUTE_REFRESH_AUTO}
+
+	s, peer := newTestSession(t, p, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001, addPath(ADD_PATH_RECEIVE, []family{IPV4_UNICAST}), capability{code: ROUTE_REFRESH})
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	s.AddPaths(learned.Prefix, []ReceivedRoute{learned})
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	// path identifiers seen in UPDATEs, and whether they were withdrawn
+	paths := func() map[uint32]bool {
+		ids := map[uint32]bool{}
+		for m := peer.next(time.Second); m != nil; m = peer.next(200 * time.Millisecond) {
+			id, _, withdrawn := addPathNLRI(t, m)
+			ids[id] = withdrawn
+		}
+		return ids
+	}
+
+	s.WithdrawAll()
+
+	if ids := paths(); len(ids) != 2 || !ids[ORIGINATED_PATH_ID] || !ids[ORIGINATED_PATH_ID+1] {
+		t.Fatal("Originated prefix and ADD-PATH path should be withdrawn:", ids)
+	}
+
+	peer.send(&routeRefresh{family: IPV4_UNICAST})
+
+	if m := peer.next(200 * time.Millisecond); m != nil {
+		t.Fatal("Nothing should be re-sent by a route refresh:", m)
+	}
+
+	s.Configure(p)
+
+	if ids := paths(); len(ids) != 2 || ids[ORIGINATED_PATH_ID] || ids[ORIGINATED_PATH_ID+1] {
+		t.Error("Both should be advertised again after an update:", ids)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+// https://datatracker.ietf.org/doc/html/rfc4760#section-6
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+const (
+	UNNEGOTIATED_IGNORE = ""      // NLRI for the family are discarded, with a warning
+	UNNEGOTIATED_RESET  = "reset" // the session is reset with an UPDATE Message Error
+)
+
+// Families which the peer may send to us: IPv4 unicast is always
+// accepted, and IPv6 unicast if the session runs over IPv6 (as without
+// Multiprotocol we do the same) or both sides advertised the capability
+func acceptedFamilies(ipv6, multiprotocol, rtc bool, caps []capability) map[family]bool {
+	f := map[family]bool{IPV4_UNICAST: true}
+
+	if ipv6 || (multiprotocol && peerMultiprotocol(caps, IPV6_UNICAST)) {
+		f[IPV6_UNICAST] = true
+	}
+
+	if rtc {
+		f[RT_CONSTRAIN] = true
+	}
+
+	return f
+}
+
+// The first family in an MP_REACH_NLRI/MP_UNREACH_NLRI attribute of
+// the UPDATE which was not negotiated
+func (u *decoded) unnegotiated(accepted map[family]bool) (family, bool) {
+	for _, f := range u.families {
+		if !accepted[f] {
+			return f, true
+		}
+	}
+	return family{}, false
+}
+
+// Drop the NLRI for the families which were not negotiated. Only IPv4
+// and IPv6 unicast are imported, and the former is always accepted.
+func (u *decoded) discard(accepted map[family]bool) {
+
+	if accepted[IPV6_UNICAST] {
+		return
+	}
+
+	ipv4 := func(in []netip.Prefix) (out []netip.Prefix) {
+		for _, p := range in {
+			if p.Addr().Is4() {
+				out = append(out, p)
+			}
+		}
+		return
+	}
+
+	u.advertised = ipv4(u.advertised)
+	u.withdrawn = ipv4(u.withdrawn)
+	u.labeled = nil
+}
+
+func (f family) String() string {
+	return fmt.Sprintf("AFI %d/SAFI %d", f.afi, f.safi)
+}
@@ -0,0 +1,99 @@
+package bgp
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+type warningLog struct {
+	nul
+	warnings chan string
+}
+
+func (l *warningLog) BGPWarning(peer string, w string) {
+	l.warnings <- w
+}
+
+// An UPDATE with an IPv4 route and an IPv6 route in MP_REACH_NLRI,
+// sent on a session where IPv6 was not negotiated
+func sendUnnegotiated(t *testing.T, p Parameters, l BGPNotify) (*Session, *testPeer) {
+
+	s, peer := newTestSession(t, p, nil, l)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	a := advert{ASNumber: 65001, PeerASNumber: 65000, NextHop: [4]byte{10, 0, 0, 2}, NextHop6: IP6{0xfd, 15: 2}}
+	u, _ := a.message(map[netip.Addr]bool{ipv4_0: true, ipv6_0: true})
+	peer.send(&u)
+
+	return s, peer
+}
+
+func TestUnnegotiatedIgnore(t *testing.T) {
+
+	l := &warningLog{warnings: make(chan string, 10)}
+
+	s, _ := sendUnnegotiated(t, Parameters{ASNumber: 65000}, l)
+
+	for w := ""; !strings.Contains(w, "unnegotiated AFI 2/SAFI 1"); {
+		select {
+		case w = <-l.warnings:
+		case <-time.After(time.Second):
+			t.Fatal("No warning")
+		}
+	}
+
+	for i := 0; len(s.AdjRIBIn()) < 1; i++ {
+		if i > 100 {
+			t.Fatal("IPv4 route not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if r := s.AdjRIBIn(); len(r) != 1 || r[0].Prefix != hostRoute(ipv4_0) {
+		t.Error("Only the IPv4 route should be imported:", r)
+	}
+
+	if st := s.Status(); st.State != ESTABLISHED {
+		t.Error("Session should remain established:", st.State)
+	}
+}
+
+func TestUnnegotiatedReset(t *testing.T) {
+
+	_, peer := sendUnnegotiated(t, Parameters{ASNumber: 65000, UnnegotiatedAFIAction: UNNEGOTIATED_RESET}, nil)
+
+	for m := peer.next(time.Second); m != nil; m = peer.next(time.Second) {
+		if n, ok := m.(*notification); ok {
+			if n.code != UPDATE_MESSAGE_ERROR || n.sub != OPTIONAL_ATTRIBUTE_ERROR {
+				t.Error("Unexpected NOTIFICATION:", n.code, n.sub)
+			}
+			return
+		}
+	}
+
+	t.Error("Expected NOTIFICATION")
+}
+
+func TestAcceptedFamilies(t *testing.T) {
+
+	peer := []capability{mpCapability(IPV4_UNICAST), mpCapability(IPV6_UNICAST)}
+
+	if f := acceptedFamilies(false, false, false, peer); f[IPV6_UNICAST] || !f[IPV4_UNICAST] {
+		t.Error("IPv6 requires Multiprotocol:", f)
+	}
+
+	if f := acceptedFamilies(false, true, false, peer); !f[IPV6_UNICAST] {
+		t.Error("IPv6 should be negotiated:", f)
+	}
+
+	if f := acceptedFamilies(false, true, false, peer[:1]); f[IPV6_UNICAST] {
+		t.Error("IPv6 not supported by the peer:", f)
+	}
+}
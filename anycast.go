@@ -0,0 +1,157 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// Attributes for a prefix advertised as a backup - see
+// Session.SetBackup. Zero values leave the attribute unchanged.
+type Backup struct {
+	LocalPref   uint32      `json:"local_pref,omitempty"`  // for internal peers
+	Prepend     int         `json:"prepend,omitempty"`     // times our AS is prepended for external peers
+	Communities []Community `json:"communities,omitempty"` // added to mark the route as a backup
+}
+
+// Advertise prefix as a backup for primary, with the Parameters.Backup
+// attributes, while primary is healthy (see SetHealth). If primary is
+// reported unhealthy then the backup is promoted and advertised with
+// the normal attributes until the primary recovers. An invalid primary
+// makes prefix a primary again.
+func (s *Session) SetBackup(prefix, primary netip.Prefix) error {
+
+	if !prefix.IsValid() || !prefix.IsSingleIP() {
+		return errors.New("Only host prefixes may be advertised: " + prefix.String())
+	}
+
+	if primary.IsValid() && !primary.IsSingleIP() {
+		return errors.New("Only host prefixes may be advertised: " + primary.String())
+	}
+
+	ip := prefix.Addr().Unmap() // as in the RIB - see _rib.dup()
+
+	s.health.mutex.Lock()
+	defer s.health.mutex.Unlock()
+
+	s.mutex.Lock()
+	if s.health.backup == nil {
+		s.health.backup = map[netip.Addr]netip.Addr{}
+	}
+	if primary.IsValid() {
+		s.health.backup[ip] = primary.Addr().Unmap()
+	} else {
+		delete(s.health.backup, ip)
+	}
+	s.mutex.Unlock()
+
+	s.readvertise([]netip.Addr{ip})
+
+	return nil
+}
+
+// A prefix is advertised as a backup while its primary is healthy
+func (s *Session) isBackup(ip netip.Addr) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	primary, ok := s.health.backup[ip]
+
+	if !ok {
+		return false
+	}
+
+	if h, ok := s.health.health[primary]; ok {
+		return h.healthy
+	}
+
+	return true // primary's health has not been reported
+}
+
+// Backups which are promoted or demoted by a change in the primary's health
+func (s *Session) backups(primary netip.Addr) (b []netip.Addr) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for ip, p := range s.health.backup {
+		if p == primary {
+			b = append(b, ip)
+		}
+	}
+	return
+}
+
+// Send prefixes which are in the RIB again, with their current attributes
+func (s *Session) readvertise(ips []netip.Addr) {
+
+	var add []netip.Addr
+
+	u := s.ribUpdate(nil)
+
+	for _, ip := range ips {
+		if inRIB(u.RIB, ip) {
+			add = append(add, ip)
+		}
+	}
+
+	if len(add) > 0 {
+		u.add = add
+		s.c <- u
+	}
+}
+
+func (a *advert) backupFor(ip netip.Addr) bool {
+	return a.backup != nil && a.backupAttr != nil && a.backup(ip)
+}
+
+func (a *advert) backupAttributes(attr Attributes) Attributes {
+	b := a.backupAttr
+
+	if b.LocalPref > 0 && a.includeLocalPref() {
+		attr.LocalPref = b.LocalPref
+	}
+
+	if len(b.Communities) > 0 {
+		attr.Communities = append(append([]Community{}, attr.Communities...), b.Communities...)
+	}
+
+	if a.external() {
+		for i := 0; i < b.Prepend; i++ {
+			attr.ASPath = attr.ASPath.Prepend(uint32(a.ASNumber))
+		}
+	}
+
+	return attr
+}
+
+// AS_PATH for a backup sent to an external peer, with our AS prepended
+func (a *advert) backupPath() []uint32 {
+
+	path := a.path
+
+	if path == nil {
+		path = []uint32{uint32(a.ASNumber)}
+	}
+
+	for i := 0; i < a.backupAttr.Prepend; i++ {
+		path = append([]uint32{uint32(a.ASNumber)}, path...)
+	}
+
+	return path
+}
@@ -0,0 +1,96 @@
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestBackup(t *testing.T) {
+
+	backup := Backup{LocalPref: 50, Communities: []Community{65000<<16 | 666}}
+
+	p := Parameters{ASNumber: 65000, Backup: &backup}
+
+	s, peer := newTestSession(t, p, []netip.Addr{ipv4_0, ipv4_1}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65000)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	primary, secondary := hostRoute(ipv4_0), hostRoute(ipv4_1)
+
+	expect := func(lp uint32, tagged bool) {
+		m := peer.next(time.Second)
+
+		if m == nil || m.Type() != M_UPDATE {
+			t.Fatalf("Expected UPDATE: %v", m)
+		}
+
+		d, _ := decodeUpdate(m.Body())
+
+		if len(d.advertised) != 1 || d.advertised[0] != secondary {
+			t.Fatal("Backup should be advertised:", d.advertised, d.withdrawn)
+		}
+
+		if d.attributes.LocalPref != lp {
+			t.Error("Unexpected LOCAL_PREF:", d.attributes.LocalPref)
+		}
+
+		if communityMatch(backup.Communities, d.attributes.Communities) != tagged {
+			t.Error("Unexpected communities:", d.attributes.Communities)
+		}
+	}
+
+	s.SetBackup(secondary, primary)
+	expect(50, true)
+
+	// primary fails: it is withdrawn and the backup is promoted
+	s.SetHealth(primary, false)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	} else if d, _ := decodeUpdate(m.Body()); len(d.withdrawn) != 1 || d.withdrawn[0] != primary {
+		t.Error("Primary should be withdrawn:", d.withdrawn)
+	}
+
+	expect(100, false)
+
+	// primary recovers
+	s.SetHealth(primary, true)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	} else if d, _ := decodeUpdate(m.Body()); len(d.advertised) != 1 || d.advertised[0] != primary {
+		t.Error("Primary should be advertised:", d.advertised)
+	}
+
+	expect(50, true)
+}
+
+func TestBackupPrepend(t *testing.T) {
+
+	a := advert{ASNumber: 65000, PeerASNumber: 65001, backupAttr: &Backup{Prepend: 2}}
+	a.backup = func(ip netip.Addr) bool { return ip == ipv4_1 }
+
+	groups := a.groups(map[netip.Addr]bool{ipv4_0: true, ipv4_1: true})
+
+	if len(groups) != 2 {
+		t.Fatal("Expected primary and backup groups:", groups)
+	}
+
+	for _, g := range groups {
+		switch {
+		case g.nlri[ipv4_0] && g.advert.path != nil:
+			t.Error("Primary should have the default AS_PATH:", g.advert.path)
+		case g.nlri[ipv4_1] && len(g.advert.path) != 3:
+			t.Error("Backup should have our AS prepended twice:", g.advert.path)
+		}
+	}
+}
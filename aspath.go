@@ -0,0 +1,243 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type ASPathSegment struct {
+	Type uint8    `json:"type"` // AS_SET or AS_SEQUENCE
+	ASNs []uint32 `json:"asns"`
+}
+
+type ASPath []ASPathSegment
+
+// Canonical space-separated form, with AS_SET members enclosed in
+// braces, eg.: "65000 65001 {65002 65003}"
+func (p ASPath) String() string {
+	var s []string
+	for _, seg := range p {
+		var asns []string
+		for _, asn := range seg.ASNs {
+			asns = append(asns, fmt.Sprint(asn))
+		}
+		if seg.Type == AS_SET {
+			s = append(s, "{"+strings.Join(asns, " ")+"}")
+		} else {
+			s = append(s, asns...)
+		}
+	}
+	return strings.Join(s, " ")
+}
+
+// Path length for route selection - an AS_SET counts as 1 regardless
+// of the number of ASes in the set (RFC 4271 9.1.2.2)
+func (p ASPath) Length() (n int) {
+	for _, seg := range p {
+		if seg.Type == AS_SET {
+			n++
+		} else {
+			n += len(seg.ASNs)
+		}
+	}
+	return
+}
+
+// The AS from which the route was received - zero if not known (eg.
+// an empty AS_PATH from an internal peer)
+func (p ASPath) Neighbour() uint32 {
+	if len(p) > 0 && p[0].Type == AS_SEQUENCE && len(p[0].ASNs) > 0 {
+		return p[0].ASNs[0]
+	}
+	return 0
+}
+
+func (p ASPath) Contains(asn uint32) bool {
+	for _, seg := range p {
+		for _, a := range seg.ASNs {
+			if a == asn {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A new path with the AS added to the front. The AS is only added to
+// an initial AS_SEQUENCE - never into an AS_SET, which would change
+// the meaning of the aggregate - otherwise a new segment is created.
+func (p ASPath) Prepend(asn uint32) ASPath {
+
+	if len(p) > 0 && p[0].Type == AS_SEQUENCE && len(p[0].ASNs) < 255 {
+		seg := ASPathSegment{Type: AS_SEQUENCE, ASNs: append([]uint32{asn}, p[0].ASNs...)}
+		return append(ASPath{seg}, p[1:]...)
+	}
+
+	return append(ASPath{{Type: AS_SEQUENCE, ASNs: []uint32{asn}}}, p...)
+}
+
+// The ASes in a path which is made up only of AS_SEQUENCE segments
+func (p ASPath) sequence() (asns []uint32, ok bool) {
+	for _, seg := range p {
+		if seg.Type != AS_SEQUENCE {
+			return nil, false
+		}
+		asns = append(asns, seg.ASNs...)
+	}
+	return asns, true
+}
+
+// Each path segment is represented by a triple <path segment type,
+// path segment length, path segment value> where the length is the
+// number of ASes in the segment, each of which is 2 octets (or 4 for
+// AS4_PATH/four-octet AS speakers)
+func decodeASPath(d []byte, as4 bool) (ASPath, bool) {
+
+	size := 2
+
+	if as4 {
+		size = 4
+	}
+
+	var path ASPath
+
+	for len(d) > 0 {
+		if len(d) < 2 {
+			return nil, false
+		}
+
+		t := d[0]
+		n := int(d[1])
+		d = d[2:]
+
+		if (t != AS_SET && t != AS_SEQUENCE) || n == 0 || len(d) < n*size {
+			return nil, false
+		}
+
+		seg := ASPathSegment{Type: t}
+
+		for i := 0; i < n; i++ {
+			var asn uint32
+			for j := 0; j < size; j++ {
+				asn = asn<<8 | uint32(d[j])
+			}
+			seg.ASNs = append(seg.ASNs, asn)
+			d = d[size:]
+		}
+
+		path = append(path, seg)
+	}
+
+	return path, true
+}
+
+// Reconstruct the four-octet path from an AS_PATH (which contains
+// AS_TRANS for ASes which can't be represented in two octets) and an
+// AS4_PATH, which covers the most recent part of the path. The leading
+// ASes in AS_PATH which are not represented in AS4_PATH (added by
+// speakers which don't support four-octet ASes) are retained. If
+// AS4_PATH is longer then it is ignored (RFC 6793 section 4.2.3).
+func (p ASPath) merge(as4 ASPath) ASPath {
+
+	n := p.Length() - as4.Length()
+
+	if n < 0 {
+		return p
+	}
+
+	var path ASPath
+
+	for _, seg := range p {
+		if n < 1 {
+			break
+		}
+
+		if seg.Type == AS_SET {
+			path = append(path, seg)
+			n--
+			continue
+		}
+
+		if len(seg.ASNs) > n {
+			seg = ASPathSegment{Type: AS_SEQUENCE, ASNs: seg.ASNs[:n]}
+		}
+
+		path = append(path, seg)
+		n -= len(seg.ASNs)
+	}
+
+	// join the leading ASes to the start of AS4_PATH's first sequence
+	if l := len(path) - 1; l >= 0 && len(as4) > 0 && path[l].Type == AS_SEQUENCE && as4[0].Type == AS_SEQUENCE &&
+		len(path[l].ASNs)+len(as4[0].ASNs) <= 255 {
+		asns := append(append([]uint32{}, path[l].ASNs...), as4[0].ASNs...)
+		path[l] = ASPathSegment{Type: AS_SEQUENCE, ASNs: asns}
+		return append(path, as4[1:]...)
+	}
+
+	return append(path, as4...)
+}
+
+// A regular expression matched against the canonical string form of
+// an AS_PATH, eg.: `^65000( 65001)*$`
+type ASPathMatch struct {
+	re *regexp.Regexp
+}
+
+func CompileASPathRegex(s string) (*ASPathMatch, error) {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return nil, err
+	}
+	return &ASPathMatch{re: re}, nil
+}
+
+func (m *ASPathMatch) Match(p ASPath) bool {
+	return m.re.MatchString(p.String())
+}
+
+func (m *ASPathMatch) String() string {
+	return m.re.String()
+}
+
+func (m *ASPathMatch) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.re.String())
+}
+
+func (m *ASPathMatch) UnmarshalJSON(data []byte) error {
+	var s string
+
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("Badly formed AS_PATH regular expression")
+	}
+
+	re, err := regexp.Compile(s)
+
+	if err != nil {
+		return err
+	}
+
+	m.re = re
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package bgp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+func TestASPathDecode(t *testing.T) {
+
+	d := []byte{
+		AS_SEQUENCE, 2, 0xfd, 0xe8, 0xfd, 0xe9, // 65000 65001
+		AS_SET, 2, 0xfd, 0xea, 0xfd, 0xeb, // {65002 65003}
+	}
+
+	path, ok := decodeASPath(d, false)
+
+	if !ok || path.String() != "65000 65001 {65002 65003}" {
+		t.Fatalf("AS_PATH decode incorrect: %v", path)
+	}
+
+	if _, ok := decodeASPath(d[:len(d)-1], false); ok {
+		t.Fatalf("Truncated AS_PATH should fail")
+	}
+
+	if _, ok := decodeASPath([]byte{3, 1, 0, 1}, false); ok {
+		t.Fatalf("Invalid segment type should fail")
+	}
+
+	path, ok = decodeASPath([]byte{AS_SEQUENCE, 1, 0, 1, 0, 0}, true)
+
+	if !ok || path.String() != "65536" {
+		t.Fatalf("Four octet AS_PATH decode incorrect: %v", path)
+	}
+}
+
+func TestASPathRegex(t *testing.T) {
+
+	m, err := CompileASPathRegex(`^65000( 65001)*$`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path ASPath
+		want bool
+	}{
+		{ASPath{{Type: AS_SEQUENCE, ASNs: []uint32{65000}}}, true},
+		{ASPath{{Type: AS_SEQUENCE, ASNs: []uint32{65000, 65001, 65001}}}, true},
+		{ASPath{{Type: AS_SEQUENCE, ASNs: []uint32{65000, 65002}}}, false},
+		{ASPath{{Type: AS_SEQUENCE, ASNs: []uint32{64999, 65000}}}, false},
+		{nil, false},
+	}
+
+	for _, test := range tests {
+		if m.Match(test.path) != test.want {
+			t.Fatalf("%s: expected %v", test.path, test.want)
+		}
+	}
+
+	if m, err = CompileASPathRegex(`(^| )65002( |$)`); err != nil {
+		t.Fatal(err)
+	}
+
+	if !m.Match(ASPath{{Type: AS_SEQUENCE, ASNs: []uint32{65000, 65002, 65003}}}) {
+		t.Fatalf("Transit AS should match")
+	}
+
+	if m.Match(ASPath{{Type: AS_SEQUENCE, ASNs: []uint32{65000, 650021}}}) {
+		t.Fatalf("Partial ASN should not match")
+	}
+
+	var p PolicyMatch
+
+	if err := json.Unmarshal([]byte(`{"as_path":"^65000$"}`), &p); err != nil || p.ASPath.String() != "^65000$" {
+		t.Fatalf("JSON AS_PATH regular expression incorrect: %v", err)
+	}
+}
+
+func TestASSet(t *testing.T) {
+
+	// AS_SEQUENCE 65001, AS_SET {65002 65003}
+	d := []byte{AS_SEQUENCE, 1, 0xfd, 0xe9, AS_SET, 2, 0xfd, 0xea, 0xfd, 0xeb}
+
+	p, ok := decodeASPath(d, false)
+
+	if !ok || p.String() != "65001 {65002 65003}" {
+		t.Fatalf("AS_PATH decode failed: %v", p)
+	}
+
+	if p.Length() != 2 {
+		t.Errorf("AS_SET should count as one: %d", p.Length())
+	}
+
+	// re-advertised to an external peer
+	a := advert{ASNumber: 65000, PeerASNumber: 65100, NextHop: [4]byte{10, 1, 2, 3}}
+	r := a.relay(Attributes{ASPath: p})
+
+	msg, err := r.message(map[netip.Addr]bool{ipv4_0: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, n := decodeUpdate(msg)
+
+	if n != nil || u.attributes.ASPath.String() != "65000 65001 {65002 65003}" || u.attributes.ASPath.Length() != 3 {
+		t.Fatalf("AS_SET not preserved: %v %v", n, u.attributes.ASPath)
+	}
+
+	if p.String() != "65001 {65002 65003}" {
+		t.Errorf("Original path should not be modified: %v", p)
+	}
+
+	// never prepend into a set
+	set := ASPath{{Type: AS_SET, ASNs: []uint32{65002, 65003}}}
+
+	if s := set.Prepend(65000); s.String() != "65000 {65002 65003}" || len(s) != 2 || s[1].Type != AS_SET {
+		t.Errorf("Prepend should add a new segment: %v", s)
+	}
+
+	// internal peers get the path unchanged
+	a.PeerASNumber = 65000
+	r = a.relay(Attributes{ASPath: set})
+
+	msg, _ = r.message(map[netip.Addr]bool{ipv4_0: true})
+
+	if u, n = decodeUpdate(msg); n != nil || u.attributes.ASPath.String() != "{65002 65003}" {
+		t.Errorf("AS_PATH should be unchanged for internal peer: %v %v", n, u.attributes.ASPath)
+	}
+}
+
+func TestAS4PathMerge(t *testing.T) {
+
+	// 65001 AS_TRANS AS_TRANS {65002 AS_TRANS}, with AS4_PATH 70000 80000 {65002 90000}
+	as_path := []byte{
+		AS_SEQUENCE, 3, 0xfd, 0xe9, 0x5b, 0xa0, 0x5b, 0xa0,
+		AS_SET, 2, 0xfd, 0xea, 0x5b, 0xa0,
+	}
+
+	as4_path := []byte{
+		AS_SEQUENCE, 2, 0, 1, 0x11, 0x70, 0, 1, 0x38, 0x80,
+		AS_SET, 2, 0, 0, 0xfd, 0xea, 0, 1, 0x5f, 0x90,
+	}
+
+	var attr []byte
+	attr = append(attr, WTCR, ORIGIN, 1, IGP)
+	attr = append(attr, WTCR, AS_PATH, byte(len(as_path)))
+	attr = append(attr, as_path...)
+	attr = append(attr, OTCR, AS4_PATH, byte(len(as4_path)))
+	attr = append(attr, as4_path...)
+	attr = append(attr, WTCR, NEXT_HOP, 4, 10, 1, 2, 3)
+
+	msg := append(append([]byte{0, 0, 0, byte(len(attr))}, attr...), 24, 10, 0, 0)
+
+	u, n := decodeUpdate(msg)
+
+	if n != nil {
+		t.Fatal(n)
+	}
+
+	p := u.attributes.ASPath
+
+	if len(p) != 2 || fmt.Sprint(p[0].ASNs) != fmt.Sprint([]uint32{65001, 70000, 80000}) ||
+		p[1].Type != AS_SET || fmt.Sprint(p[1].ASNs) != fmt.Sprint([]uint32{65002, 90000}) {
+		t.Errorf("Four-octet AS_PATH not reconstructed: %v", p)
+	}
+
+	// an AS4_PATH longer than AS_PATH is ignored
+	short := ASPath{{Type: AS_SEQUENCE, ASNs: []uint32{AS_TRANS}}}
+	long := ASPath{{Type: AS_SEQUENCE, ASNs: []uint32{70000, 80000}}}
+
+	if m := short.merge(long); m.String() != "23456" {
+		t.Error("Longer AS4_PATH should be ignored:", m)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+// https://datatracker.ietf.org/doc/html/rfc4271#section-9.1.2 - Phase 2: Route Selection
+
+import (
+	"net/netip"
+)
+
+// A route learned from a peer
+type ReceivedRoute struct {
+	Route
+	Peer     netip.Addr `json:"peer"`      // address of the peer that the route was learned from
+	RouterID IP4        `json:"router_id"` // BGP identifier of the peer
+	External bool       `json:"external"`  // learned over an eBGP session
+
+	NextHopUnreachable bool `json:"next_hop_unreachable,omitempty"` // see UNREACHABLE_DEPREF
+	Stale              bool `json:"stale,omitempty"`                // retained while the peer restarts
+}
+
+func (r *ReceivedRoute) localPref() uint32 {
+	if r.LocalPref > 0 {
+		return r.LocalPref
+	}
+	return 100
+}
+
+// Returns the index of the preferred route among the candidates, or -1
+// if there are none.
+func BestPath(candidates []ReceivedRoute) int {
+	return BestPathIGP(candidates, nil)
+}
+
+// As BestPath, with igp (if not nil) returning the interior cost to
+// reach a next hop.
+func BestPathIGP(candidates []ReceivedRoute, igp func(netip.Addr) uint32) int {
+
+	var set []int
+
+	for i := range candidates {
+		set = append(set, i)
+	}
+
+	// each step eliminates less preferred routes from the set
+	keep := func(better func(a, b *ReceivedRoute) bool) {
+		var best []int
+		for _, i := range set {
+			worse := false
+			for _, j := range set {
+				if better(&candidates[j], &candidates[i]) {
+					worse = true
+					break
+				}
+			}
+			if !worse {
+				best = append(best, i)
+			}
+		}
+		set = best
+	}
+
+	// routes with a reachable next hop
+	keep(func(a, b *ReceivedRoute) bool { return !a.NextHopUnreachable && b.NextHopUnreachable })
+
+	// routes which are not stale - as with LLGR_STALE (RFC 9494 4.3)
+	keep(func(a, b *ReceivedRoute) bool { return !a.Stale && b.Stale })
+
+	// highest LOCAL_PREF
+	keep(func(a, b *ReceivedRoute) bool { return a.localPref() > b.localPref() })
+
+	// shortest AS_PATH
+	keep(func(a, b *ReceivedRoute) bool { return a.ASPath.Length() < b.ASPath.Length() })
+
+	// lowest ORIGIN (IGP < EGP < INCOMPLETE)
+	keep(func(a, b *ReceivedRoute) bool { return a.Origin < b.Origin })
+
+	// lowest MED, only comparable between routes from the same neighbouring AS
+	keep(func(a, b *ReceivedRoute) bool {
+		return a.ASPath.Neighbour() == b.ASPath.Neighbour() && a.MED < b.MED
+	})
+
+	// eBGP over iBGP
+	keep(func(a, b *ReceivedRoute) bool { return a.External && !b.External })
+
+	// lowest interior cost to the next hop
+	if igp != nil {
+		keep(func(a, b *ReceivedRoute) bool { return igp(a.NextHop) < igp(b.NextHop) })
+	}
+
+	// lowest BGP identifier
+	keep(func(a, b *ReceivedRoute) bool {
+		return netip.AddrFrom4(a.RouterID).Less(netip.AddrFrom4(b.RouterID))
+	})
+
+	// lowest peer address
+	keep(func(a, b *ReceivedRoute) bool { return a.Peer.Less(b.Peer) })
+
+	if len(set) < 1 {
+		return -1
+	}
+
+	return set[0]
+}
@@ -0,0 +1,94 @@
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestBestPath(t *testing.T) {
+
+	path := func(asns ...uint32) ASPath {
+		return ASPath{{Type: AS_SEQUENCE, ASNs: asns}}
+	}
+
+	route := func(lp uint32, p ASPath, origin uint8, med uint32, external bool, id byte, peer string) ReceivedRoute {
+		return ReceivedRoute{
+			Route:    Route{Attributes: Attributes{LocalPref: lp, ASPath: p, Origin: origin, MED: med, NextHop: netip.MustParseAddr(peer)}},
+			External: external,
+			RouterID: IP4{10, 0, 0, id},
+			Peer:     netip.MustParseAddr(peer),
+		}
+	}
+
+	igp := func(a netip.Addr) uint32 {
+		if a == netip.MustParseAddr("10.1.1.2") {
+			return 10
+		}
+		return 20
+	}
+
+	tests := []struct {
+		name string
+		want int
+		c    []ReceivedRoute
+	}{
+		{"LOCAL_PREF", 1, []ReceivedRoute{
+			route(100, path(1), IGP, 0, true, 1, "10.1.1.1"),
+			route(200, path(1, 2), IGP, 0, true, 2, "10.1.1.2"),
+		}},
+		{"AS_PATH", 1, []ReceivedRoute{
+			route(0, path(1, 2, 3), IGP, 0, true, 1, "10.1.1.1"),
+			route(0, path(1, 2), IGP, 0, true, 2, "10.1.1.2"),
+		}},
+		{"AS_SET", 0, []ReceivedRoute{
+			route(0, ASPath{{Type: AS_SEQUENCE, ASNs: []uint32{1}}, {Type: AS_SET, ASNs: []uint32{2, 3, 4}}}, IGP, 0, true, 1, "10.1.1.1"),
+			route(0, path(1, 2, 3), IGP, 0, true, 2, "10.1.1.2"),
+		}},
+		{"ORIGIN", 1, []ReceivedRoute{
+			route(0, path(1), EGP, 0, true, 1, "10.1.1.1"),
+			route(0, path(2), IGP, 0, true, 2, "10.1.1.2"),
+		}},
+		{"MED", 1, []ReceivedRoute{
+			route(0, path(1), IGP, 20, true, 1, "10.1.1.1"),
+			route(0, path(1), IGP, 10, true, 2, "10.1.1.2"),
+		}},
+		{"MED different AS", 0, []ReceivedRoute{
+			route(0, path(1), IGP, 20, true, 1, "10.1.1.1"),
+			route(0, path(2), IGP, 10, true, 2, "10.1.1.2"),
+		}},
+		{"eBGP", 1, []ReceivedRoute{
+			route(0, path(1), IGP, 0, false, 1, "10.1.1.1"),
+			route(0, path(1), IGP, 0, true, 2, "10.1.1.2"),
+		}},
+		{"IGP metric", 1, []ReceivedRoute{
+			route(0, path(1), IGP, 0, true, 1, "10.1.1.1"),
+			route(0, path(1), IGP, 0, true, 2, "10.1.1.2"),
+		}},
+		{"router ID", 1, []ReceivedRoute{
+			route(0, path(1), IGP, 0, true, 2, "10.1.1.1"),
+			route(0, path(1), IGP, 0, true, 1, "10.1.1.3"),
+		}},
+		{"peer address", 1, []ReceivedRoute{
+			route(0, path(1), IGP, 0, true, 1, "10.1.1.3"),
+			route(0, path(1), IGP, 0, true, 1, "10.1.1.1"),
+		}},
+	}
+
+	for _, test := range tests {
+		var best int
+
+		if test.name == "IGP metric" {
+			best = BestPathIGP(test.c, igp)
+		} else {
+			best = BestPath(test.c)
+		}
+
+		if best != test.want {
+			t.Fatalf("%s: expected %d, got %d", test.name, test.want, best)
+		}
+	}
+
+	if BestPath(nil) != -1 {
+		t.Fatalf("No candidates should return -1")
+	}
+}
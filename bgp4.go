@@ -42,8 +42,9 @@ const (
 	M_NOTIFICATION = 3
 	M_KEEPALIVE    = 4
 
-	IGP = 0
-	EGP = 1
+	IGP        = 0
+	EGP        = 1
+	INCOMPLETE = 2
 
 	//https://www.rfc-editor.org/rfc/rfc3392.txt
 	CAPABILITIES_OPTIONAL_PARAMETER = 2 // Capabilities Optional Parameter (Parameter Type 2)
@@ -60,6 +61,15 @@ const (
 	COMMUNITIES     = 8
 	MP_REACH_NLRI   = 14 // Multiprotocol Reachable NLRI - MP_REACH_NLRI (Type Code 14)
 	MP_UNREACH_NLRI = 15 // Multiprotocol Unreachable NLRI - MP_UNREACH_NLRI (Type Code 15)
+	AS4_PATH        = 17 // [RFC6793]
+
+	ATOMIC_AGGREGATE     = 6
+	AGGREGATOR           = 7
+	AS4_AGGREGATOR       = 18 // [RFC6793]
+	EXTENDED_COMMUNITIES = 16 // [RFC4360]
+	LARGE_COMMUNITIES    = 32 // [RFC8092]
+
+	AS_TRANS = 23456 // [RFC6793]
 
 	AS_SET      = 1
 	AS_SEQUENCE = 2
@@ -78,6 +88,8 @@ const (
 	UNNACEPTABLE_HOLD_TIME     = 6 // OPEN_MESSAGE_ERROR
 	BAD_MESSAGE_TYPE           = 3 // MESSAGE_HEADER_ERROR
 	ADMINISTRATIVE_SHUTDOWN    = 2 // CEASE
+	ADMINISTRATIVE_RESET       = 4 // CEASE
+	OTHER_CONFIGURATION_CHANGE = 6 // CEASE
 	OUT_OF_RESOURCES           = 8 // CEASE
 
 	// Optional/Well-known, Non-transitive/Transitive Complete/Partial Regular/Extended-length
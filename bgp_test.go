@@ -2,6 +2,8 @@ package bgp
 
 import (
 	"net/netip"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -156,7 +158,11 @@ func TestUpdateMessage(t *testing.T) {
 		PeerASNumber: 65000,
 	}
 
-	update := a.message(rib)
+	update, err := a.message(rib)
+
+	if err != nil {
+		t.Fatalf("iBGP UPDATE message failed: %s", err.Error())
+	}
 
 	if !byteSliceEqual(update, internal) {
 		t.Fatalf("iBGP UPDATE message incorrect: %v", update)
@@ -164,9 +170,594 @@ func TestUpdateMessage(t *testing.T) {
 
 	a.PeerASNumber = 65001
 
-	update = a.message(rib)
+	update, err = a.message(rib)
 
-	if !byteSliceEqual(a.message(rib), external) {
+	if err != nil || !byteSliceEqual(update, external) {
 		t.Fatalf("eBGP UPDATE message incorrect: %v", update)
 	}
 }
+
+func TestCommunitiesLength(t *testing.T) {
+
+	attr, err := communities([]Community{0xfde80064})
+
+	if err != nil || !byteSliceEqual(attr, []byte{0xc0, 8, 4, 0xfd, 0xe8, 0, 100}) {
+		t.Fatalf("COMMUNITIES 65000:100 incorrect: %v", attr)
+	}
+
+	attr, err = communities(make([]Community, 64))
+
+	if err != nil || !byteSliceEqual(attr[0:4], []byte{0xd0, 8, 1, 0}) || len(attr) != 260 {
+		t.Fatalf("COMMUNITIES extended length incorrect")
+	}
+
+	if _, err = communities(make([]Community, 16384)); err == nil {
+		t.Fatalf("COMMUNITIES attribute over 65535 bytes should fail")
+	}
+
+	a := advert{
+		ASNumber:     65000,
+		NextHop:      [4]byte{10, 1, 2, 3},
+		PeerASNumber: 65000,
+		Communities:  make([]Community, 16384),
+	}
+
+	rib := map[netip.Addr]bool{ipv4_0: true, ipv4_1: true}
+
+	if _, err := a.message(rib); err == nil {
+		t.Fatalf("UPDATE message with over-long COMMUNITIES should fail")
+	}
+
+	if updates := a.updates(rib); updates != nil {
+		t.Fatalf("UPDATE messages with over-long COMMUNITIES should not be generated")
+	}
+}
+
+func TestASPathSequence(t *testing.T) {
+
+	as_path, as4_path := asPathSequence([]uint32{65000, 4200000000, 65002})
+
+	if !byteSliceEqual(as_path, []byte{0x40, 2, 8, 2, 3, 0xfd, 0xe8, 0x5b, 0xa0, 0xfd, 0xea}) {
+		t.Fatalf("Synthetic AS_PATH incorrect: %v", as_path)
+	}
+
+	if !byteSliceEqual(as4_path, []byte{0xc0, 17, 14, 2, 3, 0, 0, 0xfd, 0xe8, 0xfa, 0x56, 0xea, 0, 0, 0, 0xfd, 0xea}) {
+		t.Fatalf("Synthetic AS4_PATH incorrect: %v", as4_path)
+	}
+
+	if _, as4_path = asPathSequence([]uint32{65000, 65001, 65002}); as4_path != nil {
+		t.Fatalf("AS4_PATH should not be sent for two octet ASes")
+	}
+
+	a := advert{ASNumber: 65000, PeerASNumber: 65001, NextHop: [4]byte{10, 1, 2, 3}}
+	u := a.withParameters(Parameters{OriginateWithPath: []uint32{}}, 65001)
+
+	if _, err := u.message(map[netip.Addr]bool{ipv4_0: true}); err == nil {
+		t.Fatalf("Empty AS_PATH should be rejected for eBGP")
+	}
+
+	u = a.withParameters(Parameters{OriginateWithPath: []uint32{64512, 64513, 64514}}, 65001)
+	update, err := u.message(map[netip.Addr]bool{ipv4_0: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d, n := decodeUpdate(update); n != nil || d.attributes.ASPath.String() != "64512 64513 64514" {
+		t.Fatalf("Synthetic AS_PATH not used: %v", d.attributes.ASPath)
+	}
+}
+
+func TestAdvertiseWithdrawnOverlap(t *testing.T) {
+
+	ll := netip.MustParseAddr("fe80::1")
+
+	rib := map[netip.Addr]bool{
+		ll.WithZone("eth0"): false,
+		ll:                  true,
+		ll.WithZone("eth1"): true,
+		ipv4_0:              false,
+	}
+
+	advertise, withdrawn := sortAdvertiseWithdrawn(rib)
+
+	if !addrSliceEqual(advertise, []netip.Addr{ll}) {
+		t.Fatalf("Prefix should be advertised exactly once: %v", advertise)
+	}
+
+	if !addrSliceEqual(withdrawn, []netip.Addr{ipv4_0}) {
+		t.Fatalf("Advertised prefix should not be withdrawn: %v", withdrawn)
+	}
+}
+
+func TestOpenMessage(t *testing.T) {
+
+	o := open{asNumber: 65000, holdTime: 30, routerID: [4]byte{10, 1, 2, 3}, multiprotocol: true}
+
+	msg := o.message()
+
+	if !byteSliceEqual(msg, []byte{4, 0xfd, 0xe8, 0, 30, 10, 1, 2, 3, 16,
+		2, 6, 1, 4, 0, 2, 0, 1, // IPv6 unicast
+		2, 6, 1, 4, 0, 1, 0, 1, // IPv4 unicast
+	}) {
+		t.Fatalf("OPEN message incorrect: %v", msg)
+	}
+
+	var p open
+
+	if !p.parse(msg) || p.extended || p.asNumber != 65000 || p.holdTime != 30 || p.routerID != o.routerID {
+		t.Fatalf("OPEN parse incorrect: %v", p)
+	}
+
+	if caps, ok := p.capabilities(); !ok || len(caps) != 2 || caps[0].code != BGP4_MP || !byteSliceEqual(caps[1].value, []byte{0, 1, 0, 1}) {
+		t.Fatalf("OPEN capabilities incorrect: %v", caps)
+	}
+}
+
+func TestOpenVersion(t *testing.T) {
+
+	o := open{asNumber: 65001, holdTime: 30, routerID: [4]byte{10, 1, 2, 4}}
+
+	msg := o.message()
+	msg[0] = 3
+
+	m, ok := parseMessage(M_OPEN, msg)
+
+	if !ok {
+		t.Fatal("OPEN parse failed")
+	}
+
+	n := m.(*open).validate([4]byte{10, 1, 2, 3})
+
+	if n == nil || n.code != OPEN_MESSAGE_ERROR || n.sub != UNSUPPORTED_VERSION_NUMBER {
+		t.Fatalf("Expected Unsupported Version Number: %v", n)
+	}
+
+	if !byteSliceEqual(n.Body(), []byte{OPEN_MESSAGE_ERROR, UNSUPPORTED_VERSION_NUMBER, 0, 4}) {
+		t.Fatalf("NOTIFICATION should carry version 4: %v", n.Body())
+	}
+
+	msg[0] = 4
+	m, _ = parseMessage(M_OPEN, msg)
+
+	if n = m.(*open).validate([4]byte{10, 1, 2, 3}); n != nil {
+		t.Fatalf("Version 4 should be accepted: %v", n)
+	}
+}
+
+func TestOpenExtendedParameters(t *testing.T) {
+
+	o := open{asNumber: 65000, holdTime: 30, routerID: [4]byte{10, 1, 2, 3}, multiprotocol: true}
+
+	for n := 0; n < 50; n++ {
+		o.caps = append(o.caps, capability{code: 200, value: []byte{byte(n), 1, 2, 3}})
+	}
+
+	msg := o.message()
+
+	// 52 parameters of 3 + 6 bytes
+	if !byteSliceEqual(msg[9:16], []byte{255, 255, 1, 212, 2, 0, 6}) {
+		t.Fatalf("Extended optional parameters header incorrect: %v", msg[9:16])
+	}
+
+	var p open
+
+	if !p.parse(msg) || !p.extended {
+		t.Fatalf("Extended OPEN parse failed")
+	}
+
+	caps, ok := p.capabilities()
+
+	if !ok || len(caps) != 52 || caps[51].code != 200 || !byteSliceEqual(caps[51].value, []byte{49, 1, 2, 3}) {
+		t.Fatalf("Extended OPEN capabilities incorrect: %v", caps)
+	}
+
+	if p.parse(msg[:len(msg)-1]) {
+		t.Fatalf("Truncated OPEN should fail to parse")
+	}
+}
+
+func TestWithdrawAddr(t *testing.T) {
+
+	a := advert{ASNumber: 65000, PeerASNumber: 65000, NextHop: [4]byte{10, 1, 2, 3}}
+
+	adjRIBOut, nlri := withdrawAddr([]netip.Addr{ipv4_0, ipv4_1, ipv6_0}, ipv4_1)
+
+	if !addrSliceEqual(adjRIBOut, []netip.Addr{ipv4_0, ipv6_0}) {
+		t.Fatalf("Adj-RIB-Out not updated: %v", adjRIBOut)
+	}
+
+	updates := a.updates(nlri)
+
+	if len(updates) != 1 || !byteSliceEqual(updates[0].Body(), []byte{0, 5, 32, 192, 168, 101, 1, 0, 0}) {
+		t.Fatalf("Single prefix withdrawal incorrect: %v", updates)
+	}
+
+	if adjRIBOut, nlri = withdrawAddr(adjRIBOut, ipv4_1); len(nlri) != 0 || len(adjRIBOut) != 2 {
+		t.Fatalf("Withdrawing a prefix which is not advertised should be a no-op: %v", nlri)
+	}
+
+	s := Session{c: make(chan _update, 1), rib: []netip.Addr{ipv4_0, ipv4_1}}
+
+	if err := s.Withdraw(netip.MustParsePrefix("192.168.101.0/24")); err == nil {
+		t.Fatalf("Withdrawing a non-host prefix should fail")
+	}
+
+	if err := s.Withdraw(hostRoute(ipv4_1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if u := <-s.c; u.withdraw != ipv4_1 || !addrSliceEqual(u.RIB, []netip.Addr{ipv4_0}) {
+		t.Fatalf("Withdrawal update incorrect: %v", u)
+	}
+}
+
+func TestAddAddrs(t *testing.T) {
+
+	adjRIBOut, nlri := addAddrs([]netip.Addr{ipv4_0, ipv6_0}, []netip.Addr{ipv4_0, ipv4_1, ipv4_1})
+
+	if !addrSliceEqual(adjRIBOut, []netip.Addr{ipv4_0, ipv6_0, ipv4_1}) {
+		t.Fatalf("Adj-RIB-Out should not contain duplicates: %v", adjRIBOut)
+	}
+
+	if len(nlri) != 2 || !nlri[ipv4_0] || !nlri[ipv4_1] {
+		t.Fatalf("Prefixes already present should be re-advertised: %v", nlri)
+	}
+}
+
+func TestPeerTypeAttributes(t *testing.T) {
+
+	p := Parameters{MED: 50, LocalPref: 200, StripMED: true, Communities: []Community{65000<<16 | 1}}
+	a := advert{ASNumber: 65000, NextHop: [4]byte{10, 1, 2, 3}}
+	rib := map[netip.Addr]bool{ipv4_0: true}
+
+	decode := func(remote uint16) decoded {
+		u := a.withParameters(p, remote)
+		updates := u.updates(rib)
+		if len(updates) != 1 {
+			t.Fatalf("Expected one UPDATE: %v", updates)
+		}
+		d, n := decodeUpdate(updates[0].Body())
+		if n != nil {
+			t.Fatal(n)
+		}
+		return d
+	}
+
+	ibgp := decode(65000)
+	ebgp := decode(65001)
+
+	if len(ibgp.attributes.ASPath) != 0 || ibgp.attributes.LocalPref != 200 || ibgp.attributes.MED != 50 {
+		t.Fatalf("iBGP attributes incorrect: %v", ibgp.attributes)
+	}
+
+	if ebgp.attributes.ASPath.String() != "65000" || ebgp.attributes.LocalPref != 0 || ebgp.attributes.MED != 0 {
+		t.Fatalf("eBGP attributes incorrect: %v", ebgp.attributes)
+	}
+
+	if len(ibgp.attributes.Communities) != 1 || len(ebgp.attributes.Communities) != 1 {
+		t.Fatalf("Communities should be sent to both peers")
+	}
+}
+
+// An advert and a set of IPv4 host prefixes, padded with communities so
+// that a single UPDATE carrying them all would have a body of exactly
+// size octets
+func fragmentBoundary(t *testing.T, size int) (advert, map[netip.Addr]bool) {
+
+	a := advert{ASNumber: 65000, PeerASNumber: 65000, NextHop: [4]byte{10, 1, 2, 3}}
+
+	one := map[netip.Addr]bool{ipv4_0: true}
+
+	for c := 1; c < 10; c++ {
+		a.Communities = make([]Community, c)
+
+		m, err := a.message(one)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (size-len(m))%5 != 0 {
+			continue
+		}
+
+		nlri := map[netip.Addr]bool{}
+
+		for i := 0; len(nlri) < 1+(size-len(m))/5; i++ {
+			nlri[netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)})] = true // 5 octets each
+		}
+
+		if m, _ = a.message(nlri); len(m) != size {
+			t.Fatalf("Padding failed: %d != %d", len(m), size)
+		}
+
+		return a, nlri
+	}
+
+	t.Fatal("No padding found for", size)
+	return a, nil
+}
+
+func TestFragmentBoundary(t *testing.T) {
+
+	const limit = 4000 // largest body is limit-1
+
+	prefixes := func(updates []message) map[netip.Addr]bool {
+		nlri := map[netip.Addr]bool{}
+		for _, m := range updates {
+			if len(m.Body()) >= limit {
+				t.Fatalf("Fragment too large: %d", len(m.Body()))
+			}
+			d, n := decodeUpdate(m.Body())
+			if n != nil {
+				t.Fatal(n)
+			}
+			for _, p := range d.advertised {
+				if _, ok := nlri[p.Addr()]; ok {
+					t.Fatal("Prefix sent more than once:", p)
+				}
+				nlri[p.Addr()] = true
+			}
+			for _, p := range d.withdrawn {
+				if _, ok := nlri[p.Addr()]; ok {
+					t.Fatal("Prefix sent more than once:", p)
+				}
+				nlri[p.Addr()] = false
+			}
+		}
+		return nlri
+	}
+
+	// just fits
+	a, nlri := fragmentBoundary(t, limit-1)
+	updates := a.updates(nlri)
+
+	if len(updates) != 1 || len(updates[0].Body()) != limit-1 {
+		t.Fatalf("Expected a single UPDATE: %d", len(updates))
+	}
+
+	// one octet too many
+	a, nlri = fragmentBoundary(t, limit)
+	updates = a.updates(nlri)
+
+	if len(updates) != 2 {
+		t.Fatalf("Expected two fragments: %d", len(updates))
+	}
+
+	if p := prefixes(updates); !reflect.DeepEqual(p, nlri) {
+		t.Fatalf("Fragments don't reconstruct the prefix set: %d != %d", len(p), len(nlri))
+	}
+
+	// much too large, with a mixture of advertisements and withdrawals
+	a, nlri = fragmentBoundary(t, 3*limit)
+
+	var n int
+	for ip := range nlri {
+		if n++; n%2 == 0 {
+			nlri[ip] = false
+		}
+	}
+
+	updates = a.updates(nlri)
+
+	if len(updates) < 3 {
+		t.Fatalf("Expected at least three fragments: %d", len(updates))
+	}
+
+	if p := prefixes(updates); !reflect.DeepEqual(p, nlri) {
+		t.Fatalf("Fragments don't reconstruct the prefix set: %d != %d", len(p), len(nlri))
+	}
+
+	// a single prefix whose attributes alone exceed the limit
+	a.Communities = make([]Community, limit/4)
+
+	if _, err := a.message(map[netip.Addr]bool{ipv4_0: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if updates = a.updates(map[netip.Addr]bool{ipv4_0: true}); updates != nil {
+		t.Fatalf("Oversized single prefix should not be sent: %d", len(updates))
+	}
+}
+
+func TestIPv4Mapped(t *testing.T) {
+
+	mapped := netip.AddrFrom16(ipv4_0.As16()) // ::ffff:192.168.101.0
+
+	if !mapped.Is6() || !mapped.Is4In6() {
+		t.Fatal("Not an IPv4-mapped address:", mapped)
+	}
+
+	u := newupdate(Parameters{}, []netip.Addr{mapped, ipv4_0, ipv6_0})
+
+	if !addrSliceEqual(u.RIB, []netip.Addr{ipv4_0, ipv6_0}) {
+		t.Fatalf("IPv4-mapped address should be normalised to IPv4: %v", u.RIB)
+	}
+
+	if out := u.adjRIBOut(false); !addrSliceEqual(out, []netip.Addr{ipv4_0}) {
+		t.Fatalf("IPv4-mapped address should be sent over an IPv4 session: %v", out)
+	}
+
+	v4, v6 := nlriByVersion(u.RIB)
+
+	if len(v4) != 5 || len(v6) != 17 {
+		t.Fatalf("IPv4-mapped address in the wrong NLRI section: %v %v", v4, v6)
+	}
+
+	s := Session{c: make(chan _update, 1), rib: []netip.Addr{mapped, ipv4_1}}
+
+	if err := s.Withdraw(hostRoute(ipv4_0)); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := <-s.c; !addrSliceEqual(r.RIB, []netip.Addr{ipv4_1}) || r.withdraw != ipv4_0 {
+		t.Fatalf("IPv4-mapped address not withdrawn: %v %v", r.RIB, r.withdraw)
+	}
+}
+
+func TestIPv4MappedNLRI(t *testing.T) {
+
+	mapped := netip.MustParseAddr("::ffff:192.0.2.1")
+
+	a := advert{ASNumber: 65000, PeerASNumber: 65000, NextHop: [4]byte{10, 1, 2, 3}, Multiprotocol: true}
+
+	m, err := a.message(map[netip.Addr]bool{mapped: true, netip.MustParseAddr("192.0.2.1"): true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(findAttribute(m, MP_REACH_NLRI)) != 0 {
+		t.Error("IPv4-mapped address should not be sent in MP_REACH_NLRI")
+	}
+
+	d, n := decodeUpdate(m)
+
+	if n != nil || !prefixSliceEqual(d.advertised, []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")}) {
+		t.Errorf("IPv4-mapped address should be advertised once as IPv4: %v %v", d.advertised, n)
+	}
+}
+
+func TestSendLocalPref(t *testing.T) {
+
+	localPref := func(a advert) uint32 {
+		updates := a.updates(map[netip.Addr]bool{ipv4_0: true})
+		if len(updates) != 1 {
+			t.Fatalf("Expected one UPDATE: %d", len(updates))
+		}
+		d, n := decodeUpdate(updates[0].Body())
+		if n != nil {
+			t.Fatal(n)
+		}
+		return d.attributes.LocalPref
+	}
+
+	off, on := false, true
+
+	a := advert{ASNumber: 65000, NextHop: [4]byte{10, 1, 2, 3}}
+
+	if lp := localPref(a.withParameters(Parameters{LocalPref: 200}, 65000)); lp != 200 {
+		t.Error("LOCAL_PREF should be sent to an internal peer:", lp)
+	}
+
+	if lp := localPref(a.withParameters(Parameters{LocalPref: 200, SendLocalPref: &off}, 65000)); lp != 0 {
+		t.Error("LOCAL_PREF should not be sent when forced off:", lp)
+	}
+
+	if lp := localPref(a.withParameters(Parameters{LocalPref: 200, SendLocalPref: &on}, 65001)); lp != 200 {
+		t.Error("LOCAL_PREF should be sent to an external peer when forced on:", lp)
+	}
+}
+
+func TestWithdrawals(t *testing.T) {
+
+	m := map[netip.Addr]bool{}
+
+	for i := 0; i < 2000; i++ {
+		m[netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)})] = false
+	}
+
+	for i := 0; i < 1000; i++ {
+		m[netip.AddrFrom16([16]byte{0xfd, 14: byte(i >> 8), 15: byte(i)})] = false
+	}
+
+	a := advert{ASNumber: 65000, PeerASNumber: 65001}
+
+	updates := a.updates(m)
+
+	// 5 octets per IPv4 prefix, 17 per IPv6
+	if len(updates) != 3+5 {
+		t.Errorf("Withdrawals not packed into the fewest messages: %d", len(updates))
+	}
+
+	seen := map[netip.Prefix]bool{}
+
+	for _, u := range updates {
+		if len(u.Body()) >= 4000 {
+			t.Error("UPDATE too large:", len(u.Body()))
+		}
+
+		d, n := decodeUpdate(u.Body())
+
+		if n != nil {
+			t.Fatal(n)
+		}
+
+		if len(d.advertised) != 0 {
+			t.Error("Nothing should be advertised:", d.advertised)
+		}
+
+		for _, p := range d.withdrawn {
+			if seen[p] {
+				t.Error("Prefix withdrawn twice:", p)
+			}
+			seen[p] = true
+		}
+	}
+
+	if len(seen) != len(m) {
+		t.Errorf("Expected %d prefixes to be withdrawn: %d", len(m), len(seen))
+	}
+}
+
+func TestMaxFragments(t *testing.T) {
+
+	// long enough that only a few prefixes fit in each UPDATE
+	var communities []Community
+
+	for i := 0; i < 950; i++ {
+		communities = append(communities, Community(i))
+	}
+
+	nlri := map[netip.Addr]bool{}
+
+	for i := 0; i < 1000; i++ {
+		nlri[netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)})] = true
+	}
+
+	a := advert{ASNumber: 65000, NextHop: [4]byte{10, 1, 2, 3}}
+
+	u := a.withParameters(Parameters{Communities: communities}, 65001)
+
+	updates, err := u.build(nlri)
+
+	if err != nil || len(updates) < 10 {
+		t.Fatalf("Expected many UPDATEs: %d %v", len(updates), err)
+	}
+
+	u = a.withParameters(Parameters{Communities: communities, MaxFragments: 5}, 65001)
+
+	if updates, err = u.build(nlri); err == nil || updates != nil {
+		t.Errorf("Limit should be exceeded: %d", len(updates))
+	} else if !strings.Contains(err.Error(), "1000 prefixes") || !strings.Contains(err.Error(), "bytes of path attributes") {
+		t.Error("Error should describe the RIB:", err)
+	}
+}
+
+func TestColorExtendedCommunity(t *testing.T) {
+
+	if c := ColorExtendedCommunity(100); c != 0x030b000000000064 {
+		t.Fatalf("Incorrect Color extended community: %016x", uint64(c))
+	}
+
+	a := advert{ASNumber: 65000, NextHop: [4]byte{10, 1, 2, 3}}
+	u := a.withParameters(Parameters{ExtendedCommunities: []ExtendedCommunity{ColorExtendedCommunity(100)}}, 65001)
+
+	update, err := u.message(map[netip.Addr]bool{ipv4_0: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ec := findAttribute(update, EXTENDED_COMMUNITIES)
+
+	if len(ec) != 1 || !byteSliceEqual(ec[0], []byte{0x03, 0x0b, 0, 0, 0, 0, 0, 100}) {
+		t.Fatalf("EXTENDED_COMMUNITIES attribute incorrect: %v", ec)
+	}
+
+	if d, n := decodeUpdate(update); n != nil || len(d.attributes.ExtendedCommunities) != 1 ||
+		d.attributes.ExtendedCommunities[0] != ColorExtendedCommunity(100) {
+		t.Fatalf("Color extended community not decoded: %v", d.attributes.ExtendedCommunities)
+	}
+}
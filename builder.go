@@ -0,0 +1,230 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// Builds UPDATE messages outside of a session - eg. for tools which
+// inject routes over their own transport. Whether the peer is internal
+// or external (and so the AS_PATH and LOCAL_PREF sent) is determined
+// from the AS numbers.
+type UpdateBuilder struct {
+	LocalASN    uint16
+	PeerASN     uint16
+	NextHop     netip.Addr // IPv4
+	NextHop6    netip.Addr // only required if IPv6 prefixes are advertised
+	MED         uint32
+	LocalPref   uint32 // internal peers only; 100 if not set
+	Communities []Community
+	Path        []uint32 // if not nil, overrides the default AS_PATH
+
+	// Named sets of prefixes to be advertised, each of which must be
+	// sent in a single UPDATE - if a group won't fit then Build fails
+	// rather than splitting it
+	AtomicGroups map[string][]netip.Addr
+
+	// Build messages for the prefixes which can be encoded, rather
+	// than failing if any can't - an *EncodeError is still returned
+	BestEffort bool
+}
+
+// Prefixes which could not be encoded, and why
+type EncodeError struct {
+	Failed map[netip.Addr]string
+}
+
+func (e *EncodeError) Error() string {
+	var ips []netip.Addr
+
+	for ip := range e.Failed {
+		ips = append(ips, ip)
+	}
+
+	sort.Slice(ips, func(i, j int) bool { return ips[i].Less(ips[j]) })
+
+	var s []string
+
+	for _, ip := range ips {
+		s = append(s, ip.String()+": "+e.Failed[ip])
+	}
+
+	return fmt.Sprintf("Unable to encode %d prefixes - %s", len(ips), strings.Join(s, ", "))
+}
+
+// Why a prefix could not be sent in an UPDATE by itself, if it can't
+func (a *advert) encodeError(ip netip.Addr, advertise bool) (string, bool) {
+
+	if !ip.IsValid() {
+		return "invalid address", true
+	}
+
+	u, err := a.message(map[netip.Addr]bool{ip: advertise})
+
+	if err != nil {
+		return err.Error(), true
+	}
+
+	if len(u) >= 4000 {
+		return fmt.Sprintf("UPDATE would be %d bytes", len(u)), true
+	}
+
+	return "", false
+}
+
+// Returns framed UPDATE messages (header included) advertising and
+// withdrawing the host routes, split across messages if necessary.
+// Each of the AtomicGroups is sent in its own UPDATE, first. If any
+// prefix can't be encoded then an *EncodeError describing each is
+// returned - along with the messages for the remainder if BestEffort
+// is set.
+func (b *UpdateBuilder) Build(advertise, withdraw []netip.Addr) ([][]byte, error) {
+
+	if b.LocalASN == 0 || b.PeerASN == 0 {
+		return nil, errors.New("Local and peer AS numbers must be set")
+	}
+
+	nlri := map[netip.Addr]bool{}
+	failed := map[netip.Addr]string{}
+
+	for _, ip := range withdraw {
+		if !ip.IsValid() {
+			failed[ip] = "invalid address"
+			continue
+		}
+		nlri[ip] = false
+	}
+
+	var groups []string
+
+	advertise = append([]netip.Addr{}, advertise...)
+
+	for name, group := range b.AtomicGroups {
+		groups = append(groups, name)
+		advertise = append(advertise, group...)
+	}
+
+	sort.Strings(groups)
+
+	for _, ip := range advertise {
+		if !ip.IsValid() {
+			failed[ip] = "invalid address"
+			continue
+		}
+
+		if ip.Is4() && !b.NextHop.Is4() {
+			return nil, errors.New("No IPv4 next hop")
+		}
+
+		if ip.Is6() && !b.NextHop6.Is6() {
+			return nil, errors.New("No IPv6 next hop")
+		}
+
+		nlri[ip] = true
+	}
+
+	a := advert{
+		ASNumber:      b.LocalASN,
+		PeerASNumber:  b.PeerASN,
+		MED:           b.MED,
+		Communities:   b.Communities,
+		Multiprotocol: true,
+		localpref:     b.LocalPref,
+		path:          b.Path,
+	}
+
+	if b.NextHop.Is4() {
+		a.NextHop = b.NextHop.As4()
+	}
+
+	if b.NextHop6.Is6() {
+		a.NextHop6 = b.NextHop6.As16()
+	}
+
+	var msgs [][]byte
+	var m []message
+
+	for _, name := range groups {
+		group := map[netip.Addr]bool{}
+
+		for _, ip := range b.AtomicGroups[name] {
+			group[ip] = true
+			delete(nlri, ip)
+		}
+
+		u, err := a.message(group)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(u) >= 4000 {
+			return nil, fmt.Errorf("Atomic group %q does not fit in a single UPDATE", name)
+		}
+
+		m = append(m, &u)
+	}
+
+	if len(failed) > 0 && !b.BestEffort {
+		return nil, &EncodeError{Failed: failed}
+	}
+
+	if len(nlri) > 0 {
+		f := a.fragment(nlri)
+
+		if len(f) < 1 {
+			// find the prefixes responsible
+			for ip, v := range nlri {
+				if reason, ok := a.encodeError(ip, v); ok {
+					failed[ip] = reason
+					delete(nlri, ip)
+				}
+			}
+
+			if len(failed) == 0 {
+				return nil, errors.New("Unable to build UPDATE")
+			}
+
+			if !b.BestEffort {
+				return nil, &EncodeError{Failed: failed}
+			}
+
+			if f = a.fragment(nlri); len(f) < 1 && len(nlri) > 0 {
+				return nil, &EncodeError{Failed: failed}
+			}
+		}
+
+		m = append(m, f...)
+	}
+
+	for _, u := range m {
+		msgs = append(msgs, addHeader(u.Type(), u.Body()))
+	}
+
+	if len(failed) > 0 {
+		return msgs, &EncodeError{Failed: failed}
+	}
+
+	return msgs, nil
+}
@@ -0,0 +1,139 @@
+package bgp
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestUpdateBuilder(t *testing.T) {
+
+	b := UpdateBuilder{LocalASN: 65000, PeerASN: 65000, NextHop: netip.MustParseAddr("10.1.2.3")}
+
+	decode := func() decoded {
+		msgs, err := b.Build([]netip.Addr{ipv4_0}, nil)
+
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("Build failed: %v %v", msgs, err)
+		}
+
+		m := msgs[0]
+
+		if len(m) < 19 || m[18] != M_UPDATE || int(m[16])<<8|int(m[17]) != len(m) {
+			t.Fatalf("Bad message header: %v", m)
+		}
+
+		u, n := decodeUpdate(m[19:])
+
+		if n != nil {
+			t.Fatalf("Decode failed: %v", n)
+		}
+
+		return u
+	}
+
+	// iBGP
+	u := decode()
+
+	if len(u.attributes.ASPath) != 0 || u.attributes.LocalPref != 100 {
+		t.Errorf("iBGP UPDATE should have an empty AS_PATH and LOCAL_PREF: %v", u.attributes)
+	}
+
+	// eBGP
+	b.PeerASN = 65001
+	u = decode()
+
+	if u.attributes.ASPath.String() != "65000" || u.attributes.LocalPref != 0 {
+		t.Errorf("eBGP UPDATE should have a single AS and no LOCAL_PREF: %v", u.attributes)
+	}
+
+	if _, err := b.Build([]netip.Addr{ipv6_0}, nil); err == nil {
+		t.Error("IPv6 prefix without IPv6 next hop should fail")
+	}
+
+	if _, err := (&UpdateBuilder{LocalASN: 65000}).Build(nil, []netip.Addr{ipv4_0}); err == nil {
+		t.Error("Missing peer AS should fail")
+	}
+}
+
+func TestUpdateBuilderAtomicGroups(t *testing.T) {
+
+	var big, small []netip.Addr
+
+	for i := 0; i < 1000; i++ {
+		big = append(big, netip.AddrFrom4([4]byte{10, 1, byte(i >> 8), byte(i)}))
+	}
+
+	for i := 0; i < 600; i++ {
+		small = append(small, netip.AddrFrom4([4]byte{10, 2, byte(i >> 8), byte(i)}))
+	}
+
+	b := UpdateBuilder{LocalASN: 65000, PeerASN: 65001, NextHop: netip.MustParseAddr("10.1.2.3")}
+
+	b.AtomicGroups = map[string][]netip.Addr{"big": big}
+
+	if _, err := b.Build(nil, nil); err == nil {
+		t.Error("Oversized atomic group should fail")
+	}
+
+	b.AtomicGroups = map[string][]netip.Addr{"small": small}
+
+	// the remaining prefixes are fragmented as usual
+	msgs, err := b.Build(big, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(msgs) < 3 {
+		t.Fatalf("Expected the atomic group and fragmented UPDATEs: %d", len(msgs))
+	}
+
+	u, n := decodeUpdate(msgs[0][19:])
+
+	if n != nil {
+		t.Fatal(n)
+	}
+
+	if len(u.advertised) != len(small) {
+		t.Errorf("Atomic group split across UPDATEs: %d", len(u.advertised))
+	}
+
+	for _, m := range msgs[1:] {
+		if u, _ := decodeUpdate(m[19:]); len(u.advertised) > 0 && u.advertised[0].Addr().As4()[1] != 1 {
+			t.Error("Atomic group prefixes in a fragmented UPDATE")
+		}
+	}
+}
+
+func TestUpdateBuilderEncodeError(t *testing.T) {
+
+	b := UpdateBuilder{LocalASN: 65000, PeerASN: 65001, NextHop: netip.MustParseAddr("10.1.2.3")}
+
+	rib := []netip.Addr{ipv4_0, {}, ipv4_1}
+
+	msgs, err := b.Build(rib, nil)
+
+	if e, ok := err.(*EncodeError); !ok || msgs != nil || len(e.Failed) != 1 || !strings.Contains(err.Error(), "invalid address") {
+		t.Fatalf("Invalid address should be reported: %v %v", msgs, err)
+	}
+
+	b.BestEffort = true
+
+	msgs, err = b.Build(rib, nil)
+
+	if e, ok := err.(*EncodeError); !ok || len(e.Failed) != 1 || len(msgs) != 1 {
+		t.Fatalf("Valid prefixes should still be built: %v %v", msgs, err)
+	}
+
+	if u, n := decodeUpdate(msgs[0][19:]); n != nil || len(u.advertised) != 2 {
+		t.Errorf("Expected two prefixes: %v %v", n, u.advertised)
+	}
+
+	// path attributes which can't fit in any UPDATE
+	b.Communities = make([]Community, 1000)
+
+	if _, err = b.Build([]netip.Addr{ipv4_0}, nil); err == nil || !strings.Contains(err.Error(), ipv4_0.String()+": UPDATE would be") {
+		t.Errorf("Oversized attributes should be reported: %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A capability offered by either side in the OPEN messages
+type CapabilityStatus struct {
+	Name       string `json:"name"`
+	Code       uint8  `json:"code"`
+	Local      bool   `json:"local,omitempty"`      // we offered it
+	Peer       bool   `json:"peer,omitempty"`       // the peer offered it
+	Negotiated bool   `json:"negotiated,omitempty"` // both did, so it is in effect
+}
+
+const EXTENDED_MESSAGE = 6 // capability code (RFC 8654)
+
+var capabilityNames = map[uint8]string{
+	BGP4_MP:                "multiprotocol",
+	ROUTE_REFRESH:          "route-refresh",
+	EXTENDED_MESSAGE:       "extended-message",
+	EXTENDED_NEXT_HOP:      "extended-next-hop",
+	BGP_ROLE:               "role",
+	GRACEFUL_RESTART:       "graceful-restart",
+	65:                     "4-octet-as",
+	ADD_PATH:               "add-path",
+	ENHANCED_ROUTE_REFRESH: "enhanced-route-refresh",
+	SOFTWARE_VERSION:       "software-version",
+}
+
+// Multiprotocol capabilities are distinguished by address family
+func capabilityName(c capability) string {
+	name, ok := capabilityNames[c.code]
+
+	if !ok {
+		name = fmt.Sprintf("capability-%d", c.code)
+	}
+
+	if c.code == BGP4_MP && len(c.value) == 4 {
+		name += fmt.Sprintf(" AFI %d/SAFI %d", uint16(c.value[0])<<8|uint16(c.value[1]), c.value[3])
+	}
+
+	return name
+}
+
+func capabilityReport(local, peer []capability) (report []CapabilityStatus) {
+
+	index := map[string]int{}
+
+	entry := func(c capability) *CapabilityStatus {
+		name := capabilityName(c)
+		if i, ok := index[name]; ok {
+			return &report[i]
+		}
+		index[name] = len(report)
+		report = append(report, CapabilityStatus{Name: name, Code: c.code})
+		return &report[len(report)-1]
+	}
+
+	for _, c := range local {
+		entry(c).Local = true
+	}
+
+	for _, c := range peer {
+		entry(c).Peer = true
+	}
+
+	for i := range report {
+		report[i].Negotiated = report[i].Local && report[i].Peer
+	}
+
+	return
+}
+
+// The capabilities which we offered on the current session, and those
+// the peer offered in its OPEN - nil if no OPEN has been received.
+func (s *Session) CapabilityReport() []CapabilityStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.peerInfo == nil {
+		return nil
+	}
+
+	return capabilityReport(s.offered, s.peerCaps)
+}
+
+var familyNames = map[family]string{
+	IPV4_UNICAST:              "ipv4-unicast",
+	IPV6_UNICAST:              "ipv6-unicast",
+	{1, SAFI_LABELED_UNICAST}: "ipv4-labeled-unicast",
+	{2, SAFI_LABELED_UNICAST}: "ipv6-labeled-unicast",
+	{1, SAFI_MPLS_VPN}:        "ipv4-vpn",
+	{2, SAFI_MPLS_VPN}:        "ipv6-vpn",
+	RT_CONSTRAIN:              "rt-constrain",
+}
+
+func familyName(f family) string {
+	if name, ok := familyNames[f]; ok {
+		return name
+	}
+	return f.String()
+}
+
+// Readable descriptions of the capabilities in the peer's OPEN, with
+// address families named, eg. "multiprotocol ipv6-unicast"
+func peerCapabilities(caps []capability) (names []string) {
+
+	for _, c := range caps {
+		v := c.value
+
+		switch {
+		case c.code == BGP4_MP && len(v) == 4:
+			names = append(names, "multiprotocol "+familyName(family{afi: uint16(v[0])<<8 | uint16(v[1]), safi: v[3]}))
+
+		case c.code == ADD_PATH:
+			// AFI[2], SAFI[1], Send/Receive[1] for each family
+			for ; len(v) >= 4; v = v[4:] {
+				var mode []string
+				if v[3]&ADD_PATH_RECEIVE != 0 {
+					mode = append(mode, "receive")
+				}
+				if v[3]&ADD_PATH_SEND != 0 {
+					mode = append(mode, "send")
+				}
+				f := family{afi: uint16(v[0])<<8 | uint16(v[1]), safi: v[2]}
+				names = append(names, "add-path "+familyName(f)+" "+strings.Join(mode, "/"))
+			}
+
+		case c.code == GRACEFUL_RESTART:
+			t, _ := peerRestartTime([]capability{c})
+			names = append(names, fmt.Sprintf("graceful-restart (restart time %ds)", t))
+
+		default:
+			names = append(names, capabilityName(c))
+		}
+	}
+
+	return
+}
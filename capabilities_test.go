@@ -0,0 +1,89 @@
+package bgp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCapabilityReport(t *testing.T) {
+
+	s, peer := newTestSession(t, Parameters{ASNumber: 65000, Multiprotocol: true}, nil, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	if r := s.CapabilityReport(); r != nil {
+		t.Error("No report before the peer's OPEN:", r)
+	}
+
+	peer.open(65001, mpCapability(IPV4_UNICAST), capability{code: 2})
+
+	for i := 0; s.Status().State != ESTABLISHED; i++ {
+		if i > 100 {
+			t.Fatal("Session not established")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	report := map[string]CapabilityStatus{}
+
+	for _, c := range s.CapabilityReport() {
+		report[c.Name] = c
+	}
+
+	if c := report["multiprotocol AFI 2/SAFI 1"]; !c.Local || c.Peer || c.Negotiated {
+		t.Errorf("IPv6 should be offered locally but not negotiated: %+v", c)
+	}
+
+	if c := report["multiprotocol AFI 1/SAFI 1"]; !c.Negotiated {
+		t.Errorf("IPv4 should be negotiated: %+v", c)
+	}
+
+	if c := report["route-refresh"]; c.Local || !c.Peer || c.Negotiated {
+		t.Errorf("Route refresh is only offered by the peer: %+v", c)
+	}
+}
+
+func TestStatusPeerCapabilities(t *testing.T) {
+
+	s, peer := newTestSession(t, Parameters{ASNumber: 65000}, nil, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	if c := s.Status().PeerCapabilities; c != nil {
+		t.Error("No capabilities before the peer's OPEN:", c)
+	}
+
+	peer.open(65001,
+		mpCapability(IPV6_UNICAST),
+		capability{code: 65, value: []byte{0, 0, 0xfd, 0xe9}},
+		capability{code: ROUTE_REFRESH},
+		gracefulRestart(false, 90, []family{IPV4_UNICAST}),
+		addPath(ADD_PATH_RECEIVE|ADD_PATH_SEND, []family{IPV4_UNICAST}),
+		capability{code: EXTENDED_MESSAGE},
+	)
+
+	for i := 0; s.Status().State != ESTABLISHED; i++ {
+		if i > 100 {
+			t.Fatal("Session not established")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	exp := []string{
+		"multiprotocol ipv6-unicast",
+		"4-octet-as",
+		"route-refresh",
+		"graceful-restart (restart time 90s)",
+		"add-path ipv4-unicast receive/send",
+		"extended-message",
+	}
+
+	if c := s.Status().PeerCapabilities; !reflect.DeepEqual(c, exp) {
+		t.Errorf("Unexpected capabilities: %q", c)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"time"
+)
+
+// Source of time for the session's timers, so that tests can replace
+// the wall clock. Socket deadlines always use real time.
+type clock interface {
+	Now() time.Time
+	NewTimer(time.Duration) timer
+	NewTicker(time.Duration) timer
+	After(time.Duration) <-chan time.Time
+	AfterFunc(time.Duration, func()) timer
+}
+
+type timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(time.Duration) bool
+}
+
+type realClock struct{}
+
+type realTimer struct{ t *time.Timer }
+type realTicker struct{ t *time.Ticker }
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) NewTimer(d time.Duration) timer         { return realTimer{time.NewTimer(d)} }
+func (realClock) NewTicker(d time.Duration) timer        { return realTicker{time.NewTicker(d)} }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) AfterFunc(d time.Duration, f func()) timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+func (r realTimer) C() <-chan time.Time        { return r.t.C }
+func (r realTimer) Stop() bool                 { return r.t.Stop() }
+func (r realTimer) Reset(d time.Duration) bool { return r.t.Reset(d) }
+
+func (r realTicker) C() <-chan time.Time        { return r.t.C }
+func (r realTicker) Stop() bool                 { r.t.Stop(); return true }
+func (r realTicker) Reset(d time.Duration) bool { r.t.Reset(d); return true }
+
+// Stop a timer or ticker, discarding any expiry which has not been
+// received
+func stopTimer(t timer) {
+	t.Stop()
+	select {
+	case <-t.C():
+	default:
+	}
+}
+
+func (s *Session) clock() clock {
+	if s.timers == nil {
+		return realClock{}
+	}
+	return s.timers
+}
@@ -0,0 +1,190 @@
+package bgp
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Timers fire only when the clock is advanced
+type mockClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*mockTimer
+}
+
+type mockTimer struct {
+	clock  *mockClock
+	c      chan time.Time
+	f      func()
+	when   time.Time
+	period time.Duration // non-zero for tickers
+	active bool
+}
+
+func newMockClock() *mockClock {
+	return &mockClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (m *mockClock) Now() time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.now
+}
+
+func (m *mockClock) timer(d, period time.Duration, f func()) *mockTimer {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	t := &mockTimer{clock: m, c: make(chan time.Time, 1), f: f, when: m.now.Add(d), period: period, active: true}
+	m.timers = append(m.timers, t)
+	return t
+}
+
+func (m *mockClock) NewTimer(d time.Duration) timer  { return m.timer(d, 0, nil) }
+func (m *mockClock) NewTicker(d time.Duration) timer { return m.timer(d, d, nil) }
+func (m *mockClock) After(d time.Duration) <-chan time.Time {
+	return m.timer(d, 0, nil).C()
+}
+func (m *mockClock) AfterFunc(d time.Duration, f func()) timer { return m.timer(d, 0, f) }
+
+// Move time forward, firing any timers which become due in order
+func (m *mockClock) Advance(d time.Duration) {
+	m.mutex.Lock()
+	end := m.now.Add(d)
+
+	for {
+		var due []*mockTimer
+		for _, t := range m.timers {
+			if t.active && !t.when.After(end) {
+				due = append(due, t)
+			}
+		}
+
+		if len(due) < 1 {
+			break
+		}
+
+		sort.Slice(due, func(i, j int) bool { return due[i].when.Before(due[j].when) })
+
+		t := due[0]
+		m.now = t.when
+
+		if t.period > 0 {
+			t.when = t.when.Add(t.period)
+		} else {
+			t.active = false
+		}
+
+		if t.f != nil {
+			m.mutex.Unlock()
+			t.f()
+			m.mutex.Lock()
+			continue
+		}
+
+		select {
+		case t.c <- m.now:
+		default: // like a real ticker, drop the tick if the last was not read
+		}
+	}
+
+	m.now = end
+	m.mutex.Unlock()
+}
+
+func (t *mockTimer) C() <-chan time.Time { return t.c }
+
+func (t *mockTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *mockTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.active
+	t.active = true
+	t.when = t.clock.now.Add(d)
+	if t.period > 0 {
+		t.period = d
+	}
+	return active
+}
+
+func TestMockClock(t *testing.T) {
+
+	m := newMockClock()
+
+	tm := m.NewTimer(10 * time.Second)
+	tk := m.NewTicker(3 * time.Second)
+
+	var fired bool
+	m.AfterFunc(5*time.Second, func() { fired = true })
+
+	m.Advance(9 * time.Second)
+
+	select {
+	case <-tm.C():
+		t.Error("Timer fired early")
+	default:
+	}
+
+	if !fired {
+		t.Error("AfterFunc did not run")
+	}
+
+	if len(tk.C()) != 1 {
+		t.Error("Ticker should have a pending tick")
+	}
+
+	m.Advance(time.Second)
+
+	select {
+	case <-tm.C():
+	default:
+		t.Error("Timer did not fire")
+	}
+}
+
+func TestHoldTimerMockClock(t *testing.T) {
+
+	m := newMockClock()
+
+	s := NewConnSession(IP{10, 0, 0, 1}, Parameters{ASNumber: 65000, HoldTime: 90}, []netip.Addr{ipv4_0}, nil)
+	s.timers = m
+
+	peer := runTestSession(t, s)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	// the peer sends nothing more, so the hold timer must expire after
+	// 90s (allowing for its KEEPALIVE being processed after a step)
+	for elapsed := 10; elapsed <= 120; elapsed += 10 {
+		m.Advance(10 * time.Second)
+
+		if msg := peer.next(20 * time.Millisecond); msg != nil {
+			if n, ok := msg.(*notification); !ok || n.code != HOLD_TIMER_EXPIRED {
+				t.Fatalf("Expected hold timer expiry: %v", msg)
+			}
+			if elapsed < 90 || elapsed > 100 {
+				t.Error("Hold timer expired after", elapsed)
+			}
+			return
+		}
+	}
+
+	t.Error("Hold timer did not expire")
+}
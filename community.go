@@ -0,0 +1,185 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// A pattern matched against the communities carried by a route, in
+// which any field may be a wildcard. The form of the pattern selects
+// the attribute: "65000:100" or "65000:*" for COMMUNITIES,
+// "65000:*:100" for LARGE_COMMUNITIES, and sixteen hex digits for
+// EXTENDED_COMMUNITIES, eg.: "0x0002fde8********"
+type CommunityPattern struct {
+	code  uint8     // COMMUNITIES, EXTENDED_COMMUNITIES or LARGE_COMMUNITIES
+	value [3]uint32 // an extended community is split over the first two
+	mask  [3]uint32 // bits which must be equal to those in value
+	s     string
+}
+
+func ParseCommunityPattern(s string) (CommunityPattern, error) {
+
+	bad := errors.New("Badly formed community pattern")
+
+	p := CommunityPattern{s: s}
+
+	if strings.HasPrefix(s, "0x") {
+		h := s[2:]
+
+		if len(h) < 1 || len(h) > 16 || (strings.Contains(h, "*") && len(h) != 16) {
+			return p, bad
+		}
+
+		var value, mask uint64
+
+		for _, c := range h {
+			value <<= 4
+			mask <<= 4
+			if c != '*' {
+				n, err := strconv.ParseUint(string(c), 16, 4)
+				if err != nil {
+					return p, bad
+				}
+				value |= n
+				mask |= 0xf
+			}
+		}
+
+		if len(h) < 16 {
+			mask = ^uint64(0) // leading digits are zero
+		}
+
+		p.code = EXTENDED_COMMUNITIES
+		p.value = [3]uint32{uint32(value >> 32), uint32(value)}
+		p.mask = [3]uint32{uint32(mask >> 32), uint32(mask)}
+
+		return p, nil
+	}
+
+	f := strings.Split(s, ":")
+
+	bits := 32
+
+	switch len(f) {
+	case 2:
+		p.code = COMMUNITIES
+		bits = 16
+	case 3:
+		p.code = LARGE_COMMUNITIES
+	default:
+		return p, bad
+	}
+
+	for i, v := range f {
+		if v == "*" {
+			continue
+		}
+
+		n, err := strconv.ParseUint(v, 10, bits)
+		if err != nil {
+			return p, bad
+		}
+
+		p.value[i] = uint32(n)
+		p.mask[i] = ^uint32(0)
+	}
+
+	if p.code == COMMUNITIES {
+		p.value = [3]uint32{p.value[0]<<16 | p.value[1]}
+		p.mask = [3]uint32{p.mask[0]<<16 | p.mask[1]&0xffff}
+	}
+
+	return p, nil
+}
+
+func (p CommunityPattern) equal(v [3]uint32) bool {
+	for i := range v {
+		if v[i]&p.mask[i] != p.value[i]&p.mask[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether any community of the pattern's type in the attributes
+// matches the pattern
+func (p CommunityPattern) Match(a Attributes) bool {
+
+	switch p.code {
+	case COMMUNITIES:
+		for _, c := range a.Communities {
+			if p.equal([3]uint32{uint32(c)}) {
+				return true
+			}
+		}
+	case EXTENDED_COMMUNITIES:
+		for _, c := range a.ExtendedCommunities {
+			if p.equal([3]uint32{uint32(c >> 32), uint32(c)}) {
+				return true
+			}
+		}
+	case LARGE_COMMUNITIES:
+		for _, c := range a.LargeCommunities {
+			if p.equal([3]uint32{c.GlobalAdministrator, c.LocalData1, c.LocalData2}) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (p CommunityPattern) String() string {
+	return p.s
+}
+
+func (p *CommunityPattern) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.s)
+}
+
+func (p *CommunityPattern) UnmarshalJSON(data []byte) error {
+	var s string
+
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("Badly formed community pattern")
+	}
+
+	c, err := ParseCommunityPattern(s)
+
+	if err != nil {
+		return err
+	}
+
+	*p = c
+
+	return nil
+}
+
+func communityPatternMatch(want []CommunityPattern, a Attributes) bool {
+	for _, p := range want {
+		if p.Match(a) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package bgp
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCommunityPattern(t *testing.T) {
+
+	attr := Attributes{
+		Communities:         []Community{64512<<16 | 1, 65000<<16 | 100, 65000<<16 | 200},
+		ExtendedCommunities: []ExtendedCommunity{0x0002fde800000001, ColorExtendedCommunity(100)},
+		LargeCommunities:    []LargeCommunity{{65000, 1, 2}},
+	}
+
+	tests := []struct {
+		pattern string
+		want    bool
+	}{
+		{"65000:100", true},
+		{"65000:*", true},
+		{"*:200", true},
+		{"*:*", true},
+		{"65000:300", false},
+		{"65001:*", false},
+		{"65000:1:2", true},
+		{"65000:*:2", true},
+		{"65000:2:*", false},
+		{"0x0002fde800000001", true},
+		{"0x0002fde8********", true},
+		{"0x030b************", true},
+		{"0x0002fde9********", false},
+	}
+
+	for _, test := range tests {
+		p, err := ParseCommunityPattern(test.pattern)
+
+		if err != nil {
+			t.Fatal(test.pattern, err)
+		}
+
+		if p.Match(attr) != test.want {
+			t.Errorf("%s: expected %v", test.pattern, test.want)
+		}
+	}
+
+	if (&CommunityPattern{}).Match(attr) {
+		t.Error("Empty pattern should not match")
+	}
+
+	for _, s := range []string{"", "65000", "65536:*", "65000:1:2:3", "a:b", "0x", "0x0002fde8****", "0x00000000000000000"} {
+		if _, err := ParseCommunityPattern(s); err == nil {
+			t.Errorf("%q should not parse", s)
+		}
+	}
+
+	var rules []PolicyRule
+
+	if err := json.Unmarshal([]byte(`[{"match":{"community_patterns":["65000:*"]},"set":{"local_pref":200}}]`), &rules); err != nil {
+		t.Fatal(err)
+	}
+
+	if r, ok := evaluate(rules, Route{Attributes: attr}); !ok || r.LocalPref != 200 {
+		t.Error("Import policy should match community pattern:", r.LocalPref)
+	}
+
+	if r, _ := evaluate(rules, Route{Attributes: Attributes{Communities: []Community{65001<<16 | 100}}}); r.LocalPref == 200 {
+		t.Error("Import policy should not match")
+	}
+}
@@ -19,42 +19,95 @@
 package bgp
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
+	"net/netip"
 	"sync"
 	"time"
 )
 
 type pdu []byte
 
+// An outbound message, or a marker to be called when all of the
+// messages queued before it have been written
+type queued struct {
+	pdu     pdu
+	written func()
+}
+
 type connection struct {
 	C     chan message
-	Error string
+	Error string // reader and writer both set this - see lastError
 
 	closed      chan bool
 	writer_exit chan bool
 	reader_exit chan bool
 	pending     chan bool
+	space       chan bool
 	conn        net.Conn
 	mutex       sync.Mutex
-	out         []pdu
+	out         []queued
+	limit       int // high-water mark for the outbound queue; 0 for unlimited
+	sent        func(uint8)
+
+	// Interop testing only: marker replaces the standard all-ones
+	// marker (RFC 4271 4.1) on sent messages, and anyMarker disables
+	// validation of the marker on received messages
+	marker    func() [16]byte
+	anyMarker bool
+}
+
+// Establishes the TCP connection to the peer in place of the net
+// package, eg. through a SOCKS proxy, in a VRF, or over an in-memory
+// test network - see Parameters.Dialer. Satisfied by *net.Dialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func newConnection(local IP4, peer string, opts socketOptions) (*connection, error) {
+
+	conn, err := dial(local, peer, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.tlsConfig != nil {
+		if conn, err = handshake(conn, peer, opts.tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	return startConnection(conn), nil
 }
 
-func newConnection(local IP4, peer string) (*connection, error) {
+func dial(local IP4, peer string, opts socketOptions) (net.Conn, error) {
 	var nul IP4
 
+	if opts.dialer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return opts.dialer.DialContext(ctx, "tcp", peer+":179")
+	}
+
 	dialer := net.Dialer{
 		Timeout: 10 * time.Second,
+		Control: opts.control,
 	}
 
 	if local != nul {
-		dialer = net.Dialer{
-			Timeout: 10 * time.Second,
-			LocalAddr: &net.TCPAddr{
-				IP:   net.IP(local[:]),
-				Port: 0,
-			},
+		dialer.LocalAddr = &net.TCPAddr{
+			IP:   net.IP(local[:]),
+			Port: opts.sourcePort,
 		}
+	} else if opts.sourcePort != 0 {
+		dialer.LocalAddr = &net.TCPAddr{Port: opts.sourcePort}
+	}
+
+	if opts.keepAlive() {
+		dialer.KeepAlive = -1 // don't let the net package override our settings
 	}
 
 	conn, err := dialer.Dial("tcp", peer+":179")
@@ -63,19 +116,29 @@ func newConnection(local IP4, peer string) (*connection, error) {
 		return nil, err
 	}
 
+	if t, ok := conn.(*net.TCPConn); ok && opts.delay {
+		t.SetNoDelay(false)
+	}
+
+	return conn, nil
+}
+
+func startConnection(conn net.Conn) *connection {
+
 	c := &connection{
 		C:           make(chan message),
 		closed:      make(chan bool),
 		writer_exit: make(chan bool),
 		reader_exit: make(chan bool),
 		pending:     make(chan bool, 1),
+		space:       make(chan bool, 1),
 		conn:        conn,
 	}
 
 	go c.writer()
 	go c.reader()
 
-	return c, nil
+	return c
 }
 
 func (c *connection) local() ([]byte, bool) {
@@ -87,15 +150,24 @@ func (c *connection) local() ([]byte, bool) {
 	return nil, false
 }
 
+func (c *connection) remote() netip.Addr {
+
+	if a, ok := c.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return a.AddrPort().Addr().Unmap()
+	}
+
+	return netip.Addr{}
+}
+
 func (c *connection) close() {
 	close(c.closed)
 }
 
-func (c *connection) shift() (pdu, bool) {
+func (c *connection) shift() (queued, bool) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	var m pdu
+	var m queued
 
 	if len(c.out) < 1 {
 		return m, false
@@ -109,32 +181,85 @@ func (c *connection) shift() (pdu, bool) {
 	default:
 	}
 
+	select {
+	case c.space <- true: // wake anyone waiting in wait()
+	default:
+	}
+
 	return m, true
 }
 
-func (c *connection) queue(ms ...message) {
+func (c *connection) setError(e string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Error = e
+}
 
-	addHeader := func(t byte, d []byte) pdu {
-		l := 19 + len(d)
-		p := make([]byte, l)
-		for n := 0; n < 16; n++ {
-			p[n] = 0xff
-		}
-		hl := htons(uint16(l))
-		p[16] = hl[0]
-		p[17] = hl[1]
-		p[18] = t
+func (c *connection) lastError() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.Error
+}
 
-		copy(p[19:], d)
+// Number of messages waiting to be written
+func (c *connection) depth() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.out)
+}
+
+func (c *connection) full() bool {
+	return c.limit > 0 && c.depth() >= c.limit
+}
 
-		return p
+// Blocks while the outbound queue is at the high-water mark. Returns
+// false if the connection fails whilst waiting.
+func (c *connection) wait() bool {
+	for c.full() {
+		select {
+		case <-c.space:
+		case <-c.writer_exit:
+			return false
+		}
 	}
+	return true
+}
 
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+// Marker[16], Length[2], Type[1], followed by the message body
+func addHeader(t byte, d []byte) pdu {
+	l := 19 + len(d)
+	p := make([]byte, l)
+	for n := 0; n < 16; n++ {
+		p[n] = 0xff
+	}
+	hl := htons(uint16(l))
+	p[16] = hl[0]
+	p[17] = hl[1]
+	p[18] = t
+
+	copy(p[19:], d)
 
+	return p
+}
+
+func (c *connection) queue(ms ...message) {
+
+	c.mutex.Lock()
 	for _, m := range ms {
-		c.out = append(c.out, addHeader(m.Type(), m.Body()))
+		p := addHeader(m.Type(), m.Body())
+		if c.marker != nil {
+			marker := c.marker()
+			copy(p[0:16], marker[:])
+		}
+		c.out = append(c.out, queued{pdu: p})
+	}
+	c.mutex.Unlock()
+
+	// not under the lock - the session's lock is taken when counting
+	if c.sent != nil {
+		for _, m := range ms {
+			c.sent(m.Type())
+		}
 	}
 
 	select {
@@ -143,6 +268,20 @@ func (c *connection) queue(ms ...message) {
 	}
 }
 
+// Call f from the writer once everything queued so far has been
+// written to the socket - it is never called if the connection fails
+func (c *connection) then(f func()) {
+
+	c.mutex.Lock()
+	c.out = append(c.out, queued{written: f})
+	c.mutex.Unlock()
+
+	select {
+	case c.pending <- true:
+	default:
+	}
+}
+
 func (c *connection) drain() bool {
 
 	for {
@@ -152,12 +291,17 @@ func (c *connection) drain() bool {
 			return true
 		}
 
+		if m.written != nil {
+			m.written()
+			continue
+		}
+
 		c.conn.SetWriteDeadline(time.Now().Add(3 * time.Second))
 
-		_, err := c.conn.Write(m)
+		_, err := c.conn.Write(m.pdu)
 
 		if err != nil {
-			c.Error = err.Error()
+			c.setError(err.Error())
 			return false
 		}
 	}
@@ -186,66 +330,84 @@ func (c *connection) writer() {
 	}
 }
 
-func (c *connection) reader() {
+// Read a single framed message - the header is validated, but not the
+// contents of the body. Returns io.EOF only if there was no more data.
+func readFrame(r io.Reader) (byte, []byte, error) {
+	return readFrameMarker(r, true)
+}
 
-	defer close(c.reader_exit)
-	defer close(c.C)
+func readFrameMarker(r io.Reader, validate bool) (byte, []byte, error) {
 
-	for {
-		// try to read a message
-		// if the writer side encounders an error, it will exit and close the connction, causing an error here
-		// if the user asks to close the connection upstream then writer will exit, closing the net connection (error here)
+	var header [19]byte
 
-		var header [19]byte
+	if _, e := io.ReadFull(r, header[:]); e != nil {
+		return 0, nil, e
+	}
 
-		n, e := io.ReadFull(c.conn, header[:])
-		if n != len(header) || e != nil {
-			c.Error = e.Error()
-			return
+	for _, b := range header[0:16] {
+		if validate && b != 0xff {
+			return 0, nil, errors.New("Bad message marker")
 		}
+	}
 
-		for _, b := range header[0:16] {
-			if b != 0xff {
-				return
-			}
-		}
+	length := int(header[16])<<8 + int(header[17])
+	mtype := header[18]
 
-		length := int(header[16])<<8 + int(header[17])
-		mtype := header[18]
+	if length < 19 || length > 4096 {
+		return 0, nil, errors.New("Bad message length")
+	}
 
-		if length < 19 || length > 4096 {
-			return
+	length -= 19
+
+	body := make([]byte, length)
+
+	if _, e := io.ReadFull(r, body[:]); e != nil {
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
 		}
+		return 0, nil, e
+	}
 
-		length -= 19
+	return mtype, body, nil
+}
 
-		body := make([]byte, length)
+func parseMessage(mtype byte, body []byte) (message, bool) {
+	switch mtype {
+	case M_OPEN:
+		var o open
+		ok := o.parse(body)
+		return &o, ok
+	case M_NOTIFICATION:
+		var n notification
+		ok := n.parse(body)
+		return &n, ok
+	}
+	return &other{mtype: mtype, body: body}, true
+}
+
+func (c *connection) reader() {
 
-		n, e = io.ReadFull(c.conn, body[:])
-		if n != len(body) || e != nil {
-			c.Error = e.Error()
+	defer close(c.reader_exit)
+	defer close(c.C)
+
+	for {
+		// try to read a message
+		// if the writer side encounders an error, it will exit and close the connction, causing an error here
+		// if the user asks to close the connection upstream then writer will exit, closing the net connection (error here)
+
+		mtype, body, e := readFrameMarker(c.conn, !c.anyMarker)
+
+		if e != nil {
+			c.setError(e.Error())
 			return
 		}
 
-		var m message
-
-		switch mtype {
-		case M_OPEN:
-			var o open
-			o.parse(body) // todo - handle failed parse better (connection gets killed anyway)
-			m = &o
-		case M_NOTIFICATION:
-			var n notification
-			n.parse(body) // todo - handle failed parse better (connection gets killed anyway)
-			m = &n
-		default:
-			m = &other{mtype: mtype, body: body}
-		}
+		m, _ := parseMessage(mtype, body) // todo - handle failed parse better (connection gets killed anyway)
 
 		select {
 		case c.C <- m:
 		case <-c.closed: // user wants to close the connection
-			c.Error = "Closed"
+			c.setError("Closed")
 			return
 		case <-c.writer_exit:
 			return
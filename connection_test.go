@@ -0,0 +1,186 @@
+package bgp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestQueueBackpressure(t *testing.T) {
+
+	local, remote := net.Pipe() // writes block until the remote end reads
+	defer remote.Close()
+
+	c := startConnection(local)
+	defer c.close()
+
+	c.limit = 2
+
+	// one message is taken by the writer, which blocks, the rest are queued
+	c.queue(&keepalive{}, &keepalive{}, &keepalive{})
+
+	time.Sleep(100 * time.Millisecond)
+
+	if !c.full() {
+		t.Fatalf("Queue should be at the limit: %d", c.depth())
+	}
+
+	s := &Session{}
+
+	done := make(chan bool)
+
+	go func() {
+		_, ok := s.send(c, []message{&keepalive{}})
+		done <- ok
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("send() should block while the queue is full")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	var buf [19]byte
+
+	if _, err := io.ReadFull(remote, buf[:]); err != nil { // peer reads one message
+		t.Fatal(err)
+	}
+
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatalf("send() should succeed once the queue drains")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("send() should unblock once the queue drains")
+	}
+
+	for c.depth() < 2 {
+		c.queue(&keepalive{})
+	}
+
+	s.update.Parameters.QueuePolicy = QUEUE_CEASE
+
+	n, ok := s.send(c, []message{&keepalive{}})
+
+	if ok || n.code != CEASE || n.sub != OUT_OF_RESOURCES {
+		t.Fatalf("send() should fail with Cease when the queue is full: %v", n)
+	}
+}
+
+func TestWritten(t *testing.T) {
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	c := startConnection(local)
+	defer c.close()
+
+	written := make(chan bool, 1)
+
+	c.queue(&keepalive{}, &keepalive{})
+	c.then(func() { written <- true })
+
+	select {
+	case <-written:
+		t.Fatal("Called before the messages were consumed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := readFrame(remote); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("Not called after the messages were consumed")
+	}
+}
+
+func TestMarker(t *testing.T) {
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	c := startConnection(local)
+	defer c.close()
+
+	var marker [16]byte
+	for i := range marker {
+		marker[i] = byte(i)
+	}
+
+	c.marker = func() [16]byte { return marker }
+	c.queue(&keepalive{})
+
+	var frame [19]byte
+
+	if _, err := io.ReadFull(remote, frame[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	if !byteSliceEqual(frame[:16], marker[:]) || frame[16] != 0 || frame[17] != 19 || frame[18] != M_KEEPALIVE {
+		t.Fatalf("Framed bytes incorrect: %v", frame)
+	}
+
+	// received markers are still validated
+	if _, _, err := readFrame(bytes.NewReader(frame[:])); err == nil {
+		t.Error("Non-standard marker should be rejected")
+	}
+
+	if mtype, _, err := readFrameMarker(bytes.NewReader(frame[:]), false); err != nil || mtype != M_KEEPALIVE {
+		t.Error("Non-standard marker should be accepted in compatibility mode:", err)
+	}
+}
+
+type pipeDialer struct {
+	address chan string
+	remote  chan net.Conn
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	local, remote := net.Pipe()
+	d.address <- address
+	d.remote <- remote
+	return local, nil
+}
+
+func TestDialer(t *testing.T) {
+
+	d := &pipeDialer{address: make(chan string, 1), remote: make(chan net.Conn, 1)}
+
+	s := newSession(IP{10, 0, 0, 1}, "192.0.2.1", Parameters{ASNumber: 65000, Dialer: d}, []netip.Addr{ipv4_0}, nil)
+	defer s.Close()
+
+	select {
+	case a := <-d.address:
+		if a != "192.0.2.1:179" {
+			t.Error("Unexpected address:", a)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Dialer was not used")
+	}
+
+	peer := newTestPeer(t, <-d.remote)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	if s.Status().State != ESTABLISHED {
+		t.Error("Session should be established:", s.Status().State)
+	}
+}
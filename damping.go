@@ -0,0 +1,153 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+// https://datatracker.ietf.org/doc/html/rfc2439 - BGP Route Flap Damping
+
+import (
+	"math"
+	"net/netip"
+	"time"
+)
+
+// Route flap damping applied to our own advertisements: each time a
+// prefix is withdrawn it accrues a penalty, which decays exponentially.
+// Once the penalty exceeds Suppress the prefix is not re-advertised
+// until it has decayed below Reuse. Zero values take the defaults.
+type Damping struct {
+	HalfLife time.Duration `json:"half_life,omitempty"` // default 15 minutes
+	Suppress uint32        `json:"suppress,omitempty"`  // default 2000
+	Reuse    uint32        `json:"reuse,omitempty"`     // default 750
+}
+
+const FLAP_PENALTY = 1000 // added for each withdrawal
+
+type flap struct {
+	penalty    float64
+	updated    time.Time
+	suppressed bool
+}
+
+// A nil *dampener passes everything through
+type dampener struct {
+	halfLife time.Duration
+	suppress float64
+	reuse    float64
+	flaps    map[netip.Addr]*flap
+}
+
+func newDampener(d *Damping) *dampener {
+
+	if d == nil {
+		return nil
+	}
+
+	r := &dampener{halfLife: d.HalfLife, suppress: float64(d.Suppress), reuse: float64(d.Reuse), flaps: map[netip.Addr]*flap{}}
+
+	if r.halfLife <= 0 {
+		r.halfLife = 15 * time.Minute
+	}
+
+	if r.suppress == 0 {
+		r.suppress = 2000
+	}
+
+	if r.reuse == 0 {
+		r.reuse = 750
+	}
+
+	return r
+}
+
+func (d *dampener) decay(f *flap, now time.Time) {
+	if elapsed := now.Sub(f.updated); elapsed > 0 {
+		f.penalty *= math.Pow(0.5, float64(elapsed)/float64(d.halfLife))
+		f.updated = now
+	}
+}
+
+// Record withdrawals in the NLRI about to be sent, and hold back
+// advertisements of suppressed prefixes, which are also removed from
+// the Adj-RIB-Out so that they are advertised once reusable
+func (d *dampener) apply(adjRIBOut []netip.Addr, nlri map[netip.Addr]bool, now time.Time) ([]netip.Addr, map[netip.Addr]bool) {
+
+	if d == nil {
+		return adjRIBOut, nlri
+	}
+
+	held := map[netip.Addr]bool{}
+
+	for ip, advertise := range nlri {
+		f, ok := d.flaps[ip]
+
+		if !advertise {
+			if !ok {
+				f = &flap{updated: now}
+				d.flaps[ip] = f
+			}
+			d.decay(f, now)
+			f.penalty += FLAP_PENALTY
+			f.suppressed = f.suppressed || f.penalty > d.suppress
+			continue
+		}
+
+		if ok && f.suppressed {
+			held[ip] = true
+			delete(nlri, ip)
+		}
+	}
+
+	if len(held) < 1 {
+		return adjRIBOut, nlri
+	}
+
+	var out []netip.Addr
+
+	for _, ip := range adjRIBOut {
+		if !held[ip] {
+			out = append(out, ip)
+		}
+	}
+
+	return out, nlri
+}
+
+// Returns true if any suppressed prefix has decayed to the reuse
+// threshold, and forgets prefixes whose penalty is negligible
+func (d *dampener) reusable(now time.Time) (reuse bool) {
+
+	if d == nil {
+		return false
+	}
+
+	for ip, f := range d.flaps {
+		d.decay(f, now)
+
+		if f.suppressed && f.penalty < d.reuse {
+			f.suppressed = false
+			reuse = true
+		}
+
+		if !f.suppressed && f.penalty < d.reuse/2 {
+			delete(d.flaps, ip)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,95 @@
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestDampener(t *testing.T) {
+
+	d := newDampener(&Damping{HalfLife: time.Minute, Suppress: 2500})
+	now := time.Now()
+
+	flap := func() map[netip.Addr]bool {
+		d.apply(nil, map[netip.Addr]bool{ipv4_0: false}, now)
+		_, nlri := d.apply([]netip.Addr{ipv4_0}, map[netip.Addr]bool{ipv4_0: true}, now)
+		return nlri
+	}
+
+	if nlri := flap(); !nlri[ipv4_0] {
+		t.Error("Prefix should not be suppressed after one flap")
+	}
+
+	flap()
+
+	if nlri := flap(); len(nlri) != 0 {
+		t.Error("Prefix should be suppressed after three flaps:", nlri)
+	}
+
+	if d.reusable(now.Add(time.Minute)) {
+		t.Error("Penalty has not yet decayed to the reuse threshold")
+	}
+
+	if !d.reusable(now.Add(2*time.Minute + time.Second)) {
+		t.Error("Prefix should be reusable")
+	}
+
+	if newDampener(nil) != nil || newDampener(&Damping{}).reuse != 750 {
+		t.Error("Defaults")
+	}
+}
+
+func TestDampingSession(t *testing.T) {
+
+	m := newMockClock()
+
+	p := Parameters{ASNumber: 65000, HoldTime: 600, Damping: &Damping{HalfLife: time.Minute, Suppress: 2500}}
+
+	s := NewConnSession(IP{10, 0, 0, 1}, p, []netip.Addr{ipv4_0}, nil)
+	s.timers = m
+
+	peer := runTestSession(t, s)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	// hold time long enough not to expire while the clock is advanced
+	peer.send(&open{version: 4, asNumber: 65001, holdTime: 600, routerID: IP4{10, 0, 0, 2}})
+	peer.send(&keepalive{})
+
+	expect := func(advertised bool) {
+		msg := peer.next(time.Second)
+
+		if msg == nil || msg.Type() != M_UPDATE {
+			t.Fatalf("Expected UPDATE: %v", msg)
+		}
+
+		d, _ := decodeUpdate(msg.Body())
+
+		if advertised && len(d.advertised) != 1 || !advertised && len(d.withdrawn) != 1 {
+			t.Fatalf("Expected advertised=%v: %v %v", advertised, d.advertised, d.withdrawn)
+		}
+	}
+
+	expect(true)
+
+	for i := 0; i < 3; i++ {
+		s.LocRIB(nil)
+		expect(false)
+		s.LocRIB([]netip.Addr{ipv4_0})
+
+		if i < 2 {
+			expect(true)
+		}
+	}
+
+	if msg := peer.next(100 * time.Millisecond); msg != nil {
+		t.Fatalf("Flapping prefix should be suppressed: %v", msg)
+	}
+
+	m.Advance(2*time.Minute + 5*time.Second)
+
+	expect(true)
+}
@@ -0,0 +1,66 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"sort"
+	"time"
+)
+
+// A snapshot of the session's state for diagnostics - see Debug
+type DebugInfo struct {
+	Status       Status             `json:"status"`
+	Peer         *PeerInfo          `json:"peer,omitempty"` // nil if no OPEN has been received
+	Negotiated   Capabilities       `json:"negotiated"`
+	Capabilities []CapabilityStatus `json:"capabilities,omitempty"`
+	Keepalive    time.Duration      `json:"keepalive_interval_s"` // derived from the negotiated hold time
+	RIBOut       RIBOutStats        `json:"rib_out"`
+	AdjRIBIn     []ReceivedRoute    `json:"adj_rib_in,omitempty"` // sample, ordered by prefix
+}
+
+// Everything which is known about the session, taken under a single
+// lock so that it is consistent, eg. for an HTTP debug handler. Up to
+// sample routes from the Adj-RIB-In are included (0 for none) - these
+// are an arbitrary selection, so the whole table is not sorted.
+func (s *Session) Debug(sample int) (d DebugInfo) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	d.Status = s.currentStatus()
+	d.Negotiated = s.negotiated
+	d.Keepalive = time.Duration(d.Status.HoldTime / 3) // in seconds, as Status.Duration
+	d.RIBOut = s.ribOut
+
+	if s.peerInfo != nil {
+		i := *s.peerInfo
+		d.Peer = &i
+		d.Capabilities = capabilityReport(s.offered, s.peerCaps)
+	}
+
+	for _, r := range s.ribIn {
+		if len(d.AdjRIBIn) >= sample {
+			break
+		}
+		d.AdjRIBIn = append(d.AdjRIBIn, r)
+	}
+
+	sort.Slice(d.AdjRIBIn, func(i, j int) bool { return prefixLess(d.AdjRIBIn[i].Prefix, d.AdjRIBIn[j].Prefix) })
+
+	return
+}
@@ -0,0 +1,51 @@
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestDebug(t *testing.T) {
+
+	s, peer := newTestSession(t, Parameters{ASNumber: 65000}, []netip.Addr{ipv4_0, ipv4_1}, nil)
+
+	if d := s.Debug(10); d.Peer != nil || d.Capabilities != nil || len(d.AdjRIBIn) != 0 {
+		t.Errorf("Nothing should be known about the peer yet: %+v", d)
+	}
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001, capability{code: ROUTE_REFRESH})
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	a := advert{ASNumber: 65001, PeerASNumber: 65000, NextHop: [4]byte{10, 0, 0, 2}}
+	u, _ := a.message(map[netip.Addr]bool{netip.MustParseAddr("10.1.0.1"): true, netip.MustParseAddr("10.1.0.2"): true})
+	peer.send(&u)
+
+	var d DebugInfo
+
+	for i := 0; i < 100; i++ {
+		if d = s.Debug(1); d.Status.ReceivedPrefixes == 2 && d.RIBOut.IPv4 == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if d.Status.State != ESTABLISHED || d.Status.ReceivedPrefixes != 2 || d.RIBOut.IPv4 != 2 {
+		t.Fatalf("Unexpected status: %+v %+v", d.Status, d.RIBOut)
+	}
+
+	if d.Peer == nil || d.Peer.ASNumber != 65001 || len(d.Capabilities) == 0 || d.Keepalive != time.Duration(d.Status.HoldTime/3) {
+		t.Errorf("Peer details should be populated: %+v", d)
+	}
+
+	if len(d.AdjRIBIn) != 1 || d.AdjRIBIn[0].Prefix.Addr().As4()[1] != 1 {
+		t.Errorf("Expected a sample of one route: %v", d.AdjRIBIn)
+	}
+}
@@ -0,0 +1,486 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+// https://datatracker.ietf.org/doc/html/rfc4760 - Multiprotocol Extensions for BGP-4
+// https://datatracker.ietf.org/doc/html/rfc7606 - Revised Error Handling for BGP UPDATE Messages
+
+import (
+	"net/netip"
+)
+
+const (
+	MALFORMED_ATTRIBUTE_LIST = 1  // UPDATE_MESSAGE_ERROR
+	OPTIONAL_ATTRIBUTE_ERROR = 9  // UPDATE_MESSAGE_ERROR
+	INVALID_NETWORK_FIELD    = 10 // UPDATE_MESSAGE_ERROR
+)
+
+// The contents of a received UPDATE message
+type decoded struct {
+	withdrawn  []netip.Prefix
+	advertised []netip.Prefix
+	attributes Attributes
+	endOfRIB   family // non-zero if the message was an End-of-RIB marker
+
+	labeled []labeledPrefix // labeled unicast/VPN routes - validated, but not imported
+
+	families []family // in MP_REACH_NLRI/MP_UNREACH_NLRI attributes
+
+	// NEXT_HOP applies to the NLRI field, and each MP_REACH_NLRI to
+	// its own family, so an UPDATE may carry more than one next hop
+	nextHop   netip.Addr
+	mpNextHop map[family]netip.Addr
+
+	as4Aggregator *Aggregator
+	as4Path       ASPath // see mergeASPath
+
+	// RFC 7606: the attributes were malformed in a way that should
+	// cause the advertised prefixes to be treated as withdrawn
+	treatAsWithdraw bool
+
+	external bool // received from an external peer
+	maxDepth int  // see Parameters.MaxDecodeDepth
+}
+
+func updateError(sub uint8) *notification {
+	return &notification{code: UPDATE_MESSAGE_ERROR, sub: sub}
+}
+
+// Errors which can't be confined to the routes in the message return
+// a NOTIFICATION to be sent to the peer.
+//
+// Decoders in this file must never allocate based on a length field
+// from the message - only on data actually present - so that the
+// memory used is bounded by the size of the message (at most 4096
+// bytes), however the lengths are crafted.
+func decodeUpdate(d []byte) (u decoded, n *notification) {
+	return decodeUpdateFrom(d, false, 0)
+}
+
+// Limit on nested structures in NLRI (eg. the labels in a labeled
+// unicast prefix) if Parameters.MaxDecodeDepth is not set
+const DEFAULT_MAX_DECODE_DEPTH = 16
+
+// As decodeUpdate, but a LOCAL_PREF from an external peer is discarded
+// (RFC 4271 5.1.5, RFC 7606 7.5) so that the peer can't influence our
+// preference, and nested structures are limited to maxDepth levels
+// (DEFAULT_MAX_DECODE_DEPTH if 0)
+func decodeUpdateFrom(d []byte, external bool, maxDepth int) (u decoded, n *notification) {
+
+	u.external = external
+	u.maxDepth = maxDepth
+
+	if u.maxDepth <= 0 {
+		u.maxDepth = DEFAULT_MAX_DECODE_DEPTH
+	}
+
+	if len(d) < 4 {
+		return u, updateError(MALFORMED_ATTRIBUTE_LIST)
+	}
+
+	wl := int(d[0])<<8 | int(d[1])
+
+	if 2+wl+2 > len(d) {
+		return u, updateError(MALFORMED_ATTRIBUTE_LIST)
+	}
+
+	withdrawn, ok := decodePrefixes(d[2:2+wl], false)
+
+	if !ok {
+		return u, updateError(INVALID_NETWORK_FIELD)
+	}
+
+	d = d[2+wl:]
+
+	al := int(d[0])<<8 | int(d[1])
+
+	// RFC 4271 6.3: the lengths must not exceed the message
+	if 2+al > len(d) {
+		return u, updateError(MALFORMED_ATTRIBUTE_LIST)
+	}
+
+	u.withdrawn = withdrawn
+
+	// attributes are decoded before the NLRI so that a Total Path
+	// Attribute Length which is too small (leaving part of an attribute
+	// to be read as NLRI) is reported as a malformed attribute list
+	if n = u.decodeAttributes(d[2 : 2+al]); n != nil {
+		return u, n
+	}
+
+	nlri, ok := decodePrefixes(d[2+al:], false)
+
+	if !ok {
+		return u, updateError(INVALID_NETWORK_FIELD)
+	}
+
+	u.advertised = append(nlri, u.advertised...)
+
+	if len(u.withdrawn) == 0 && len(u.advertised) == 0 {
+		u.endOfRIB = endOfRIBFamily(d[2 : 2+al])
+	}
+
+	return u, nil
+}
+
+func (u *decoded) decodeAttributes(d []byte) *notification {
+
+	for len(d) > 0 {
+
+		if len(d) < 3 {
+			return updateError(MALFORMED_ATTRIBUTE_LIST)
+		}
+
+		flags := d[0]
+		code := d[1]
+
+		var l, h int
+
+		if flags&16 != 0 { // extended length
+			if len(d) < 4 {
+				return updateError(MALFORMED_ATTRIBUTE_LIST)
+			}
+			l, h = int(d[2])<<8|int(d[3]), 4
+		} else {
+			l, h = int(d[2]), 3
+		}
+
+		if h+l > len(d) {
+			return updateError(MALFORMED_ATTRIBUTE_LIST)
+		}
+
+		v := d[h : h+l]
+		d = d[h+l:]
+
+		switch code {
+		case ORIGIN:
+			if len(v) != 1 || v[0] > 2 {
+				u.treatAsWithdraw = true
+			} else {
+				u.attributes.Origin = v[0]
+			}
+
+		case AS_PATH:
+			if p, ok := decodeASPath(v, false); ok {
+				u.attributes.ASPath = p
+			} else {
+				u.treatAsWithdraw = true
+			}
+
+		case NEXT_HOP:
+			if len(v) != 4 { // RFC 7606 section 7.3
+				u.treatAsWithdraw = true
+			} else {
+				u.nextHop = netip.AddrFrom4([4]byte{v[0], v[1], v[2], v[3]})
+			}
+
+		case MULTI_EXIT_DISC:
+			if len(v) != 4 {
+				u.treatAsWithdraw = true
+			} else {
+				u.attributes.MED = uint32(v[0])<<24 | uint32(v[1])<<16 | uint32(v[2])<<8 | uint32(v[3])
+			}
+
+		case LOCAL_PREF:
+			if u.external {
+				// attribute discard - RFC 7606 section 7.5
+			} else if len(v) != 4 {
+				u.treatAsWithdraw = true
+			} else {
+				u.attributes.LocalPref = uint32(v[0])<<24 | uint32(v[1])<<16 | uint32(v[2])<<8 | uint32(v[3])
+			}
+
+		case COMMUNITIES:
+			if len(v)%4 != 0 {
+				u.treatAsWithdraw = true
+			} else {
+				u.attributes.Communities = decodeCommunities(v)
+			}
+
+		case ATOMIC_AGGREGATE:
+			if len(v) == 0 {
+				u.attributes.AtomicAggregate = true
+			} // else attribute discard - RFC 7606 section 7.6
+
+		case AGGREGATOR:
+			if len(v) == 6 { // else attribute discard - RFC 7606 section 7.7
+				u.attributes.Aggregator = &Aggregator{
+					AS:      uint32(v[0])<<8 | uint32(v[1]),
+					Address: netip.AddrFrom4([4]byte{v[2], v[3], v[4], v[5]}),
+				}
+			}
+
+		case AS4_PATH:
+			if p, ok := decodeASPath(v, true); ok {
+				u.as4Path = p
+			} // else attribute discard - RFC 7606 section 7.3
+
+		case AS4_AGGREGATOR:
+			if len(v) == 8 {
+				u.as4Aggregator = &Aggregator{
+					AS:      uint32(v[0])<<24 | uint32(v[1])<<16 | uint32(v[2])<<8 | uint32(v[3]),
+					Address: netip.AddrFrom4([4]byte{v[4], v[5], v[6], v[7]}),
+				}
+			}
+
+		case EXTENDED_COMMUNITIES:
+			if len(v)%8 != 0 {
+				u.treatAsWithdraw = true
+			} else {
+				u.attributes.ExtendedCommunities = decodeExtendedCommunities(v)
+			}
+
+		case ONLY_TO_CUSTOMER:
+			if len(v) != 4 {
+				u.treatAsWithdraw = true
+			} else {
+				u.attributes.OTC = uint32(v[0])<<24 | uint32(v[1])<<16 | uint32(v[2])<<8 | uint32(v[3])
+			}
+
+		case LARGE_COMMUNITIES:
+			if len(v)%12 != 0 {
+				u.treatAsWithdraw = true
+			} else {
+				u.attributes.LargeCommunities = decodeLargeCommunities(v)
+			}
+
+		case MP_REACH_NLRI:
+			if n := u.mpReach(v); n != nil {
+				return n
+			}
+
+		case MP_UNREACH_NLRI:
+			if n := u.mpUnreach(v); n != nil {
+				return n
+			}
+		}
+	}
+
+	u.mergeASPath()
+	u.mergeAggregator()
+
+	return nil
+}
+
+// RFC 6793 section 4.2.3: AS4_PATH is ignored if an AGGREGATOR carries
+// a two-octet AS (the route was aggregated by an old speaker which
+// didn't update AS4_PATH), so check before mergeAggregator replaces it
+func (u *decoded) mergeASPath() {
+	if a := u.attributes.Aggregator; a != nil && a.AS != AS_TRANS {
+		return
+	}
+
+	if u.as4Path != nil {
+		u.attributes.ASPath = u.attributes.ASPath.merge(u.as4Path)
+	}
+}
+
+// RFC 6793 section 4.2.3: if the AGGREGATOR carries AS_TRANS then the
+// real AS is in AS4_AGGREGATOR, otherwise AS4_AGGREGATOR is ignored
+func (u *decoded) mergeAggregator() {
+	if a := u.attributes.Aggregator; a != nil && a.AS == AS_TRANS && u.as4Aggregator != nil {
+		u.attributes.Aggregator = u.as4Aggregator
+	}
+}
+
+// AFI[2], SAFI[1], Length of Next Hop[1], Next Hop[...], Reserved[1], NLRI[...]
+func (u *decoded) mpReach(v []byte) *notification {
+
+	if len(v) < 5 {
+		return updateError(OPTIONAL_ATTRIBUTE_ERROR)
+	}
+
+	afi := uint16(v[0])<<8 | uint16(v[1])
+	safi := v[2]
+	nhl := int(v[3])
+
+	u.families = append(u.families, family{afi: afi, safi: safi})
+
+	if 4+nhl+1 > len(v) {
+		// can't locate the NLRI, so can't treat-as-withdraw - RFC 7606 section 7.11
+		return updateError(OPTIONAL_ATTRIBUTE_ERROR)
+	}
+
+	if (safi == SAFI_LABELED_UNICAST || safi == SAFI_MPLS_VPN) && (afi == 1 || afi == 2) {
+		if labeled, ok := decodeLabeledPrefixes(v[4+nhl+1:], afi == 2, safi == SAFI_MPLS_VPN, u.maxDepth); ok {
+			u.labeled = append(u.labeled, labeled...)
+		} else {
+			u.treatAsWithdraw = true
+		}
+		return nil
+	}
+
+	if safi != 1 || (afi != 1 && afi != 2) {
+		return nil // not a family that we handle
+	}
+
+	nlri, ok := decodePrefixes(v[4+nhl+1:], afi == 2)
+
+	if !ok {
+		return updateError(OPTIONAL_ATTRIBUTE_ERROR)
+	}
+
+	u.advertised = append(u.advertised, nlri...)
+
+	nh := v[4 : 4+nhl]
+
+	if u.mpNextHop == nil {
+		u.mpNextHop = map[family]netip.Addr{}
+	}
+
+	f := family{afi: afi, safi: safi}
+
+	switch {
+	case !validNextHop(f, nhl):
+		u.treatAsWithdraw = true
+	case nhl == 4:
+		u.mpNextHop[f] = netip.AddrFrom4([4]byte{nh[0], nh[1], nh[2], nh[3]})
+	default: // global address, or global + link-local pair (also IPv4 NLRI - RFC 8950)
+		var a [16]byte
+		copy(a[:], nh[0:16])
+		u.mpNextHop[f] = netip.AddrFrom16(a)
+	}
+
+	return nil
+}
+
+// The next hop for an advertised prefix: from MP_REACH_NLRI for its
+// family, or NEXT_HOP for IPv4 prefixes in the NLRI field
+func (u *decoded) nextHopFor(p netip.Prefix) netip.Addr {
+	if nh, ok := u.mpNextHop[addrFamily(p.Addr())]; ok {
+		return nh
+	}
+	if p.Addr().Is4() {
+		return u.nextHop
+	}
+	return netip.Addr{}
+}
+
+// AFI[2], SAFI[1], Withdrawn Routes[...]
+func (u *decoded) mpUnreach(v []byte) *notification {
+
+	if len(v) < 3 {
+		return updateError(OPTIONAL_ATTRIBUTE_ERROR)
+	}
+
+	afi := uint16(v[0])<<8 | uint16(v[1])
+	safi := v[2]
+
+	u.families = append(u.families, family{afi: afi, safi: safi})
+
+	if safi != 1 || (afi != 1 && afi != 2) {
+		return nil
+	}
+
+	withdrawn, ok := decodePrefixes(v[3:], afi == 2)
+
+	if !ok {
+		return updateError(OPTIONAL_ATTRIBUTE_ERROR)
+	}
+
+	u.withdrawn = append(u.withdrawn, withdrawn...)
+
+	return nil
+}
+
+// No attributes for IPv4, or only an empty MP_UNREACH_NLRI attribute
+// for other families (RFC 4724 section 2)
+func endOfRIBFamily(a []byte) family {
+	switch {
+	case len(a) == 0:
+		return IPV4_UNICAST
+	case len(a) == 6 && a[0]&16 == 0 && a[1] == MP_UNREACH_NLRI && a[2] == 3:
+		return family{afi: uint16(a[3])<<8 | uint16(a[4]), safi: a[5]}
+	case len(a) == 7 && a[0]&16 != 0 && a[1] == MP_UNREACH_NLRI && a[2] == 0 && a[3] == 3:
+		return family{afi: uint16(a[4])<<8 | uint16(a[5]), safi: a[6]}
+	}
+	return family{}
+}
+
+// Length in bits[1], Prefix[...] - trailing bits are padded to an octet boundary
+func decodePrefixes(d []byte, ipv6 bool) (prefixes []netip.Prefix, ok bool) {
+
+	max := 32
+
+	if ipv6 {
+		max = 128
+	}
+
+	for len(d) > 0 {
+		bits := int(d[0])
+		octets := (bits + 7) / 8
+
+		if bits > max || 1+octets > len(d) {
+			return nil, false
+		}
+
+		var addr netip.Addr
+
+		if ipv6 {
+			var a [16]byte
+			copy(a[:], d[1:1+octets])
+			addr = netip.AddrFrom16(a)
+		} else {
+			var a [4]byte
+			copy(a[:], d[1:1+octets])
+			addr = netip.AddrFrom4(a)
+		}
+
+		prefix, err := addr.Prefix(bits)
+
+		if err != nil {
+			return nil, false
+		}
+
+		prefixes = append(prefixes, prefix)
+		d = d[1+octets:]
+	}
+
+	return prefixes, true
+}
+
+func decodeCommunities(v []byte) (c []Community) {
+	for ; len(v) >= 4; v = v[4:] {
+		c = append(c, Community(uint32(v[0])<<24|uint32(v[1])<<16|uint32(v[2])<<8|uint32(v[3])))
+	}
+	return
+}
+
+func decodeExtendedCommunities(v []byte) (c []ExtendedCommunity) {
+	for ; len(v) >= 8; v = v[8:] {
+		var e uint64
+		for _, b := range v[0:8] {
+			e = e<<8 | uint64(b)
+		}
+		c = append(c, ExtendedCommunity(e))
+	}
+	return
+}
+
+// Global Administrator[4], Local Data Part 1[4], Local Data Part 2[4]
+func decodeLargeCommunities(v []byte) (c []LargeCommunity) {
+	for ; len(v) >= 12; v = v[12:] {
+		c = append(c, LargeCommunity{
+			GlobalAdministrator: uint32(v[0])<<24 | uint32(v[1])<<16 | uint32(v[2])<<8 | uint32(v[3]),
+			LocalData1:          uint32(v[4])<<24 | uint32(v[5])<<16 | uint32(v[6])<<8 | uint32(v[7]),
+			LocalData2:          uint32(v[8])<<24 | uint32(v[9])<<16 | uint32(v[10])<<8 | uint32(v[11]),
+		})
+	}
+	return
+}
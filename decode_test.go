@@ -0,0 +1,462 @@
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func prefixSliceEqual(a, b []netip.Prefix) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i, v := range a {
+		if v != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestDecodeUpdate(t *testing.T) {
+
+	a := advert{
+		ASNumber:      65000,
+		PeerASNumber:  65001,
+		Multiprotocol: true,
+		MED:           123,
+		NextHop:       [4]byte{10, 1, 2, 3},
+		NextHop6:      netip.MustParseAddr("fd00::1").As16(),
+	}
+
+	msg, err := a.message(map[netip.Addr]bool{ipv4_0: true, ipv4_1: false, ipv6_0: true, ipv6_1: false})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, n := decodeUpdate(msg)
+
+	if n != nil || u.treatAsWithdraw {
+		t.Fatalf("Decode failed: %v", n)
+	}
+
+	if !prefixSliceEqual(u.advertised, []netip.Prefix{hostRoute(ipv4_0), hostRoute(ipv6_0)}) {
+		t.Fatalf("Advertised prefixes incorrect: %v", u.advertised)
+	}
+
+	if !prefixSliceEqual(u.withdrawn, []netip.Prefix{hostRoute(ipv4_1), hostRoute(ipv6_1)}) {
+		t.Fatalf("Withdrawn prefixes incorrect: %v", u.withdrawn)
+	}
+
+	if u.attributes.MED != 123 || u.attributes.ASPath.String() != "65000" {
+		t.Fatalf("Attributes incorrect: %v", u.attributes)
+	}
+
+	if nh := u.nextHopFor(hostRoute(ipv6_0)); nh != netip.MustParseAddr("fd00::1") {
+		t.Fatalf("MP_REACH next hop incorrect: %v", nh)
+	}
+
+	if nh := u.nextHopFor(hostRoute(ipv4_0)); nh != netip.MustParseAddr("10.1.2.3") {
+		t.Fatalf("NEXT_HOP incorrect: %v", nh)
+	}
+
+	var from source
+
+	for _, r := range from.routes(u) {
+		if r.NextHop != u.nextHopFor(r.Prefix) {
+			t.Errorf("Wrong next hop for %s: %s", r.Prefix, r.NextHop)
+		}
+	}
+}
+
+func TestDecodeMPReachNextHop(t *testing.T) {
+
+	mp_reach := []byte{0, 2, 1, 17} // IPv6 unicast, next hop length 17
+	mp_reach = append(mp_reach, make([]byte, 17)...)
+	mp_reach = append(mp_reach, 0) // reserved
+	mp_reach = append(mp_reach, 128, 0xfd, 0x0b, 0x2b, 0x0b, 0xa7, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+
+	update := func(attr []byte) []byte {
+		attr = append([]byte{ONCR, MP_REACH_NLRI, byte(len(attr))}, attr...)
+		return append([]byte{0, 0, 0, byte(len(attr))}, attr...)
+	}
+
+	u, n := decodeUpdate(update(mp_reach))
+
+	if n != nil {
+		t.Fatalf("Bad next hop length should not reset the session: %v", n)
+	}
+
+	if !u.treatAsWithdraw || !prefixSliceEqual(u.advertised, []netip.Prefix{hostRoute(ipv6_0)}) {
+		t.Fatalf("Bad next hop length should be treat-as-withdraw: %v", u)
+	}
+
+	// next hop length runs past the end of the attribute
+	mp_reach = []byte{0, 2, 1, 200, 0, 0, 0, 0}
+
+	if _, n = decodeUpdate(update(mp_reach)); n == nil || n.code != UPDATE_MESSAGE_ERROR {
+		t.Fatalf("Truncated MP_REACH_NLRI should be an error")
+	}
+}
+
+func TestDecodeLabeledVPN(t *testing.T) {
+
+	update := func(nlri ...byte) []byte {
+		attr := []byte{0, 1, SAFI_MPLS_VPN, 12} // IPv4 VPN, next hop is RD[8] + IPv4[4]
+		attr = append(attr, 0, 0, 0, 0, 0, 0, 0, 0, 10, 1, 2, 3)
+		attr = append(attr, 0) // reserved
+		attr = append(attr, nlri...)
+		attr = append([]byte{ONCR, MP_REACH_NLRI, byte(len(attr))}, attr...)
+		return append([]byte{0, 0, 0, byte(len(attr))}, attr...)
+	}
+
+	// 24 bits of label + 64 of RD + 24 of prefix: label 16, RD 65000:1, 10.9.8.0/24
+	u, n := decodeUpdate(update(112, 0, 1, 1, 0, 0, 0xfd, 0xe8, 0, 0, 0, 1, 10, 9, 8))
+
+	if n != nil || u.treatAsWithdraw || len(u.labeled) != 1 {
+		t.Fatalf("Labeled VPN NLRI not decoded: %v %v", u, n)
+	}
+
+	if p := u.labeled[0]; len(p.labels) != 1 || p.labels[0] != 16 || p.rd != 65000<<32|1 || p.prefix != netip.MustParsePrefix("10.9.8.0/24") {
+		t.Errorf("Labeled VPN NLRI incorrect: %v", p)
+	}
+
+	// the bottom-of-stack bit is never set, so the labels would run into the RD
+	u, n = decodeUpdate(update(112, 0, 2, 0, 0, 2, 0, 0, 2, 0, 0, 2, 0, 0, 2))
+
+	if n != nil || !u.treatAsWithdraw || len(u.labeled) != 0 {
+		t.Fatalf("Label stack without bottom-of-stack should be treat-as-withdraw: %v %v", u, n)
+	}
+
+	// labels and RD claim more bits than the length allows
+	if u, n = decodeUpdate(update(24, 0, 1, 1)); n != nil || !u.treatAsWithdraw {
+		t.Fatalf("Truncated VPN NLRI should be treat-as-withdraw: %v %v", u, n)
+	}
+
+	// three labels, then RD 65000:1 and 10.9.8.0/24
+	stack := update(160, 0, 1, 0, 0, 2, 0, 0, 3, 1, 0, 0, 0xfd, 0xe8, 0, 0, 0, 1, 10, 9, 8)
+
+	if u, n = decodeUpdateFrom(stack, false, 0); n != nil || u.treatAsWithdraw || len(u.labeled) != 1 || len(u.labeled[0].labels) != 3 {
+		t.Fatalf("Label stack within the default depth should be decoded: %v %v", u, n)
+	}
+
+	if u, n = decodeUpdateFrom(stack, false, 2); n != nil || !u.treatAsWithdraw || len(u.labeled) != 0 {
+		t.Errorf("Label stack deeper than MaxDecodeDepth should be treat-as-withdraw: %v %v", u, n)
+	}
+}
+
+func FuzzDecodeUpdate(f *testing.F) {
+
+	a := advert{
+		ASNumber:      65000,
+		PeerASNumber:  65001,
+		Multiprotocol: true,
+		NextHop:       [4]byte{10, 1, 2, 3},
+		Communities:   []Community{1, 2, 3},
+	}
+
+	msg, _ := a.message(map[netip.Addr]bool{ipv4_0: true, ipv4_1: false, ipv6_0: true, ipv6_1: false})
+
+	f.Add([]byte(msg))
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte{0, 0, 0, 8, ONCR, MP_REACH_NLRI, 5, 0, 2, 1, 255, 0})
+
+	f.Fuzz(func(t *testing.T, d []byte) {
+		u, _ := decodeUpdate(d)
+
+		// each prefix consumes at least one octet of the message, so
+		// the decoded form can't be disproportionately large
+		if len(u.advertised)+len(u.withdrawn) > len(d) {
+			t.Fatalf("Decoded %d prefixes from %d octets", len(u.advertised)+len(u.withdrawn), len(d))
+		}
+
+		if len(u.attributes.ASPath) > len(d) {
+			t.Fatalf("Decoded %d AS_PATH segments from %d octets", len(u.attributes.ASPath), len(d))
+		}
+	})
+}
+
+func TestAcceptOwn(t *testing.T) {
+
+	a := advert{
+		ASNumber:     65000,
+		PeerASNumber: 65000,
+		NextHop:      [4]byte{10, 1, 2, 3},
+		Communities:  []Community{65000<<16 | 1, ACCEPT_OWN},
+	}
+
+	msg, err := a.message(map[netip.Addr]bool{ipv4_0: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := findAttribute(msg, COMMUNITIES); len(c) != 1 || !byteSliceEqual(c[0], []byte{0xfd, 0xe8, 0, 1, 0xff, 0xff, 0, 1}) {
+		t.Fatalf("ACCEPT_OWN not emitted: %v", c)
+	}
+
+	u, n := decodeUpdate(msg)
+
+	if n != nil {
+		t.Fatal(n)
+	}
+
+	// reflected routes pass through import policy
+	p := Parameters{Import: []PolicyRule{{Set: PolicySet{LocalPref: 200}}}}
+
+	routes, withdrawn := p.importUpdate(u, source{})
+
+	if len(withdrawn) != 0 || len(routes) != 1 || !communityMatch([]Community{ACCEPT_OWN}, routes[0].Communities) {
+		t.Fatalf("ACCEPT_OWN route not preserved: %v", routes)
+	}
+}
+
+func TestDecodeCommunities(t *testing.T) {
+
+	var attr []byte
+	attr = append(attr, pathAttribute(OTCR, COMMUNITIES, []byte{0xfd, 0xe8, 0, 100, 0xff, 0xff, 0xff, 0x01})...)
+	attr = append(attr, pathAttribute(OTCR, EXTENDED_COMMUNITIES, []byte{0, 2, 0xfd, 0xe8, 0, 0, 0, 1})...)
+	attr = append(attr, pathAttribute(OTCR, LARGE_COMMUNITIES, []byte{
+		0, 0x03, 0x0d, 0x40, 0, 0, 0, 1, 0, 0, 0, 2,
+		0, 0x03, 0x0d, 0x41, 0, 0, 0, 3, 0, 0, 0, 4,
+	})...)
+
+	update := func(attr []byte) []byte {
+		nlri := []byte{24, 10, 0, 0}
+		return append(append([]byte{0, 0, 0, byte(len(attr))}, attr...), nlri...)
+	}
+
+	u, n := decodeUpdate(update(attr))
+
+	if n != nil || u.treatAsWithdraw {
+		t.Fatalf("Decode failed: %v", n)
+	}
+
+	a := u.attributes
+
+	if len(a.Communities) != 2 || a.Communities[0] != 65000<<16|100 || a.Communities[1] != 0xffffff01 {
+		t.Errorf("Communities incorrect: %v", a.Communities)
+	}
+
+	if len(a.ExtendedCommunities) != 1 || a.ExtendedCommunities[0] != 0x0002fde800000001 {
+		t.Errorf("Extended communities incorrect: %v", a.ExtendedCommunities)
+	}
+
+	exp := []LargeCommunity{{200000, 1, 2}, {200001, 3, 4}}
+
+	if len(a.LargeCommunities) != 2 || a.LargeCommunities[0] != exp[0] || a.LargeCommunities[1] != exp[1] {
+		t.Errorf("Large communities incorrect: %v", a.LargeCommunities)
+	}
+
+	r := Route{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Attributes: a}
+	m := PolicyMatch{LargeCommunities: []LargeCommunity{{200001, 3, 4}}}
+
+	if !m.match(r) {
+		t.Error("Policy should match large community")
+	}
+
+	for _, bad := range [][]byte{
+		pathAttribute(OTCR, COMMUNITIES, []byte{0, 0, 0}),
+		pathAttribute(OTCR, EXTENDED_COMMUNITIES, make([]byte, 12)),
+		pathAttribute(OTCR, LARGE_COMMUNITIES, make([]byte, 16)),
+	} {
+		if u, n := decodeUpdate(update(bad)); n != nil || !u.treatAsWithdraw {
+			t.Errorf("Bad length should be treat-as-withdraw: %v %v", bad, n)
+		}
+	}
+}
+
+func TestAtomicAggregate(t *testing.T) {
+
+	var attr []byte
+	attr = append(attr, WTCR, ORIGIN, 1, IGP)
+	attr = append(attr, WTCR, AS_PATH, 4, AS_SEQUENCE, 1, 0xfd, 0xe9)
+	attr = append(attr, WTCR, NEXT_HOP, 4, 10, 1, 2, 3)
+	attr = append(attr, WTCR, ATOMIC_AGGREGATE, 0)
+
+	msg := append(append([]byte{0, 0, 0, byte(len(attr))}, attr...), 24, 10, 0, 0)
+
+	u, n := decodeUpdate(msg)
+
+	if n != nil || !u.attributes.AtomicAggregate {
+		t.Fatalf("ATOMIC_AGGREGATE not decoded: %v %v", n, u.attributes)
+	}
+
+	// re-advertise with the received attributes - export policy can't remove it
+	a := advert{ASNumber: 65000, PeerASNumber: 65002, NextHop: [4]byte{10, 9, 9, 9}}
+	r := a.withAttributes(u.attributes)
+
+	msg, err := r.message(map[netip.Addr]bool{ipv4_0: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u, n = decodeUpdate(msg); n != nil || !u.attributes.AtomicAggregate {
+		t.Fatalf("ATOMIC_AGGREGATE not preserved: %v %v", n, u.attributes)
+	}
+
+	if r.sameAttributes(&a) {
+		t.Error("Routes with and without ATOMIC_AGGREGATE should not share an UPDATE")
+	}
+
+	// malformed length is discarded rather than treated as withdraw
+	bad := append(append([]byte{0, 0, 0, 4}, WTCR, ATOMIC_AGGREGATE, 1, 0), 24, 10, 0, 0)
+
+	if u, n = decodeUpdate(bad); n != nil || u.treatAsWithdraw || u.attributes.AtomicAggregate {
+		t.Errorf("Malformed ATOMIC_AGGREGATE should be discarded: %v %v", n, u)
+	}
+}
+
+func TestAggregator(t *testing.T) {
+
+	update := func(attr ...[]byte) decoded {
+		var a []byte
+		for _, v := range attr {
+			a = append(a, v...)
+		}
+		u, n := decodeUpdate(append(append([]byte{0, 0, 0, byte(len(a))}, a...), 24, 10, 0, 0))
+		if n != nil || u.treatAsWithdraw {
+			t.Fatalf("Decode failed: %v %v", n, u)
+		}
+		return u
+	}
+
+	trans := pathAttribute(OTCR, AGGREGATOR, []byte{0x5b, 0xa0, 10, 1, 1, 1})            // AS_TRANS
+	as4 := pathAttribute(OTCR, AS4_AGGREGATOR, []byte{0, 0x03, 0x0d, 0x40, 10, 1, 1, 1}) // 200000
+	plain := pathAttribute(OTCR, AGGREGATOR, []byte{0xfd, 0xe8, 10, 2, 2, 2})            // 65000
+	exp := Aggregator{AS: 200000, Address: netip.MustParseAddr("10.1.1.1")}
+
+	if u := update(trans, as4); u.attributes.Aggregator == nil || *u.attributes.Aggregator != exp {
+		t.Errorf("AS4_AGGREGATOR should be merged: %v", u.attributes.Aggregator)
+	}
+
+	if u := update(as4, trans); u.attributes.Aggregator == nil || *u.attributes.Aggregator != exp {
+		t.Errorf("Attribute order should not matter: %v", u.attributes.Aggregator)
+	}
+
+	if u := update(plain, as4); u.attributes.Aggregator == nil || u.attributes.Aggregator.AS != 65000 {
+		t.Errorf("AS4_AGGREGATOR should be ignored unless AGGREGATOR is AS_TRANS: %v", u.attributes.Aggregator)
+	}
+
+	if u := update(as4); u.attributes.Aggregator != nil {
+		t.Errorf("AS4_AGGREGATOR alone should be ignored: %v", u.attributes.Aggregator)
+	}
+
+	if u := update(pathAttribute(OTCR, AGGREGATOR, []byte{1, 2, 3})); u.attributes.Aggregator != nil {
+		t.Errorf("Malformed AGGREGATOR should be discarded: %v", u.attributes.Aggregator)
+	}
+}
+
+func TestDecodeLocalPref(t *testing.T) {
+
+	var attr []byte
+	attr = append(attr, WTCR, ORIGIN, 1, IGP)
+	attr = append(attr, WTCR, AS_PATH, 4, AS_SEQUENCE, 1, 0xfd, 0xe9)
+	attr = append(attr, WTCR, NEXT_HOP, 4, 10, 1, 2, 3)
+	attr = append(attr, WTCR, LOCAL_PREF, 4, 0, 0, 1, 244)
+
+	msg := append(append([]byte{0, 0, 0, byte(len(attr))}, attr...), 24, 10, 0, 0)
+
+	if u, n := decodeUpdateFrom(msg, false, 0); n != nil || u.attributes.LocalPref != 500 {
+		t.Errorf("LOCAL_PREF from an internal peer should be decoded: %v %v", n, u.attributes)
+	}
+
+	if u, n := decodeUpdateFrom(msg, true, 0); n != nil || u.attributes.LocalPref != 0 || len(u.advertised) != 1 {
+		t.Errorf("LOCAL_PREF from an external peer should be discarded: %v %v", n, u.attributes)
+	}
+
+	// malformed length is discarded from an external peer rather than treated as withdraw
+	bad := append(append([]byte{0, 0, 0, 5}, WTCR, LOCAL_PREF, 2, 0, 1), 24, 10, 0, 0)
+
+	if u, n := decodeUpdateFrom(bad, true, 0); n != nil || u.treatAsWithdraw {
+		t.Errorf("Malformed LOCAL_PREF from an external peer should be discarded: %v %v", n, u)
+	}
+
+	if u, n := decodeUpdateFrom(bad, false, 0); n != nil || !u.treatAsWithdraw {
+		t.Errorf("Malformed LOCAL_PREF from an internal peer should be treated as withdraw: %v %v", n, u)
+	}
+}
+
+func TestDecodeNextHopLength(t *testing.T) {
+
+	var attr []byte
+	attr = append(attr, WTCR, ORIGIN, 1, IGP)
+	attr = append(attr, WTCR, AS_PATH, 4, AS_SEQUENCE, 1, 0xfd, 0xe9)
+	attr = append(attr, WTCR, NEXT_HOP, 3, 10, 1, 2)
+
+	msg := append(append([]byte{0, 0, 0, byte(len(attr))}, attr...), 24, 10, 0, 0)
+
+	if u, n := decodeUpdate(msg); n != nil || !u.treatAsWithdraw || u.nextHop.IsValid() {
+		t.Errorf("Short NEXT_HOP should be treated as withdraw: %v %v", n, u.attributes)
+	}
+
+	// a length which runs past the end of the path attributes is a malformed list
+	bad := append(append([]byte{0, 0, 0, 5}, WTCR, NEXT_HOP, 4, 10, 1), 24, 10, 0, 0)
+
+	if _, n := decodeUpdate(bad); n == nil {
+		t.Error("NEXT_HOP overrunning the attributes should be an error")
+	}
+}
+
+func TestDecodeMPUnreachOnly(t *testing.T) {
+
+	ipv6_1 := netip.MustParseAddr("fd0b:2b0b:a7b8::1")
+
+	a := advert{ASNumber: 65000, PeerASNumber: 65001, NextHop: [4]byte{10, 1, 2, 3}, NextHop6: IP6{0xfd, 0x0b, 15: 1}}
+
+	m, err := a.message(map[netip.Addr]bool{ipv6_0: false, ipv6_1: false})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := m.Body()
+
+	// no IPv4 withdrawn routes, only MP_UNREACH_NLRI and no NLRI
+	if b[0] != 0 || b[1] != 0 || int(b[2])<<8|int(b[3]) != len(b)-4 || len(findAttribute(b, MP_UNREACH_NLRI)) != 1 {
+		t.Fatalf("Unexpected message: %v", b)
+	}
+
+	u, n := decodeUpdate(b)
+
+	if n != nil || u.treatAsWithdraw || len(u.advertised) != 0 || u.endOfRIB != (family{}) {
+		t.Fatalf("Bad decode: %v %v", n, u)
+	}
+
+	if !prefixSliceEqual(u.withdrawn, []netip.Prefix{hostRoute(ipv6_0), hostRoute(ipv6_1)}) {
+		t.Errorf("Unexpected withdrawn prefixes: %v", u.withdrawn)
+	}
+}
+
+func TestDecodeAttributeLength(t *testing.T) {
+
+	var attr []byte
+	attr = append(attr, WTCR, ORIGIN, 1, IGP)
+	attr = append(attr, WTCR, AS_PATH, 4, AS_SEQUENCE, 1, 0xfd, 0xe9)
+	attr = append(attr, WTCR, NEXT_HOP, 4, 10, 1, 2, 3)
+
+	update := func(withdrawn, attributes int) []byte {
+		msg := []byte{byte(withdrawn >> 8), byte(withdrawn), byte(attributes >> 8), byte(attributes)}
+		return append(append(msg, attr...), 24, 10, 0, 0)
+	}
+
+	if u, n := decodeUpdate(update(0, len(attr))); n != nil || len(u.advertised) != 1 {
+		t.Fatalf("Valid UPDATE should be decoded: %v %v", n, u.advertised)
+	}
+
+	for _, c := range []struct {
+		name                  string
+		withdrawn, attributes int
+	}{
+		{"attribute length too large", 0, len(attr) + 5},
+		{"attribute length too small", 0, len(attr) - 2},
+		{"withdrawn length too large", 100, len(attr)},
+	} {
+		if _, n := decodeUpdate(update(c.withdrawn, c.attributes)); n == nil || n.code != UPDATE_MESSAGE_ERROR || n.sub != MALFORMED_ATTRIBUTE_LIST {
+			t.Errorf("%s: expected malformed attribute list: %v", c.name, n)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+// Attributes for routes originated by every session, eg. to add a
+// community to all routes, which need not then be repeated in each
+// peer's Parameters. Only MED, LocalPref, Communities and Origin are
+// used. Precedence is: export policy for the route, then the peer's
+// Parameters, then these defaults. Each session takes a copy when it is
+// created, so changes only apply to sessions created afterwards.
+var DefaultParameters Parameters
+
+// A copy of the parameters with MED, LocalPref, Communities and Origin
+// taken from the defaults where they are not set
+func (p Parameters) Merge(defaults Parameters) Parameters {
+
+	if p.MED == 0 {
+		p.MED = defaults.MED
+	}
+
+	if p.LocalPref == 0 {
+		p.LocalPref = defaults.LocalPref
+	}
+
+	if len(p.Communities) == 0 {
+		p.Communities = defaults.Communities
+	}
+
+	if p.Origin == ORIGIN_UNCHANGED {
+		p.Origin = defaults.Origin
+	}
+
+	return p
+}
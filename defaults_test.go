@@ -0,0 +1,86 @@
+package bgp
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestDefaultParameters(t *testing.T) {
+
+	DefaultParameters = Parameters{MED: 10, LocalPref: 150, Communities: []Community{100}, Origin: ORIGIN_EGP}
+	t.Cleanup(func() { DefaultParameters = Parameters{} })
+
+	export := []PolicyRule{{Match: PolicyMatch{Prefixes: []netip.Prefix{hostRoute(ipv4_1)}}, Set: PolicySet{MED: 30, Origin: ORIGIN_INCOMPLETE}}}
+
+	attributes := func(p Parameters) map[netip.Prefix]Attributes {
+		a := advert{ASNumber: 65000, NextHop: [4]byte{10, 1, 2, 3}}
+		u := a.withParameters(p.Merge(DefaultParameters), 65000)
+
+		m := map[netip.Prefix]Attributes{}
+
+		for _, update := range u.updates(map[netip.Addr]bool{ipv4_0: true, ipv4_1: true}) {
+			d, n := decodeUpdate(update.Body())
+			if n != nil {
+				t.Fatal(n)
+			}
+			for _, p := range d.advertised {
+				m[p] = d.attributes
+			}
+		}
+
+		return m
+	}
+
+	// defaults only
+	a := attributes(Parameters{})[hostRoute(ipv4_0)]
+
+	if a.MED != 10 || a.LocalPref != 150 || a.Origin != EGP || !reflect.DeepEqual(a.Communities, []Community{100}) {
+		t.Errorf("Defaults should be inherited: %+v", a)
+	}
+
+	// peer overrides defaults, export policy overrides peer
+	m := attributes(Parameters{MED: 20, Communities: []Community{200}, Export: export})
+
+	if a = m[hostRoute(ipv4_0)]; a.MED != 20 || a.LocalPref != 150 || a.Origin != EGP || !reflect.DeepEqual(a.Communities, []Community{200}) {
+		t.Errorf("Peer parameters should override defaults: %+v", a)
+	}
+
+	if a = m[hostRoute(ipv4_1)]; a.MED != 30 || a.Origin != INCOMPLETE || !reflect.DeepEqual(a.Communities, []Community{200}) {
+		t.Errorf("Export policy should override peer parameters: %+v", a)
+	}
+}
+
+func TestDefaultParametersExport(t *testing.T) {
+
+	DefaultParameters = Parameters{MED: 10, Communities: []Community{NOPEER}, Origin: ORIGIN_EGP}
+	t.Cleanup(func() { DefaultParameters = Parameters{} })
+
+	s := NewConnSession(IP{10, 0, 0, 1}, Parameters{PeerType: PEER_TYPE_PEER}, []netip.Addr{ipv4_0}, nil)
+
+	DefaultParameters = Parameters{} // sessions keep the defaults they were created with
+
+	u := s.ribUpdate(nil)
+
+	if p := u.Parameters; p.MED != 10 || p.Origin != ORIGIN_EGP {
+		t.Errorf("Defaults should be applied: %+v", p)
+	}
+
+	if rib := u.adjRIBOut(false); len(rib) != 0 {
+		t.Error("Default NOPEER community should prevent export to a bilateral peer:", rib)
+	}
+
+	// export policy sees the default communities
+	p := u.Parameters
+	p.PeerType = PEER_TYPE_CUSTOMER
+
+	if rib := p.filter(false, []netip.Addr{ipv4_0}); len(rib) != 1 {
+		t.Error("Prefix should be exported to a customer:", rib)
+	}
+
+	p.Export = []PolicyRule{{Match: PolicyMatch{Communities: []Community{NOPEER}}, Deny: true}}
+
+	if rib := p.filter(false, []netip.Addr{ipv4_0}); len(rib) != 0 {
+		t.Error("Export policy should match the default communities:", rib)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+// https://datatracker.ietf.org/doc/html/rfc4724 - Graceful Restart Mechanism for BGP
+
+import (
+	"net/netip"
+	"time"
+)
+
+const (
+	GRACEFUL_RESTART = 64 // capability code
+
+	GR_RESTART_STATE    = 0x8  // Restart Flags: R bit
+	GR_FORWARDING_STATE = 0x80 // Flags for Address Family: F bit
+)
+
+// Restart Flags[4 bits], Restart Time[12 bits], followed by
+// AFI[2], SAFI[1], Flags for Address Family[1] for each family
+func gracefulRestart(restarting bool, restart uint16, families []family) capability {
+
+	var flags byte
+
+	if restarting {
+		flags |= GR_RESTART_STATE
+	}
+
+	if restart > 4095 {
+		restart = 4095
+	}
+
+	v := []byte{flags<<4 | byte(restart>>8), byte(restart)}
+
+	for _, f := range families {
+		afi := htons(f.afi)
+		// the forwarding plane (eg. a load balancer) continues to run while the BGP session restarts
+		v = append(v, afi[0], afi[1], f.safi, GR_FORWARDING_STATE)
+	}
+
+	return capability{code: GRACEFUL_RESTART, value: v}
+}
+
+// An End-of-RIB marker is an UPDATE with no withdrawn routes, NLRI or
+// path attributes for IPv4 unicast, or with an empty MP_UNREACH_NLRI
+// attribute for other families
+func endOfRIB(f family) message {
+
+	if f == IPV4_UNICAST {
+		return &update{0, 0, 0, 0}
+	}
+
+	afi := htons(f.afi)
+	return &update{0, 0, 0, 6, ONCR, MP_UNREACH_NLRI, 3, afi[0], afi[1], f.safi}
+}
+
+// Routes advertised in a previous session, retained so that they can
+// be refreshed after a graceful restart
+type staleRIB struct {
+	routes  map[netip.Addr]bool // true if not yet refreshed
+	expires time.Time
+}
+
+func newStaleRIB(adjRIBOut []netip.Addr, expires time.Time) *staleRIB {
+	s := &staleRIB{routes: map[netip.Addr]bool{}, expires: expires}
+	for _, a := range adjRIBOut {
+		s.routes[a] = true
+	}
+	return s
+}
+
+// Routes advertised in the new session are no longer stale
+func (s *staleRIB) refresh(adjRIBOut []netip.Addr) {
+	for _, a := range adjRIBOut {
+		s.routes[a] = false
+	}
+}
+
+// Once the End-of-RIB has been sent the peer removes any routes which
+// were not refreshed - do the same with our copy and return them
+func (s *staleRIB) endOfRIB() (purged []netip.Addr) {
+	for a, stale := range s.routes {
+		if stale {
+			purged = append(purged, a)
+			delete(s.routes, a)
+		}
+	}
+	return
+}
+
+// Called as a session ends - if graceful restart was negotiated then
+// the peer will retain our routes for the restart time
+func (s *Session) retain(adjRIBOut []netip.Addr, restart uint16) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stale = newStaleRIB(adjRIBOut, s.clock().Now().Add(time.Duration(restart)*time.Second))
+}
+
+// Returns routes retained from the previous session if the restart
+// time has not yet expired
+func (s *Session) restarting() *staleRIB {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stale != nil && s.clock().Now().After(s.stale.expires) {
+		s.stale = nil
+	}
+
+	return s.stale
+}
+
+func (p *Parameters) restartTime() uint16 {
+	if p.RestartTime == 0 {
+		return 120
+	}
+	return p.RestartTime
+}
+
+func (s *Session) restarted() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stale = nil
+}
+
+// Restart Time advertised in the peer's capability, if present
+func peerRestartTime(caps []capability) (uint16, bool) {
+	for _, c := range caps {
+		if c.code == GRACEFUL_RESTART && len(c.value) >= 2 {
+			return uint16(c.value[0]&0x0f)<<8 | uint16(c.value[1]), true
+		}
+	}
+	return 0, false
+}
+
+// Receiving speaker: when the session with a restarting peer drops the
+// routes learned from it are marked as stale rather than removed, and
+// are retained until it re-establishes the session and sends End-of-RIB
+// or the restart time expires
+func (s *Session) peerDown(peer string, restart uint16) {
+
+	if restart == 0 {
+		// routes retained from an earlier session were not refreshed
+		s.purgeStale(peer, func(netip.Prefix) bool { return true })
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.staleTimer != nil {
+		s.staleTimer.Stop()
+		s.staleTimer = nil
+	}
+
+	if restart == 0 {
+		s.ribIn = nil
+		s.ribInPre = nil
+		return
+	}
+
+	for p, r := range s.ribIn {
+		r.Stale = true
+		s.ribIn[p] = r
+	}
+
+	for p, r := range s.ribInPre {
+		r.Stale = true
+		s.ribInPre[p] = r
+	}
+
+	s.staleTimer = s.clock().AfterFunc(time.Duration(restart)*time.Second, func() {
+		s.purgeStale(peer, func(netip.Prefix) bool { return true })
+	})
+}
+
+// Remove stale routes for which match returns true, informing the
+// BGPImport, if any, that they have been withdrawn
+func (s *Session) purgeStale(peer string, match func(netip.Prefix) bool) {
+
+	var withdrawn []netip.Prefix
+
+	s.mutex.Lock()
+	for p, r := range s.ribIn {
+		if r.Stale && match(p) {
+			withdrawn = append(withdrawn, p)
+			delete(s.ribIn, p)
+		}
+	}
+	for p, r := range s.ribInPre {
+		if r.Stale && match(p) {
+			delete(s.ribInPre, p)
+		}
+	}
+	s.mutex.Unlock()
+
+	if len(withdrawn) == 0 {
+		return
+	}
+
+	if i, ok := s.log().(BGPImport); ok {
+		i.BGPReceived(peer, ReceivedMessage{Withdrawn: withdrawn})
+	}
+}
+
+// End-of-RIB received - any routes in the family which have not been
+// refreshed are no longer valid
+func (s *Session) endOfRIB(peer string, f family) {
+	s.purgeStale(peer, func(p netip.Prefix) bool {
+		return (f == IPV4_UNICAST && p.Addr().Is4()) || (f == IPV6_UNICAST && p.Addr().Is6())
+	})
+}
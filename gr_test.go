@@ -0,0 +1,207 @@
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestGracefulRestartCapability(t *testing.T) {
+	c := gracefulRestart(true, 300, []family{IPV4_UNICAST, IPV6_UNICAST})
+
+	exp := []byte{0x81, 0x2c, 0, 1, 1, 0x80, 0, 2, 1, 0x80}
+
+	if c.code != GRACEFUL_RESTART || string(c.value) != string(exp) {
+		t.Error("Capability mismatch:", c.code, c.value, exp)
+	}
+
+	if c := gracefulRestart(false, 5000, nil); c.value[0] != 0x0f || c.value[1] != 0xff {
+		t.Error("Restart time should be limited to 12 bits:", c.value)
+	}
+}
+
+func TestEndOfRIB(t *testing.T) {
+	for _, f := range []family{IPV4_UNICAST, IPV6_UNICAST} {
+		u, n := decodeUpdate(endOfRIB(f).Body())
+
+		if n != nil || len(u.advertised) != 0 || len(u.withdrawn) != 0 {
+			t.Error("End-of-RIB should be a valid, empty UPDATE:", f, n, u)
+		}
+
+		if u.endOfRIB != f {
+			t.Error("End-of-RIB not recognised:", f, u.endOfRIB)
+		}
+	}
+}
+
+func TestGracefulRestartStale(t *testing.T) {
+
+	a := netip.MustParseAddr("192.168.0.1")
+	b := netip.MustParseAddr("192.168.0.2")
+	c := netip.MustParseAddr("192.168.0.3")
+
+	var s Session
+
+	// session drops having advertised a and b
+	s.retain([]netip.Addr{a, b}, 120)
+
+	stale := s.restarting()
+
+	if stale == nil {
+		t.Fatal("Routes should be retained within the restart time")
+	}
+
+	if !stale.routes[a] || !stale.routes[b] {
+		t.Error("Retained routes should be marked stale:", stale.routes)
+	}
+
+	// new table contains a and c - b was not refreshed
+	stale.refresh([]netip.Addr{a, c})
+
+	purged := stale.endOfRIB()
+
+	if len(purged) != 1 || purged[0] != b {
+		t.Error("Only unrefreshed routes should be purged:", purged)
+	}
+
+	if len(stale.routes) != 2 || stale.routes[a] || stale.routes[c] {
+		t.Error("Refreshed routes should remain:", stale.routes)
+	}
+
+	s.restarted()
+
+	if s.restarting() != nil {
+		t.Error("Stale routes should be discarded after End-of-RIB")
+	}
+
+	// reconnecting after the restart time has expired is not a restart
+	s.retain([]netip.Addr{a}, 0)
+	time.Sleep(time.Millisecond)
+
+	if s.restarting() != nil {
+		t.Error("Stale routes should expire with the restart time")
+	}
+}
+
+func TestGracefulRestartReceiver(t *testing.T) {
+
+	a := netip.MustParsePrefix("10.0.0.0/24")
+	b := netip.MustParsePrefix("10.0.1.0/24")
+	c := netip.MustParsePrefix("2001:db8::/32")
+
+	from := source{addr: netip.MustParseAddr("10.1.1.1"), routerID: IP4{10, 1, 1, 1}}
+	attr := Attributes{NextHop: from.addr}
+
+	var p Parameters
+	l := &importLog{}
+	s := Session{logs: l}
+
+	s.receive(p.importUpdate(decoded{advertised: []netip.Prefix{a, b, c}, attributes: attr}, from))
+
+	// peer restarts - routes are retained, but stale
+	s.peerDown("peer", 120)
+
+	r := s.AdjRIBIn()
+
+	if len(r) != 3 || !r[0].Stale || !r[1].Stale || !r[2].Stale {
+		t.Fatal("Routes should be retained as stale:", r)
+	}
+
+	// a stale route is only used as a last resort
+	fresh := ReceivedRoute{Route: Route{Prefix: a, Attributes: Attributes{LocalPref: 50}}}
+
+	if BestPath([]ReceivedRoute{r[0], fresh}) != 1 {
+		t.Error("Route which is not stale should be preferred")
+	}
+
+	// peer re-establishes and refreshes a, then sends End-of-RIB for IPv4
+	s.receive(p.importUpdate(decoded{advertised: []netip.Prefix{a}, attributes: attr}, from))
+	s.endOfRIB("peer", IPV4_UNICAST)
+
+	r = s.AdjRIBIn()
+
+	if len(r) != 2 || r[0].Prefix != a || r[0].Stale || r[1].Prefix != c || !r[1].Stale {
+		t.Fatal("Only the unrefreshed IPv4 route should be purged:", r)
+	}
+
+	if len(l.received) != 1 || !prefixSliceEqual(l.received[0].Withdrawn, []netip.Prefix{b}) {
+		t.Error("Purged route should be reported as withdrawn:", l.received)
+	}
+
+	s.endOfRIB("peer", IPV6_UNICAST)
+
+	if r = s.AdjRIBIn(); len(r) != 1 || r[0].Prefix != a {
+		t.Error("Stale IPv6 route should be purged:", r)
+	}
+
+	// without graceful restart routes are removed immediately
+	s.peerDown("peer", 0)
+
+	if r = s.AdjRIBIn(); len(r) != 0 {
+		t.Error("Routes should be removed:", r)
+	}
+
+	// stale routes are reported as withdrawn if the next session ends
+	// without graceful restart
+	s.receive(p.importUpdate(decoded{advertised: []netip.Prefix{a}, attributes: attr}, from))
+	s.peerDown("peer", 120)
+	l.received = nil
+	s.peerDown("peer", 0)
+
+	if len(l.received) != 1 || !prefixSliceEqual(l.received[0].Withdrawn, []netip.Prefix{a}) {
+		t.Error("Stale route should be reported as withdrawn:", l.received)
+	}
+}
+
+func TestGracefulRestartFailedAttempt(t *testing.T) {
+
+	clock := newMockClock()
+
+	p := Parameters{ASNumber: 65000, GracefulRestart: true}
+
+	s := NewConnSession(IP{10, 0, 0, 1}, p, nil, nil)
+	s.timers = clock
+
+	peer := runTestSession(t, s)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001, gracefulRestart(false, 120, []family{IPV4_UNICAST}))
+
+	a := advert{ASNumber: 65001, PeerASNumber: 65000, NextHop: [4]byte{10, 0, 0, 2}}
+	u, _ := a.message(map[netip.Addr]bool{ipv4_0: true})
+	peer.send(&u)
+
+	for i := 0; len(s.AdjRIBIn()) != 1; i++ {
+		if i > 100 {
+			t.Fatalf("Route not received: %v", s.AdjRIBIn())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the peer restarts without a NOTIFICATION
+	peer.conn.Close()
+	<-peer.done
+
+	// next attempt fails before Established
+	peer = runTestSession(t, s)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.send(&notification{code: CEASE})
+	<-peer.done
+
+	if r := s.AdjRIBIn(); len(r) != 1 || !r[0].Stale {
+		t.Fatal("Stale route should be retained:", r)
+	}
+
+	clock.Advance(120 * time.Second)
+
+	if r := s.AdjRIBIn(); len(r) != 0 {
+		t.Error("Stale route should be purged when the restart time expires:", r)
+	}
+}
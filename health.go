@@ -0,0 +1,158 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+)
+
+// Health of the service behind an advertised prefix - see SetHealth
+type health struct {
+	healthy bool   // state last applied to the RIB
+	want    bool   // most recently reported state
+	gen     uint64 // discards superseded debounce timers
+	timer   timer  // pending debounce, stopped by Close
+}
+
+type healthRIB struct {
+	mutex  sync.Mutex // serialises RIB changes from debounce timers
+	closed bool       // nothing is sent once the session is closed
+	health map[netip.Addr]*health
+	backup map[netip.Addr]netip.Addr // backup to primary - see SetBackup
+}
+
+// Advertise or withdraw a host prefix as the health of the service
+// behind it (eg. a load balanced VIP) changes, without rebuilding the
+// RIB. A change only takes effect once it has persisted for
+// Parameters.HealthDebounce, so that a flapping service doesn't cause
+// the prefix to flap. A prefix not yet in the RIB is added when first
+// reported healthy. Replacing the RIB (LocRIB, etc.) overrides any
+// changes made here.
+func (s *Session) SetHealth(prefix netip.Prefix, healthy bool) error {
+
+	if !prefix.IsValid() || !prefix.IsSingleIP() {
+		return errors.New("Only host prefixes may be advertised: " + prefix.String())
+	}
+
+	ip := prefix.Addr().Unmap() // as in the RIB - see _rib.dup()
+
+	s.mutex.Lock()
+
+	if s.health.health == nil {
+		s.health.health = map[netip.Addr]*health{}
+	}
+
+	h, ok := s.health.health[ip]
+
+	if !ok {
+		h = &health{healthy: inRIB(s.rib, ip)}
+		s.health.health[ip] = h
+	}
+
+	h.want = healthy
+	h.gen++
+
+	gen := h.gen
+	changed := h.healthy != healthy
+	debounce := s.p.HealthDebounce
+
+	if h.timer != nil {
+		h.timer.Stop() // superseded
+		h.timer = nil
+	}
+
+	if changed && debounce > 0 {
+		h.timer = s.clock().AfterFunc(debounce, func() { s.applyHealth(ip, gen) })
+	}
+
+	s.mutex.Unlock()
+
+	if changed && debounce <= 0 {
+		s.applyHealth(ip, gen)
+	}
+
+	return nil
+}
+
+func (s *Session) applyHealth(ip netip.Addr, gen uint64) {
+
+	s.health.mutex.Lock()
+	defer s.health.mutex.Unlock()
+
+	if s.health.closed {
+		return
+	}
+
+	s.mutex.Lock()
+	h := s.health.health[ip]
+	apply := h.gen == gen && h.healthy != h.want
+	if apply {
+		h.healthy = h.want
+	}
+	healthy := h.healthy
+	s.mutex.Unlock()
+
+	switch {
+	case !apply:
+	case healthy:
+		var added bool
+		u := s.ribUpdate(func(rib []netip.Addr) []netip.Addr {
+			if added = !inRIB(rib, ip); added {
+				return append(rib[:len(rib):len(rib)], ip)
+			}
+			return rib
+		})
+		if added {
+			u.add = []netip.Addr{ip}
+			s.c <- u
+		}
+	default:
+		s.Withdraw(hostRoute(ip))
+	}
+
+	if apply {
+		s.readvertise(s.backups(ip))
+	}
+}
+
+// Called by Close, with health.mutex held so that a debounce timer
+// which has already fired can't send on the closed channel
+func (s *Session) stopHealth() {
+	s.health.closed = true
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, h := range s.health.health {
+		if h.timer != nil {
+			h.timer.Stop()
+		}
+	}
+}
+
+func inRIB(rib []netip.Addr, ip netip.Addr) bool {
+	for _, a := range rib {
+		if a.Unmap() == ip {
+			return true
+		}
+	}
+	return false
+}
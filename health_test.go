@@ -0,0 +1,153 @@
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSetHealth(t *testing.T) {
+
+	s, peer := newTestSession(t, Parameters{ASNumber: 65000}, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	prefix := hostRoute(ipv4_0)
+
+	if err := s.SetHealth(netip.MustParsePrefix("10.0.0.0/24"), false); err == nil {
+		t.Error("Only host prefixes should be accepted")
+	}
+
+	s.SetHealth(prefix, false)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	} else if d, _ := decodeUpdate(m.Body()); len(d.withdrawn) != 1 || d.withdrawn[0] != prefix {
+		t.Error("Prefix should be withdrawn:", d.withdrawn)
+	}
+
+	s.SetHealth(prefix, true)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	} else if d, _ := decodeUpdate(m.Body()); len(d.advertised) != 1 || d.advertised[0] != prefix {
+		t.Error("Prefix should be advertised:", d.advertised)
+	}
+}
+
+func TestSetHealthDebounce(t *testing.T) {
+
+	m := newMockClock()
+
+	p := Parameters{ASNumber: 65000, HoldTime: 600, HealthDebounce: 10 * time.Second}
+
+	s := NewConnSession(IP{10, 0, 0, 1}, p, []netip.Addr{ipv4_0}, nil)
+	s.timers = m
+
+	peer := runTestSession(t, s)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.send(&open{version: 4, asNumber: 65001, holdTime: 600, routerID: IP4{10, 0, 0, 2}})
+	peer.send(&keepalive{})
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	prefix := hostRoute(ipv4_0)
+
+	// a flap shorter than the debounce time is ignored
+	s.SetHealth(prefix, false)
+	m.Advance(5 * time.Second)
+	s.SetHealth(prefix, true)
+	m.Advance(10 * time.Second)
+
+	if msg := peer.next(200 * time.Millisecond); msg != nil {
+		t.Fatal("Flap should not be advertised:", msg)
+	}
+
+	s.SetHealth(prefix, false)
+	m.Advance(5 * time.Second)
+
+	if msg := peer.next(200 * time.Millisecond); msg != nil {
+		t.Fatal("Withdrawn before the debounce time:", msg)
+	}
+
+	m.Advance(5 * time.Second)
+
+	if msg := peer.next(time.Second); msg == nil || msg.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", msg)
+	} else if d, _ := decodeUpdate(msg.Body()); len(d.withdrawn) != 1 {
+		t.Error("Prefix should be withdrawn:", d.withdrawn)
+	}
+}
+
+func TestSetHealthConcurrent(t *testing.T) {
+
+	p := Parameters{ASNumber: 65000, HealthDebounce: time.Millisecond}
+
+	s, peer := newTestSession(t, p, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	done := make(chan bool)
+
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			s.LocRIB([]netip.Addr{ipv4_0, ipv4_1})
+			s.Withdraw(hostRoute(ipv4_1))
+		}
+	}()
+
+	// debounce timers change the RIB on their own goroutines
+	for i := 0; i < 50; i++ {
+		s.SetHealth(hostRoute(ipv4_0), i%2 == 0)
+		time.Sleep(time.Millisecond)
+	}
+
+	<-done
+
+	for peer.next(100*time.Millisecond) != nil {
+	}
+
+	if st := s.Status(); st.State != ESTABLISHED {
+		t.Error("Session should be established:", st.State)
+	}
+}
+
+func TestSetHealthClose(t *testing.T) {
+
+	m := newMockClock()
+
+	p := Parameters{ASNumber: 65000, HealthDebounce: 10 * time.Second}
+
+	s := NewConnSession(IP{10, 0, 0, 1}, p, []netip.Addr{ipv4_0}, nil)
+	s.timers = m
+
+	s.SetHealth(hostRoute(ipv4_0), false)
+	s.Close()
+
+	m.Advance(10 * time.Second) // would send on the closed channel
+
+	s.applyHealth(ipv4_0, 1) // as if the timer fired just before Close
+}
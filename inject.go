@@ -0,0 +1,80 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Messages from the connection, interleaved with any injected by a
+// test harness. The output is closed when the connection's is, and the
+// goroutine exits when done is closed if nothing is left to read it.
+func merge(c <-chan message, inject <-chan message, done <-chan struct{}) <-chan message {
+
+	out := make(chan message)
+
+	go func() {
+		defer close(out)
+		for {
+			var m message
+
+			select {
+			case r, ok := <-c:
+				if !ok {
+					return
+				}
+				m = r
+			case m = <-inject:
+			case <-done:
+				return
+			}
+
+			select {
+			case out <- m:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// Queue a message, framed as on the wire, to be handled as if it had
+// been received from the peer. Framing errors are returned rather than
+// injected, as the connection would simply be dropped.
+func (s *Session) injectRaw(raw []byte) error {
+
+	if s.inject == nil {
+		return errors.New("Message injection is not enabled")
+	}
+
+	mtype, body, err := readFrame(bytes.NewReader(raw))
+
+	if err != nil {
+		return err
+	}
+
+	m, _ := parseMessage(mtype, body)
+
+	s.inject <- m
+
+	return nil
+}
@@ -0,0 +1,38 @@
+//go:build chaos
+
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+// Resilience testing hooks, only built with the chaos tag so that they
+// can't be used in production: go test -tags chaos
+
+// Allow messages to be injected into the receive path of a session
+// created with NewConnSession - this must be called before RunConn
+func EnableInjection(s *Session) {
+	s.inject = make(chan message, 10)
+}
+
+// Inject a message (including the header) as if it had been received
+// from the peer, eg. a NOTIFICATION or a malformed UPDATE, to exercise
+// the session's error handling. RunConn returns when the session ends,
+// so reconnection backoff is left to the caller.
+func Inject(s *Session, raw []byte) error {
+	return s.injectRaw(raw)
+}
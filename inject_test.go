@@ -0,0 +1,169 @@
+package bgp
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func injectionSession(t *testing.T) (*Session, *testPeer) {
+
+	s := NewConnSession(IP{10, 0, 0, 1}, Parameters{ASNumber: 65000}, []netip.Addr{ipv4_0}, nil)
+	s.inject = make(chan message, 10)
+
+	peer := runTestSession(t, s)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	return s, peer
+}
+
+func TestInjectNotification(t *testing.T) {
+
+	s, peer := injectionSession(t)
+
+	n := notification{code: CEASE, sub: ADMINISTRATIVE_RESET}
+
+	if err := s.injectRaw(addHeader(M_NOTIFICATION, n.message())); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-peer.done:
+		if err == nil || !strings.Contains(err.Error(), "Received notification[6:4]") {
+			t.Error("Unexpected error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RunConn did not return")
+	}
+
+	if st := s.Status(); st.State != IDLE || st.LastError == "" {
+		t.Error("Session should be idle with an error:", st.State, st.LastError)
+	}
+}
+
+func TestInjectMalformedUpdate(t *testing.T) {
+
+	s, peer := injectionSession(t)
+
+	// withdrawn routes length overruns the message
+	if err := s.injectRaw(addHeader(M_UPDATE, []byte{0, 100, 0, 0})); err != nil {
+		t.Fatal(err)
+	}
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_NOTIFICATION {
+		t.Errorf("Expected NOTIFICATION: %v", m)
+	} else if n := m.(*notification); n.code != UPDATE_MESSAGE_ERROR {
+		t.Error("Expected UPDATE message error:", n.code, n.sub)
+	}
+}
+
+func TestInjectDisabled(t *testing.T) {
+
+	s, _ := newTestSession(t, Parameters{ASNumber: 65000}, nil, nil)
+
+	n := notification{code: CEASE}
+
+	if err := s.injectRaw(addHeader(M_NOTIFICATION, n.message())); err == nil {
+		t.Error("Injection should fail when not enabled")
+	}
+}
+
+// wait for the session goroutine to set a timer expiring at when
+func scheduled(t *testing.T, clock *mockClock, when time.Time) {
+	for i := 0; ; i++ {
+		if i > 100 {
+			t.Fatal("Timer not scheduled:", when)
+		}
+
+		clock.mutex.Lock()
+		var set bool
+		for _, m := range clock.timers {
+			set = set || (m.active && m.when.Equal(when))
+		}
+		clock.mutex.Unlock()
+
+		if set {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInjectBackoff(t *testing.T) {
+
+	clock := newMockClock()
+	d := &pipeDialer{address: make(chan string, 1), remote: make(chan net.Conn, 1)}
+	p := Parameters{ASNumber: 65000, Dialer: d}
+
+	s := &Session{p: p, status: Status{State: IDLE}, update: newupdate(p, nil), peer: "192.0.2.1", timers: clock}
+	s.inject = make(chan message, 10)
+	s.c = s.session(IP{10, 0, 0, 1}, "192.0.2.1")
+	defer s.Close()
+
+	dialled := func(timeout time.Duration) *testPeer {
+		select {
+		case <-d.address:
+			return newTestPeer(t, <-d.remote)
+		case <-time.After(timeout):
+			return nil
+		}
+	}
+
+	scheduled(t, clock, clock.Now().Add(1)) // first attempt is immediate
+	clock.Advance(1)
+
+	peer := dialled(time.Second)
+
+	if peer == nil {
+		t.Fatal("Session did not connect")
+	}
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	for i := 0; s.Status().State != ESTABLISHED; i++ {
+		if i > 100 {
+			t.Fatal("Session not established:", s.Status().State)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	n := notification{code: CEASE, sub: ADMINISTRATIVE_RESET}
+
+	if err := s.injectRaw(addHeader(M_NOTIFICATION, n.message())); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduled(t, clock, clock.Now().Add(30*time.Second)) // retry timer
+
+	if st := s.Status(); st.State != IDLE || !strings.Contains(st.LastError, "Received notification[6:4]") {
+		t.Error("Session should be reset:", st.State, st.LastError)
+	}
+
+	clock.Advance(29 * time.Second)
+
+	if dialled(100*time.Millisecond) != nil {
+		t.Fatal("Session should back off before reconnecting")
+	}
+
+	clock.Advance(time.Second)
+
+	if dialled(time.Second) == nil {
+		t.Error("Session should reconnect after the retry time")
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"fmt"
+	"time"
+)
+
+// Optionally implemented by the BGPNotify passed to a session to be
+// warned of peer misconfiguration which may cause the session to flap
+type BGPWarning interface {
+	BGPWarning(peer string, warning string)
+}
+
+func (s *Session) warn(peer string, warning string) {
+	if w, ok := s.log().(BGPWarning); ok {
+		w.BGPWarning(peer, warning)
+	}
+}
+
+// Watches the interval between messages from an established peer,
+// which should send a KEEPALIVE at least every third of the hold time
+// (RFC 4271 10). Gaps of more than two thirds suggest that the peer is
+// assuming a longer hold time than the negotiated one.
+type keepaliveMonitor struct {
+	hold   time.Duration
+	last   time.Time
+	warned bool
+}
+
+func newKeepaliveMonitor(hold time.Duration, now time.Time) keepaliveMonitor {
+	return keepaliveMonitor{hold: hold, last: now}
+}
+
+// Record a message received at the time given, returning a warning
+// the first time that the interval is excessive
+func (k *keepaliveMonitor) observe(now time.Time) (warning string) {
+
+	gap := now.Sub(k.last)
+	k.last = now
+
+	if !k.warned && k.hold > 0 && gap > 2*k.hold/3 {
+		k.warned = true
+		warning = fmt.Sprintf("Peer sent no messages for %v, but the hold time is %v - keepalives should be sent every %v",
+			gap.Round(time.Millisecond), k.hold, k.hold/3)
+	}
+
+	return
+}
+
+// The peer's hold time differs grossly from ours - the lower is used,
+// but this may indicate misconfiguration
+func holdTimeMismatch(local, remote uint16) string {
+	if remote != 0 && (remote >= 2*local || local >= 2*remote) {
+		return fmt.Sprintf("Peer's hold time (%ds) differs substantially from ours (%ds)", remote, local)
+	}
+	return ""
+}
@@ -0,0 +1,128 @@
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveMonitor(t *testing.T) {
+
+	start := time.Now()
+	k := newKeepaliveMonitor(90*time.Second, start)
+
+	// keepalives every 30s, as expected
+	for i := 1; i <= 3; i++ {
+		if w := k.observe(start.Add(time.Duration(i) * 30 * time.Second)); w != "" {
+			t.Fatal("Unexpected warning:", w)
+		}
+	}
+
+	// the peer assumes a longer hold time and slows down
+	now := start.Add(90 * time.Second)
+
+	if w := k.observe(now.Add(70 * time.Second)); w == "" {
+		t.Fatal("Slow keepalives should cause a warning")
+	}
+
+	if w := k.observe(now.Add(140 * time.Second)); w != "" {
+		t.Error("Warning should only be given once:", w)
+	}
+
+	var idle keepaliveMonitor // not established
+
+	if w := idle.observe(now); w != "" {
+		t.Error("No warning expected before the session is established:", w)
+	}
+}
+
+func TestHoldTimeMismatch(t *testing.T) {
+
+	if w := holdTimeMismatch(90, 60); w != "" {
+		t.Error("Small difference should not warn:", w)
+	}
+
+	if w := holdTimeMismatch(90, 240); w == "" {
+		t.Error("Large difference should warn")
+	}
+
+	if w := holdTimeMismatch(90, 9); w == "" {
+		t.Error("Large difference should warn")
+	}
+}
+
+func TestZeroHoldTime(t *testing.T) {
+
+	// count of KEEPALIVEs sent by the session (after the one which
+	// confirms the OPEN) while the mock clock advances by an hour,
+	// failing if it sends anything else
+	keepalives := func(p Parameters) (n int) {
+		m := newMockClock()
+
+		p.ASNumber = 65000
+		s := NewConnSession(IP{10, 0, 0, 1}, p, []netip.Addr{ipv4_0}, nil)
+		s.timers = m
+
+		peer := runTestSession(t, s)
+
+		if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+			t.Fatalf("Expected OPEN: %v", m)
+		}
+
+		peer.send(&open{version: 4, asNumber: 65001, holdTime: 0, routerID: IP4{10, 0, 0, 2}})
+		peer.send(&keepalive{})
+
+		if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+			t.Fatalf("Expected UPDATE: %v", m)
+		}
+
+		for i := 0; i < 60; i++ {
+			m.Advance(time.Minute)
+			time.Sleep(time.Millisecond)
+		}
+
+		for {
+			select {
+			case msg := <-peer.msgs:
+				if msg.Type() != M_KEEPALIVE {
+					t.Fatalf("Unexpected message: %v", msg)
+				}
+				n++
+			case <-time.After(100 * time.Millisecond):
+				if s.Status().State != ESTABLISHED {
+					t.Error("Session should be established:", s.Status().State)
+				}
+				return
+			}
+		}
+	}
+
+	if n := keepalives(Parameters{}); n != 0 {
+		t.Error("No KEEPALIVEs should be sent with a zero hold time:", n)
+	}
+
+	if n := keepalives(Parameters{ZeroHoldTimeKeepalive: 10 * time.Minute}); n != 6 {
+		t.Error("KEEPALIVEs should be sent every 10 minutes:", n)
+	}
+
+	_, peer := newTestSession(t, Parameters{ASNumber: 65000, RejectZeroHoldTime: true}, nil, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.send(&open{version: 4, asNumber: 65001, holdTime: 0, routerID: IP4{10, 0, 0, 2}})
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_NOTIFICATION {
+		t.Fatalf("Expected NOTIFICATION: %v", m)
+	} else if n := m.(*notification); n.code != OPEN_MESSAGE_ERROR || n.sub != UNNACEPTABLE_HOLD_TIME {
+		t.Error("Expected unacceptable hold time:", n.code, n.sub)
+	}
+
+	// exactly one NOTIFICATION, then the connection is closed
+	for m := peer.next(time.Second); m != nil; m = peer.next(time.Second) {
+		if m.Type() == M_NOTIFICATION {
+			t.Fatal("NOTIFICATION sent more than once")
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+// https://datatracker.ietf.org/doc/html/rfc8277 - Using BGP to Bind MPLS Labels to Address Prefixes
+// https://datatracker.ietf.org/doc/html/rfc4364 - BGP/MPLS IP Virtual Private Networks (VPNs)
+
+import "net/netip"
+
+const (
+	SAFI_LABELED_UNICAST = 4
+	SAFI_MPLS_VPN        = 128
+)
+
+// A prefix from a labeled unicast or VPN NLRI
+type labeledPrefix struct {
+	labels []uint32
+	rd     uint64 // route distinguisher - VPN only
+	prefix netip.Prefix
+}
+
+// Length in bits[1], Label[3]..., Route Distinguisher[8] (VPN only),
+// Prefix[...] - the length covers the labels and RD as well as the
+// prefix. Labels are read until one has the bottom-of-stack bit set,
+// which must happen within the length of the NLRI and within maxDepth
+// labels.
+func decodeLabeledPrefixes(d []byte, ipv6, vpn bool, maxDepth int) (prefixes []labeledPrefix, ok bool) {
+
+	max := 32
+
+	if ipv6 {
+		max = 128
+	}
+
+	for len(d) > 0 {
+		bits := int(d[0])
+		octets := (bits + 7) / 8
+
+		if 1+octets > len(d) {
+			return nil, false
+		}
+
+		n := d[1 : 1+octets]
+		d = d[1+octets:]
+
+		var p labeledPrefix
+
+		for bottom := false; !bottom; {
+			if len(n) < 3 {
+				return nil, false // no bottom-of-stack bit
+			}
+			if len(p.labels) >= maxDepth {
+				return nil, false
+			}
+			l := uint32(n[0])<<16 | uint32(n[1])<<8 | uint32(n[2])
+			p.labels = append(p.labels, l>>4)
+			bottom = l&1 != 0
+			n = n[3:]
+		}
+
+		if vpn {
+			if len(n) < 8 {
+				return nil, false
+			}
+			for _, b := range n[:8] {
+				p.rd = p.rd<<8 | uint64(b)
+			}
+			n = n[8:]
+		}
+
+		bits -= 8 * (octets - len(n)) // what remains is the prefix
+
+		if bits < 0 || bits > max {
+			return nil, false
+		}
+
+		var addr netip.Addr
+
+		if ipv6 {
+			var a [16]byte
+			copy(a[:], n)
+			addr = netip.AddrFrom16(a)
+		} else {
+			var a [4]byte
+			copy(a[:], n)
+			addr = netip.AddrFrom4(a)
+		}
+
+		prefix, err := addr.Prefix(bits)
+
+		if err != nil {
+			return nil, false
+		}
+
+		p.prefix = prefix
+		prefixes = append(prefixes, p)
+	}
+
+	return prefixes, true
+}
@@ -0,0 +1,157 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"errors"
+	"net/netip"
+	"sort"
+)
+
+// A set of host prefixes to originate. The zero value is an empty RIB
+// ready for use. Routes are advertised with the attributes from the
+// session's Parameters (and export policy). A RIB is not safe for
+// concurrent use.
+type RIB struct {
+	routes map[netip.Prefix]bool
+}
+
+// Add a host prefix. Prefixes are stored in their canonical form -
+// zones are removed and IPv4-mapped IPv6 prefixes are treated as IPv4.
+func (r *RIB) Advertise(prefix netip.Prefix) error {
+
+	if !prefix.IsValid() || !prefix.IsSingleIP() {
+		return errors.New("Only host prefixes may be advertised: " + prefix.String())
+	}
+
+	if r.routes == nil {
+		r.routes = map[netip.Prefix]bool{}
+	}
+
+	r.routes[canonicalPrefix(prefix)] = true
+
+	return nil
+}
+
+// Remove a prefix, returning false if it was not present
+func (r *RIB) Withdraw(prefix netip.Prefix) bool {
+
+	p := canonicalPrefix(prefix)
+
+	if !r.routes[p] {
+		return false
+	}
+
+	delete(r.routes, p)
+
+	return true
+}
+
+func (r *RIB) Len() int {
+	return len(r.routes)
+}
+
+// A copy of the RIB, unaffected by subsequent changes - eg. to later
+// pass to Diff
+func (r *RIB) Snapshot() *RIB {
+
+	s := &RIB{routes: make(map[netip.Prefix]bool, len(r.routes))}
+
+	for p := range r.routes {
+		s.routes[p] = true
+	}
+
+	return s
+}
+
+// The routes in the RIB, ordered by prefix
+func (r *RIB) Routes() (routes []Route) {
+
+	for p := range r.routes {
+		routes = append(routes, Route{Prefix: p})
+	}
+
+	sortRoutes(routes)
+
+	return
+}
+
+// The changes needed to get from a previous RIB (which may be nil) to
+// this one: routes which are new, and prefixes which are no longer
+// present. Both are ordered by prefix.
+func (r *RIB) Diff(previous *RIB) (advertise []Route, withdraw []netip.Prefix) {
+
+	var prev map[netip.Prefix]bool
+
+	if previous != nil {
+		prev = previous.routes
+	}
+
+	for p := range r.routes {
+		if !prev[p] {
+			advertise = append(advertise, Route{Prefix: p})
+		}
+	}
+
+	for p := range prev {
+		if !r.routes[p] {
+			withdraw = append(withdraw, p)
+		}
+	}
+
+	sortRoutes(advertise)
+
+	sort.Slice(withdraw, func(i, j int) bool { return prefixLess(withdraw[i], withdraw[j]) })
+
+	return
+}
+
+// Replace the session's RIB with the prefixes in r
+func (s *Session) SetRIB(r *RIB) {
+
+	var rib []netip.Addr
+
+	for _, route := range r.Routes() {
+		rib = append(rib, route.Prefix.Addr())
+	}
+
+	s.LocRIB(rib)
+}
+
+func canonicalPrefix(p netip.Prefix) netip.Prefix {
+
+	a := p.Addr().WithZone("")
+
+	if a.Is4In6() && p.Bits() >= 96 {
+		return netip.PrefixFrom(a.Unmap(), p.Bits()-96).Masked()
+	}
+
+	return netip.PrefixFrom(a, p.Bits()).Masked()
+}
+
+func prefixLess(a, b netip.Prefix) bool {
+	if a.Addr() != b.Addr() {
+		return a.Addr().Less(b.Addr())
+	}
+	return a.Bits() < b.Bits()
+}
+
+func sortRoutes(r []Route) {
+	sort.Slice(r, func(i, j int) bool { return prefixLess(r[i].Prefix, r[j].Prefix) })
+}
@@ -0,0 +1,108 @@
+package bgp
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRIBAdvertiseWithdraw(t *testing.T) {
+
+	var r RIB
+
+	if err := r.Advertise(netip.Prefix{}); err == nil {
+		t.Error("Invalid prefix should be rejected")
+	}
+
+	if err := r.Advertise(netip.MustParsePrefix("10.0.0.0/8")); err == nil {
+		t.Error("Only host prefixes should be accepted")
+	}
+
+	r.Advertise(netip.MustParsePrefix("10.1.2.3/32"))
+	r.Advertise(netip.MustParsePrefix("::ffff:192.168.101.1/128"))
+	r.Advertise(netip.MustParsePrefix("10.1.2.3/32")) // already present
+
+	exp := []Route{
+		{Prefix: netip.MustParsePrefix("10.1.2.3/32")},
+		{Prefix: netip.MustParsePrefix("192.168.101.1/32")},
+	}
+
+	if routes := r.Routes(); !reflect.DeepEqual(routes, exp) {
+		t.Errorf("Unexpected routes: %v", routes)
+	}
+
+	if !r.Withdraw(netip.MustParsePrefix("192.168.101.1/32")) || r.Withdraw(netip.MustParsePrefix("192.168.101.1/32")) {
+		t.Error("Prefix should be withdrawn once")
+	}
+
+	if r.Len() != 1 {
+		t.Error("Expected one route:", r.Routes())
+	}
+}
+
+func TestRIBDiff(t *testing.T) {
+
+	a := hostRoute(ipv4_0)
+	b := hostRoute(ipv4_1)
+	c := hostRoute(ipv6_0)
+
+	var r RIB
+
+	r.Advertise(a)
+	r.Advertise(b)
+
+	if adv, wd := r.Diff(nil); len(adv) != 2 || len(wd) != 0 {
+		t.Errorf("Everything is new: %v %v", adv, wd)
+	}
+
+	prev := r.Snapshot()
+
+	if adv, wd := r.Diff(prev); len(adv) != 0 || len(wd) != 0 {
+		t.Errorf("No changes: %v %v", adv, wd)
+	}
+
+	r.Withdraw(a)
+	r.Advertise(c)
+
+	if prev.Len() != 2 {
+		t.Error("Snapshot should not change")
+	}
+
+	adv, wd := r.Diff(prev)
+
+	if len(adv) != 1 || adv[0].Prefix != c {
+		t.Errorf("New route should be advertised: %v", adv)
+	}
+
+	if !reflect.DeepEqual(wd, []netip.Prefix{a}) {
+		t.Errorf("Removed prefix should be withdrawn: %v", wd)
+	}
+}
+
+func TestSetRIB(t *testing.T) {
+
+	s, peer := newTestSession(t, Parameters{ASNumber: 65000}, nil, nil)
+
+	var r RIB
+	r.Advertise(hostRoute(ipv4_0))
+	r.Advertise(hostRoute(ipv4_1))
+
+	s.SetRIB(&r)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	m := peer.next(time.Second)
+
+	if m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	if u, n := decodeUpdate(m.Body()); n != nil || len(u.advertised) != 2 {
+		t.Errorf("Expected two prefixes: %v %v", n, u.advertised)
+	}
+}
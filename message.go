@@ -19,6 +19,8 @@
 package bgp
 
 import (
+	"errors"
+	"fmt"
 	"net/netip"
 	"sort"
 )
@@ -77,9 +79,34 @@ type open struct {
 	holdTime      uint16
 	routerID      [4]byte
 	multiprotocol bool
+	caps          []capability // additional capabilities to send
 
-	version byte
-	op      []byte
+	version  byte
+	op       []byte // optional parameters, without the length field(s)
+	extended bool   // optional parameters used the RFC 9072 encoding
+}
+
+// https://datatracker.ietf.org/doc/html/rfc9072 - Extended Optional Parameters Length for BGP OPEN Message
+
+// Returns a NOTIFICATION to be sent if the OPEN is not acceptable
+func (o *open) validate(routerid IP4) *notification {
+
+	if o.version != 4 {
+		// Data is the largest locally-supported version number less
+		// than the version the remote BGP peer bid - we only support 4
+		v := htons(4)
+		return &notification{code: OPEN_MESSAGE_ERROR, sub: UNSUPPORTED_VERSION_NUMBER, data: v[:]}
+	}
+
+	if o.holdTime == 1 || o.holdTime == 2 { // zero disables the hold timer - RFC 4271 6.2
+		return &notification{code: OPEN_MESSAGE_ERROR, sub: UNNACEPTABLE_HOLD_TIME}
+	}
+
+	if o.routerID == routerid {
+		return &notification{code: OPEN_MESSAGE_ERROR, sub: BAD_BGP_ID}
+	}
+
+	return nil
 }
 
 func (o *open) parse(d []byte) bool {
@@ -90,38 +117,147 @@ func (o *open) parse(d []byte) bool {
 	o.asNumber = (uint16(d[1]) << 8) | uint16(d[2])
 	o.holdTime = (uint16(d[3]) << 8) | uint16(d[4])
 	copy(o.routerID[:], d[5:9])
-	o.op = d[10:]
+
+	l := int(d[9])
+	op := d[10:]
+
+	// Non-Ext OP Len[1] = 255, Non-Ext OP Type[1] = 255, Extended Opt. Parm. Length[2]
+	if l == 255 && len(op) >= 3 && op[0] == 255 {
+		o.extended = true
+		l = int(op[1])<<8 | int(op[2])
+		op = op[3:]
+	}
+
+	if l != len(op) {
+		return false
+	}
+
+	o.op = op
 	return true
 }
 
-func (o *open) message() []byte {
-	as := htons(o.asNumber)
-	ht := htons(o.holdTime)
-	id := o.routerID
+type family struct {
+	afi  uint16
+	safi uint8
+}
 
-	open := []byte{4, as[0], as[1], ht[0], ht[1], id[0], id[1], id[2], id[3]}
-	var params []byte
+var IPV4_UNICAST = family{afi: 1, safi: 1}
+var IPV6_UNICAST = family{afi: 2, safi: 1}
+
+type capability struct {
+	code  uint8
+	value []byte
+}
+
+// Capabilities from all Capabilities Optional Parameters; other types of parameter are ignored
+func (o *open) capabilities() (caps []capability, ok bool) {
+
+	h := 2 // Parm. Type[1], Parm. Length[1] (or [2] if extended)
+
+	if o.extended {
+		h = 3
+	}
+
+	for p := o.op; len(p) > 0; {
+		if len(p) < h {
+			return nil, false
+		}
+
+		t := p[0]
+		l := int(p[1])
+
+		if o.extended {
+			l = l<<8 | int(p[2])
+		}
+
+		if h+l > len(p) {
+			return nil, false
+		}
+
+		v := p[h : h+l]
+		p = p[h+l:]
+
+		if t != CAPABILITIES_OPTIONAL_PARAMETER {
+			continue
+		}
+
+		// Capability Code[1], Capability Length[1], Capability Value[...]
+		for len(v) > 0 {
+			if len(v) < 2 || 2+int(v[1]) > len(v) {
+				return nil, false
+			}
+			caps = append(caps, capability{code: v[0], value: v[2 : 2+int(v[1])]})
+			v = v[2+int(v[1]):]
+		}
+	}
+
+	return caps, true
+}
+
+// All of the capabilities sent in the OPEN
+func (o *open) offered() []capability {
 
 	// AFI[2], Reserved[1](always 0), SAFI[1]
 
 	// https://infocenter.nokia.com/public/7750SR222R1A/index.jsp?topic=%2Fcom.nokia.Unicast_Guide%2Fmulti-protocol_-ai9exj5yje.html
 	// https://datatracker.ietf.org/doc/html/rfc3392 - Capabilities Advertisement with BGP-4
 	// Capability Code (1 octet), Capability Length (1 octet), Capability Value (variable)
-	mp_ipv4 := []byte{BGP4_MP, 4, 0, 1, 0, 1} // Capability Code (1 octet), Length (1 octet), Value [IPv4 unicast AFI 1, SAFI 1]
-	mp_ipv6 := []byte{BGP4_MP, 4, 0, 2, 0, 1} // Capability Code (1 octet), Length (1 octet), Value [IPv6 unicast AFI 2, SAFI 1]
+	mp_ipv4 := capability{code: BGP4_MP, value: []byte{0, 1, 0, 1}} // IPv4 unicast AFI 1, SAFI 1
+	mp_ipv6 := capability{code: BGP4_MP, value: []byte{0, 2, 0, 1}} // IPv6 unicast AFI 2, SAFI 1
 
-	// Optional Parameters: Parm.Type[1], Parm.Length[1], Parm.Value[...]
-	param_ipv4 := append([]byte{CAPABILITIES_OPTIONAL_PARAMETER, byte(len(mp_ipv4))}, mp_ipv4...)
-	param_ipv6 := append([]byte{CAPABILITIES_OPTIONAL_PARAMETER, byte(len(mp_ipv6))}, mp_ipv6...)
+	var caps []capability
 
 	if o.multiprotocol {
-		params = append(params, param_ipv6...)
-		params = append(params, param_ipv4...)
+		caps = append(caps, mp_ipv6, mp_ipv4)
 	}
 
-	params = append([]byte{byte(len(params))}, params...)
+	return append(caps, o.caps...)
+}
 
-	return append(open, params...)
+func (o *open) message() []byte {
+	as := htons(o.asNumber)
+	ht := htons(o.holdTime)
+	id := o.routerID
+
+	open := []byte{4, as[0], as[1], ht[0], ht[1], id[0], id[1], id[2], id[3]}
+
+	// each capability is sent in its own Capabilities Optional Parameter
+	var params [][]byte
+
+	for _, c := range o.offered() {
+		params = append(params, append([]byte{c.code, byte(len(c.value))}, c.value...))
+	}
+
+	return append(open, optionalParameters(params)...)
+}
+
+// Optional Parameters: Parm.Type[1], Parm.Length[1], Parm.Value[...],
+// preceded by the total length. If they won't fit into 255 bytes then
+// the RFC 9072 encoding, with two byte lengths, is used.
+func optionalParameters(params [][]byte) []byte {
+
+	var op []byte
+
+	for _, p := range params {
+		op = append(op, CAPABILITIES_OPTIONAL_PARAMETER, byte(len(p)))
+		op = append(op, p...)
+	}
+
+	if len(op) <= 255 {
+		return append([]byte{byte(len(op))}, op...)
+	}
+
+	op = nil
+
+	for _, p := range params {
+		l := htons(uint16(len(p)))
+		op = append(op, CAPABILITIES_OPTIONAL_PARAMETER, l[0], l[1])
+		op = append(op, p...)
+	}
+
+	l := htons(uint16(len(op)))
+
+	return append([]byte{255, 255, l[0], l[1]}, op...)
 }
 
 type advert struct {
@@ -138,15 +274,64 @@ type advert struct {
 	PeerASNumber uint16
 	//external     bool
 	localpref uint32
+	export    []PolicyRule
+
+	localPrefFunc func(Route) uint32 // see Parameters.LocalPrefFunc
+	sendLocalPref *bool              // see Parameters.SendLocalPref
+	drain         bool               // see Parameters.GracefulShutdown
+	selfOnly      bool               // see Parameters.AdvertiseSelfOnly
+	learnedOnly   bool               // see Parameters.AdvertiseLearnedOnly
+
+	backup     func(netip.Addr) bool // see Session.SetBackup
+	backupAttr *Backup               // see Parameters.Backup
+
+	self4        [4]byte  // local address of the session, used for "self" next hops
+	self6        [16]byte // may be unset if the session is not over IPv6
+	nextHopMode4 string
+	nextHopMode6 string
+
+	path   []uint32 // if not nil, overrides the default AS_PATH
+	origin uint8    // IGP unless changed by export policy
+
+	atomicAggregate bool
+	relayed         ASPath // if not nil, the AS_PATH of a received route being re-advertised
+
+	role string // see Parameters.PeerRole
+	otc  uint32 // Only to Customer attribute, if not zero
+
+	// IPv4 NLRI are carried in MP_REACH_NLRI/MP_UNREACH_NLRI, with a
+	// next hop of this length - see Parameters.MultiprotocolIPv4
+	mpIPv4         bool
+	nextHopLength4 int
+
+	// ADD-PATH: identifier for the NLRI in families where it has been
+	// negotiated
+	pathID             uint32
+	addPath4, addPath6 bool
+
+	maxFragments int // see Parameters.MaxFragments; 0 for no limit
+
+	extendedCommunities []ExtendedCommunity // see Parameters.ExtendedCommunities
 }
 
 func (a *advert) localPref() uint32 {
+	if a.drain {
+		return 0 // RFC 8326: lowest preference while shutting down
+	}
 	if a.localpref > 0 {
 		return a.localpref
 	}
 	return 100
 }
 
+// LOCAL_PREF is only sent to internal peers unless overridden
+func (a *advert) includeLocalPref() bool {
+	if a.sendLocalPref != nil {
+		return *a.sendLocalPref
+	}
+	return !a.external()
+}
+
 func (a *advert) external() bool {
 	return a.PeerASNumber != a.ASNumber
 }
@@ -158,16 +343,206 @@ func (a *advert) withParameters(p Parameters, remoteASNumber uint16) (r advert)
 	r.PeerASNumber = remoteASNumber
 	//r.external = a.ASNumber != remoteASNumber
 	r.localpref = p.LocalPref
+	r.export = p.Export
+	r.localPrefFunc = p.LocalPrefFunc
+	r.sendLocalPref = p.SendLocalPref
+	r.drain = p.GracefulShutdown
+	r.selfOnly = p.AdvertiseSelfOnly
+	r.learnedOnly = p.AdvertiseLearnedOnly
+	r.backupAttr = p.Backup
+	r.nextHopMode4 = p.NextHopMode4
+	r.nextHopMode6 = p.NextHopMode6
+	r.path = p.OriginateWithPath
+	r.origin = originCode(p.Origin, IGP)
+	r.role = p.PeerRole
+	r.otc = r.onlyToCustomer()
+	r.maxFragments = p.MaxFragments
+	r.extendedCommunities = p.ExtendedCommunities
+
+	if r.maxFragments == 0 {
+		r.maxFragments = DEFAULT_MAX_FRAGMENTS
+	}
+
+	if r.drain {
+		r.Communities = append(append([]Community{}, p.Communities...), GRACEFUL_SHUTDOWN)
+	}
+
+	if r.external() && p.StripMED {
+		r.MED = 0
+	}
+
+	var nul6 [16]byte
+
+	if r.nextHopMode4 == NEXT_HOP_SELF {
+		r.NextHop = r.self4
+	}
+
+	if r.nextHopMode6 == NEXT_HOP_SELF && r.self6 != nul6 {
+		r.NextHop6 = r.self6
+	}
+
 	return
 }
 
-func (a *advert) updates(m map[netip.Addr]bool) (ret []message) {
+// Limit on the number of UPDATEs for a single change to the RIB if
+// Parameters.MaxFragments is not set - about 400MB of messages
+const DEFAULT_MAX_FRAGMENTS = 100000
+
+func (a *advert) updates(m map[netip.Addr]bool) []message {
+	ret, _ := a.build(m)
+	return ret
+}
+
+// As updates, but with the reason that no messages could be built
+func (a *advert) build(m map[netip.Addr]bool) (ret []message, err error) {
+
+	if len(m) < 1 {
+		return nil, nil
+	}
+
+	if withdrawOnly(m) {
+		if ret = a.withdrawals(m); len(ret) < 1 {
+			return nil, errors.New("Unable to build withdrawals")
+		}
+		return ret, nil
+	}
+
+	for _, g := range a.groups(m) {
+		f := g.advert.fragment(g.nlri)
+
+		if len(f) < 1 {
+			return nil, fmt.Errorf("Unable to fit %d prefixes into UPDATEs with %d bytes of path attributes",
+				len(g.nlri), g.advert.attributeLength(g.nlri))
+		}
+
+		ret = append(ret, f...)
+
+		if a.maxFragments > 0 && len(ret) > a.maxFragments {
+			return nil, fmt.Errorf("More than %d UPDATEs needed for %d prefixes with %d bytes of path attributes",
+				a.maxFragments, len(m), g.advert.attributeLength(g.nlri))
+		}
+	}
+
+	if len(ret) < 1 {
+		return nil, errors.New("Unable to build UPDATE")
+	}
+
+	return ret, nil
+}
+
+// Size of the path attributes sent for a set of prefixes (0 if no
+// message could be built)
+func (a *advert) attributeLength(m map[netip.Addr]bool) int {
+	for ip, v := range m {
+		u, err := a.message(map[netip.Addr]bool{ip: v})
+		if err != nil || len(u) < 4 {
+			return 0
+		}
+		wl := int(u[0])<<8 | int(u[1])
+		if len(u) < 4+wl {
+			return 0
+		}
+		return int(u[2+wl])<<8 | int(u[3+wl])
+	}
+	return 0
+}
+
+func withdrawOnly(m map[netip.Addr]bool) bool {
+	for _, v := range m {
+		if v {
+			return false
+		}
+	}
+	return true
+}
+
+// Space for withdrawn NLRI in an UPDATE body (limited to 4000 bytes as
+// in fragment), less the fixed fields and an extended length
+// MP_UNREACH_NLRI attribute header: 2+2 lengths, 4 header, 3 AFI/SAFI
+const withdrawnSpace = 4000 - 11
+
+// UPDATEs withdrawing the prefixes in m (the values are ignored).
+// Withdrawals need no path attributes, so rather than halving the set
+// until each part fits, as fragment does, each message is filled up to
+// the size limit - IPv4 in the Withdrawn Routes field (MP_UNREACH_NLRI
+// if IPv4 is sent as multiprotocol) and IPv6 in MP_UNREACH_NLRI.
+func (a *advert) withdrawals(m map[netip.Addr]bool) (ret []message) {
+
+	w := map[netip.Addr]bool{}
+
+	for k := range m {
+		w[k] = false
+	}
+
+	_, withdrawn := sortAdvertiseWithdrawn(w)
+
+	var v4, v6 []netip.Addr
+
+	for _, ip := range withdrawn {
+		if ip.Is4() {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	for _, addrs := range [][]netip.Addr{v4, v6} {
+
+		chunk := map[netip.Addr]bool{}
+		var size int
+
+		for i, ip := range addrs {
+
+			n4, n6 := nlriByVersion([]netip.Addr{ip})
+
+			if a.pathID != 0 && (a.addPath4 || a.addPath6) {
+				n4, n6 = nlriPathID([]netip.Addr{ip}, a.pathID, a.addPath4, a.addPath6)
+			}
+
+			size += len(n4) + len(n6)
+			chunk[ip] = false
+
+			if last := i == len(addrs)-1; last || size+len(n4)+len(n6) > withdrawnSpace {
+				msg, err := a.message(chunk)
+				if err != nil {
+					return nil
+				}
+				ret = append(ret, &msg)
+				chunk = map[netip.Addr]bool{}
+				size = 0
+			}
+		}
+	}
+
+	return ret
+}
+
+func (a *advert) fragment(m map[netip.Addr]bool) (ret []message) {
 
 	if len(m) < 1 {
 		return nil
 	}
 
-	msg := a.message(m)
+	// with IPv4 as multiprotocol both families would need their own
+	// MP_REACH_NLRI/MP_UNREACH_NLRI, but each may only appear once in
+	// an UPDATE (RFC 7606 3(g)) - so send the families separately
+	if a.mpIPv4 {
+		if v4, v6 := splitFamilies(m); len(v4) > 0 && len(v6) > 0 {
+			f4, f6 := a.fragment(v4), a.fragment(v6)
+			if len(f4) < 1 || len(f6) < 1 {
+				return nil
+			}
+			return append(f4, f6...)
+		}
+	}
+
+	msg, err := a.message(m)
+
+	if err != nil {
+		// the path attributes are common to all prefixes, so splitting
+		// the set would not help - give up
+		return nil
+	}
 
 	if len(msg) < 4000 {
 		return append(ret, &msg)
@@ -196,13 +571,13 @@ func (a *advert) updates(m map[netip.Addr]bool) (ret []message) {
 		n++
 	}
 
-	if m := a.updates(m1); len(m) < 1 {
+	if m := a.fragment(m1); len(m) < 1 {
 		return nil
 	} else {
 		ret = append(ret, m...)
 	}
 
-	if m := a.updates(m2); len(m) < 1 {
+	if m := a.fragment(m2); len(m) < 1 {
 		return nil
 	} else {
 		ret = append(ret, m...)
@@ -211,8 +586,21 @@ func (a *advert) updates(m map[netip.Addr]bool) (ret []message) {
 	return ret
 }
 
+func splitFamilies(m map[netip.Addr]bool) (v4, v6 map[netip.Addr]bool) {
+	v4 = map[netip.Addr]bool{}
+	v6 = map[netip.Addr]bool{}
+	for ip, v := range m {
+		if ip.Is4() {
+			v4[ip] = v
+		} else {
+			v6[ip] = v
+		}
+	}
+	return
+}
+
 //func (u *update) message(rib map[netip.Addr]bool) []byte {
-func (a *advert) message(rib map[netip.Addr]bool) update {
+func (a *advert) message(rib map[netip.Addr]bool) (update, error) {
 
 	next_hop_address6 := a.NextHop6[:] // should be 16 or 32 bytes - a global adddress or global+link-local pair
 	next_hop_address4 := a.NextHop
@@ -221,11 +609,28 @@ func (a *advert) message(rib map[netip.Addr]bool) update {
 	advertise4, advertise6 := nlriByVersion(advertise)
 	withdrawn4, withdrawn6 := nlriByVersion(withdrawn)
 
+	if a.pathID != 0 && (a.addPath4 || a.addPath6) {
+		advertise4, advertise6 = nlriPathID(advertise, a.pathID, a.addPath4, a.addPath6)
+		withdrawn4, withdrawn6 = nlriPathID(withdrawn, a.pathID, a.addPath4, a.addPath6)
+	}
+
 	// <attribute type, attribute length, attribute value> [data ...]
 	// (Well-known, Mandatory, Transitive, Complete, Regular length), 1(ORIGIN), 1(byte), 0(IGP)
-	origin := []byte{WTCR, ORIGIN, 1, IGP}
+	origin := []byte{WTCR, ORIGIN, 1, a.origin}
 
 	as_path := asPath(a.ASNumber, a.external()) // Well-known, Mandatory
+	var as4_path []byte
+
+	if a.path != nil {
+		if len(a.path) < 1 && a.external() {
+			return nil, errors.New("Empty AS_PATH for external peer")
+		}
+		as_path, as4_path = asPathSequence(a.path)
+	}
+
+	if a.relayed != nil {
+		as_path, as4_path = asPathSegments(a.relayed)
+	}
 
 	// (Well-known, Mandatory, Transitive, Complete, Regular length), NEXT_HOP(3), 4(bytes)
 	next_hop := append([]byte{WTCR, NEXT_HOP, 4}, next_hop_address4[:]...)
@@ -233,32 +638,48 @@ func (a *advert) message(rib map[netip.Addr]bool) update {
 	path_attributes := []byte{}
 	path_attributes = append(path_attributes, origin...)
 	path_attributes = append(path_attributes, as_path...)
-	path_attributes = append(path_attributes, next_hop...)
+	path_attributes = append(path_attributes, as4_path...)
+
+	// rfc4760: An UPDATE message that carries no NLRI, other than the
+	// one encoded in the MP_REACH_NLRI attribute, SHOULD NOT carry the
+	// NEXT_HOP attribute.
+	if !a.mpIPv4 {
+		path_attributes = append(path_attributes, next_hop...)
+	}
 
 	// rfc4271: A BGP speaker MUST NOT include this attribute in UPDATE messages it sends to external peers ...
 	// LOCAL_PREF is a well-known attribute that SHALL be included in
 	// all UPDATE messages that a given BGP speaker sends to other
 	// internal peers. (NB: SHALL is synonymous for MUST - an absolute requirement)
-	if !a.external() {
+	if a.includeLocalPref() {
 		path_attributes = append(path_attributes, localPref(a.localPref())...)
 	}
 
 	if len(a.Communities) > 0 {
-		communities := []byte{}
-		for _, v := range a.Communities {
-			c := htonl(uint32(v))
-			communities = append(communities, c[:]...)
+		attr, err := communities(a.Communities)
+		if err != nil {
+			return nil, err
 		}
+		path_attributes = append(path_attributes, attr...)
+	}
 
-		if len(communities) > 255 {
-			hilo := htons(uint16(len(communities)))
-			attr := append([]byte{OTCE, COMMUNITIES, hilo[0], hilo[1]}, communities...)
-			path_attributes = append(path_attributes, attr...)
-		} else {
-			// (Optional, Transitive, Complete, Regular length), COMMUNITIES(8), n bytes
-			attr := append([]byte{OTCR, COMMUNITIES, uint8(len(communities))}, communities...)
-			path_attributes = append(path_attributes, attr...)
+	if len(a.extendedCommunities) > 0 {
+		attr, err := extendedCommunities(a.extendedCommunities)
+		if err != nil {
+			return nil, err
 		}
+		path_attributes = append(path_attributes, attr...)
+	}
+
+	if a.atomicAggregate {
+		// (Well-known, Transitive, Complete, Regular length), ATOMIC_AGGREGATE(6), 0 bytes
+		path_attributes = append(path_attributes, WTCR, ATOMIC_AGGREGATE, 0)
+	}
+
+	if a.otc != 0 {
+		// (Optional, Transitive, Complete, Regular length), ONLY_TO_CUSTOMER(35), 4 bytes
+		otc := htonl(a.otc)
+		path_attributes = append(path_attributes, OTCR, ONLY_TO_CUSTOMER, 4, otc[0], otc[1], otc[2], otc[3])
 	}
 
 	if a.MED > 0 {
@@ -268,6 +689,30 @@ func (a *advert) message(rib map[netip.Addr]bool) update {
 		path_attributes = append(path_attributes, attr...)
 	}
 
+	var mp bool        // IPv4 prefixes moved into MP_REACH_NLRI
+	var unreach []byte // MP_UNREACH_NLRI attributes
+
+	if a.mpIPv4 && len(advertise4) > 0 {
+		nh, err := a.nextHopMP4()
+		if err != nil {
+			return nil, err
+		}
+		mp_reach_nlri := []byte{0, 1, 1} // IPv4 unicast AFI 1, SAFI 1
+		mp_reach_nlri = append(mp_reach_nlri, byte(len(nh)))
+		mp_reach_nlri = append(mp_reach_nlri, nh...)
+		mp_reach_nlri = append(mp_reach_nlri, 0) // Number of SNPAs (1 octet) - none
+		mp_reach_nlri = append(mp_reach_nlri, advertise4...)
+		path_attributes = append(path_attributes, pathAttribute(ONCR, MP_REACH_NLRI, mp_reach_nlri)...)
+		advertise4 = nil
+		mp = true
+	}
+
+	if a.mpIPv4 && len(withdrawn4) > 0 {
+		mp_unreach_nlri := append([]byte{0, 1, 1}, withdrawn4...) // IPv4 unicast AFI 1, SAFI 1
+		unreach = append(unreach, pathAttribute(ONCR, MP_UNREACH_NLRI, mp_unreach_nlri)...)
+		withdrawn4 = nil
+	}
+
 	if len(advertise6) > 0 {
 		// https://datatracker.ietf.org/doc/html/rfc2545
 		mp_reach_nlri := []byte{0, 2, 1} // IPv6 unicast AFI 2, SAFI 1
@@ -289,15 +734,16 @@ func (a *advert) message(rib map[netip.Addr]bool) update {
 	if len(withdrawn6) > 0 {
 		mp_unreach_nlri := []byte{0, 2, 1} // IPv6 unicast AFI 2, SAFI 1
 		mp_unreach_nlri = append(mp_unreach_nlri, withdrawn6...)
+		unreach = append(unreach, pathAttribute(ONCR, MP_UNREACH_NLRI, mp_unreach_nlri)...)
+	}
 
-		if len(mp_unreach_nlri) > 255 {
-			hilo := htons(uint16(len(mp_unreach_nlri)))
-			attr := append([]byte{ONCE, MP_UNREACH_NLRI, hilo[0], hilo[1]}, mp_unreach_nlri...)
-			path_attributes = append(path_attributes, attr...)
-		} else {
-			attr := append([]byte{ONCR, MP_UNREACH_NLRI, byte(len(mp_unreach_nlri))}, mp_unreach_nlri...)
-			path_attributes = append(path_attributes, attr...)
-		}
+	advertised := len(advertise4) > 0 || len(advertise6) > 0 || mp
+
+	if advertised {
+		path_attributes = append(path_attributes, unreach...)
+	} else {
+		// withdrawals need no other path attributes
+		path_attributes = unreach
 	}
 
 	//   +-----------------------------------------------------+
@@ -319,7 +765,7 @@ func (a *advert) message(rib map[netip.Addr]bool) update {
 	update = append(update, wd[:]...)
 	update = append(update, withdrawn4...)
 
-	if len(advertise4) > 0 || len(advertise6) > 0 || len(withdrawn6) > 0 {
+	if advertised || len(unreach) > 0 {
 		pa := htons(uint16(len(path_attributes)))
 		update = append(update, pa[:]...)
 		update = append(update, path_attributes...)
@@ -328,7 +774,7 @@ func (a *advert) message(rib map[netip.Addr]bool) update {
 		update = append(update, 0, 0) // total path attribute length 0
 	}
 
-	return update
+	return update, nil
 }
 
 func asPath(asn uint16, external bool) (as_path []byte) {
@@ -361,6 +807,117 @@ func asPath(asn uint16, external bool) (as_path []byte) {
 	return
 }
 
+func communities(c []Community) ([]byte, error) {
+
+	var communities []byte
+
+	for _, v := range c {
+		c := htonl(uint32(v))
+		communities = append(communities, c[:]...)
+	}
+
+	if len(communities) > 65535 {
+		// won't fit in an extended length attribute (and certainly not in a 4096 byte message)
+		return nil, errors.New("COMMUNITIES attribute too long")
+	}
+
+	if len(communities) > 255 {
+		// (Optional, Transitive, Complete, Extended length), COMMUNITIES(8), n bytes
+		hilo := htons(uint16(len(communities)))
+		return append([]byte{OTCE, COMMUNITIES, hilo[0], hilo[1]}, communities...), nil
+	}
+
+	// (Optional, Transitive, Complete, Regular length), COMMUNITIES(8), n bytes
+	return append([]byte{OTCR, COMMUNITIES, uint8(len(communities))}, communities...), nil
+}
+
+func extendedCommunities(c []ExtendedCommunity) ([]byte, error) {
+
+	var communities []byte
+
+	for _, v := range c {
+		for i := 56; i >= 0; i -= 8 {
+			communities = append(communities, byte(v>>i))
+		}
+	}
+
+	if len(communities) > 65535 {
+		return nil, errors.New("EXTENDED_COMMUNITIES attribute too long")
+	}
+
+	if len(communities) > 255 {
+		// (Optional, Transitive, Complete, Extended length), EXTENDED_COMMUNITIES(16), n bytes
+		hilo := htons(uint16(len(communities)))
+		return append([]byte{OTCE, EXTENDED_COMMUNITIES, hilo[0], hilo[1]}, communities...), nil
+	}
+
+	// (Optional, Transitive, Complete, Regular length), EXTENDED_COMMUNITIES(16), n bytes
+	return append([]byte{OTCR, EXTENDED_COMMUNITIES, uint8(len(communities))}, communities...), nil
+}
+
+// https://datatracker.ietf.org/doc/html/rfc6793 - BGP Support for Four-Octet Autonomous System (AS) Number Space
+
+// An AS_PATH consisting of an arbitrary sequence of ASes. We don't
+// negotiate four-octet AS numbers, so any which won't fit into two
+// octets are replaced by AS_TRANS and the real path is sent in an
+// AS4_PATH attribute.
+func asPathSequence(path []uint32) (as_path, as4_path []byte) {
+	return asPathSegments(ASPath{{Type: AS_SEQUENCE, ASNs: path}})
+}
+
+// As asPathSequence, but for any combination of AS_SEQUENCE and AS_SET
+// segments - eg. a received path being re-advertised
+func asPathSegments(segments ASPath) (as_path, as4_path []byte) {
+
+	var as2, as4 []byte
+	var trans bool
+
+	for _, s := range segments {
+		for path := s.ASNs; len(path) > 0; {
+			n := len(path)
+
+			if n > 255 {
+				n = 255 // maximum number of ASes in a segment
+			}
+
+			as2 = append(as2, s.Type, byte(n))
+			as4 = append(as4, s.Type, byte(n))
+
+			for _, asn := range path[:n] {
+				a4 := htonl(asn)
+				as4 = append(as4, a4[:]...)
+
+				if asn > 65535 {
+					trans = true
+					asn = AS_TRANS
+				}
+
+				a2 := htons(uint16(asn))
+				as2 = append(as2, a2[:]...)
+			}
+
+			path = path[n:]
+		}
+	}
+
+	as_path = pathAttribute(WTCR, AS_PATH, as2)
+
+	if trans {
+		as4_path = pathAttribute(OTCR, AS4_PATH, as4)
+	}
+
+	return
+}
+
+// Uses the extended length form of the flags if the value won't fit into 255 bytes
+func pathAttribute(flags, code byte, value []byte) []byte {
+	if len(value) > 255 {
+		hilo := htons(uint16(len(value)))
+		return append([]byte{flags | 16, code, hilo[0], hilo[1]}, value...)
+	}
+	return append([]byte{flags, code, byte(len(value))}, value...)
+}
+
 func localPref(lp uint32) []byte {
 
 	local_pref := htonl(lp)
@@ -369,11 +926,32 @@ func localPref(lp uint32) []byte {
 	return append([]byte{WTCR, LOCAL_PREF, 4}, local_pref[:]...)
 }
 
+// Distinct map keys may encode to the same NLRI (eg. IPv6 addresses
+// which differ only by zone), so addresses are normalised and
+// de-duplicated. If the same prefix is both advertised and withdrawn
+// then the advertisement wins - it implicitly replaces any previous
+// route, so the prefix is present in the peer's RIB afterwards either
+// way, and it never appears twice in one message.
 func sortAdvertiseWithdrawn(m map[netip.Addr]bool) (advertise []netip.Addr, withdrawn []netip.Addr) {
+
+	adv := map[netip.Addr]bool{}
+	wdr := map[netip.Addr]bool{}
+
 	for k, v := range m {
+		k = k.Unmap().WithZone("")
 		if v {
-			advertise = append(advertise, k)
+			adv[k] = true
 		} else {
+			wdr[k] = true
+		}
+	}
+
+	for k, _ := range adv {
+		advertise = append(advertise, k)
+	}
+
+	for k, _ := range wdr {
+		if _, ok := adv[k]; !ok {
 			withdrawn = append(withdrawn, k)
 		}
 	}
@@ -384,9 +962,10 @@ func sortAdvertiseWithdrawn(m map[netip.Addr]bool) (advertise []netip.Addr, with
 	return
 }
 
+// IPv4-mapped IPv6 addresses are always encoded as IPv4
 func nlriByVersion(in []netip.Addr) (v4, v6 []byte) {
 	for _, a := range in {
-		if a.Is4() {
+		if a = a.Unmap(); a.Is4() {
 			i := a.As4()
 			l := append([]byte{32}, i[:]...) // 32 bit prefix & 4 bytes
 			v4 = append(v4, l...)
@@ -0,0 +1,96 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+// Implemented by the caller to adapt to a metrics library (eg. with
+// Prometheus' GaugeFunc and CounterFunc) so that this package does not
+// depend on any particular one. Values are read when collected.
+type MetricsRegisterer interface {
+	Gauge(name, help string, labels map[string]string, value func() float64)
+	Counter(name, help string, labels map[string]string, value func() float64)
+}
+
+var stateValue = map[string]float64{
+	IDLE:         0,
+	ACTIVE:       1,
+	CONNECT:      2,
+	OPEN_SENT:    3,
+	OPEN_CONFIRM: 4,
+	ESTABLISHED:  5,
+}
+
+// Register gauges and counters for the session, labelled with the
+// peer's address
+func (s *Session) RegisterMetrics(r MetricsRegisterer) {
+
+	labels := func(kv ...string) map[string]string {
+		l := map[string]string{"peer": s.peer}
+		for i := 0; i+1 < len(kv); i += 2 {
+			l[kv[i]] = kv[i+1]
+		}
+		return l
+	}
+
+	status := func(f func(Status) float64) func() float64 {
+		return func() float64 { return f(s.Status()) }
+	}
+
+	r.Gauge("bgp_session_state", "Session state (0 idle, 1 active, 2 connect, 3 open sent, 4 open confirm, 5 established)", labels(),
+		status(func(s Status) float64 { return stateValue[s.State] }))
+
+	r.Gauge("bgp_session_uptime_seconds", "Time since the session was established", labels(),
+		status(func(s Status) float64 {
+			if s.State != ESTABLISHED {
+				return 0
+			}
+			return float64(s.Duration) // already in seconds
+		}))
+
+	r.Gauge("bgp_prefixes_received", "Routes currently learned from the peer", labels(),
+		status(func(s Status) float64 { return float64(s.ReceivedPrefixes) }))
+
+	r.Gauge("bgp_prefixes_advertised", "Routes currently advertised to the peer", labels(),
+		status(func(s Status) float64 { return float64(s.Prefixes) }))
+
+	r.Gauge("bgp_last_error_timestamp_seconds", "Time of the last error, as a Unix timestamp", labels(),
+		status(func(s Status) float64 {
+			if s.LastErrorTime.IsZero() {
+				return 0
+			}
+			return float64(s.LastErrorTime.Unix())
+		}))
+
+	types := []struct {
+		name string
+		get  func(Messages) uint64
+	}{
+		{"open", func(m Messages) uint64 { return m.Open }},
+		{"update", func(m Messages) uint64 { return m.Update }},
+		{"notification", func(m Messages) uint64 { return m.Notification }},
+		{"keepalive", func(m Messages) uint64 { return m.Keepalive }},
+	}
+
+	for _, t := range types {
+		get := t.get
+		r.Counter("bgp_messages_received_total", "Messages received from the peer", labels("type", t.name),
+			status(func(s Status) float64 { return float64(get(s.MessagesReceived)) }))
+		r.Counter("bgp_messages_sent_total", "Messages sent to the peer", labels("type", t.name),
+			status(func(s Status) float64 { return float64(get(s.MessagesSent)) }))
+	}
+}
@@ -0,0 +1,84 @@
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+type series struct {
+	counter bool
+	value   func() float64
+}
+
+type registry map[string]series
+
+func (r registry) key(name string, labels map[string]string) string {
+	return name + "{peer=" + labels["peer"] + ",type=" + labels["type"] + "}"
+}
+
+func (r registry) Gauge(name, help string, labels map[string]string, value func() float64) {
+	r[r.key(name, labels)] = series{value: value}
+}
+
+func (r registry) Counter(name, help string, labels map[string]string, value func() float64) {
+	r[r.key(name, labels)] = series{counter: true, value: value}
+}
+
+func TestRegisterMetrics(t *testing.T) {
+
+	s := &Session{peer: "10.1.1.1"}
+	r := registry{}
+
+	s.RegisterMetrics(r)
+
+	if len(r) != 13 {
+		t.Fatalf("Expected 13 series: %v", r)
+	}
+
+	get := func(name, typ string, counter bool) float64 {
+		m, ok := r[r.key(name, map[string]string{"peer": "10.1.1.1", "type": typ})]
+		if !ok || m.counter != counter {
+			t.Fatalf("Series not registered: %s %s", name, typ)
+		}
+		return m.value()
+	}
+
+	s.established(90, 65000, 65001)
+	s.received(M_OPEN)
+	s.received(M_UPDATE)
+	s.received(M_UPDATE)
+	s.sent(M_KEEPALIVE)
+	s.receive([]ReceivedRoute{{Route: Route{Prefix: netip.MustParsePrefix("10.0.0.0/24")}}}, nil)
+	s.update_stats(0, []netip.Addr{ipv4_0, ipv4_1}, nil)
+
+	if v := get("bgp_session_state", "", false); v != 5 {
+		t.Errorf("State incorrect: %v", v)
+	}
+
+	if v := get("bgp_messages_received_total", "update", true); v != 2 {
+		t.Errorf("UPDATEs received incorrect: %v", v)
+	}
+
+	if v := get("bgp_messages_sent_total", "keepalive", true); v != 1 {
+		t.Errorf("KEEPALIVEs sent incorrect: %v", v)
+	}
+
+	if v := get("bgp_prefixes_received", "", false); v != 1 {
+		t.Errorf("Prefixes received incorrect: %v", v)
+	}
+
+	if v := get("bgp_prefixes_advertised", "", false); v != 2 {
+		t.Errorf("Prefixes advertised incorrect: %v", v)
+	}
+
+	if v := get("bgp_last_error_timestamp_seconds", "", false); v != 0 {
+		t.Errorf("No error should have occurred: %v", v)
+	}
+
+	s.error("Hold timer expired")
+
+	if v := get("bgp_last_error_timestamp_seconds", "", false); v < float64(time.Now().Add(-time.Minute).Unix()) {
+		t.Errorf("Error timestamp incorrect: %v", v)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+// https://datatracker.ietf.org/doc/html/rfc4760 - Multiprotocol Extensions for BGP-4
+// https://datatracker.ietf.org/doc/html/rfc8950 - Advertising IPv4 NLRI with an IPv6 Next Hop
+
+import (
+	"errors"
+)
+
+const EXTENDED_NEXT_HOP = 5 // capability code
+
+// The only encoding we offer: IPv4 unicast NLRI with an IPv6 next hop
+// NLRI AFI[2], NLRI SAFI[2], Nexthop AFI[2]
+func extendedNextHop() capability {
+	return capability{code: EXTENDED_NEXT_HOP, value: []byte{0, 1, 0, 1, 0, 2}}
+}
+
+func peerExtendedNextHop(caps []capability) bool {
+	for _, c := range caps {
+		if c.code != EXTENDED_NEXT_HOP {
+			continue
+		}
+		for v := c.value; len(v) >= 6; v = v[6:] {
+			if v[1] == 1 && v[3] == 1 && v[5] == 2 && v[0] == 0 && v[2] == 0 && v[4] == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Length of the next hop in MP_REACH_NLRI: an IPv6 global address, or
+// global and link-local pair (RFC 2545), which RFC 8950 also allows
+// for IPv4 NLRI as an alternative to a 4 octet IPv4 address
+func validNextHop(f family, length int) bool {
+	switch {
+	case f == IPV4_UNICAST:
+		return length == 4 || length == 16 || length == 32
+	case f == IPV6_UNICAST:
+		return length == 16 || length == 32
+	}
+	return false
+}
+
+// Next hop for IPv4 NLRI carried in MP_REACH_NLRI
+func (a *advert) nextHopMP4() ([]byte, error) {
+
+	var nh []byte
+
+	switch a.nextHopLength4 {
+	case 0, 4:
+		nh = a.NextHop[:]
+	case 16:
+		var nul6 [16]byte
+		if a.NextHop6 == nul6 {
+			return nil, errors.New("No IPv6 next hop for IPv4 prefixes")
+		}
+		nh = a.NextHop6[:]
+	}
+
+	if !validNextHop(IPV4_UNICAST, len(nh)) {
+		return nil, errors.New("Invalid next hop length for IPv4 unicast")
+	}
+
+	return nh, nil
+}
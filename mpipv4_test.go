@@ -0,0 +1,110 @@
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestMultiprotocolIPv4NextHop(t *testing.T) {
+
+	nh6 := netip.MustParseAddr("2001:db8::1")
+
+	a := advert{ASNumber: 65000, PeerASNumber: 65001, NextHop: [4]byte{10, 1, 2, 3}, NextHop6: nh6.As16(), mpIPv4: true}
+
+	for _, c := range []struct {
+		length  int
+		nexthop netip.Addr
+	}{
+		{4, netip.MustParseAddr("10.1.2.3")},
+		{16, nh6},
+	} {
+		a.nextHopLength4 = c.length
+
+		m, err := a.message(map[netip.Addr]bool{ipv4_0: true})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// no withdrawn routes, and no NLRI outside of MP_REACH_NLRI
+		if m[0] != 0 || m[1] != 0 || int(m[2])<<8|int(m[3]) != len(m)-4 {
+			t.Error("IPv4 prefixes should only be in MP_REACH_NLRI:", c.length)
+		}
+
+		d, n := decodeUpdate(m.Body())
+
+		if n != nil {
+			t.Fatal(n)
+		}
+
+		if len(d.advertised) != 1 || d.advertised[0] != hostRoute(ipv4_0) {
+			t.Error("Prefix not advertised:", c.length, d.advertised)
+		}
+
+		if nh := d.nextHopFor(hostRoute(ipv4_0)); nh != c.nexthop || d.treatAsWithdraw {
+			t.Error("Unexpected next hop:", c.length, nh)
+		}
+	}
+
+	a.nextHopLength4 = 8
+
+	if _, err := a.message(map[netip.Addr]bool{ipv4_0: true}); err == nil {
+		t.Error("Invalid next hop length should be rejected")
+	}
+
+	// withdrawals go in MP_UNREACH_NLRI
+	m, _ := a.message(map[netip.Addr]bool{ipv4_0: false})
+
+	if d, _ := decodeUpdate(m.Body()); m[0] != 0 || m[1] != 0 || len(d.withdrawn) != 1 {
+		t.Error("IPv4 prefix should be withdrawn in MP_UNREACH_NLRI:", d.withdrawn)
+	}
+}
+
+func TestValidNextHop(t *testing.T) {
+
+	if !validNextHop(IPV4_UNICAST, 4) || !validNextHop(IPV4_UNICAST, 16) || validNextHop(IPV4_UNICAST, 8) {
+		t.Error("IPv4 unicast next hop lengths")
+	}
+
+	if validNextHop(IPV6_UNICAST, 4) || !validNextHop(IPV6_UNICAST, 32) {
+		t.Error("IPv6 unicast next hop lengths")
+	}
+
+	if !peerExtendedNextHop([]capability{extendedNextHop()}) || peerExtendedNextHop([]capability{{code: EXTENDED_NEXT_HOP, value: []byte{0, 2, 0, 1, 0, 1}}}) {
+		t.Error("Extended next hop capability")
+	}
+}
+
+func TestMultiprotocolIPv4Families(t *testing.T) {
+
+	a := advert{ASNumber: 65000, PeerASNumber: 65001, NextHop: [4]byte{10, 1, 2, 3}, NextHop6: netip.MustParseAddr("2001:db8::1").As16(),
+		Multiprotocol: true, mpIPv4: true, nextHopLength4: 4}
+
+	for _, v := range []bool{true, false} {
+
+		var advertised, withdrawn int
+
+		for _, m := range a.updates(map[netip.Addr]bool{ipv4_0: v, ipv4_1: v, ipv6_0: v, ipv6_1: v}) {
+			if n := len(findAttribute(m.Body(), MP_REACH_NLRI)); n > 1 {
+				t.Error("MP_REACH_NLRI should appear at most once:", n)
+			}
+
+			if n := len(findAttribute(m.Body(), MP_UNREACH_NLRI)); n > 1 {
+				t.Error("MP_UNREACH_NLRI should appear at most once:", n)
+			}
+
+			d, n := decodeUpdate(m.Body())
+
+			if n != nil {
+				t.Fatal(n)
+			}
+
+			advertised += len(d.advertised)
+			withdrawn += len(d.withdrawn)
+		}
+
+		if (v && advertised != 4) || (!v && withdrawn != 4) {
+			t.Error("All prefixes should be sent:", v, advertised, withdrawn)
+		}
+	}
+}
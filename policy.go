@@ -0,0 +1,519 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"net/netip"
+	"reflect"
+)
+
+// Path attributes associated with a route. Zero values are treated
+// as "not present".
+type Attributes struct {
+	Origin      uint8       `json:"origin"`
+	ASPath      ASPath      `json:"as_path,omitempty"` // four-octet ASes, with any AS4_PATH merged
+	NextHop     netip.Addr  `json:"next_hop,omitempty"`
+	MED         uint32      `json:"med,omitempty"`
+	LocalPref   uint32      `json:"local_pref,omitempty"`
+	Communities []Community `json:"communities,omitempty"`
+
+	ExtendedCommunities []ExtendedCommunity `json:"extended_communities,omitempty"`
+	LargeCommunities    []LargeCommunity    `json:"large_communities,omitempty"`
+
+	// The route is an aggregate which may not be de-aggregated, so
+	// this must be preserved if the route is re-advertised
+	AtomicAggregate bool `json:"atomic_aggregate,omitempty"`
+
+	Aggregator *Aggregator `json:"aggregator,omitempty"`
+
+	OTC uint32 `json:"otc,omitempty"` // Only to Customer (RFC 9234)
+}
+
+// The AS and BGP identifier of the speaker that formed an aggregate
+type Aggregator struct {
+	AS      uint32     `json:"as"`
+	Address netip.Addr `json:"address"`
+}
+
+type Route struct {
+	Prefix netip.Prefix `json:"prefix"`
+	Attributes
+	Learned bool `json:"learned,omitempty"` // received from a peer rather than originated locally
+}
+
+// A route-map style policy: rules are evaluated in order and the first
+// rule whose match conditions are all met decides the fate of the
+// route - it is either rejected (Deny) or accepted with the rule's set
+// actions applied. If no rule matches then the route is accepted
+// unmodified.
+type PolicyRule struct {
+	Match PolicyMatch `json:"match,omitempty"`
+	Set   PolicySet   `json:"set,omitempty"`
+	Deny  bool        `json:"deny,omitempty"`
+
+	// Import only: accept the route even if our own AS is in the
+	// AS_PATH, which would otherwise be dropped as a loop
+	AllowASLoop bool `json:"allow_as_loop,omitempty"`
+}
+
+// Empty conditions always match.
+type PolicyMatch struct {
+	Prefixes    []netip.Prefix `json:"prefixes,omitempty"`    // prefix is contained in any of these
+	Communities []Community    `json:"communities,omitempty"` // route carries any of these
+	ASPath      *ASPathMatch   `json:"as_path,omitempty"`     // AS_PATH matches regular expression
+
+	ExtendedCommunities []ExtendedCommunity `json:"extended_communities,omitempty"` // route carries any of these
+	LargeCommunities    []LargeCommunity    `json:"large_communities,omitempty"`    // route carries any of these
+
+	CommunityPatterns []CommunityPattern `json:"community_patterns,omitempty"` // route carries a match for any of these
+}
+
+// Zero values leave the attribute unchanged.
+type PolicySet struct {
+	LocalPref         uint32      `json:"local_pref,omitempty"`
+	MED               uint32      `json:"med,omitempty"`
+	NextHop           netip.Addr  `json:"next_hop,omitempty"`
+	AddCommunities    []Community `json:"add_communities,omitempty"`
+	DeleteCommunities []Community `json:"delete_communities,omitempty"`
+	Origin            string      `json:"origin,omitempty"` // see ORIGIN_IGP
+
+	// The first AS in the AS_PATH is repeated this many more times -
+	// on export to an external peer this is our own AS (the path sent
+	// to an internal peer is empty, so nothing is prepended)
+	PrependASPath int `json:"prepend_as_path,omitempty"`
+}
+
+const (
+	ORIGIN_UNCHANGED  = ""
+	ORIGIN_IGP        = "igp"
+	ORIGIN_EGP        = "egp"
+	ORIGIN_INCOMPLETE = "incomplete"
+)
+
+func (m *PolicyMatch) match(r Route) bool {
+
+	if len(m.Prefixes) > 0 && !prefixListMatch(m.Prefixes, r.Prefix) {
+		return false
+	}
+
+	if len(m.Communities) > 0 && !communityMatch(m.Communities, r.Communities) {
+		return false
+	}
+
+	if m.ASPath != nil && !m.ASPath.Match(r.ASPath) {
+		return false
+	}
+
+	if len(m.ExtendedCommunities) > 0 && !extendedCommunityMatch(m.ExtendedCommunities, r.ExtendedCommunities) {
+		return false
+	}
+
+	if len(m.LargeCommunities) > 0 && !largeCommunityMatch(m.LargeCommunities, r.LargeCommunities) {
+		return false
+	}
+
+	if len(m.CommunityPatterns) > 0 && !communityPatternMatch(m.CommunityPatterns, r.Attributes) {
+		return false
+	}
+
+	return true
+}
+
+func prefixListMatch(list []netip.Prefix, p netip.Prefix) bool {
+	for _, n := range list {
+		if n.Bits() <= p.Bits() && n.Contains(p.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+func communityMatch(want, have []Community) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if w == h {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func extendedCommunityMatch(want, have []ExtendedCommunity) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if w == h {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func largeCommunityMatch(want, have []LargeCommunity) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if w == h {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The ORIGIN attribute value for one of ORIGIN_IGP, etc., or o if
+// unchanged
+func originCode(s string, o uint8) uint8 {
+	switch s {
+	case ORIGIN_IGP:
+		return IGP
+	case ORIGIN_EGP:
+		return EGP
+	case ORIGIN_INCOMPLETE:
+		return INCOMPLETE
+	}
+	return o
+}
+
+func (s *PolicySet) apply(r Route) Route {
+
+	if s.LocalPref != 0 {
+		r.LocalPref = s.LocalPref
+	}
+
+	if s.MED != 0 {
+		r.MED = s.MED
+	}
+
+	if s.NextHop.IsValid() {
+		r.NextHop = s.NextHop
+	}
+
+	r.Origin = originCode(s.Origin, r.Origin)
+
+	if asn := r.ASPath.Neighbour(); asn != 0 {
+		for i := 0; i < s.PrependASPath; i++ {
+			r.ASPath = r.ASPath.Prepend(asn)
+		}
+	}
+
+	if len(s.AddCommunities) > 0 || len(s.DeleteCommunities) > 0 {
+		var communities []Community // create a new slice so that the original is not modified
+
+		for _, c := range r.Communities {
+			if !communityMatch([]Community{c}, s.DeleteCommunities) {
+				communities = append(communities, c)
+			}
+		}
+
+		for _, c := range s.AddCommunities {
+			if !communityMatch([]Community{c}, communities) {
+				communities = append(communities, c)
+			}
+		}
+
+		r.Communities = communities
+	}
+
+	return r
+}
+
+func evaluate(rules []PolicyRule, r Route) (Route, bool) {
+	if rule := first(rules, r); rule != nil {
+		if rule.Deny {
+			return r, false
+		}
+		return rule.Set.apply(r), true
+	}
+	return r, true
+}
+
+// The first rule which matches the route, if any
+func first(rules []PolicyRule, r Route) *PolicyRule {
+	for i := range rules {
+		if rules[i].Match.match(r) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+func policyDiff(a, b []PolicyRule) bool {
+	return !reflect.DeepEqual(a, b)
+}
+
+// Apply import policy to a received route. Routes with our own AS in
+// the AS_PATH are dropped (RFC 4271 9.1.2) unless the matching rule
+// has AllowASLoop set.
+func (p *Parameters) importRoute(r Route) (Route, bool) {
+
+	if p.ASNumber != 0 && r.ASPath.Contains(uint32(p.ASNumber)) {
+		if rule := first(p.Import, r); rule == nil || !rule.AllowASLoop {
+			return r, false
+		}
+	}
+
+	return evaluate(p.Import, r)
+}
+
+// Returns false if export policy denies the prefix, or if it would be
+// tagged NOPEER and the neighbour is a bilateral peer (RFC 3765)
+func (p *Parameters) exported(ip netip.Addr) bool {
+
+	if p.AdvertiseLearnedOnly {
+		return false // prefixes in the RIB are locally originated
+	}
+
+	// as sent - see withParameters
+	attr := Attributes{Origin: originCode(p.Origin, IGP), MED: p.MED, LocalPref: p.LocalPref, Communities: p.Communities, ExtendedCommunities: p.ExtendedCommunities}
+	r, ok := evaluate(p.Export, Route{Prefix: hostRoute(ip), Attributes: attr})
+
+	if ok && p.PeerType == PEER_TYPE_PEER && communityMatch([]Community{NOPEER}, r.Communities) {
+		return false
+	}
+
+	return ok
+}
+
+func hostRoute(a netip.Addr) netip.Prefix {
+	return netip.PrefixFrom(a, a.BitLen())
+}
+
+// Attributes that would be sent for a prefix in the absence of any policy
+func (a *advert) attributes(ip netip.Addr) Attributes {
+
+	nh := netip.AddrFrom4(a.NextHop)
+
+	if ip.Is6() {
+		nh = netip.AddrFrom16(a.NextHop6)
+	}
+
+	var path ASPath
+
+	if a.path != nil {
+		if len(a.path) > 0 {
+			path = ASPath{{Type: AS_SEQUENCE, ASNs: a.path}}
+		}
+	} else if a.external() {
+		path = ASPath{{Type: AS_SEQUENCE, ASNs: []uint32{uint32(a.ASNumber)}}}
+	}
+
+	var lp uint32
+
+	if a.includeLocalPref() {
+		lp = a.localPref() // LOCAL_PREF is only sent to internal peers
+	}
+
+	attr := Attributes{
+		Origin:          a.origin,
+		ASPath:          path,
+		NextHop:         nh,
+		MED:             a.MED,
+		LocalPref:       lp,
+		Communities:     a.Communities,
+		AtomicAggregate: a.atomicAggregate,
+		OTC:             a.otc,
+
+		ExtendedCommunities: a.extendedCommunities,
+	}
+
+	if a.localPrefFunc != nil && a.includeLocalPref() {
+		if lp := a.localPrefFunc(Route{Prefix: hostRoute(ip), Attributes: attr}); lp != 0 {
+			attr.LocalPref = lp
+		}
+	}
+
+	return attr
+}
+
+// A template with the attributes set by export policy
+func (a *advert) withAttributes(attr Attributes) (r advert) {
+	r = *a
+	r.MED = attr.MED
+	r.origin = attr.Origin
+	r.localpref = attr.LocalPref
+	r.Communities = attr.Communities
+	r.extendedCommunities = attr.ExtendedCommunities
+
+	// policy can't clear this - the route must not be made more specific
+	r.atomicAggregate = a.atomicAggregate || attr.AtomicAggregate
+
+	if attr.OTC != 0 {
+		r.otc = attr.OTC // never replaced once set
+	}
+
+	// next hop is only taken from the route if not forced by the session
+	if attr.NextHop.Is4() && a.nextHopMode4 != NEXT_HOP_SELF && a.nextHopMode4 != NEXT_HOP_REWRITE {
+		r.NextHop = attr.NextHop.As4()
+	} else if attr.NextHop.Is6() && a.nextHopMode6 != NEXT_HOP_SELF && a.nextHopMode6 != NEXT_HOP_REWRITE {
+		r.NextHop6 = attr.NextHop.As16()
+	}
+
+	return
+}
+
+// A template to re-advertise a received route with its attributes,
+// preserving the AS_PATH (including any AS_SET) and MED, and adding
+// our AS for an external peer. A MED received from a neighbouring AS
+// must not be propagated to other ASes (RFC 4271 5.1.4), so external
+// peers get the session's MED instead - see egressMED() - and the
+// session's next hop unless NEXT_HOP_UNCHANGED is set.
+func (a *advert) relay(attr Attributes) (r advert) {
+	r = a.withAttributes(attr)
+	r.origin = attr.Origin
+	r.relayed = ASPath{}
+	r.extendedCommunities = a.extendedCommunities // received extended communities are not relayed
+
+	if len(attr.ASPath) > 0 {
+		r.relayed = attr.ASPath
+	}
+
+	if a.external() {
+		r.relayed = r.relayed.Prepend(uint32(a.ASNumber))
+		r.MED = a.MED
+
+		// RFC 4271 5.1.3: external peers get our next hop unless the
+		// received one is to be left unchanged
+		if a.nextHopMode4 != NEXT_HOP_UNCHANGED {
+			r.NextHop = a.NextHop
+		}
+		if a.nextHopMode6 != NEXT_HOP_UNCHANGED {
+			r.NextHop6 = a.NextHop6
+		}
+	}
+
+	return
+}
+
+// The MED sent to an external peer for a relayed route: the session's
+// MED (zero if StripMED is set) as modified by export policy
+func (a *advert) egressMED(ip netip.Addr, attr Attributes) uint32 {
+	attr.MED = a.MED
+	if r, ok := evaluate(a.export, Route{Prefix: hostRoute(ip), Attributes: attr}); ok {
+		return r.MED
+	}
+	return a.MED
+}
+
+// Whether the peer takes locally originated or learned routes - see
+// Parameters.AdvertiseSelfOnly
+func (a *advert) originated(r Route) bool {
+	if r.Learned {
+		return !a.selfOnly
+	}
+	return !a.learnedOnly
+}
+
+// A received route tagged NO_ADVERTISE must not be re-advertised to any
+// peer, and one tagged NO_EXPORT only to internal peers (RFC 1997).
+// Routes carrying OTC are subject to RFC 9234 egress rules.
+func (a *advert) advertisable(attr Attributes) bool {
+
+	if communityMatch([]Community{NO_ADVERTISE}, attr.Communities) {
+		return false
+	}
+
+	if a.external() && communityMatch([]Community{NO_EXPORT}, attr.Communities) {
+		return false
+	}
+
+	return !a.leak(attr)
+}
+
+type group struct {
+	advert advert
+	nlri   map[netip.Addr]bool
+}
+
+// Split the NLRI into sets which share the same path attributes after
+// export policy (and Parameters.LocalPrefFunc) has been applied. The
+// classic NEXT_HOP attribute applies to all IPv4 NLRI in a message, so
+// prefixes with different next hops are never sent together. Withdrawn
+// prefixes need no attributes, so they remain with the default template.
+func (a *advert) groups(nlri map[netip.Addr]bool) (groups []group) {
+
+	if len(a.export) < 1 && a.localPrefFunc == nil && a.backupAttr == nil {
+		return []group{{advert: *a, nlri: nlri}}
+	}
+
+	base := group{advert: *a, nlri: map[netip.Addr]bool{}}
+
+	for ip, v := range nlri {
+
+		if !v {
+			base.nlri[ip] = false
+			continue
+		}
+
+		attr := a.attributes(ip)
+		backup := a.backupFor(ip)
+
+		if backup {
+			attr = a.backupAttributes(attr)
+		}
+
+		r, _ := evaluate(a.export, Route{Prefix: hostRoute(ip), Attributes: attr})
+
+		u := a.withAttributes(r.Attributes)
+
+		if backup && a.external() {
+			u.path = a.backupPath()
+		}
+
+		if a.external() && !reflect.DeepEqual(r.ASPath, attr.ASPath) {
+			if path, ok := r.ASPath.sequence(); ok {
+				u.path = path // prepended by export policy
+			}
+		}
+
+		var found bool
+
+		for _, g := range groups {
+			if g.advert.sameAttributes(&u) {
+				g.nlri[ip] = true
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			groups = append(groups, group{advert: u, nlri: map[netip.Addr]bool{ip: true}})
+		}
+	}
+
+	if len(base.nlri) > 0 {
+		groups = append(groups, base)
+	}
+
+	return
+}
+
+func (a *advert) sameAttributes(b *advert) bool {
+	return a.NextHop == b.NextHop &&
+		a.NextHop6 == b.NextHop6 &&
+		a.MED == b.MED &&
+		a.origin == b.origin &&
+		a.localpref == b.localpref &&
+		a.atomicAggregate == b.atomicAggregate &&
+		a.otc == b.otc &&
+		reflect.DeepEqual(a.Communities, b.Communities) &&
+		reflect.DeepEqual(a.extendedCommunities, b.extendedCommunities) &&
+		reflect.DeepEqual(a.relayed, b.relayed) &&
+		reflect.DeepEqual(a.path, b.path)
+}
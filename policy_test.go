@@ -0,0 +1,374 @@
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPolicyImport(t *testing.T) {
+
+	p := Parameters{
+		Import: []PolicyRule{
+			{
+				Match: PolicyMatch{Communities: []Community{65000<<16 | 100}},
+				Set:   PolicySet{LocalPref: 200, AddCommunities: []Community{65000<<16 | 999}},
+			},
+		},
+	}
+
+	r := Route{
+		Prefix:     netip.MustParsePrefix("10.0.0.0/24"),
+		Attributes: Attributes{LocalPref: 100, Communities: []Community{65000<<16 | 100}},
+	}
+
+	i, ok := p.importRoute(r)
+
+	if !ok || i.LocalPref != 200 {
+		t.Fatalf("Import rule should set LOCAL_PREF to 200: %v", i)
+	}
+
+	if len(i.Communities) != 2 || i.Communities[1] != 65000<<16|999 {
+		t.Fatalf("Import rule should add community: %v", i.Communities)
+	}
+
+	if len(r.Communities) != 1 {
+		t.Fatalf("Original route should not be modified: %v", r.Communities)
+	}
+
+	r.Communities = []Community{65000<<16 | 200}
+
+	if i, ok = p.importRoute(r); !ok || i.LocalPref != 100 {
+		t.Fatalf("Unmatched route should be accepted unmodified: %v", i)
+	}
+}
+
+func TestPolicyExport(t *testing.T) {
+
+	p := Parameters{
+		Export: []PolicyRule{
+			{
+				Match: PolicyMatch{Prefixes: []netip.Prefix{netip.MustParsePrefix("192.168.101.0/31")}},
+				Deny:  true,
+			},
+			{
+				Set: PolicySet{MED: 50},
+			},
+		},
+	}
+
+	ipv4_2 := netip.MustParseAddr("192.168.101.2")
+
+	pass := p.filter(false, []netip.Addr{ipv4_0, ipv4_1, ipv4_2})
+
+	if !addrSliceEqual(pass, []netip.Addr{ipv4_2}) {
+		t.Fatalf("Export deny rule not applied: %v", pass)
+	}
+
+	a := advert{ASNumber: 65000, PeerASNumber: 65000, MED: 10}
+	u := a.withParameters(p, 65000)
+
+	groups := u.groups(map[netip.Addr]bool{ipv4_2: true, ipv4_0: false})
+
+	if len(groups) != 2 {
+		t.Fatalf("Expected two groups: %v", groups)
+	}
+
+	if groups[0].advert.MED != 50 || !groups[0].nlri[ipv4_2] {
+		t.Fatalf("Export set action not applied: %v", groups[0])
+	}
+
+	if v, ok := groups[1].nlri[ipv4_0]; !ok || v {
+		t.Fatalf("Withdrawal not in base group: %v", groups[1])
+	}
+}
+
+// returns the values of path attributes of type t in an UPDATE message body
+func findAttribute(u []byte, t byte) (ret [][]byte) {
+	w := int(u[0])<<8 | int(u[1])
+	u = u[2+w:]
+	l := int(u[0])<<8 | int(u[1])
+	a := u[2 : 2+l]
+
+	for len(a) > 0 {
+		flags, code := a[0], a[1]
+		var n, h int
+		if flags&16 != 0 {
+			n, h = int(a[2])<<8|int(a[3]), 4
+		} else {
+			n, h = int(a[2]), 3
+		}
+		if code == t {
+			ret = append(ret, a[h:h+n])
+		}
+		a = a[h+n:]
+	}
+
+	return
+}
+
+func TestNextHopMode(t *testing.T) {
+
+	p := Parameters{
+		Multiprotocol: true,
+		NextHopMode4:  NEXT_HOP_SELF,
+		NextHopMode6:  NEXT_HOP_UNCHANGED,
+		Export: []PolicyRule{
+			{Set: PolicySet{NextHop: netip.MustParseAddr("10.2.2.2")}, Match: PolicyMatch{Prefixes: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}}},
+			{Set: PolicySet{NextHop: netip.MustParseAddr("fd00::2")}},
+		},
+	}
+
+	a := advert{
+		ASNumber:      65000,
+		PeerASNumber:  65000,
+		Multiprotocol: true,
+		NextHop:       [4]byte{10, 9, 9, 9},
+		NextHop6:      netip.MustParseAddr("fd00::9").As16(),
+		self4:         [4]byte{10, 1, 1, 1},
+		self6:         netip.MustParseAddr("fd00::1").As16(),
+	}
+
+	u := a.withParameters(p, 65000)
+
+	var nh4, nh6 [][]byte
+
+	for _, m := range u.updates(map[netip.Addr]bool{ipv4_0: true, ipv6_0: true}) {
+		nh4 = append(nh4, findAttribute(m.Body(), NEXT_HOP)...)
+		for _, mp := range findAttribute(m.Body(), MP_REACH_NLRI) {
+			nh6 = append(nh6, mp[4:4+mp[3]])
+		}
+	}
+
+	if len(nh4) < 1 {
+		t.Fatalf("No IPv4 NEXT_HOP found")
+	}
+
+	for _, nh := range nh4 {
+		if !byteSliceEqual(nh, []byte{10, 1, 1, 1}) {
+			t.Fatalf("IPv4 next hop should be self: %v", nh)
+		}
+	}
+
+	want6 := netip.MustParseAddr("fd00::2").As16()
+
+	if len(nh6) != 1 || !byteSliceEqual(nh6[0], want6[:]) {
+		t.Fatalf("IPv6 next hop should be unchanged: %v", nh6)
+	}
+}
+
+func TestNoPeer(t *testing.T) {
+
+	p := Parameters{
+		Export: []PolicyRule{
+			{
+				Match: PolicyMatch{Prefixes: []netip.Prefix{netip.MustParsePrefix("192.168.101.0/31")}},
+				Set:   PolicySet{AddCommunities: []Community{NOPEER}},
+			},
+		},
+	}
+
+	ipv4_2 := netip.MustParseAddr("192.168.101.2")
+	rib := []netip.Addr{ipv4_0, ipv4_1, ipv4_2}
+
+	p.PeerType = PEER_TYPE_CUSTOMER
+
+	if pass := p.filter(false, rib); !addrSliceEqual(pass, rib) {
+		t.Errorf("NOPEER routes should be advertised to a customer: %v", pass)
+	}
+
+	p.PeerType = PEER_TYPE_PEER
+
+	if pass := p.filter(false, rib); !addrSliceEqual(pass, []netip.Addr{ipv4_2}) {
+		t.Errorf("NOPEER routes should be suppressed to a peer: %v", pass)
+	}
+
+	p = Parameters{PeerType: PEER_TYPE_PEER, Communities: []Community{NOPEER}}
+
+	if pass := p.filter(false, rib); len(pass) != 0 {
+		t.Errorf("NOPEER session communities should suppress all routes to a peer: %v", pass)
+	}
+}
+
+func TestOrigin(t *testing.T) {
+
+	prefix := netip.MustParsePrefix("10.0.0.0/24")
+
+	igp := ReceivedRoute{Route: Route{Prefix: prefix, Attributes: Attributes{Origin: IGP}}, Peer: netip.MustParseAddr("10.1.1.2")}
+	egp := ReceivedRoute{Route: Route{Prefix: prefix, Attributes: Attributes{Origin: EGP}}, Peer: netip.MustParseAddr("10.1.1.1")}
+	inc := ReceivedRoute{Route: Route{Prefix: prefix, Attributes: Attributes{Origin: INCOMPLETE}}, Peer: netip.MustParseAddr("10.1.1.0")}
+
+	if BestPath([]ReceivedRoute{inc, egp, igp}) != 2 || BestPath([]ReceivedRoute{inc, egp}) != 1 {
+		t.Error("Route selection should prefer IGP < EGP < INCOMPLETE")
+	}
+
+	p := Parameters{
+		Import: []PolicyRule{
+			{Set: PolicySet{Origin: ORIGIN_INCOMPLETE}},
+		},
+	}
+
+	r, ok := p.importRoute(igp.Route)
+
+	if !ok || r.Origin != INCOMPLETE {
+		t.Fatalf("Set action should change ORIGIN: %v", r)
+	}
+
+	igp.Route = r
+
+	if BestPath([]ReceivedRoute{igp, egp}) != 1 {
+		t.Error("Rewritten ORIGIN should be used in route selection")
+	}
+
+	// export
+	a := advert{ASNumber: 65000, PeerASNumber: 65000, NextHop: [4]byte{10, 1, 2, 3}, export: []PolicyRule{{Set: PolicySet{Origin: ORIGIN_EGP}}}}
+	g := a.groups(map[netip.Addr]bool{ipv4_0: true})
+
+	if len(g) != 1 {
+		t.Fatalf("Expected one group: %v", g)
+	}
+
+	msg, err := g[0].advert.message(g[0].nlri)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u, n := decodeUpdate(msg); n != nil || u.attributes.Origin != EGP {
+		t.Errorf("Export set action should change ORIGIN: %v %v", n, u.attributes)
+	}
+}
+
+func TestLocalPrefFunc(t *testing.T) {
+
+	weight := map[netip.Prefix]uint32{hostRoute(ipv4_0): 10, hostRoute(ipv4_1): 20}
+
+	p := Parameters{LocalPrefFunc: func(r Route) uint32 { return 100 + weight[r.Prefix] }}
+
+	a := advert{ASNumber: 65000, NextHop: [4]byte{10, 1, 2, 3}}
+	u := a.withParameters(p, 65000)
+
+	updates := u.updates(map[netip.Addr]bool{ipv4_0: true, ipv4_1: true})
+
+	if len(updates) != 2 {
+		t.Fatalf("Expected an UPDATE for each LOCAL_PREF: %d", len(updates))
+	}
+
+	lp := map[netip.Prefix]uint32{}
+
+	for _, m := range updates {
+		d, n := decodeUpdate(m.Body())
+		if n != nil {
+			t.Fatal(n)
+		}
+		for _, p := range d.advertised {
+			lp[p] = d.attributes.LocalPref
+		}
+	}
+
+	if lp[hostRoute(ipv4_0)] != 110 || lp[hostRoute(ipv4_1)] != 120 {
+		t.Errorf("LOCAL_PREF not derived from weights: %v", lp)
+	}
+
+	// not sent to external peers
+	if u = a.withParameters(p, 65001); len(u.updates(map[netip.Addr]bool{ipv4_0: true, ipv4_1: true})) != 1 {
+		t.Error("LOCAL_PREF should not split UPDATEs to an external peer")
+	}
+}
+
+func TestAllowASLoop(t *testing.T) {
+
+	re, _ := CompileASPathRegex(`^65001 65000 `)
+
+	p := Parameters{
+		ASNumber: 65000,
+		Import: []PolicyRule{
+			{Match: PolicyMatch{ASPath: re}, AllowASLoop: true, Set: PolicySet{LocalPref: 50}},
+		},
+	}
+
+	looped := Route{
+		Prefix:     netip.MustParsePrefix("10.9.0.0/24"),
+		Attributes: Attributes{ASPath: ASPath{{Type: AS_SEQUENCE, ASNs: []uint32{65002, 65000, 65003}}}},
+	}
+
+	if _, ok := p.importRoute(looped); ok {
+		t.Fatal("Route with our own AS in the path should be dropped")
+	}
+
+	// eg. a site of the same AS connected through a transit AS
+	looped.ASPath = ASPath{{Type: AS_SEQUENCE, ASNs: []uint32{65001, 65000, 65003}}}
+
+	if r, ok := p.importRoute(looped); !ok || r.LocalPref != 50 {
+		t.Fatalf("Policy should exempt the route from loop detection: %v %v", r, ok)
+	}
+
+	if _, ok := (&Parameters{ASNumber: 65000}).importRoute(looped); ok {
+		t.Fatal("Route should be dropped without the exemption")
+	}
+}
+
+func TestNextHopGroups(t *testing.T) {
+
+	p := Parameters{
+		Export: []PolicyRule{
+			{Set: PolicySet{NextHop: netip.MustParseAddr("10.2.2.2")}, Match: PolicyMatch{Prefixes: []netip.Prefix{hostRoute(ipv4_1)}}},
+		},
+	}
+
+	a := advert{ASNumber: 65000, PeerASNumber: 65000, NextHop: [4]byte{10, 9, 9, 9}}
+	u := a.withParameters(p, 65000)
+
+	nh := map[netip.Prefix]netip.Addr{}
+
+	updates := u.updates(map[netip.Addr]bool{ipv4_0: true, ipv4_1: true})
+
+	if len(updates) != 2 {
+		t.Fatalf("Prefixes with different next hops need separate UPDATEs: %d", len(updates))
+	}
+
+	for _, m := range updates {
+		d, n := decodeUpdate(m.Body())
+		if n != nil {
+			t.Fatal(n)
+		}
+		for _, p := range d.advertised {
+			nh[p] = d.nextHopFor(p)
+		}
+	}
+
+	if nh[hostRoute(ipv4_0)] != netip.MustParseAddr("10.9.9.9") || nh[hostRoute(ipv4_1)] != netip.MustParseAddr("10.2.2.2") {
+		t.Errorf("Wrong next hops: %v", nh)
+	}
+}
+
+func TestPolicyPrependASPath(t *testing.T) {
+
+	path := func(p Parameters, peer uint16) ASPath {
+		a := advert{ASNumber: 65000, NextHop: [4]byte{10, 1, 2, 3}}
+		u := a.withParameters(p, peer)
+		updates := u.updates(map[netip.Addr]bool{ipv4_0: true, ipv4_1: true})
+		if len(updates) != 1 {
+			t.Fatalf("Expected one UPDATE: %d", len(updates))
+		}
+		d, n := decodeUpdate(updates[0].Body())
+		if n != nil || len(d.advertised) != 2 {
+			t.Fatalf("Bad UPDATE: %v %v", n, d.advertised)
+		}
+		return d.attributes.ASPath
+	}
+
+	// prepend twice to a backup transit provider
+	backup := Parameters{Export: []PolicyRule{{Set: PolicySet{PrependASPath: 2}}}}
+
+	if p := path(Parameters{}, 65001); p.String() != "65000" {
+		t.Error("Unexpected AS_PATH:", p)
+	}
+
+	if p := path(backup, 65002); p.String() != "65000 65000 65000" {
+		t.Error("AS_PATH should be prepended:", p)
+	}
+
+	if p := path(backup, 65000); len(p) != 0 {
+		t.Error("Nothing should be prepended for an internal peer:", p)
+	}
+}
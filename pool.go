@@ -19,6 +19,7 @@
 package bgp
 
 import (
+	"context"
 	"net/netip"
 )
 
@@ -36,11 +37,18 @@ type status = map[string]Status
 
 type Pool struct {
 	c chan map[string]Parameters
-	r chan []IP
+	r chan []netip.Addr
 	s chan chan status
+	g chan closing
 	l BGPNotify
 }
 
+type closing struct {
+	ctx    context.Context
+	reason string
+	err    chan error
+}
+
 func (p *Pool) log() BGPNotify {
 	if l := p.l; l != nil {
 		return l
@@ -58,27 +66,30 @@ func (p *Pool) Configure(c map[string]Parameters) {
 	p.c <- c
 }
 
+// Each session derives the attributes appropriate to its peer (eg.
+// AS_PATH and LOCAL_PREF differ for iBGP and eBGP) from the one RIB
 func (p *Pool) RIB(r []netip.Addr) {
-	var f []IP
-
-	for _, a := range r {
-		if a.Is4() {
-			f = append(f, a.As4())
-		}
-	}
-
-	p.r <- f
+	p.r <- _rib(r).dup()
 }
 
 func (p *Pool) Close() {
 	close(p.c)
 }
 
-func dup(i []IP) (o []IP) {
-	for _, x := range i {
-		o = append(o, x)
+// Shut down all sessions (see Session.Shutdown) and close the pool,
+// eg. on SIGTERM. External peers are drained concurrently, so this
+// takes the longest of the peers' ShutdownDrain times, or until the
+// context is done. The pool can't be used afterwards.
+func (p *Pool) CloseGracefully(ctx context.Context, reason string) error {
+	c := closing{ctx: ctx, reason: reason, err: make(chan error, 1)}
+
+	select {
+	case p.g <- c:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return
+
+	return <-c.err
 }
 
 func NewPool(routerid IP, peers map[string]Parameters, rib []IP, log BGPNotify) *Pool {
@@ -86,13 +97,13 @@ func NewPool(routerid IP, peers map[string]Parameters, rib []IP, log BGPNotify)
 
 	var nul IP
 
-	rib = dup(rib) // create a local copy of the RIB
+	loc := toaddr(rib) // create a local copy of the RIB
 
 	if routerid == nul {
 		return nil
 	}
 
-	pool := &Pool{c: make(chan map[string]Parameters), r: make(chan []IP), s: make(chan chan status), l: log}
+	pool := &Pool{c: make(chan map[string]Parameters), r: make(chan []netip.Addr), s: make(chan chan status), g: make(chan closing), l: log}
 
 	go func() {
 
@@ -113,12 +124,16 @@ func NewPool(routerid IP, peers map[string]Parameters, rib []IP, log BGPNotify)
 				}
 				c <- s
 
+			case g := <-pool.g:
+				g.err <- shutdown(g.ctx, sessions, g.reason)
+				return
+
 			case r := <-pool.r:
 
-				rib = dup(r)
+				loc = r
 
 				for _, session := range sessions {
-					session.RIB(rib)
+					session.LocRIB(loc)
 				}
 
 			case i, ok := <-pool.c:
@@ -132,7 +147,7 @@ func NewPool(routerid IP, peers map[string]Parameters, rib []IP, log BGPNotify)
 						session.Configure(params)
 					} else {
 						pool.log().BGPPeer(peer, params, true)
-						sessions[peer] = NewSession(routerid, peer, params, rib, pool.log())
+						sessions[peer] = newSession(routerid, peer, params, loc, pool.log())
 					}
 				}
 
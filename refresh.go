@@ -0,0 +1,220 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+// https://datatracker.ietf.org/doc/html/rfc2918 - Route Refresh Capability for BGP-4
+// https://datatracker.ietf.org/doc/html/rfc7313 - Enhanced Route Refresh Capability for BGP-4
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+)
+
+const (
+	M_ROUTE_REFRESH = 5
+
+	ROUTE_REFRESH          = 2  // capability code
+	ENHANCED_ROUTE_REFRESH = 70 // capability code
+
+	// ROUTE-REFRESH message subtypes
+	REFRESH_REQUEST = 0
+	REFRESH_BORR    = 1 // Beginning of Route Refresh
+	REFRESH_EORR    = 2 // End of Route Refresh
+
+	INVALID_MESSAGE_LENGTH = 1 // ROUTE_REFRESH_MESSAGE_ERROR
+)
+
+// Handling of ROUTE-REFRESH requests from the peer - see
+// Parameters.RouteRefresh
+const (
+	ROUTE_REFRESH_OFF    = ""       // the capability is not offered
+	ROUTE_REFRESH_AUTO   = "auto"   // the Adj-RIB-Out for the family is sent again
+	ROUTE_REFRESH_MANUAL = "manual" // requests are passed to the BGPRefresh, if any
+)
+
+// Optionally implemented by the BGPNotify passed to a session to be
+// told of ROUTE-REFRESH requests in ROUTE_REFRESH_MANUAL mode
+type BGPRefresh interface {
+	BGPRefresh(peer string, afi uint16, safi uint8)
+}
+
+// AFI[2], Reserved/Subtype[1], SAFI[1]
+type routeRefresh struct {
+	family  family
+	subtype uint8
+}
+
+func (r *routeRefresh) Type() uint8 { return M_ROUTE_REFRESH }
+func (r *routeRefresh) Body() []byte {
+	afi := htons(r.family.afi)
+	return []byte{afi[0], afi[1], r.subtype, r.family.safi}
+}
+
+func (r *routeRefresh) parse(d []byte) bool {
+	if len(d) != 4 {
+		return false
+	}
+	r.family = family{afi: uint16(d[0])<<8 | uint16(d[1]), safi: d[3]}
+	r.subtype = d[2]
+	return true
+}
+
+// A RequestFullTable call waiting for the peer to finish re-sending
+type refreshWait struct {
+	pending map[family]bool // families for which the peer has not yet signalled the end
+	count   int             // routes received so far
+	closed  bool            // the session went down first
+	done    chan struct{}
+}
+
+// Ask the peer to re-send all of its routes with a ROUTE-REFRESH for
+// each negotiated unicast family, and wait until it signals the end of
+// each with an End of Route Refresh (or an End-of-RIB) marker. Returns
+// the number of routes received meanwhile, which is incomplete if the
+// context is done first. A plain route refresh has no end marker (RFC
+// 2918), so enhanced route refresh (RFC 7313) must have been negotiated
+// - it is only offered if Parameters.RouteRefresh is set.
+func (s *Session) RequestFullTable(ctx context.Context) (int, error) {
+
+	s.mutex.Lock()
+
+	conn := s.conn
+
+	if conn == nil || s.status.State != ESTABLISHED {
+		s.mutex.Unlock()
+		return 0, errors.New("Session is not established")
+	}
+
+	if !hasCapability(s.peerCaps, ROUTE_REFRESH) && !hasCapability(s.peerCaps, ENHANCED_ROUTE_REFRESH) {
+		s.mutex.Unlock()
+		return 0, errors.New("Peer does not support route refresh")
+	}
+
+	if !hasCapability(s.offered, ENHANCED_ROUTE_REFRESH) || !hasCapability(s.peerCaps, ENHANCED_ROUTE_REFRESH) {
+		s.mutex.Unlock()
+		return 0, errors.New("Enhanced route refresh was not negotiated - see Parameters.RouteRefresh")
+	}
+
+	if s.refresh != nil {
+		s.mutex.Unlock()
+		return 0, errors.New("Route refresh already in progress")
+	}
+
+	w := &refreshWait{pending: map[family]bool{}, done: make(chan struct{})}
+
+	var families []family
+
+	for _, f := range []family{IPV4_UNICAST, IPV6_UNICAST} {
+		if s.families[f] {
+			w.pending[f] = true
+			families = append(families, f)
+		}
+	}
+
+	s.refresh = w
+
+	s.mutex.Unlock()
+
+	for _, f := range families {
+		conn.queue(&routeRefresh{family: f})
+	}
+
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.refresh == w {
+		s.refresh = nil
+	}
+
+	if w.closed {
+		return w.count, errors.New("Session closed during route refresh")
+	}
+
+	if len(w.pending) > 0 {
+		return w.count, ctx.Err()
+	}
+
+	return w.count, nil
+}
+
+// Count routes received while a refresh is in progress, and note the
+// end of a family (f is zero for an ordinary UPDATE)
+func (s *Session) refreshed(routes int, f family) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	w := s.refresh
+
+	if w == nil {
+		return
+	}
+
+	w.count += routes
+
+	if w.pending[f] {
+		delete(w.pending, f)
+		if len(w.pending) == 0 {
+			close(w.done)
+			s.refresh = nil
+		}
+	}
+}
+
+// The session has gone down - a refresh in progress can't complete,
+// and must not be completed by the next session's End-of-RIB, and
+// KEEPALIVEs awaited by Shutdown will not arrive
+func (s *Session) dropped() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if w := s.refresh; w != nil {
+		w.closed = true
+		close(w.done)
+		s.refresh = nil
+	}
+
+	for _, w := range s.keepalives {
+		close(w.down)
+	}
+
+	s.keepalives = nil
+}
+
+func hasCapability(caps []capability, code uint8) bool {
+	for _, c := range caps {
+		if c.code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// The family that a prefix from the RIB is advertised in
+func addrFamily(ip netip.Addr) family {
+	if ip.Is4() {
+		return IPV4_UNICAST
+	}
+	return IPV6_UNICAST
+}
@@ -0,0 +1,361 @@
+package bgp
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRequestFullTable(t *testing.T) {
+
+	s, peer := newTestSession(t, Parameters{ASNumber: 65000, RouteRefresh: ROUTE_REFRESH_AUTO}, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001, capability{code: ROUTE_REFRESH}, capability{code: ENHANCED_ROUTE_REFRESH})
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		n, err := s.RequestFullTable(context.Background())
+		done <- result{n, err}
+	}()
+
+	var r routeRefresh
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_ROUTE_REFRESH {
+		t.Fatalf("Expected ROUTE-REFRESH: %v", m)
+	} else if !r.parse(m.Body()) || r.family != IPV4_UNICAST || r.subtype != REFRESH_REQUEST {
+		t.Fatalf("Bad ROUTE-REFRESH: %v", m.Body())
+	}
+
+	a := advert{ASNumber: 65001, PeerASNumber: 65000, NextHop: [4]byte{10, 0, 0, 2}}
+	u, _ := a.message(map[netip.Addr]bool{ipv4_0: true, ipv4_1: true})
+	peer.send(&u)
+
+	select {
+	case <-done:
+		t.Fatal("Returned before End-of-RIB")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	peer.send(endOfRIB(IPV4_UNICAST))
+
+	select {
+	case r := <-done:
+		if r.err != nil || r.n != 2 {
+			t.Error("Expected two routes:", r.n, r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RequestFullTable did not return")
+	}
+
+	// enhanced route refresh markers end the refresh too
+	go func() {
+		n, err := s.RequestFullTable(context.Background())
+		done <- result{n, err}
+	}()
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_ROUTE_REFRESH {
+		t.Fatalf("Expected ROUTE-REFRESH: %v", m)
+	}
+
+	peer.send(&routeRefresh{family: IPV4_UNICAST, subtype: REFRESH_BORR})
+	peer.send(&u)
+	peer.send(&routeRefresh{family: IPV4_UNICAST, subtype: REFRESH_EORR})
+
+	select {
+	case r := <-done:
+		if r.err != nil || r.n != 2 {
+			t.Error("Expected two routes:", r.n, r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RequestFullTable did not return")
+	}
+
+	// timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := s.RequestFullTable(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected deadline to be exceeded:", err)
+	}
+}
+
+func TestRequestFullTableDropped(t *testing.T) {
+
+	s, peer := newTestSession(t, Parameters{ASNumber: 65000, RouteRefresh: ROUTE_REFRESH_AUTO}, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001, capability{code: ROUTE_REFRESH}, capability{code: ENHANCED_ROUTE_REFRESH})
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := s.RequestFullTable(context.Background())
+		done <- err
+	}()
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_ROUTE_REFRESH {
+		t.Fatalf("Expected ROUTE-REFRESH: %v", m)
+	}
+
+	peer.send(&notification{code: CEASE, sub: ADMINISTRATIVE_SHUTDOWN})
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected an error when the session closes")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RequestFullTable did not return")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.refresh != nil {
+		t.Error("Refresh should be cleared")
+	}
+}
+
+func TestRequestFullTableUnsupported(t *testing.T) {
+
+	s, peer := newTestSession(t, Parameters{ASNumber: 65000}, []netip.Addr{ipv4_0}, nil)
+
+	if _, err := s.RequestFullTable(context.Background()); err == nil {
+		t.Error("Session is not established")
+	}
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	if _, err := s.RequestFullTable(context.Background()); err == nil {
+		t.Error("Peer did not offer route refresh")
+	}
+
+	// without the enhanced procedure there is no end marker to wait for
+	for _, c := range []struct {
+		refresh string
+		caps    []capability
+	}{
+		{ROUTE_REFRESH_AUTO, []capability{{code: ROUTE_REFRESH}}},
+		{ROUTE_REFRESH_OFF, []capability{{code: ROUTE_REFRESH}, {code: ENHANCED_ROUTE_REFRESH}}},
+	} {
+		s, peer := newTestSession(t, Parameters{ASNumber: 65000, RouteRefresh: c.refresh}, []netip.Addr{ipv4_0}, nil)
+
+		if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+			t.Fatalf("Expected OPEN: %v", m)
+		}
+
+		peer.open(65001, c.caps...)
+
+		if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+			t.Fatalf("Expected UPDATE: %v", m)
+		}
+
+		if _, err := s.RequestFullTable(context.Background()); err == nil {
+			t.Error("Enhanced route refresh was not negotiated:", c.refresh)
+		}
+	}
+}
+
+func TestRouteRefreshAuto(t *testing.T) {
+
+	for _, enhanced := range []bool{false, true} {
+
+		p := Parameters{ASNumber: 65000, RouteRefresh: ROUTE_REFRESH_AUTO}
+
+		_, peer := newTestSession(t, p, []netip.Addr{ipv4_0, ipv4_1}, nil)
+
+		if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+			t.Fatalf("Expected OPEN: %v", m)
+		} else if caps, _ := m.(*open).capabilities(); !hasCapability(caps, ROUTE_REFRESH) || !hasCapability(caps, ENHANCED_ROUTE_REFRESH) {
+			t.Fatalf("Route refresh should be offered: %v", caps)
+		}
+
+		if enhanced {
+			peer.open(65001, capability{code: ROUTE_REFRESH}, capability{code: ENHANCED_ROUTE_REFRESH})
+		} else {
+			peer.open(65001, capability{code: ROUTE_REFRESH})
+		}
+
+		if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+			t.Fatalf("Expected UPDATE: %v", m)
+		}
+
+		peer.send(&routeRefresh{family: IPV4_UNICAST})
+
+		var r routeRefresh
+
+		if enhanced {
+			if m := peer.next(time.Second); m == nil || m.Type() != M_ROUTE_REFRESH || !r.parse(m.Body()) || r.subtype != REFRESH_BORR {
+				t.Fatalf("Expected BoRR: %v", m)
+			}
+		}
+
+		m := peer.next(time.Second)
+
+		if m == nil || m.Type() != M_UPDATE {
+			t.Fatalf("Expected UPDATE: %v", m)
+		}
+
+		if u, n := decodeUpdate(m.Body()); n != nil || !prefixSliceEqual(u.advertised, []netip.Prefix{hostRoute(ipv4_0), hostRoute(ipv4_1)}) {
+			t.Errorf("Adj-RIB-Out should be sent again: %v %v", n, u.advertised)
+		}
+
+		if enhanced {
+			if m := peer.next(time.Second); m == nil || m.Type() != M_ROUTE_REFRESH || !r.parse(m.Body()) || r.subtype != REFRESH_EORR {
+				t.Fatalf("Expected EoRR: %v", m)
+			}
+		}
+	}
+}
+
+type refreshLog struct {
+	nul
+	requests chan family
+}
+
+func (l *refreshLog) BGPRefresh(peer string, afi uint16, safi uint8) {
+	l.requests <- family{afi: afi, safi: safi}
+}
+
+func TestRouteRefreshManual(t *testing.T) {
+
+	l := &refreshLog{requests: make(chan family, 1)}
+	p := Parameters{ASNumber: 65000, RouteRefresh: ROUTE_REFRESH_MANUAL}
+
+	_, peer := newTestSession(t, p, []netip.Addr{ipv4_0}, l)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001, capability{code: ROUTE_REFRESH})
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	peer.send(&routeRefresh{family: IPV4_UNICAST})
+
+	select {
+	case f := <-l.requests:
+		if f != IPV4_UNICAST {
+			t.Error("Unexpected family:", f)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("BGPRefresh not called")
+	}
+
+	if m := peer.next(100 * time.Millisecond); m != nil {
+		t.Error("Nothing should be sent:", m)
+	}
+}
+
+func TestRouteRefreshUnknownSubtype(t *testing.T) {
+
+	p := Parameters{ASNumber: 65000, RouteRefresh: ROUTE_REFRESH_OFF}
+
+	_, peer := newTestSession(t, p, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001, capability{code: ROUTE_REFRESH})
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	peer.send(&routeRefresh{family: IPV4_UNICAST, subtype: 3})
+
+	if m := peer.next(100 * time.Millisecond); m != nil {
+		t.Fatal("Unknown subtypes should be ignored:", m)
+	}
+
+	peer.send(&routeRefresh{family: IPV4_UNICAST})
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_NOTIFICATION {
+		t.Error("Request without the capability offered should be an error:", m)
+	}
+}
+
+func TestRefreshInterval(t *testing.T) {
+
+	clock := newMockClock()
+
+	p := Parameters{ASNumber: 65000, HoldTime: 90, RefreshInterval: 5 * time.Minute}
+
+	s := NewConnSession(IP{10, 0, 0, 1}, p, []netip.Addr{ipv4_0, ipv4_1}, nil)
+	s.timers = clock
+
+	peer := runTestSession(t, s)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	// keep the session up while the clock runs
+	advance := func(d time.Duration) {
+		for ; d > 0; d -= 30 * time.Second {
+			peer.send(&keepalive{})
+			time.Sleep(10 * time.Millisecond)
+			clock.Advance(30 * time.Second)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		advance(4*time.Minute + 30*time.Second)
+
+		if m := peer.next(100 * time.Millisecond); m != nil {
+			t.Fatalf("Nothing should be sent before the interval: %v", m)
+		}
+
+		advance(30 * time.Second)
+
+		m := peer.next(time.Second)
+
+		if m == nil || m.Type() != M_UPDATE {
+			t.Fatalf("Expected UPDATE: %v", m)
+		}
+
+		if u, n := decodeUpdate(m.Body()); n != nil || !prefixSliceEqual(u.advertised, []netip.Prefix{hostRoute(ipv4_0), hostRoute(ipv4_1)}) {
+			t.Errorf("Adj-RIB-Out should be sent again: %v %v", n, u.advertised)
+		}
+	}
+}
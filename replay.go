@@ -0,0 +1,82 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"fmt"
+	"io"
+)
+
+type replay struct {
+	nul
+	BGPImport
+}
+
+// Feed a capture of the messages received from a peer (a sequence of
+// framed BGP messages) through the decoder and import policy, as if
+// they had been received on a live session, reporting the routes to
+// the handler. Returns an error identifying the first message which
+// could not be processed.
+func ReplaySession(r io.Reader, p Parameters, handler BGPImport) error {
+
+	const peer = "replay"
+
+	s := &Session{p: p, logs: &replay{BGPImport: handler}}
+
+	var from source
+
+	for n := 1; ; n++ {
+
+		mtype, body, err := readFrame(r)
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("Message %d: %s", n, err.Error())
+		}
+
+		m, ok := parseMessage(mtype, body)
+
+		if !ok {
+			return fmt.Errorf("Message %d: Badly formed message type %d", n, mtype)
+		}
+
+		switch mtype {
+		case M_OPEN:
+			o := m.(*open)
+			from = source{routerID: o.routerID, external: o.asNumber != p.ASNumber, asn: o.asNumber}
+
+		case M_UPDATE:
+			u, e := decodeUpdateFrom(body, from.external, p.MaxDecodeDepth)
+
+			if e != nil {
+				return fmt.Errorf("Message %d: UPDATE error[%d:%d]: %s", n, e.code, e.sub, e.note())
+			}
+
+			s.imported(peer, p.received(m, u, from))
+
+		case M_KEEPALIVE, M_NOTIFICATION:
+
+		default:
+			return fmt.Errorf("Message %d: Bad message type %d", n, mtype)
+		}
+	}
+}
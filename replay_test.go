@@ -0,0 +1,59 @@
+package bgp
+
+import (
+	"bytes"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestReplaySession(t *testing.T) {
+
+	var capture []byte
+
+	o := open{version: 4, asNumber: 65001, holdTime: 90, routerID: IP4{10, 1, 1, 1}}
+	capture = append(capture, addHeader(M_OPEN, o.message())...)
+	capture = append(capture, addHeader(M_KEEPALIVE, nil)...)
+
+	a := advert{ASNumber: 65001, PeerASNumber: 65000, NextHop: [4]byte{10, 1, 1, 1}}
+	msg, err := a.message(map[netip.Addr]bool{ipv4_0: true, ipv4_1: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	capture = append(capture, addHeader(M_UPDATE, msg)...)
+
+	l := &importLog{}
+
+	if err := ReplaySession(bytes.NewReader(capture), Parameters{ASNumber: 65000}, l); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(l.received) != 1 || len(l.received[0].Advertised) != 2 {
+		t.Fatalf("Expected two routes: %v", l.received)
+	}
+
+	if r := l.received[0].Advertised[0]; !r.External || r.RouterID != o.routerID || r.ASPath.String() != "65001" {
+		t.Errorf("Route attributes incorrect: %v", r)
+	}
+
+	// a malformed UPDATE is reported by position
+	bad := append(append([]byte{}, capture...), addHeader(M_UPDATE, []byte{0, 0, 0, 9, 0})...)
+	bad = append(bad, addHeader(M_KEEPALIVE, nil)...)
+
+	l = &importLog{}
+
+	if err := ReplaySession(bytes.NewReader(bad), Parameters{ASNumber: 65000}, l); err == nil || !strings.HasPrefix(err.Error(), "Message 4:") {
+		t.Errorf("Expected message 4 to fail: %v", err)
+	}
+
+	if len(l.received) != 1 {
+		t.Errorf("Messages before the failure should be processed: %v", l.received)
+	}
+
+	// truncated capture
+	if err := ReplaySession(bytes.NewReader(capture[:len(capture)-1]), Parameters{}, &importLog{}); err == nil || !strings.HasPrefix(err.Error(), "Message 3:") {
+		t.Errorf("Expected message 3 to be truncated: %v", err)
+	}
+}
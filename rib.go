@@ -26,13 +26,30 @@ import (
 type _update struct {
 	RIB        []netip.Addr
 	Parameters Parameters
+
+	withdraw netip.Addr    // if valid, the only change from the previous update
+	paths    *addPaths     // if not nil, the only change from the previous update
+	flush    bool          // send the initial advertisement if it is being delayed
+	reset    *notification // if not nil, close the session with this NOTIFICATION
+	down     bool          // with reset, don't reconnect until reset again with down unset
+	add      []netip.Addr  // if not nil, the only change from the previous update
+	clear    bool          // withdraw everything advertised - see WithdrawAll
+	written  func()        // if not nil, called once the resulting UPDATEs are written
 }
 
 type _rib []netip.Addr
 
+// A copy of the RIB in canonical form: IPv4-mapped IPv6 addresses
+// (::ffff:a.b.c.d) are treated as the IPv4 address, so that they are
+// always sent in the IPv4 NLRI, and any duplicates are removed
 func (r _rib) dup() (ret []netip.Addr) {
+	seen := map[netip.Addr]bool{}
 	for _, i := range r {
-		ret = append(ret, i)
+		i = i.Unmap().WithZone("") // zones are not meaningful in NLRI
+		if !seen[i] {
+			seen[i] = true
+			ret = append(ret, i)
+		}
 	}
 	return
 }
@@ -89,7 +106,9 @@ filter:
 		for _, ipnet := range p.Accept {
 			n := ipnet
 			if n.Contains(ip) {
-				pass = append(pass, i)
+				if p.exported(ip) {
+					pass = append(pass, i)
+				}
 				continue filter
 			}
 		}
@@ -101,7 +120,9 @@ filter:
 			}
 		}
 
-		pass = append(pass, i)
+		if p.exported(ip) {
+			pass = append(pass, i)
+		}
 	}
 
 	return pass
@@ -150,6 +171,46 @@ func (u *_update) nlri(prev []netip.Addr, ipv6, force bool) ([]netip.Addr, map[n
 	return list, nlri
 }
 
+// Remove a single address from the Adj-RIB-Out, returning the NLRI
+// needed to withdraw it (empty if it was not advertised)
+func withdrawAddr(prev []netip.Addr, ip netip.Addr) ([]netip.Addr, map[netip.Addr]bool) {
+	var list []netip.Addr
+
+	nlri := map[netip.Addr]bool{}
+
+	for _, i := range prev {
+		if i == ip {
+			nlri[i] = false
+		} else {
+			list = append(list, i)
+		}
+	}
+
+	return list, nlri
+}
+
+// Addresses already in the Adj-RIB-Out are advertised again (see
+// readvertise) but not added to it a second time
+func addAddrs(prev []netip.Addr, add []netip.Addr) ([]netip.Addr, map[netip.Addr]bool) {
+
+	nlri := map[netip.Addr]bool{}
+	seen := map[netip.Addr]bool{}
+
+	for _, i := range prev {
+		seen[i] = true
+	}
+
+	for _, i := range add {
+		nlri[i] = true
+		if !seen[i] {
+			seen[i] = true
+			prev = append(prev, i)
+		}
+	}
+
+	return prev, nlri
+}
+
 func (c *_update) updates(p _update, ipv6 bool) (uint64, uint64, map[netip.Addr]bool) {
 	nrli := map[netip.Addr]bool{}
 
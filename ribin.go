@@ -0,0 +1,411 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"sort"
+)
+
+const (
+	UNREACHABLE_WITHHOLD = ""       // routes with an unreachable next hop are discarded
+	UNREACHABLE_DEPREF   = "depref" // routes with an unreachable next hop are only used as a last resort
+)
+
+// What to do with a new route when the Adj-RIB-In is full - see
+// Parameters.AdjRIBInLimit
+const (
+	EVICT_REJECT_NEW = ""    // the new route is not stored
+	EVICT_LRU        = "lru" // the least recently updated route is removed to make room
+)
+
+// Optionally implemented by the BGPNotify passed to a session to be
+// informed of routes received from the peer
+type BGPImport interface {
+	BGPReceived(peer string, m ReceivedMessage)
+}
+
+// The result of processing an UPDATE message from a peer
+type ReceivedMessage struct {
+	Advertised []ReceivedRoute `json:"advertised,omitempty"` // routes accepted by import policy
+	Withdrawn  []netip.Prefix  `json:"withdrawn,omitempty"`  // withdrawn, or rejected by import policy
+	Raw        []byte          `json:"raw,omitempty"`        // the message as received, if Parameters.RetainRaw is set
+}
+
+// Details of the peer that an UPDATE was received from
+type source struct {
+	addr     netip.Addr
+	routerID IP4
+	external bool
+	asn      uint16     // from the peer's OPEN - see Parameters.onlyToCustomer
+	local    netip.Addr // our end of the connection - see Parameters.self
+}
+
+// Convert a decoded UPDATE to routes, applying import policy. Routes
+// which are rejected are returned in the withdrawn list so that any
+// previously accepted version is removed from the Adj-RIB-In.
+func (p *Parameters) importUpdate(u decoded, from source) (routes []ReceivedRoute, withdrawn []netip.Prefix) {
+
+	withdrawn = append(withdrawn, u.withdrawn...)
+
+	if u.treatAsWithdraw {
+		return routes, append(withdrawn, u.advertised...)
+	}
+
+	for _, r := range from.routes(u) {
+		if r, ok := p.importReceived(r, from); ok {
+			routes = append(routes, r)
+		} else {
+			withdrawn = append(withdrawn, r.Prefix)
+		}
+	}
+
+	return
+}
+
+// The routes advertised in an UPDATE, before import policy is applied
+func (from source) routes(u decoded) (routes []ReceivedRoute) {
+	for _, prefix := range u.advertised {
+		attr := u.attributes
+		attr.NextHop = u.nextHopFor(prefix)
+		routes = append(routes, ReceivedRoute{
+			Route:    Route{Prefix: prefix, Attributes: attr, Learned: true},
+			Peer:     from.addr,
+			RouterID: from.routerID,
+			External: from.external,
+		})
+	}
+	return
+}
+
+// Apply import policy and the next hop reachability check to a route
+func (p *Parameters) importReceived(r ReceivedRoute, from source) (ReceivedRoute, bool) {
+
+	var ok bool
+
+	if p.MaxASPathLength > 0 && r.ASPath.Length() > p.MaxASPathLength {
+		return r, false
+	}
+
+	// RFC 7611: a route tagged ACCEPT_OWN is meant to come back to us
+	if p.RejectSelfNextHop && p.self(r.NextHop, from.local) && !communityMatch([]Community{ACCEPT_OWN}, r.Communities) {
+		return r, false
+	}
+
+	if !p.onlyToCustomer(&r, uint32(from.asn)) {
+		return r, false
+	}
+
+	// a LOCAL_PREF from an external peer was already discarded by decodeUpdateFrom
+	if r.LocalPref == 0 {
+		r.LocalPref = p.DefaultLocalPref // import policy may override this
+	}
+
+	if r.Route, ok = p.importRoute(r.Route); !ok {
+		return r, false
+	}
+
+	if p.NextHopReachable != nil && !p.NextHopReachable(r.NextHop) {
+		if p.UnreachableNextHop != UNREACHABLE_DEPREF {
+			return r, false
+		}
+		r.NextHopUnreachable = true
+	}
+
+	return r, true
+}
+
+// The address is the local address of the connection, or one of those
+// configured for the session
+func (p *Parameters) self(a netip.Addr, local netip.Addr) bool {
+
+	var nul4 IP4
+	var nul6 IP6
+
+	if local.IsValid() && !local.IsUnspecified() && a.Unmap() == local.Unmap() {
+		return true
+	}
+
+	for _, s := range []IP4{p.SourceIP, p.NextHop4} {
+		if s != nul4 && a.Unmap() == netip.AddrFrom4(s) {
+			return true
+		}
+	}
+
+	return p.NextHop6 != nul6 && a == netip.AddrFrom16(p.NextHop6)
+}
+
+func (p *Parameters) received(m message, u decoded, from source) (r ReceivedMessage) {
+
+	r.Advertised, r.Withdrawn = p.importUpdate(u, from)
+
+	if p.RetainRaw {
+		r.Raw = addHeader(m.Type(), m.Body()) // a new slice, not sharing the read buffer
+	}
+
+	return
+}
+
+func (s *Session) imported(peer string, r ReceivedMessage) {
+	rejected, evicted, duplicate := s.receive(r.Advertised, r.Withdrawn)
+	s.report(peer, &s.update.Parameters, r, rejected, evicted, duplicate)
+}
+
+// Pass the changes to the Adj-RIB-In made by a message to the
+// BGPImport, if any, warning of routes which didn't fit
+func (s *Session) report(peer string, p *Parameters, r ReceivedMessage, rejected map[netip.Prefix]bool, evicted []netip.Prefix, duplicate map[netip.Prefix]bool) {
+
+	if len(duplicate) > 0 && !p.ReportDuplicates {
+		var advertised []ReceivedRoute
+
+		for _, a := range r.Advertised {
+			if !duplicate[a.Prefix] {
+				advertised = append(advertised, a)
+			}
+		}
+
+		if len(advertised) == 0 && len(r.Withdrawn) == 0 {
+			return // nothing has changed
+		}
+
+		r.Advertised = advertised
+	}
+
+	if len(rejected) > 0 {
+		s.warn(peer, fmt.Sprintf("Adj-RIB-In full, %d routes rejected", len(rejected)))
+
+		var advertised []ReceivedRoute
+
+		for _, a := range r.Advertised {
+			if !rejected[a.Prefix] {
+				advertised = append(advertised, a)
+			}
+		}
+
+		r.Advertised = advertised
+	}
+
+	if len(evicted) > 0 {
+		s.warn(peer, fmt.Sprintf("Adj-RIB-In full, %d routes evicted", len(evicted)))
+		r.Withdrawn = append(r.Withdrawn, evicted...)
+	}
+
+	if i, ok := s.log().(BGPImport); ok {
+		i.BGPReceived(peer, r)
+	}
+}
+
+// Store routes in the Adj-RIB-In, returning those which didn't fit,
+// those which were removed to make room for them and those which were
+// identical to the route already stored
+func (s *Session) receive(routes []ReceivedRoute, withdrawn []netip.Prefix) (rejected map[netip.Prefix]bool, evicted []netip.Prefix, duplicate map[netip.Prefix]bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store(&s.update.Parameters, routes, withdrawn)
+}
+
+// As receive, with the mutex held, limited by the Adj-RIB-In settings
+// in p
+func (s *Session) store(p *Parameters, routes []ReceivedRoute, withdrawn []netip.Prefix) (rejected map[netip.Prefix]bool, evicted []netip.Prefix, duplicate map[netip.Prefix]bool) {
+
+	if s.ribIn == nil {
+		s.ribIn = map[netip.Prefix]ReceivedRoute{}
+	}
+
+	limit := p.AdjRIBInLimit
+	lru := p.AdjRIBInEviction == EVICT_LRU && limit > 0
+
+	for _, p := range withdrawn {
+		delete(s.ribIn, p)
+		s.ribInLRU.remove(p)
+	}
+
+	for _, r := range routes {
+		if o, ok := s.ribIn[r.Prefix]; ok && reflect.DeepEqual(o, r) {
+			if duplicate == nil {
+				duplicate = map[netip.Prefix]bool{}
+			}
+			duplicate[r.Prefix] = true
+		} else if !ok && limit > 0 && len(s.ribIn) >= limit {
+			if p, ok := s.evict(lru); ok {
+				evicted = append(evicted, p)
+			} else {
+				if rejected == nil {
+					rejected = map[netip.Prefix]bool{}
+				}
+				rejected[r.Prefix] = true
+				continue
+			}
+		}
+
+		s.ribIn[r.Prefix] = r
+
+		if lru {
+			s.ribInLRU.touch(r.Prefix)
+		}
+	}
+
+	return
+}
+
+// Remove the least recently updated route to make room for a new one
+func (s *Session) evict(lru bool) (netip.Prefix, bool) {
+	if !lru {
+		return netip.Prefix{}, false
+	}
+
+	p, ok := s.ribInLRU.oldest(s.ribIn)
+
+	if ok {
+		delete(s.ribIn, p)
+	}
+
+	return p, ok
+}
+
+// Order in which routes were last updated, for EVICT_LRU
+type ribInLRU struct {
+	order *list.List // least recently updated at the front
+	elem  map[netip.Prefix]*list.Element
+}
+
+func (l *ribInLRU) touch(p netip.Prefix) {
+	if l.order == nil {
+		l.order = list.New()
+		l.elem = map[netip.Prefix]*list.Element{}
+	}
+
+	if e, ok := l.elem[p]; ok {
+		l.order.MoveToBack(e)
+	} else {
+		l.elem[p] = l.order.PushBack(p)
+	}
+}
+
+func (l *ribInLRU) remove(p netip.Prefix) {
+	if e, ok := l.elem[p]; ok {
+		l.order.Remove(e)
+		delete(l.elem, p)
+	}
+}
+
+// The least recently updated route still in the Adj-RIB-In (which may
+// have been replaced wholesale, eg. by SoftReconfigIn), which is
+// removed from the list
+func (l *ribInLRU) oldest(ribIn map[netip.Prefix]ReceivedRoute) (netip.Prefix, bool) {
+	for l.order != nil && l.order.Len() > 0 {
+		p := l.order.Remove(l.order.Front()).(netip.Prefix)
+		delete(l.elem, p)
+		if _, ok := ribIn[p]; ok {
+			return p, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// Store the routes in an UPDATE before import policy is applied, so
+// that policy can be re-applied later - see SoftReconfigIn
+func (s *Session) storePrePolicy(u decoded, from source) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ribInPre == nil {
+		s.ribInPre = map[netip.Prefix]ReceivedRoute{}
+	}
+
+	for _, p := range u.withdrawn {
+		delete(s.ribInPre, p)
+	}
+
+	if u.treatAsWithdraw {
+		for _, p := range u.advertised {
+			delete(s.ribInPre, p)
+		}
+		return
+	}
+
+	for _, r := range from.routes(u) {
+		s.ribInPre[r.Prefix] = r
+	}
+}
+
+// Re-apply the current import policy to the unmodified routes received
+// from the peer, without asking it to send them again. Requires
+// Parameters.SoftReconfigInbound. Routes which have changed, and any
+// which are no longer accepted, are reported to the BGPImport, if any.
+// Routes received before SoftReconfigInbound was set have no unmodified
+// copy, so are left as they are until the peer sends them again. The
+// Adj-RIB-In remains subject to Parameters.AdjRIBInLimit.
+func (s *Session) SoftReconfigIn() error {
+
+	s.mutex.Lock()
+
+	p := s.p
+
+	var from source // the connection the routes were received on
+	from.local, _ = netip.ParseAddr(s.status.LocalIP)
+
+	if s.peerInfo != nil {
+		from.asn = s.peerInfo.ASNumber
+	}
+
+	if !p.SoftReconfigInbound {
+		s.mutex.Unlock()
+		return errors.New("Inbound soft reconfiguration is not enabled")
+	}
+
+	var m ReceivedMessage
+
+	for prefix, r := range s.ribInPre {
+		if r, ok := p.importReceived(r, from); ok {
+			m.Advertised = append(m.Advertised, r)
+		} else if _, ok := s.ribIn[prefix]; ok {
+			m.Withdrawn = append(m.Withdrawn, prefix)
+		}
+	}
+
+	rejected, evicted, duplicate := s.store(&p, m.Advertised, m.Withdrawn)
+
+	s.mutex.Unlock()
+
+	s.report(s.peer, &p, m, rejected, evicted, duplicate)
+
+	return nil
+}
+
+// Routes currently learned from the peer, after import policy
+func (s *Session) AdjRIBIn() (routes []ReceivedRoute) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, r := range s.ribIn {
+		routes = append(routes, r)
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		a, b := routes[i].Prefix, routes[j].Prefix
+		return a.Addr().Less(b.Addr()) || (a.Addr() == b.Addr() && a.Bits() < b.Bits())
+	})
+
+	return
+}
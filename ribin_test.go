@@ -0,0 +1,306 @@
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestNextHopReachable(t *testing.T) {
+
+	bad := netip.MustParseAddr("10.9.9.9")
+
+	p := Parameters{
+		NextHopReachable: func(a netip.Addr) bool { return a != bad },
+	}
+
+	prefix := netip.MustParsePrefix("10.0.0.0/24")
+
+	u := decoded{advertised: []netip.Prefix{prefix}, nextHop: bad}
+	from := source{addr: netip.MustParseAddr("10.1.1.1"), routerID: IP4{10, 1, 1, 1}}
+
+	routes, withdrawn := p.importUpdate(u, from)
+
+	if len(routes) != 0 || !prefixSliceEqual(withdrawn, []netip.Prefix{prefix}) {
+		t.Fatalf("Route with unreachable next hop should be excluded: %v %v", routes, withdrawn)
+	}
+
+	var s Session
+	s.receive(p.importUpdate(decoded{advertised: []netip.Prefix{prefix}, nextHop: from.addr}, from))
+	s.receive(p.importUpdate(u, from))
+
+	if r := s.AdjRIBIn(); len(r) != 0 {
+		t.Fatalf("Route with unreachable next hop should replace the original: %v", r)
+	}
+
+	p.UnreachableNextHop = UNREACHABLE_DEPREF
+
+	routes, withdrawn = p.importUpdate(u, from)
+
+	if len(routes) != 1 || len(withdrawn) != 0 || !routes[0].NextHopUnreachable {
+		t.Fatalf("Route with unreachable next hop should be depref'd: %v %v", routes, withdrawn)
+	}
+
+	good := ReceivedRoute{Route: Route{Prefix: prefix, Attributes: Attributes{NextHop: from.addr, LocalPref: 50}}}
+
+	if BestPath([]ReceivedRoute{routes[0], good}) != 1 {
+		t.Fatalf("Route with reachable next hop should be preferred")
+	}
+}
+
+type importLog struct {
+	nul
+	received []ReceivedMessage
+}
+
+func (l *importLog) BGPReceived(peer string, m ReceivedMessage) {
+	l.received = append(l.received, m)
+}
+
+func TestRetainRaw(t *testing.T) {
+
+	a := advert{ASNumber: 65000, PeerASNumber: 65001, NextHop: [4]byte{10, 1, 2, 3}}
+
+	body, err := a.message(map[netip.Addr]bool{ipv4_0: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := addHeader(M_UPDATE, body) // simulate a read buffer
+	wire := append([]byte{}, buf...)
+
+	m := &other{mtype: M_UPDATE, body: buf[19:]}
+
+	u, n := decodeUpdate(m.Body())
+
+	if n != nil {
+		t.Fatalf("Decode failed: %v", n)
+	}
+
+	p := Parameters{}
+
+	if r := p.received(m, u, source{}); r.Raw != nil {
+		t.Fatalf("Raw bytes should not be retained by default")
+	}
+
+	p.RetainRaw = true
+
+	r := p.received(m, u, source{})
+
+	for i := range buf {
+		buf[i] = 0 // buffer reuse
+	}
+
+	if !byteSliceEqual(r.Raw, wire) {
+		t.Fatalf("Retained bytes incorrect: %v", r.Raw)
+	}
+
+	l := &importLog{}
+	s := Session{logs: l}
+	s.imported("10.1.1.1", r)
+
+	if len(l.received) != 1 || len(l.received[0].Advertised) != 1 || len(s.AdjRIBIn()) != 1 {
+		t.Fatalf("Import callback not called")
+	}
+}
+
+func TestDefaultLocalPref(t *testing.T) {
+
+	prefix := netip.MustParsePrefix("10.0.0.0/24")
+
+	u := decoded{advertised: []netip.Prefix{prefix}, attributes: Attributes{LocalPref: 500}}
+	e := decoded{advertised: []netip.Prefix{prefix}, external: true} // LOCAL_PREF discarded by decodeUpdateFrom
+	ebgp := source{addr: netip.MustParseAddr("10.1.1.1"), routerID: IP4{10, 1, 1, 1}, external: true}
+	ibgp := source{addr: netip.MustParseAddr("10.1.1.2"), routerID: IP4{10, 1, 1, 2}}
+
+	p := Parameters{DefaultLocalPref: 200}
+
+	if r, _ := p.importUpdate(e, ebgp); len(r) != 1 || r[0].LocalPref != 200 {
+		t.Errorf("eBGP route should get the default LOCAL_PREF: %v", r)
+	}
+
+	if r, _ := p.importUpdate(u, ibgp); len(r) != 1 || r[0].LocalPref != 500 {
+		t.Errorf("iBGP route should keep its LOCAL_PREF: %v", r)
+	}
+
+	p.Import = []PolicyRule{{Set: PolicySet{LocalPref: 50}}}
+
+	if r, _ := p.importUpdate(e, ebgp); len(r) != 1 || r[0].LocalPref != 50 {
+		t.Errorf("Import policy should override the default: %v", r)
+	}
+}
+
+func TestMaxASPathLength(t *testing.T) {
+
+	p := Parameters{MaxASPathLength: 3}
+
+	short := netip.MustParsePrefix("10.0.0.0/24")
+	long := netip.MustParsePrefix("10.0.1.0/24")
+
+	from := source{addr: netip.MustParseAddr("10.1.1.1"), routerID: IP4{10, 1, 1, 1}, external: true}
+
+	// an AS_SET counts as one, so this is exactly the limit
+	path := ASPath{{Type: AS_SEQUENCE, ASNs: []uint32{65001, 65002}}, {Type: AS_SET, ASNs: []uint32{65003, 65004, 65005}}}
+
+	routes, withdrawn := p.importUpdate(decoded{advertised: []netip.Prefix{short}, attributes: Attributes{ASPath: path}}, from)
+
+	if len(routes) != 1 || len(withdrawn) != 0 {
+		t.Fatalf("Route within the limit should be accepted: %v %v", routes, withdrawn)
+	}
+
+	path = path.Prepend(65000)
+
+	routes, withdrawn = p.importUpdate(decoded{advertised: []netip.Prefix{long}, attributes: Attributes{ASPath: path}}, from)
+
+	if len(routes) != 0 || !prefixSliceEqual(withdrawn, []netip.Prefix{long}) {
+		t.Fatalf("Route with a long AS_PATH should be dropped: %v %v", routes, withdrawn)
+	}
+
+	p.MaxASPathLength = 0
+
+	if routes, _ = p.importUpdate(decoded{advertised: []netip.Prefix{long}, attributes: Attributes{ASPath: path}}, from); len(routes) != 1 {
+		t.Fatalf("AS_PATH length should be unlimited by default: %v", routes)
+	}
+}
+
+func TestRejectSelfNextHop(t *testing.T) {
+
+	p := Parameters{SourceIP: IP4{10, 0, 0, 1}, NextHop4: IP4{10, 0, 0, 2}, NextHop6: IP6{0xfd, 0, 15: 1}}
+
+	prefix := netip.MustParsePrefix("10.9.0.0/24")
+	from := source{addr: netip.MustParseAddr("10.1.1.1"), routerID: IP4{10, 1, 1, 1}}
+
+	accepted := func(nh string) bool {
+		u := decoded{advertised: []netip.Prefix{prefix}, nextHop: netip.MustParseAddr(nh)}
+		if u.nextHop.Is6() {
+			u = decoded{advertised: []netip.Prefix{prefix}, mpNextHop: map[family]netip.Addr{IPV4_UNICAST: u.nextHop}} // RFC 8950
+		}
+		routes, _ := p.importUpdate(u, from)
+		return len(routes) == 1
+	}
+
+	if !accepted("10.0.0.1") {
+		t.Fatal("Our own next hop should be accepted unless the option is set")
+	}
+
+	p.RejectSelfNextHop = true
+
+	for _, nh := range []string{"10.0.0.1", "10.0.0.2", "fd00::1"} {
+		if accepted(nh) {
+			t.Error("Route with our own next hop should be dropped:", nh)
+		}
+	}
+
+	if !accepted("10.1.1.1") {
+		t.Error("Route with the peer's next hop should be accepted")
+	}
+
+	u := decoded{advertised: []netip.Prefix{prefix}, nextHop: netip.MustParseAddr("10.0.0.1"), attributes: Attributes{Communities: []Community{ACCEPT_OWN}}}
+
+	if routes, _ := p.importUpdate(u, from); len(routes) != 1 {
+		t.Error("Route tagged ACCEPT_OWN should be accepted with our own next hop")
+	}
+
+	// the connection's local address is used without any configuration
+	p = Parameters{RejectSelfNextHop: true}
+	from.local = netip.MustParseAddr("10.0.0.3")
+
+	if accepted("10.0.0.3") {
+		t.Error("Route with the local address as next hop should be dropped")
+	}
+
+	if !accepted("10.0.0.1") {
+		t.Error("Route with another next hop should be accepted")
+	}
+}
+
+func TestAdjRIBInLimit(t *testing.T) {
+
+	route := func(s string) ReceivedRoute {
+		return ReceivedRoute{Route: Route{Prefix: netip.MustParsePrefix(s)}}
+	}
+
+	a, b, c := route("10.1.0.0/16"), route("10.2.0.0/16"), route("10.3.0.0/16")
+
+	prefixes := func(s *Session) (p []netip.Prefix) {
+		for _, r := range s.AdjRIBIn() {
+			p = append(p, r.Prefix)
+		}
+		return
+	}
+
+	l := &warningLog{warnings: make(chan string, 10)}
+
+	s := NewConnSession(IP{10, 0, 0, 1}, Parameters{AdjRIBInLimit: 2}, nil, l)
+
+	s.imported("peer", ReceivedMessage{Advertised: []ReceivedRoute{a, b, c}})
+
+	if p := prefixes(s); len(p) != 2 || p[0] != a.Prefix || p[1] != b.Prefix {
+		t.Error("New route should be rejected when full:", p)
+	}
+
+	if len(l.warnings) != 1 {
+		t.Error("Expected a warning")
+	}
+
+	// replacing a stored route is always permitted
+	s.imported("peer", ReceivedMessage{Advertised: []ReceivedRoute{b}})
+
+	if p := prefixes(s); len(p) != 2 || len(l.warnings) != 1 {
+		t.Error("Update to a stored route should be accepted:", p)
+	}
+
+	s = NewConnSession(IP{10, 0, 0, 1}, Parameters{AdjRIBInLimit: 2, AdjRIBInEviction: EVICT_LRU}, nil, l)
+
+	s.imported("peer", ReceivedMessage{Advertised: []ReceivedRoute{a, b}})
+	s.imported("peer", ReceivedMessage{Advertised: []ReceivedRoute{a}}) // b is now least recently updated
+	s.imported("peer", ReceivedMessage{Advertised: []ReceivedRoute{c}})
+
+	if p := prefixes(s); len(p) != 2 || p[0] != a.Prefix || p[1] != c.Prefix {
+		t.Error("Least recently updated route should be evicted:", p)
+	}
+
+	if len(l.warnings) != 2 {
+		t.Error("Expected a warning")
+	}
+}
+
+func TestDuplicateUpdate(t *testing.T) {
+
+	a := advert{ASNumber: 65001, PeerASNumber: 65000, NextHop: [4]byte{10, 1, 2, 3}}
+	m, _ := a.message(map[netip.Addr]bool{ipv4_0: true})
+	u, _ := decodeUpdate(m.Body())
+
+	from := source{addr: netip.MustParseAddr("10.1.2.3"), external: true}
+
+	for _, report := range []bool{false, true} {
+		p := Parameters{ReportDuplicates: report}
+
+		l := &importLog{}
+		s := Session{logs: l}
+		s.update.Parameters = p
+
+		s.imported("peer", p.received(&m, u, from))
+		s.imported("peer", p.received(&m, u, from))
+
+		if exp := map[bool]int{false: 1, true: 2}[report]; len(l.received) != exp {
+			t.Errorf("ReportDuplicates %v: expected %d callbacks, got %d", report, exp, len(l.received))
+		}
+	}
+
+	// a change to the attributes is reported
+	l := &importLog{}
+	s := Session{logs: l}
+
+	s.imported("peer", s.update.Parameters.received(&m, u, from))
+
+	a.MED = 10
+	m, _ = a.message(map[netip.Addr]bool{ipv4_0: true})
+	u, _ = decodeUpdate(m.Body())
+
+	s.imported("peer", s.update.Parameters.received(&m, u, from))
+
+	if len(l.received) != 2 || l.received[1].Advertised[0].MED != 10 {
+		t.Errorf("Changed route should be reported: %v", l.received)
+	}
+}
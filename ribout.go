@@ -0,0 +1,77 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"net/netip"
+)
+
+// Size of the Adj-RIB-Out, for capacity planning
+type RIBOutStats struct {
+	IPv4           int `json:"ipv4"`
+	IPv6           int `json:"ipv6"`
+	AttributeSets  int `json:"attribute_sets"`  // distinct sets of path attributes after export policy
+	AttributeBytes int `json:"attribute_bytes"` // estimated encoded size of the attribute sets
+}
+
+// Statistics for the routes currently advertised to the peer. These
+// are recorded when the Adj-RIB-Out changes, so this is cheap to call.
+func (s *Session) RIBOutStats() RIBOutStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ribOut
+}
+
+func (s *Session) ribOutStats(r RIBOutStats) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ribOut = r
+}
+
+// Each group of prefixes sharing path attributes holds one copy of
+// them; the size is taken from an UPDATE for a single member.
+func (a *advert) ribOutStats(adjRIBOut []netip.Addr) (r RIBOutStats) {
+
+	nlri := map[netip.Addr]bool{}
+
+	for _, ip := range adjRIBOut {
+		if ip.Is4() {
+			r.IPv4++
+		} else {
+			r.IPv6++
+		}
+		nlri[ip] = true
+	}
+
+	if len(nlri) < 1 {
+		return
+	}
+
+	for _, g := range a.groups(nlri) {
+		for ip := range g.nlri {
+			if m, err := g.advert.message(map[netip.Addr]bool{ip: true}); err == nil && len(m) >= 4 {
+				r.AttributeSets++
+				r.AttributeBytes += int(m[2])<<8 | int(m[3]) // Total Path Attribute Length
+			}
+			break
+		}
+	}
+
+	return
+}
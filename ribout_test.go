@@ -0,0 +1,59 @@
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRIBOutStats(t *testing.T) {
+
+	p := Parameters{ASNumber: 65000, Multiprotocol: true, NextHop6: IP6{0xfd, 0x0b, 15: 1}}
+
+	s, peer := newTestSession(t, p, []netip.Addr{ipv4_0, ipv4_1, ipv6_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	var r RIBOutStats
+
+	for i := 0; i < 100 && r.IPv4+r.IPv6 < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		r = s.RIBOutStats()
+	}
+
+	if r.IPv4 != 2 || r.IPv6 != 1 || r.AttributeSets != 1 || r.AttributeBytes == 0 {
+		t.Errorf("Unexpected statistics: %+v", r)
+	}
+}
+
+func TestRIBOutStatsAttributeSets(t *testing.T) {
+
+	export := []PolicyRule{{Match: PolicyMatch{Prefixes: []netip.Prefix{hostRoute(ipv4_1)}}, Set: PolicySet{MED: 50}}}
+
+	a := advert{ASNumber: 65000, NextHop: [4]byte{10, 1, 2, 3}}
+	u := a.withParameters(Parameters{}, 65001)
+
+	r := u.ribOutStats([]netip.Addr{ipv4_0, ipv4_1})
+
+	if r.IPv4 != 2 || r.AttributeSets != 1 {
+		t.Errorf("Unexpected statistics: %+v", r)
+	}
+
+	u = a.withParameters(Parameters{Export: export}, 65001)
+
+	if s := u.ribOutStats([]netip.Addr{ipv4_0, ipv4_1}); s.AttributeSets != 2 || s.AttributeBytes <= r.AttributeBytes {
+		t.Errorf("MED should create a second attribute set: %+v", s)
+	}
+
+	if s := u.ribOutStats(nil); s != (RIBOutStats{}) {
+		t.Errorf("Empty Adj-RIB-Out: %+v", s)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+// https://datatracker.ietf.org/doc/html/rfc9234 - Route Leak Prevention and Detection Using Roles in UPDATE and OPEN Messages
+
+const (
+	BGP_ROLE         = 9  // capability code
+	ONLY_TO_CUSTOMER = 35 // path attribute type (OTC)
+	ROLE_MISMATCH    = 11 // OPEN_MESSAGE_ERROR
+)
+
+// Our role on the session - see Parameters.PeerRole
+const (
+	ROLE_NONE      = ""
+	ROLE_PROVIDER  = "provider"  // the neighbour is our customer
+	ROLE_RS        = "rs"        // we are a route server, the neighbour is a client
+	ROLE_RS_CLIENT = "rs-client" // the neighbour is a route server
+	ROLE_CUSTOMER  = "customer"  // the neighbour is our provider
+	ROLE_PEER      = "peer"      // lateral peering
+)
+
+var roles = map[string]uint8{
+	ROLE_PROVIDER:  0,
+	ROLE_RS:        1,
+	ROLE_RS_CLIENT: 2,
+	ROLE_CUSTOMER:  3,
+	ROLE_PEER:      4,
+}
+
+// The role which the neighbour should have for each of ours
+var counterpart = map[string]string{
+	ROLE_PROVIDER:  ROLE_CUSTOMER,
+	ROLE_RS:        ROLE_RS_CLIENT,
+	ROLE_RS_CLIENT: ROLE_RS,
+	ROLE_CUSTOMER:  ROLE_PROVIDER,
+	ROLE_PEER:      ROLE_PEER,
+}
+
+func roleCapability(role string) (capability, bool) {
+	v, ok := roles[role]
+	return capability{code: BGP_ROLE, value: []byte{v}}, ok
+}
+
+// The role advertised by the peer - ROLE_NONE if it did not send the
+// capability, or sent an unknown value
+func peerRole(caps []capability) string {
+	for _, c := range caps {
+		if c.code == BGP_ROLE && len(c.value) == 1 {
+			for role, v := range roles {
+				if v == c.value[0] {
+					return role
+				}
+			}
+		}
+	}
+	return ROLE_NONE
+}
+
+// Roles are only checked if both sides advertise one
+func roleMismatch(local, remote string) bool {
+	return local != ROLE_NONE && remote != ROLE_NONE && counterpart[local] != remote
+}
+
+// Egress: we add OTC with our AS when sending to a customer, lateral
+// peer or route server client (RFC 9234 5)
+func (a *advert) onlyToCustomer() uint32 {
+	switch a.role {
+	case ROLE_PROVIDER, ROLE_PEER, ROLE_RS:
+		return uint32(a.ASNumber)
+	}
+	return 0
+}
+
+// Egress: a route carrying OTC must not be sent to a provider, lateral
+// peer or route server
+func (a *advert) leak(attr Attributes) bool {
+	switch a.role {
+	case ROLE_CUSTOMER, ROLE_PEER, ROLE_RS_CLIENT:
+		return attr.OTC != 0
+	}
+	return false
+}
+
+// Ingress: routes carrying OTC from a customer or route server client,
+// or from a lateral peer with an OTC other than its AS, are leaks.
+// Otherwise routes from a provider, lateral peer or route server are
+// marked with the peer's AS - that of the session, not the neighbour
+// in the AS_PATH, which may differ behind a transparent route server
+// (RFC 9234 5). Returns false for a leaked route.
+func (p *Parameters) onlyToCustomer(r *ReceivedRoute, neighbour uint32) bool {
+
+	if !r.External {
+		return true
+	}
+
+	switch p.PeerRole {
+	case ROLE_PROVIDER, ROLE_RS:
+		return r.OTC == 0
+	case ROLE_PEER:
+		if r.OTC != 0 && r.OTC != neighbour {
+			return false
+		}
+		fallthrough
+	case ROLE_CUSTOMER, ROLE_RS_CLIENT:
+		if r.OTC == 0 {
+			r.OTC = neighbour
+		}
+	}
+
+	return true
+}
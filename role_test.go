@@ -0,0 +1,119 @@
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestOnlyToCustomerEgress(t *testing.T) {
+
+	a := advert{ASNumber: 65000, NextHop: [4]byte{10, 1, 2, 3}}
+	rib := map[netip.Addr]bool{ipv4_0: true}
+
+	otc := func(role string) uint32 {
+		u := a.withParameters(Parameters{PeerRole: role}, 65001)
+		updates := u.updates(rib)
+		if len(updates) != 1 {
+			t.Fatalf("Expected one UPDATE: %v", updates)
+		}
+		d, n := decodeUpdate(updates[0].Body())
+		if n != nil {
+			t.Fatal(n)
+		}
+		return d.attributes.OTC
+	}
+
+	for _, role := range []string{ROLE_PROVIDER, ROLE_PEER, ROLE_RS} {
+		if v := otc(role); v != 65000 {
+			t.Errorf("OTC should be our AS when our role is %s: %d", role, v)
+		}
+	}
+
+	for _, role := range []string{ROLE_NONE, ROLE_CUSTOMER, ROLE_RS_CLIENT} {
+		if v := otc(role); v != 0 {
+			t.Errorf("OTC should not be sent when our role is %s: %d", role, v)
+		}
+	}
+
+	// a received route with OTC is not sent to a provider, and the
+	// original value is preserved when sent to a customer
+	leaked := Attributes{NextHop: netip.MustParseAddr("10.9.9.9"), OTC: 64512}
+
+	if u := a.withParameters(Parameters{PeerRole: ROLE_CUSTOMER}, 65001); u.advertisable(leaked) {
+		t.Error("Route with OTC should not be sent to a provider")
+	}
+
+	if u := a.withParameters(Parameters{PeerRole: ROLE_PROVIDER}, 65001); !u.advertisable(leaked) {
+		t.Error("Route with OTC should be sent to a customer")
+	} else if r := u.relay(leaked); r.otc != 64512 {
+		t.Error("OTC should be preserved:", r.otc)
+	}
+}
+
+func TestOnlyToCustomerIngress(t *testing.T) {
+
+	prefix := netip.MustParsePrefix("10.9.0.0/24")
+	from := source{addr: netip.MustParseAddr("10.1.1.1"), routerID: IP4{10, 1, 1, 1}, external: true, asn: 65001}
+	path := ASPath{{Type: AS_SEQUENCE, ASNs: []uint32{65001, 65002}}}
+
+	imported := func(role string, otc uint32) (uint32, bool) {
+		p := Parameters{PeerRole: role}
+		u := decoded{advertised: []netip.Prefix{prefix}, attributes: Attributes{ASPath: path, OTC: otc}}
+		routes, _ := p.importUpdate(u, from)
+		if len(routes) != 1 {
+			return 0, false
+		}
+		return routes[0].OTC, true
+	}
+
+	if _, ok := imported(ROLE_PROVIDER, 64512); ok {
+		t.Error("Route with OTC from a customer is a leak")
+	}
+
+	if _, ok := imported(ROLE_PEER, 64512); ok {
+		t.Error("Route with OTC from a peer other than its own AS is a leak")
+	}
+
+	if otc, ok := imported(ROLE_PEER, 65001); !ok || otc != 65001 {
+		t.Error("Route with the peer's own OTC should be accepted:", otc, ok)
+	}
+
+	if otc, ok := imported(ROLE_CUSTOMER, 0); !ok || otc != 65001 {
+		t.Error("Route from a provider should be marked with its AS:", otc, ok)
+	}
+
+	if otc, ok := imported(ROLE_NONE, 64512); !ok || otc != 64512 {
+		t.Error("OTC should be ignored if no role is configured:", otc, ok)
+	}
+
+	// the session's AS is used rather than the AS_PATH, which may be
+	// empty, or start with another AS behind a transparent route server
+	path = nil
+
+	if otc, ok := imported(ROLE_CUSTOMER, 0); !ok || otc != 65001 {
+		t.Error("Route with an empty AS_PATH should be marked with the peer's AS:", otc, ok)
+	}
+
+	path = ASPath{{Type: AS_SEQUENCE, ASNs: []uint32{65002}}}
+
+	if otc, ok := imported(ROLE_PEER, 65001); !ok || otc != 65001 {
+		t.Error("Route with the peer's own OTC should be accepted from a route server:", otc, ok)
+	}
+}
+
+func TestRoleMismatch(t *testing.T) {
+
+	c, _ := roleCapability(ROLE_CUSTOMER)
+
+	if r := peerRole([]capability{c}); r != ROLE_CUSTOMER {
+		t.Fatal("Role capability not parsed:", r)
+	}
+
+	if roleMismatch(ROLE_PROVIDER, ROLE_CUSTOMER) || roleMismatch(ROLE_PEER, ROLE_PEER) || roleMismatch(ROLE_RS, ROLE_NONE) {
+		t.Error("Compatible roles should not mismatch")
+	}
+
+	if !roleMismatch(ROLE_PROVIDER, ROLE_PROVIDER) || !roleMismatch(ROLE_RS, ROLE_PEER) {
+		t.Error("Incompatible roles should mismatch")
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+// https://datatracker.ietf.org/doc/html/rfc4684 - Constrained Route Distribution for BGP/MPLS IP VPNs
+
+import (
+	"fmt"
+)
+
+var RT_CONSTRAIN = family{afi: 1, safi: 132}
+
+func mpCapability(f family) capability {
+	afi := htons(f.afi)
+	return capability{code: BGP4_MP, value: []byte{afi[0], afi[1], 0, f.safi}}
+}
+
+func peerMultiprotocol(caps []capability, f family) bool {
+	for _, c := range caps {
+		if c.code == BGP4_MP && len(c.value) == 4 && f == (family{afi: uint16(c.value[0])<<8 | uint16(c.value[1]), safi: c.value[3]}) {
+			return true
+		}
+	}
+	return false
+}
+
+// Length in bits[1], Origin AS[4], Route Target[8]
+func rtMembership(origin uint32, rt ExtendedCommunity) []byte {
+	as := htonl(origin)
+	var v [8]byte
+	for i := range v {
+		v[i] = byte(rt >> (56 - 8*i))
+	}
+	return append(append([]byte{96}, as[:]...), v[:]...)
+}
+
+// An UPDATE advertising membership of the route targets, and
+// withdrawing membership of those in withdrawn
+func (a *advert) rtConstrain(rts, withdrawn []ExtendedCommunity) update {
+
+	origin := uint32(a.ASNumber)
+
+	var reach, unreach []byte
+
+	for _, rt := range rts {
+		reach = append(reach, rtMembership(origin, rt)...)
+	}
+
+	for _, rt := range withdrawn {
+		unreach = append(unreach, rtMembership(origin, rt)...)
+	}
+
+	var attr []byte
+
+	if len(reach) > 0 {
+		attr = append(attr, WTCR, ORIGIN, 1, a.origin)
+		attr = append(attr, asPath(a.ASNumber, a.external())...)
+
+		if a.includeLocalPref() {
+			attr = append(attr, localPref(a.localPref())...)
+		}
+
+		mp_reach_nlri := []byte{0, 1, RT_CONSTRAIN.safi, 4}
+		mp_reach_nlri = append(mp_reach_nlri, a.NextHop[:]...)
+		mp_reach_nlri = append(mp_reach_nlri, 0) // reserved
+		mp_reach_nlri = append(mp_reach_nlri, reach...)
+		attr = append(attr, pathAttribute(ONCR, MP_REACH_NLRI, mp_reach_nlri)...)
+	}
+
+	if len(unreach) > 0 {
+		mp_unreach_nlri := append([]byte{0, 1, RT_CONSTRAIN.safi}, unreach...)
+		attr = append(attr, pathAttribute(ONCR, MP_UNREACH_NLRI, mp_unreach_nlri)...)
+	}
+
+	al := htons(uint16(len(attr)))
+
+	return append([]byte{0, 0, al[0], al[1]}, attr...)
+}
+
+// Route targets which are no longer present
+func rtWithdrawn(prev, curr []ExtendedCommunity) (withdrawn []ExtendedCommunity) {
+	for _, p := range prev {
+		if !extendedCommunityMatch([]ExtendedCommunity{p}, curr) {
+			withdrawn = append(withdrawn, p)
+		}
+	}
+	return
+}
+
+func rtDiff(a, b []ExtendedCommunity) bool {
+	return fmt.Sprint(a) != fmt.Sprint(b)
+}
@@ -0,0 +1,51 @@
+package bgp
+
+import (
+	"testing"
+)
+
+func TestRTMembership(t *testing.T) {
+
+	rt := ExtendedCommunity(0x0002fde800000064) // route target 65000:100
+
+	nlri := rtMembership(65001, rt)
+
+	exp := []byte{96, 0, 0, 0xfd, 0xe9, 0, 2, 0xfd, 0xe8, 0, 0, 0, 0x64}
+
+	if !byteSliceEqual(nlri, exp) {
+		t.Fatalf("RT membership NLRI incorrect: %v %v", nlri, exp)
+	}
+
+	a := advert{ASNumber: 65001, PeerASNumber: 65001, NextHop: [4]byte{10, 1, 2, 3}}
+
+	msg := a.rtConstrain([]ExtendedCommunity{rt}, nil)
+
+	mp := findAttribute(msg, MP_REACH_NLRI)
+
+	if len(mp) != 1 || !byteSliceEqual(mp[0], append([]byte{0, 1, 132, 4, 10, 1, 2, 3, 0}, exp...)) {
+		t.Fatalf("MP_REACH_NLRI incorrect: %v", mp)
+	}
+
+	if lp := findAttribute(msg, LOCAL_PREF); len(lp) != 1 {
+		t.Error("LOCAL_PREF should be sent to an internal peer")
+	}
+
+	// the update is otherwise well formed, and the unknown SAFI ignored
+	if u, n := decodeUpdate(msg); n != nil || len(u.advertised) != 0 {
+		t.Errorf("Decode failed: %v %v", n, u)
+	}
+
+	msg = a.rtConstrain(nil, rtWithdrawn([]ExtendedCommunity{rt, 1}, []ExtendedCommunity{1}))
+
+	if mp = findAttribute(msg, MP_UNREACH_NLRI); len(mp) != 1 || !byteSliceEqual(mp[0], append([]byte{0, 1, 132}, exp...)) {
+		t.Fatalf("MP_UNREACH_NLRI incorrect: %v", mp)
+	}
+
+	if mp = findAttribute(msg, MP_REACH_NLRI); len(mp) != 0 {
+		t.Fatalf("Unexpected MP_REACH_NLRI: %v", mp)
+	}
+
+	if c := mpCapability(RT_CONSTRAIN); !peerMultiprotocol([]capability{c}, RT_CONSTRAIN) || peerMultiprotocol([]capability{c}, IPV4_UNICAST) {
+		t.Error("Capability mismatch:", c)
+	}
+}
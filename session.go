@@ -19,6 +19,7 @@
 package bgp
 
 import (
+	"errors"
 	"fmt"
 	"net/netip"
 	"sync"
@@ -51,6 +52,52 @@ type Status struct {
 	RemoteASN         uint16        `json:"remote_asn"`
 	AdjRIBOut         []string      `json:"adj_rib_out"`
 	LocalIP           string        `json:"local_ip"`
+	QueueDepth        int           `json:"queue_depth"`
+	LastErrorTime     time.Time     `json:"last_error_time,omitempty"`
+	ReceivedPrefixes  int           `json:"received_routes"`
+	MessagesReceived  Messages      `json:"messages_received"`
+	MessagesSent      Messages      `json:"messages_sent"`
+	PeerCapabilities  []string      `json:"peer_capabilities,omitempty"` // offered in the peer's OPEN
+}
+
+// Capabilities received from the peer on the current session
+type Capabilities struct {
+	GracefulRestart       bool   `json:"graceful_restart,omitempty"`
+	RestartTime           uint16 `json:"restart_time,omitempty"`
+	AddPathIPv4           bool   `json:"add_path_ipv4,omitempty"`
+	AddPathIPv6           bool   `json:"add_path_ipv6,omitempty"`
+	RouteTargetConstraint bool   `json:"route_target_constraint,omitempty"`
+	SoftwareVersion       string `json:"software_version,omitempty"`
+	Role                  string `json:"role,omitempty"` // RFC 9234
+}
+
+// Details from the OPEN message received from the peer
+type PeerInfo struct {
+	ASNumber     uint16  `json:"as_number"`
+	HoldTime     uint16  `json:"hold_time"`
+	RouterID     IP4     `json:"router_id"`
+	Capabilities []uint8 `json:"capabilities,omitempty"` // codes of all capabilities sent
+}
+
+// Message counts by type
+type Messages struct {
+	Open         uint64 `json:"open"`
+	Update       uint64 `json:"update"`
+	Notification uint64 `json:"notification"`
+	Keepalive    uint64 `json:"keepalive"`
+}
+
+func (m *Messages) count(t uint8) {
+	switch t {
+	case M_OPEN:
+		m.Open++
+	case M_UPDATE:
+		m.Update++
+	case M_NOTIFICATION:
+		m.Notification++
+	case M_KEEPALIVE:
+		m.Keepalive++
+	}
 }
 
 const (
@@ -68,6 +115,37 @@ type Session struct {
 	mutex  sync.Mutex
 	update _update
 	logs   BGPNotify
+	ribIn  map[netip.Prefix]ReceivedRoute
+	conn   *connection
+	stale  *staleRIB
+
+	staleTimer timer // purges routes retained from a restarting peer
+	timers     clock // wall clock if nil - see clock.go
+
+	paths map[netip.Prefix][]ReceivedRoute // see AddPaths
+
+	ribInPre map[netip.Prefix]ReceivedRoute // before import policy - see SoftReconfigIn
+	ribInLRU ribInLRU                       // see Parameters.AdjRIBInLimit
+	peer     string
+	id       IP         // router ID for RunConn
+	defaults Parameters // DefaultParameters when the session was created
+	stopIdle func()     // see idleUpdates
+
+	negotiated Capabilities
+	peerInfo   *PeerInfo
+	offered    []capability // sent in our OPEN - see CapabilityReport
+	peerCaps   []capability
+	peerOpen   []byte // raw optional parameters - see PeerOpenRaw
+	ribOut     RIBOutStats
+
+	inject chan message // resilience testing only - see inject.go
+
+	health healthRIB // see SetHealth
+
+	families map[family]bool // negotiated with the peer
+	refresh  *refreshWait    // see RequestFullTable
+
+	keepalives []*keepaliveWait // see Shutdown
 }
 
 func (s *Session) log() BGPNotify {
@@ -85,13 +163,12 @@ func toaddr(in []IP) (out []netip.Addr) {
 }
 
 func NewSession(id IP, peer string, p Parameters, r []IP, l BGPNotify) *Session {
+	return newSession(id, peer, p, toaddr(r), l)
+}
 
-	var rib []netip.Addr
-	for _, i := range r {
-		rib = append(rib, netip.AddrFrom4(i))
-	}
-
-	s := &Session{p: p, rib: toaddr(r), logs: l, status: Status{State: IDLE}, update: newupdate(p, rib)}
+func newSession(id IP, peer string, p Parameters, r []netip.Addr, l BGPNotify) *Session {
+	s := &Session{p: p, rib: _rib(r).dup(), logs: l, status: Status{State: IDLE}, defaults: DefaultParameters, peer: peer}
+	s.update = newupdate(s.parameters(), r)
 	s.c = s.session(id, peer)
 	return s
 }
@@ -101,43 +178,221 @@ func (s *Session) Start(id IP, peer string, p Parameters, r []netip.Addr, l BGPN
 	s.rib = r
 	s.logs = l
 	s.status = Status{State: IDLE}
-	s.update = newupdate(p, r)
+	s.defaults = DefaultParameters
+	s.update = newupdate(s.parameters(), r)
+	s.peer = peer
 	s.c = s.session(id, peer)
 }
 
 func (s *Session) Status() Status {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.status.Duration = time.Now().Sub(s.status.When) / time.Second
+	return s.currentStatus()
+}
+
+// Called with the mutex held
+func (s *Session) currentStatus() Status {
+	s.status.Duration = s.clock().Now().Sub(s.status.When) / time.Second
+	s.status.QueueDepth = 0
+	if s.conn != nil {
+		s.status.QueueDepth = s.conn.depth()
+	}
+	s.status.ReceivedPrefixes = len(s.ribIn)
+	s.status.PeerCapabilities = nil
+	if s.peerInfo != nil {
+		s.status.PeerCapabilities = peerCapabilities(s.peerCaps)
+	}
 	return s.status
 }
 
+// Queue UPDATEs, applying the configured policy if the outbound queue
+// is full - either wait for it to drain (during which time no further
+// updates are read from the channel, blocking callers once it fills)
+// or tear down the session.
+func (s *Session) send(conn *connection, updates []message) (notification, bool) {
+
+	if conn.full() {
+		if s.update.Parameters.QueuePolicy == QUEUE_CEASE {
+			n := notification{code: CEASE, sub: OUT_OF_RESOURCES}
+			conn.queue(&n)
+			return n, false
+		}
+
+		if !conn.wait() {
+			return local(REMOTE_SHUTDOWN, conn.lastError()), false
+		}
+	}
+
+	conn.queue(updates...)
+
+	return notification{}, true
+}
+
+// Optionally implemented by the BGPNotify passed to a session to be
+// told when withdrawals have been written to the peer's connection
+// (called from the connection's writer, so it should not block)
+type BGPWithdrawn interface {
+	BGPWithdrawn(peer string, prefixes []netip.Prefix)
+}
+
+// A function to confirm the withdrawals in the NLRI, or nil if there
+// are none or nobody is interested
+func (s *Session) withdrawn(peer string, nlri map[netip.Addr]bool) func() {
+
+	w, ok := s.log().(BGPWithdrawn)
+
+	if !ok {
+		return nil
+	}
+
+	var prefixes []netip.Prefix
+
+	for ip, v := range nlri {
+		if !v {
+			prefixes = append(prefixes, hostRoute(ip))
+		}
+	}
+
+	if len(prefixes) < 1 {
+		return nil
+	}
+
+	return func() { w.BGPWithdrawn(peer, prefixes) }
+}
+
+func (s *Session) received(t uint8) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status.MessagesReceived.count(t)
+	if t == M_KEEPALIVE {
+		s.keepalive()
+	}
+}
+
+func (s *Session) sent(t uint8) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status.MessagesSent.count(t)
+}
+
+func (s *Session) connection(c *connection) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.conn = c
+}
+
+// An update for the RIB, after replacing it with the result of change
+// (if not nil). The RIB may be changed from other goroutines (see
+// SetHealth), so it is only accessed with the mutex held.
+func (s *Session) ribUpdate(change func([]netip.Addr) []netip.Addr) _update {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if change != nil {
+		s.rib = change(s.rib)
+	}
+
+	return newupdate(s.parameters(), s.rib)
+}
+
+// The session's parameters with the defaults applied - see Merge
+func (s *Session) parameters() Parameters {
+	return s.p.Merge(s.defaults)
+}
+
 func (s *Session) RIB(r []IP) {
-	s.rib = toaddr(r)
-	s.c <- newupdate(s.p, s.rib)
+	s.c <- s.ribUpdate(func([]netip.Addr) []netip.Addr { return toaddr(r) })
 }
 
+// Replace the RIB. Addresses should be supplied in their canonical form
+// - IPv4-mapped IPv6 addresses (eg. ::ffff:192.0.2.1) are treated as
+// IPv4 and advertised in the IPv4 NLRI.
 func (s *Session) LocRIB(r []netip.Addr) {
-	s.rib = r
-	s.c <- newupdate(s.p, s.rib)
+	s.c <- s.ribUpdate(func([]netip.Addr) []netip.Addr { return r })
 }
 
+// Immediately withdraw a single prefix, which is also removed from the
+// RIB. Prefixes which are not currently advertised are ignored.
+func (s *Session) Withdraw(prefix netip.Prefix) error {
+
+	if !prefix.IsValid() || !prefix.IsSingleIP() {
+		return errors.New("Only host prefixes may be withdrawn: " + prefix.String())
+	}
+
+	ip := prefix.Addr().Unmap() // as in the RIB - see _rib.dup()
+
+	u := s.ribUpdate(func(r []netip.Addr) (rib []netip.Addr) {
+		for _, a := range r {
+			if a.Unmap() != ip {
+				rib = append(rib, a)
+			}
+		}
+		return
+	})
+
+	u.withdraw = ip
+	s.c <- u
+
+	return nil
+}
+
+// Withdraw every prefix currently advertised to the peer, including
+// ADD-PATH paths, without resetting the session - eg. before changing
+// export policy. The RIB is unchanged, but nothing is advertised
+// again (not after damping, a route refresh or a reconnection) until
+// the next update to the RIB, paths or parameters.
+func (s *Session) WithdrawAll() {
+	u := s.ribUpdate(nil)
+	u.clear = true
+	s.c <- u
+}
+
+// Send the initial advertisement immediately, rather than waiting for
+// Parameters.InitialAdvertDelay to elapse
+func (s *Session) Flush() {
+	u := s.ribUpdate(nil)
+	u.flush = true
+	s.c <- u
+}
+
+// Close the session with the chosen NOTIFICATION (eg. CEASE and
+// OTHER_CONFIGURATION_CHANGE). If down is set then the session
+// stays in IDLE until Reset is called again with down unset, otherwise
+// it reconnects after the usual retry interval.
+func (s *Session) Reset(code, sub uint8, data []byte, down bool) {
+	u := s.ribUpdate(nil)
+	u.reset = &notification{code: code, sub: sub, data: data}
+	u.down = down
+	s.c <- u
+}
+
+// Change the parameters of a running session without resetting it.
+// If attributes (MED, LOCAL_PREF, communities, export policy, etc.)
+// have changed then all prefixes are re-advertised, and any which are
+// now permitted or denied by export policy are advertised or withdrawn.
+// Session level parameters (AS number, hold time, capabilities) take
+// effect when the session is next established.
 func (s *Session) Configure(p Parameters) {
+	s.mutex.Lock()
 	s.p = p
-	s.c <- newupdate(s.p, s.rib)
+	s.mutex.Unlock()
+	s.c <- s.ribUpdate(nil)
 }
 
 func (s *Session) Close() {
+	s.health.mutex.Lock()
+	defer s.health.mutex.Unlock()
+	s.stopHealth()
 	close(s.c)
 }
 
 func (s *Session) Stop() {
-	close(s.c)
+	s.Close()
 }
 
 func (s *Session) state2(state string) {
 	s.status.State = state
-	s.status.When = time.Now().Round(time.Second)
+	s.status.When = s.clock().Now().Round(time.Second)
 }
 
 func (s *Session) state(state string) {
@@ -150,9 +405,83 @@ func (s *Session) error(error string) string {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.status.LastError = error
+	if error != "" {
+		s.status.LastErrorTime = s.clock().Now()
+	}
 	return error
 }
 
+// Capabilities received from the peer, if the session is established
+func (s *Session) Negotiated() Capabilities {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.negotiated
+}
+
+func (s *Session) negotiate(c Capabilities) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.negotiated = c
+}
+
+// Details from the peer's OPEN message - false if it has not been
+// received on the current connection
+func (s *Session) PeerInfo() (PeerInfo, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.peerInfo == nil {
+		return PeerInfo{}, false
+	}
+	return *s.peerInfo, true
+}
+
+// A copy of the optional parameters from the peer's OPEN message (not
+// including the length field), for inspecting capabilities which are
+// not otherwise decoded - nil if it has not been received
+func (s *Session) PeerOpenRaw() []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.peerInfo == nil {
+		return nil
+	}
+	return append([]byte{}, s.peerOpen...)
+}
+
+func (s *Session) opened(o *open, caps []capability) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if o == nil {
+		s.peerInfo = nil
+		s.peerCaps = nil
+		s.peerOpen = nil
+		return
+	}
+
+	s.peerCaps = caps
+	s.peerOpen = append([]byte{}, o.op...)
+
+	i := PeerInfo{ASNumber: o.asNumber, HoldTime: o.holdTime, RouterID: o.routerID}
+
+	for _, c := range caps {
+		i.Capabilities = append(i.Capabilities, c.code)
+	}
+
+	s.peerInfo = &i
+}
+
+func (s *Session) accepted(f map[family]bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.families = f
+}
+
+func (s *Session) offer(caps []capability) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.offered = caps
+}
+
 func (s *Session) established(ht uint16, local, remote uint16) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -173,6 +502,7 @@ func (s *Session) active(ht uint16, local uint16, ip [4]byte) {
 
 	s.status.AdjRIBOut = nil
 	s.status.Prefixes = 0
+	s.ribOut = RIBOutStats{}
 	s.status.Advertised = 0
 	s.status.Withdrawn = 0
 	s.status.HoldTime = ht
@@ -221,47 +551,39 @@ func (s *Session) session(id IP, peer string) chan _update {
 
 		retry_time := 30 * time.Second
 
-		timer := time.NewTimer(1) // fires immediately
+		timer := s.clock().NewTimer(1) // fires immediately
 		defer timer.Stop()
 
 		var ok bool
+		var down bool // see Reset()
 
 		for {
 			select {
-			case <-timer.C:
+			case <-timer.C():
 				s.log().BGPSession(peer, true, "Connecting ...")
-				b, n := s.try(id, peer, updates)
-				var e string
+				b, n := s.try(id, peer, updates, newConnection, nil)
+				s.ended(peer, b, n)
 
-				if b {
-					e = fmt.Sprintf("Received notification[%d:%d]: %s", n.code, n.sub, n.note())
-					s.log().BGPSession(peer, false, e)
-
-				} else {
-					if n.code == 0 {
-						e = n.note()
-					} else {
-						e = fmt.Sprintf("Sent notification[%d:%d]: %s", n.code, n.sub, n.note())
-					}
-					if len(n.data) > 0 {
-						e += " (" + string(n.data) + ")"
-					}
-
-					if n.code == 0 && n.sub == LOCAL_SHUTDOWN {
-						s.log().BGPSession(peer, true, e)
-					} else {
-						s.log().BGPSession(peer, false, e) // treat as "remote" as it was a failed connection, not a local shutdown
-					}
+				if down = s.update.reset != nil && s.update.down; !down {
+					timer.Reset(retry_time)
 				}
 
-				s.error(e)
-				s.idle()
-				timer.Reset(retry_time)
-
 			case s.update, ok = <-updates: // stores last update
 				if !ok {
 					return
 				}
+
+				if s.update.reset != nil && s.update.down != down {
+					// not connected, so only whether we retry changes
+					if down = s.update.down; !down {
+						timer.Reset(1)
+					} else if !timer.Stop() {
+						select {
+						case <-timer.C():
+						default:
+						}
+					}
+				}
 			}
 		}
 
@@ -276,7 +598,39 @@ func (s *Session) idle() {
 	s.state2(IDLE)
 }
 
-func (s *Session) try(routerid IP, peer string, updates chan _update) (bool, notification) {
+// Log the reason that the session ended, and return to IDLE
+func (s *Session) ended(peer string, remote bool, n notification) (e string) {
+
+	if remote {
+		e = fmt.Sprintf("Received notification[%d:%d]: %s", n.code, n.sub, n.note())
+		s.log().BGPSession(peer, false, e)
+
+	} else {
+		if n.code == 0 {
+			e = n.note()
+		} else {
+			e = fmt.Sprintf("Sent notification[%d:%d]: %s", n.code, n.sub, n.note())
+		}
+		if n.code == 0 && len(n.data) > 0 {
+			e += " (" + string(n.data) + ")"
+		}
+
+		if n.code == 0 && n.sub == LOCAL_SHUTDOWN {
+			s.log().BGPSession(peer, true, e)
+		} else {
+			s.log().BGPSession(peer, false, e) // treat as "remote" as it was a failed connection, not a local shutdown
+		}
+	}
+
+	s.error(e)
+	s.idle()
+
+	return e
+}
+
+type dialer func(IP4, string, socketOptions) (*connection, error)
+
+func (s *Session) try(routerid IP, peer string, updates chan _update, dial dialer, stop <-chan struct{}) (remote bool, n notification) {
 
 	nexthop4 := s.update.Parameters.NextHop4
 	nexthop6 := s.update.Parameters.NextHop6
@@ -296,60 +650,151 @@ func (s *Session) try(routerid IP, peer string, updates chan _update) (bool, not
 
 	s.active(holdtime, asnumber, localip)
 
-	conn, err := newConnection(localip, peer)
+	conn, err := dial(localip, peer, s.update.Parameters.socketOptions())
 
 	if err != nil {
 		return false, local(CONNECTION_FAILED, err.Error())
 	}
 
 	defer conn.close()
+	defer s.dropped()
+
+	conn.limit = s.update.Parameters.QueueLimit
+	conn.sent = s.sent
+
+	s.connection(conn)
+	defer s.connection(nil)
 
 	var local6 [16]byte
 
 	loc, ok := conn.local()
 
 	if !ok {
-		return false, local(INVALID_LOCALIP, "No local address")
+		loc = localip[:] // not TCP (eg. a pipe or tunnel) so use the source address, if any
 	}
 
 	var ipv6 bool
 
-	var localaddr string
+	var localaddr netip.Addr
 
 	if len(loc) == 4 {
 		copy(localip[:], loc[:])
-		localaddr = netip.AddrFrom4(localip).String()
+		localaddr = netip.AddrFrom4(localip)
 	} else if len(loc) == 16 {
 		copy(local6[:], loc[:])
 		ipv6 = true
-		localaddr = netip.AddrFrom16(local6).String()
+		localaddr = netip.AddrFrom16(local6)
 	} else {
 		return false, local(INVALID_LOCALIP, "No local address")
 	}
 
 	s.mutex.Lock()
 	s.status.HoldTime = holdtime
-	s.status.LocalIP = localaddr
+	s.status.LocalIP = localaddr.String()
 	s.mutex.Unlock()
 
 	s.connect()
 
 	o := open{asNumber: asnumber, holdTime: holdtime, routerID: routerid, multiprotocol: multiprotocol}
+
+	families := []family{IPV4_UNICAST}
+
+	if multiprotocol {
+		families = append(families, IPV6_UNICAST)
+	}
+
+	graceful := s.update.Parameters.GracefulRestart
+	restart := s.update.Parameters.restartTime()
+
+	var stale *staleRIB
+
+	if graceful {
+		stale = s.restarting()
+		o.caps = append(o.caps, gracefulRestart(stale != nil, restart, families))
+	}
+
+	addpaths := s.update.Parameters.AddPathSendCount
+	pathids := pathIDs{}
+
+	if addpaths > 0 {
+		o.caps = append(o.caps, addPath(ADD_PATH_SEND, families))
+	}
+
+	rtc := len(s.update.Parameters.RouteTargets) > 0 // negotiated if the peer also supports the SAFI
+
+	if rtc {
+		o.caps = append(o.caps, mpCapability(RT_CONSTRAIN))
+	}
+
+	role := s.update.Parameters.PeerRole
+
+	if c, ok := roleCapability(role); ok {
+		o.caps = append(o.caps, c)
+	}
+
+	if v := s.update.Parameters.SoftwareVersion; v != "" {
+		o.caps = append(o.caps, softwareVersion(v))
+	}
+
+	refresh := s.update.Parameters.RouteRefresh
+	var enhanced bool // peer supports enhanced route refresh
+
+	if refresh != ROUTE_REFRESH_OFF {
+		o.caps = append(o.caps, capability{code: ROUTE_REFRESH}, capability{code: ENHANCED_ROUTE_REFRESH})
+	}
+
+	mpipv4 := s.update.Parameters.MultiprotocolIPv4
+	nhlength4 := 4
+
+	if s.update.Parameters.NextHopLength4 == 16 {
+		nhlength4 = 16
+	}
+
+	if mpipv4 && !multiprotocol {
+		o.caps = append(o.caps, mpCapability(IPV4_UNICAST))
+	}
+
+	if mpipv4 && nhlength4 != 4 {
+		o.caps = append(o.caps, extendedNextHop())
+	}
+
 	conn.queue(&o)
 
+	s.offer(o.offered())
 	s.state(OPEN_SENT)
 
 	hold_time_ns := time.Duration(holdtime) * time.Second
-	hold_timer := time.NewTimer(hold_time_ns)
+	clock := s.clock()
+
+	hold_timer := clock.NewTimer(hold_time_ns)
 	defer hold_timer.Stop()
 
 	keepalive_time_ns := hold_time_ns / 3
-	keepalive_timer := time.NewTicker(keepalive_time_ns)
+	keepalive_timer := clock.NewTicker(keepalive_time_ns)
 	defer keepalive_timer.Stop()
 
+	var monitor keepaliveMonitor // started when established
+
+	var accepted map[family]bool // address families negotiated with the peer
+	warned := map[family]bool{}  // unnegotiated families already reported
+
+	var received <-chan message = conn.C
+
+	if s.inject != nil {
+		done := make(chan struct{})
+		defer close(done)
+		received = merge(conn.C, s.inject, done)
+	}
+
 	var nul4 IP4
 	var nul6 IP6
 
+	self4 := localip
+
+	if self4 == nul4 {
+		self4 = routerid
+	}
+
 	if nexthop4 == nul4 {
 		nexthop4 = localip
 	}
@@ -367,6 +812,28 @@ func (s *Session) try(routerid IP, peer string, updates chan _update) (bool, not
 	var nlri map[netip.Addr]bool
 	var adjRIBOut []netip.Addr
 	var parameters Parameters
+	var from source
+
+	var negotiated bool    // graceful restart
+	var peerRestart uint16 // restart time advertised by the peer
+	var up bool            // the session reached Established
+
+	defer func() {
+		// routes retained from a previous session are left alone if this
+		// attempt failed before Established - they remain until End-of-RIB
+		// or the restart time expires
+		if up {
+			// graceful restart does not apply if the session was closed with a NOTIFICATION
+			if !negotiated || n.code != 0 {
+				peerRestart = 0
+			} else {
+				s.retain(adjRIBOut, restart)
+			}
+			s.peerDown(peer, peerRestart)
+		}
+		s.negotiate(Capabilities{})
+		s.opened(nil, nil)
+	}()
 
 	notify := func(code, sub byte) notification {
 		n := notification{code: code, sub: sub}
@@ -380,18 +847,181 @@ func (s *Session) try(routerid IP, peer string, updates chan _update) (bool, not
 		//External:      external,
 		NextHop:       nexthop4,
 		NextHop6:      nexthop6,
+		self4:         self4,
+		self6:         local6,
 		Multiprotocol: multiprotocol,
+		backup:        s.isBackup,
+	}
+
+	var advertised bool // initial advertisement has been sent
+	var advert_delay <-chan time.Time
+
+	// send the initial advertisement of the RIB
+	advertise := func() (notification, bool) {
+		advertised = true
+		advert_delay = nil
+
+		t := clock.Now()
+		p := s.update.Parameters
+		u := updateTemplate.withParameters(p, remoteasn)
+
+		// initial NLRI will simply advertise any initial addresses in the RIB
+		//adjRIBOut, nlri = NLRI(s.update.adjRIBOut(ipv6), nil, false)
+		adjRIBOut, nlri = s.update.nlri(nil, ipv6, false)
+		parameters = p
+
+		if s.update.clear {
+			adjRIBOut, nlri = nil, nil // withdrawn before we (re)connected - see WithdrawAll
+		}
+
+		//fmt.Println("Init:", adjRIBOut, nlri)
+
+		if len(nlri) > 0 {
+			if updates, err := u.build(nlri); err != nil {
+				s.warn(peer, err.Error())
+				return notify(CEASE, OUT_OF_RESOURCES), false
+			} else if n, ok := s.send(conn, updates); !ok {
+				return n, false
+			}
+		}
+
+		for _, a := range s.allPaths(s.update.clear) {
+			if updates, err := u.addPathUpdates(pathids, addpaths, a.prefix, a.candidates); err != nil {
+				return notify(CEASE, OUT_OF_RESOURCES), false
+			} else if n, ok := s.send(conn, updates); !ok {
+				return n, false
+			}
+		}
+
+		if rtc {
+			rt := u.rtConstrain(p.RouteTargets, nil)
+			conn.queue(&rt)
+		}
+
+		if negotiated {
+			for _, f := range families {
+				conn.queue(endOfRIB(f))
+			}
+			if rtc {
+				conn.queue(endOfRIB(RT_CONSTRAIN))
+			}
+		}
+
+		if stale != nil {
+			stale.refresh(adjRIBOut)
+			if purged := stale.endOfRIB(); len(purged) > 0 {
+				s.log().BGPSession(peer, true, fmt.Sprintf("Graceful restart: %d stale routes not refreshed", len(purged)))
+			}
+			s.restarted()
+		}
+
+		s.update_stats(clock.Now().Sub(t), adjRIBOut, nlri)
+		s.ribOutStats(u.ribOutStats(adjRIBOut))
+
+		return notification{}, true
+	}
+
+	// send the NLRI calculated for an update to the RIB or parameters
+	transmit := func(u advert, t time.Time) (notification, bool) {
+		if len(nlri) > 0 {
+			if updates, err := u.build(nlri); err != nil {
+				s.warn(peer, err.Error())
+				return notify(CEASE, OUT_OF_RESOURCES), false
+			} else if n, ok := s.send(conn, updates); !ok {
+				return n, false
+			}
+
+			if f := s.withdrawn(peer, nlri); f != nil {
+				conn.then(f)
+			}
+		}
+
+		s.update_stats(clock.Now().Sub(t), adjRIBOut, nlri)
+		s.ribOutStats(u.ribOutStats(adjRIBOut))
+
+		return notification{}, true
+	}
+
+	// send the Adj-RIB-Out for a family again at the peer's request,
+	// bracketed by BoRR/EoRR markers if enhanced refresh is supported
+	// (markers are only sent in response to a request - RFC 7313)
+	resend := func(f family, markers bool) (notification, bool) {
+		u := updateTemplate.withParameters(parameters, remoteasn)
+
+		if markers {
+			conn.queue(&routeRefresh{family: f, subtype: REFRESH_BORR})
+		}
+
+		m := map[netip.Addr]bool{}
+
+		for _, ip := range adjRIBOut {
+			if addrFamily(ip) == f {
+				m[ip] = true
+			}
+		}
+
+		if len(m) > 0 {
+			if updates, err := u.build(m); err != nil {
+				s.warn(peer, err.Error())
+				return notify(CEASE, OUT_OF_RESOURCES), false
+			} else if n, ok := s.send(conn, updates); !ok {
+				return n, false
+			}
+		}
+
+		for _, a := range s.allPaths(s.update.clear) {
+			if addrFamily(a.prefix.Addr()) != f {
+				continue
+			}
+			if updates, err := u.addPathUpdates(pathids, addpaths, a.prefix, a.candidates); err != nil {
+				return notify(CEASE, OUT_OF_RESOURCES), false
+			} else if n, ok := s.send(conn, updates); !ok {
+				return n, false
+			}
+		}
+
+		if markers {
+			conn.queue(&routeRefresh{family: f, subtype: REFRESH_EORR})
+		}
+
+		return notification{}, true
+	}
+
+	damping := newDampener(s.update.Parameters.Damping)
+
+	var reuse <-chan time.Time
+
+	if damping != nil {
+		t := clock.NewTicker(time.Second)
+		defer t.Stop()
+		reuse = t.C()
+	}
+
+	var periodic <-chan time.Time
+
+	if d := s.update.Parameters.RefreshInterval; d > 0 {
+		t := clock.NewTicker(d)
+		defer t.Stop()
+		periodic = t.C()
 	}
 
 	for {
 		select {
-		case m, ok := <-conn.C:
+		case m, ok := <-received:
 
 			if !ok {
-				return false, local(REMOTE_SHUTDOWN, conn.Error)
+				return false, local(REMOTE_SHUTDOWN, conn.lastError())
+			}
+
+			if hold_time_ns > 0 {
+				hold_timer.Reset(hold_time_ns)
 			}
 
-			hold_timer.Reset(hold_time_ns)
+			s.received(m.Type())
+
+			if w := monitor.observe(clock.Now()); w != "" {
+				s.warn(peer, w)
+			}
 
 			switch m.Type() {
 			case M_NOTIFICATION:
@@ -399,7 +1029,26 @@ func (s *Session) try(routerid IP, peer string, updates chan _update) (bool, not
 				return true, *n
 
 			case M_KEEPALIVE:
-				if s.status.State == OPEN_SENT {
+				// RFC 4271 8.2.2: a KEEPALIVE confirms our OPEN in
+				// OpenConfirm, and just restarts the hold timer (done
+				// above) once Established; anywhere else it's an error
+				switch s.status.State {
+				case ESTABLISHED:
+				case OPEN_CONFIRM:
+					s.established(holdtime, asnumber, remoteasn)
+					up = true
+
+					monitor = newKeepaliveMonitor(hold_time_ns, clock.Now())
+
+					if delay := s.update.Parameters.InitialAdvertDelay; delay > 0 {
+						// wait for the application to populate the RIB - see Flush()
+						t := clock.NewTimer(delay)
+						defer t.Stop()
+						advert_delay = t.C()
+					} else if n, ok := advertise(); !ok {
+						return false, n
+					}
+				default:
 					return false, notify(FSM_ERROR, 0)
 				}
 
@@ -413,17 +1062,17 @@ func (s *Session) try(routerid IP, peer string, updates chan _update) (bool, not
 					return false, notify(FSM_ERROR, 0)
 				}
 
-				//if m.open.version != 4 {
-				if o.version != 4 {
-					return false, notify(OPEN_MESSAGE_ERROR, UNSUPPORTED_VERSION_NUMBER)
+				if n := o.validate(routerid); n != nil {
+					conn.queue(n)
+					return false, *n
 				}
 
-				if o.holdTime < 3 {
+				if o.holdTime == 0 && s.update.Parameters.RejectZeroHoldTime {
 					return false, notify(OPEN_MESSAGE_ERROR, UNNACEPTABLE_HOLD_TIME)
 				}
 
-				if o.routerID == routerid {
-					return false, notify(OPEN_MESSAGE_ERROR, BAD_BGP_ID)
+				if w := holdTimeMismatch(holdtime, o.holdTime); w != "" {
+					s.warn(peer, w)
 				}
 
 				if o.holdTime < holdtime {
@@ -432,84 +1081,283 @@ func (s *Session) try(routerid IP, peer string, updates chan _update) (bool, not
 					keepalive_time_ns = hold_time_ns / 3
 				}
 
-				hold_timer.Reset(hold_time_ns)
-				keepalive_timer.Reset(keepalive_time_ns)
+				if holdtime == 0 {
+					// RFC 4271 4.4: no hold timer, and no KEEPALIVEs
+					// unless the peer is known to need them anyway
+					stopTimer(hold_timer)
+					stopTimer(keepalive_timer)
+					if d := s.update.Parameters.ZeroHoldTimeKeepalive; d > 0 {
+						keepalive_timer.Reset(d)
+					}
+				} else {
+					hold_timer.Reset(hold_time_ns)
+					keepalive_timer.Reset(keepalive_time_ns)
+				}
 
 				//external = o.asNumber != asnumber
 				remoteasn = o.asNumber
 
-				s.established(holdtime, asnumber, remoteasn)
+				from = source{addr: conn.remote(), routerID: o.routerID, external: remoteasn != asnumber, asn: remoteasn, local: localaddr}
 
-				conn.queue(&keepalive{})
+				caps, _ := o.capabilities()
 
-				t := time.Now()
-				p := s.update.Parameters
-				u := updateTemplate.withParameters(p, remoteasn)
+				s.opened(o, caps)
 
-				// initial NLRI will simply advertise any initial addresses in the RIB
-				//adjRIBOut, nlri = NLRI(s.update.adjRIBOut(ipv6), nil, false)
-				adjRIBOut, nlri = s.update.nlri(nil, ipv6, false)
-				parameters = p
+				if roleMismatch(role, peerRole(caps)) {
+					return false, notify(OPEN_MESSAGE_ERROR, ROLE_MISMATCH)
+				}
+
+				if graceful {
+					peerRestart, negotiated = peerRestartTime(caps)
+				}
 
-				//fmt.Println("Init:", adjRIBOut, nlri)
+				if addpaths > 0 {
+					updateTemplate.addPath4, updateTemplate.addPath6 = peerAddPathReceive(caps)
+					updateTemplate.pathID = ORIGINATED_PATH_ID
+				}
 
-				if len(nlri) > 0 {
-					if updates := u.updates(nlri); len(updates) < 1 {
-						return false, notify(CEASE, OUT_OF_RESOURCES)
-					} else {
-						conn.queue(updates...)
+				rtc = rtc && peerMultiprotocol(caps, RT_CONSTRAIN)
+
+				accepted = acceptedFamilies(ipv6, multiprotocol, rtc, caps)
+				s.accepted(accepted)
+
+				enhanced = refresh != ROUTE_REFRESH_OFF && hasCapability(caps, ENHANCED_ROUTE_REFRESH)
+
+				if mpipv4 && peerMultiprotocol(caps, IPV4_UNICAST) {
+					updateTemplate.mpIPv4 = true
+					updateTemplate.nextHopLength4 = 4
+					if nhlength4 != 4 && peerExtendedNextHop(caps) {
+						updateTemplate.nextHopLength4 = nhlength4
 					}
 				}
 
-				s.update_stats(time.Now().Sub(t), adjRIBOut, nlri)
+				pc := Capabilities{SoftwareVersion: peerSoftwareVersion(caps), Role: peerRole(caps)}
+				pc.RestartTime, pc.GracefulRestart = peerRestartTime(caps)
+				pc.AddPathIPv4, pc.AddPathIPv6 = peerAddPathReceive(caps)
+				pc.RouteTargetConstraint = peerMultiprotocol(caps, RT_CONSTRAIN)
+				s.negotiate(pc)
+
+				if !negotiated {
+					// routes retained from a previous session are not going to be refreshed
+					s.purgeStale(peer, func(netip.Prefix) bool { return true })
+				}
+
+				s.state(OPEN_CONFIRM)
+
+				conn.queue(&keepalive{})
 
 			case M_UPDATE:
 				if s.status.State != ESTABLISHED {
 					return false, notify(FSM_ERROR, 0)
 				}
-				// we don't process update contents because we don't need to do any routing
+
+				u, n := decodeUpdateFrom(m.Body(), remoteasn != asnumber, s.update.Parameters.MaxDecodeDepth)
+
+				if n != nil {
+					return false, notify(n.code, n.sub)
+				}
+
+				if f, ok := u.unnegotiated(accepted); ok {
+					if s.update.Parameters.UnnegotiatedAFIAction == UNNEGOTIATED_RESET {
+						return false, notify(UPDATE_MESSAGE_ERROR, OPTIONAL_ATTRIBUTE_ERROR)
+					}
+
+					if !warned[f] {
+						warned[f] = true
+						s.warn(peer, "Ignoring UPDATE for unnegotiated "+f.String())
+					}
+
+					u.discard(accepted)
+				}
+
+				if s.update.Parameters.SoftReconfigInbound {
+					s.storePrePolicy(u, from)
+				}
+
+				s.imported(peer, s.update.Parameters.received(m, u, from))
+
+				if u.endOfRIB != (family{}) {
+					s.endOfRIB(peer, u.endOfRIB)
+				}
+
+				s.refreshed(len(u.advertised), u.endOfRIB)
+
+			case M_ROUTE_REFRESH:
+				var r routeRefresh
+
+				if !r.parse(m.Body()) {
+					return false, notify(ROUTE_REFRESH_MESSAGE_ERROR, INVALID_MESSAGE_LENGTH)
+				}
+
+				// requests are only expected if we offered the capability,
+				// otherwise just the markers around an enhanced refresh
+				// that we requested
+				switch {
+				case r.subtype == REFRESH_BORR:
+				case r.subtype == REFRESH_EORR:
+					s.refreshed(0, r.family)
+				case r.subtype != REFRESH_REQUEST:
+					// RFC 7313 section 5: unknown subtypes MUST be ignored
+				case refresh == ROUTE_REFRESH_OFF:
+					return false, notify(MESSAGE_HEADER_ERROR, BAD_MESSAGE_TYPE)
+				case s.status.State != ESTABLISHED:
+					return false, notify(FSM_ERROR, 0)
+				case !accepted[r.family]:
+					// RFC 2918 section 4: ignored if not negotiated
+				case refresh == ROUTE_REFRESH_MANUAL:
+					if l, ok := s.log().(BGPRefresh); ok {
+						l.BGPRefresh(peer, r.family.afi, r.family.safi)
+					}
+				case advertised: // otherwise the initial advertisement is still to come
+					if n, ok := resend(r.family, enhanced); !ok {
+						return false, n
+					}
+				}
 
 			default:
 				return false, notify(MESSAGE_HEADER_ERROR, BAD_MESSAGE_TYPE)
 			}
 
+		case <-stop:
+			return false, notify(CEASE, ADMINISTRATIVE_SHUTDOWN)
+
 		case r, ok := <-updates:
 
 			if !ok {
 				return false, notify(CEASE, ADMINISTRATIVE_SHUTDOWN)
 			}
 
-			if s.status.State == ESTABLISHED {
-				t := time.Now()
+			if r.reset != nil {
+				s.update = r
+				conn.queue(r.reset)
+				return false, *r.reset
+			}
+
+			if s.status.State == ESTABLISHED && !advertised {
+				s.update = r // the initial advertisement will use the latest RIB
+				if r.flush {
+					if n, ok := advertise(); !ok {
+						return false, n
+					}
+				}
+				if r.written != nil {
+					conn.then(r.written)
+				}
+				continue
+			}
+
+			if s.status.State == ESTABLISHED && r.paths != nil {
+				u := updateTemplate.withParameters(r.Parameters, remoteasn)
+				if updates, err := u.addPathUpdates(pathids, addpaths, r.paths.prefix, r.paths.candidates); err != nil {
+					return false, notify(CEASE, OUT_OF_RESOURCES)
+				} else if n, ok := s.send(conn, updates); !ok {
+					return false, n
+				}
+			} else if s.status.State == ESTABLISHED {
+				t := clock.Now()
 				p := r.Parameters
 				u := updateTemplate.withParameters(p, remoteasn)
 
-				// calculate NLRI to transmit - force re-advertisement if parameters have changed (MED, local-pref, communities)
-				//adjRIBOut, nlri = NLRI(r.adjRIBOut(ipv6), adjRIBOut, parameters.Diff(p))
-				adjRIBOut, nlri = r.nlri(adjRIBOut, ipv6, parameters.Diff(p))
+				if r.clear {
+					nlri = map[netip.Addr]bool{}
+					for _, ip := range adjRIBOut {
+						nlri[ip] = false
+					}
+					adjRIBOut = nil
+				} else if r.withdraw.IsValid() && !parameters.Diff(p) {
+					// fast path for a single withdrawal - no need to compute the full diff
+					adjRIBOut, nlri = withdrawAddr(adjRIBOut, r.withdraw)
+				} else if r.add != nil && !parameters.Diff(p) {
+					// fast path for a batch of additions - see SetRIBStreaming
+					adjRIBOut, nlri = addAddrs(adjRIBOut, p.filter(ipv6, r.add))
+				} else {
+					// calculate NLRI to transmit - force re-advertisement if parameters have changed (MED, local-pref, communities)
+					//adjRIBOut, nlri = NLRI(r.adjRIBOut(ipv6), adjRIBOut, parameters.Diff(p))
+					adjRIBOut, nlri = r.nlri(adjRIBOut, ipv6, parameters.Diff(p))
+				}
+				if rtc && rtDiff(parameters.RouteTargets, p.RouteTargets) {
+					rt := u.rtConstrain(p.RouteTargets, rtWithdrawn(parameters.RouteTargets, p.RouteTargets))
+					conn.queue(&rt)
+				}
+
 				parameters = p
 
 				//fmt.Println("Update:", adjRIBOut, nlri)
 
-				if len(nlri) > 0 {
-					if updates := u.updates(nlri); len(updates) < 1 {
+				if !r.clear { // an operator action, not a flap
+					adjRIBOut, nlri = damping.apply(adjRIBOut, nlri, clock.Now())
+				}
+
+				if n, ok := transmit(u, t); !ok {
+					return false, n
+				}
+
+				if r.clear {
+					// ADD-PATH paths too - all are removed from pathids
+					for prefix := range pathids {
+						if updates, err := u.addPathUpdates(pathids, addpaths, prefix, nil); err != nil {
+							return false, notify(CEASE, OUT_OF_RESOURCES)
+						} else if n, ok := s.send(conn, updates); !ok {
+							return false, n
+						}
+					}
+				}
+			}
+
+			if s.status.State == ESTABLISHED && s.update.clear && !r.clear {
+				// paths withdrawn by WithdrawAll are advertised again
+				u := updateTemplate.withParameters(r.Parameters, remoteasn)
+				for _, a := range s.allPaths(false) {
+					if r.paths != nil && a.prefix == r.paths.prefix {
+						continue // just sent
+					}
+					if updates, err := u.addPathUpdates(pathids, addpaths, a.prefix, a.candidates); err != nil {
 						return false, notify(CEASE, OUT_OF_RESOURCES)
-					} else {
-						conn.queue(updates...)
+					} else if n, ok := s.send(conn, updates); !ok {
+						return false, n
 					}
 				}
+			}
 
-				s.update_stats(time.Now().Sub(t), adjRIBOut, nlri)
+			if r.written != nil {
+				conn.then(r.written) // after anything sent for this update
 			}
 
 			s.update = r
 
-		case <-keepalive_timer.C:
-			if s.status.State == ESTABLISHED {
+		case <-reuse:
+			if damping.reusable(clock.Now()) && s.status.State == ESTABLISHED && advertised && !s.update.clear {
+				// suppressed prefixes still in the RIB are advertised
+				t := clock.Now()
+				u := updateTemplate.withParameters(parameters, remoteasn)
+				adjRIBOut, nlri = s.update.nlri(adjRIBOut, ipv6, false)
+				adjRIBOut, nlri = damping.apply(adjRIBOut, nlri, clock.Now())
+
+				if n, ok := transmit(u, t); !ok {
+					return false, n
+				}
+			}
+
+		case <-periodic:
+			if s.status.State == ESTABLISHED && advertised {
+				for _, f := range families {
+					if n, ok := resend(f, false); !ok {
+						return false, n
+					}
+				}
+			}
+
+		case <-advert_delay:
+			if n, ok := advertise(); !ok {
+				return false, n
+			}
+
+		case <-keepalive_timer.C():
+			if s.status.State == ESTABLISHED || s.status.State == OPEN_CONFIRM {
 				conn.queue(&keepalive{})
 			}
 
-		case <-hold_timer.C:
+		case <-hold_timer.C():
 			return false, notify(HOLD_TIMER_EXPIRED, 0)
 		}
 	}
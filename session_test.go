@@ -0,0 +1,697 @@
+package bgp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// The remote end of a session, connected over a pipe
+type testPeer struct {
+	t    *testing.T
+	conn net.Conn
+	msgs chan message
+	done chan error // result of RunConn
+	stop context.CancelFunc
+}
+
+func newTestSession(t *testing.T, p Parameters, rib []netip.Addr, l BGPNotify) (*Session, *testPeer) {
+
+	s := NewConnSession(IP{10, 0, 0, 1}, p, rib, l)
+	return s, runTestSession(t, s)
+}
+
+// Run an unstarted session against a test peer
+func runTestSession(t *testing.T, s *Session) *testPeer {
+
+	local, remote := net.Pipe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	peer := newTestPeer(t, remote)
+	peer.stop = cancel
+
+	go func() {
+		peer.done <- s.RunConn(ctx, local)
+	}()
+
+	t.Cleanup(cancel)
+
+	return peer
+}
+
+// Read messages sent by the session over the remote end of a connection
+func newTestPeer(t *testing.T, remote net.Conn) *testPeer {
+
+	peer := &testPeer{t: t, conn: remote, msgs: make(chan message, 100), done: make(chan error, 1), stop: func() {}}
+
+	go func() {
+		defer close(peer.msgs)
+		for {
+			mtype, body, err := readFrame(remote)
+			if err != nil {
+				return
+			}
+			m, _ := parseMessage(mtype, body)
+			peer.msgs <- m
+		}
+	}()
+
+	t.Cleanup(func() { remote.Close() })
+
+	return peer
+}
+
+func (p *testPeer) send(m message) {
+	if _, err := p.conn.Write(addHeader(m.Type(), m.Body())); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// Complete the OPEN exchange
+func (p *testPeer) open(asn uint16, caps ...capability) {
+	p.send(&open{version: 4, asNumber: asn, holdTime: 90, routerID: IP4{10, 0, 0, 2}, caps: caps})
+	p.send(&keepalive{})
+}
+
+// The next message other than a KEEPALIVE, or nil if none arrives in time
+func (p *testPeer) next(timeout time.Duration) message {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	for {
+		select {
+		case m, ok := <-p.msgs:
+			if !ok {
+				return nil
+			}
+			if m.Type() != M_KEEPALIVE {
+				return m
+			}
+		case <-t.C:
+			return nil
+		}
+	}
+}
+
+func TestInitialAdvertDelay(t *testing.T) {
+
+	p := Parameters{ASNumber: 65000, InitialAdvertDelay: 300 * time.Millisecond}
+
+	_, peer := newTestSession(t, p, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	start := time.Now()
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	if d := time.Now().Sub(start); d < 250*time.Millisecond {
+		t.Errorf("UPDATE sent before the delay elapsed: %v", d)
+	}
+}
+
+func TestInitialAdvertFlush(t *testing.T) {
+
+	p := Parameters{ASNumber: 65000, InitialAdvertDelay: time.Hour}
+
+	s, peer := newTestSession(t, p, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	// RIB updates while waiting are not advertised
+	s.LocRIB([]netip.Addr{ipv4_0, ipv4_1})
+
+	if m := peer.next(200 * time.Millisecond); m != nil {
+		t.Fatalf("No UPDATE should be sent during the delay: %v", m)
+	}
+
+	s.Flush()
+
+	m := peer.next(time.Second)
+
+	if m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE after flush: %v", m)
+	}
+
+	if u, n := decodeUpdate(m.Body()); n != nil || len(u.advertised) != 2 {
+		t.Errorf("UPDATE should contain the latest RIB: %v %v", n, u.advertised)
+	}
+}
+
+func TestSoftReconfigIn(t *testing.T) {
+
+	p := Parameters{ASNumber: 65000, SoftReconfigInbound: true}
+
+	s, peer := newTestSession(t, p, nil, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	a := advert{ASNumber: 65001, PeerASNumber: 65000, NextHop: [4]byte{10, 0, 0, 2}}
+	u, _ := a.message(map[netip.Addr]bool{ipv4_0: true, ipv4_1: true})
+	peer.send(&u)
+
+	for i := 0; len(s.AdjRIBIn()) != 2; i++ {
+		if i > 100 {
+			t.Fatalf("Routes not received: %v", s.AdjRIBIn())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	p.Import = []PolicyRule{
+		{Match: PolicyMatch{Prefixes: []netip.Prefix{hostRoute(ipv4_0)}}, Deny: true},
+		{Set: PolicySet{LocalPref: 200}},
+	}
+
+	s.Configure(p)
+
+	if err := s.SoftReconfigIn(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := s.AdjRIBIn()
+
+	if len(r) != 1 || r[0].Prefix != hostRoute(ipv4_1) || r[0].LocalPref != 200 {
+		t.Errorf("Import policy not re-applied: %v", r)
+	}
+
+	// and back again, from the unmodified routes
+	p.Import = nil
+	s.Configure(p)
+	s.SoftReconfigIn()
+
+	if r = s.AdjRIBIn(); len(r) != 2 || r[0].LocalPref != 0 || r[1].LocalPref != 0 {
+		t.Errorf("Original routes not restored: %v", r)
+	}
+
+	if m := peer.next(100 * time.Millisecond); m != nil {
+		t.Errorf("Nothing should be sent to the peer: %v", m)
+	}
+
+	s.p.SoftReconfigInbound = false
+
+	if err := s.SoftReconfigIn(); err == nil {
+		t.Error("Soft reconfiguration should require SoftReconfigInbound")
+	}
+}
+
+func TestSoftReconfigInEnabledLater(t *testing.T) {
+
+	p := Parameters{ASNumber: 65000}
+
+	s, peer := newTestSession(t, p, []netip.Addr{netip.MustParseAddr("10.9.9.9")}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	a := advert{ASNumber: 65001, PeerASNumber: 65000, NextHop: [4]byte{10, 0, 0, 2}}
+
+	received := func(ip netip.Addr, n int) {
+		u, _ := a.message(map[netip.Addr]bool{ip: true})
+		peer.send(&u)
+
+		for i := 0; len(s.AdjRIBIn()) != n; i++ {
+			if i > 100 {
+				t.Fatalf("Route not received: %v", s.AdjRIBIn())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	received(ipv4_0, 1)
+
+	p.SoftReconfigInbound = true
+	p.MED = 10 // so that the change is seen to be applied
+	s.Configure(p)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	received(ipv4_1, 2)
+
+	p.Import = []PolicyRule{{Match: PolicyMatch{Prefixes: []netip.Prefix{hostRoute(ipv4_1)}}, Deny: true}}
+	s.Configure(p)
+
+	if err := s.SoftReconfigIn(); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := s.AdjRIBIn(); len(r) != 1 || r[0].Prefix != hostRoute(ipv4_0) {
+		t.Errorf("Route received before soft reconfiguration was enabled should be kept: %v", r)
+	}
+}
+
+func TestSoftReconfigInLimit(t *testing.T) {
+
+	p := Parameters{ASNumber: 65000, SoftReconfigInbound: true, AdjRIBInLimit: 1}
+	p.Import = []PolicyRule{{Match: PolicyMatch{Prefixes: []netip.Prefix{hostRoute(ipv4_0)}}, Deny: true}}
+
+	s, peer := newTestSession(t, p, nil, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	a := advert{ASNumber: 65001, PeerASNumber: 65000, NextHop: [4]byte{10, 0, 0, 2}}
+	u, _ := a.message(map[netip.Addr]bool{ipv4_0: true, ipv4_1: true})
+	peer.send(&u)
+
+	for i := 0; len(s.AdjRIBIn()) != 1; i++ {
+		if i > 100 {
+			t.Fatalf("Routes not received: %v", s.AdjRIBIn())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	p.Import = nil
+	s.Configure(p)
+
+	if err := s.SoftReconfigIn(); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := s.AdjRIBIn(); len(r) != 1 || r[0].Prefix != hostRoute(ipv4_1) {
+		t.Errorf("Adj-RIB-In limit should apply: %v", r)
+	}
+}
+
+func TestRunConn(t *testing.T) {
+
+	s, peer := newTestSession(t, Parameters{ASNumber: 65000}, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	if s.Status().State != ESTABLISHED {
+		t.Error("Session should be established:", s.Status().State)
+	}
+
+	peer.stop()
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_NOTIFICATION {
+		t.Errorf("Expected NOTIFICATION: %v", m)
+	} else if n := m.(*notification); n.code != CEASE || n.sub != ADMINISTRATIVE_SHUTDOWN {
+		t.Error("Expected administrative shutdown:", n.code, n.sub)
+	}
+
+	select {
+	case err := <-peer.done:
+		if err != context.Canceled {
+			t.Error("Expected cancellation:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RunConn did not return")
+	}
+}
+
+func TestRunConnIdle(t *testing.T) {
+
+	s := NewConnSession(IP{10, 0, 0, 1}, Parameters{ASNumber: 65000}, nil, nil)
+
+	done := make(chan bool)
+
+	go func() {
+		for i := 0; i < 20; i++ {
+			s.LocRIB([]netip.Addr{ipv4_0})
+		}
+		s.LocRIB([]netip.Addr{ipv4_0, ipv4_1})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("RIB updates should not block while not connected")
+	}
+
+	peer := runTestSession(t, s)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	} else if u, n := decodeUpdate(m.Body()); n != nil || len(u.advertised) != 2 {
+		t.Errorf("UPDATE should contain the latest RIB: %v %v", n, u.advertised)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+
+	p := Parameters{ASNumber: 65000, Communities: []Community{0xfde80001}}
+
+	s, peer := newTestSession(t, p, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65000)
+
+	communities := func() []Community {
+		m := peer.next(time.Second)
+		if m == nil || m.Type() != M_UPDATE {
+			t.Fatalf("Expected UPDATE: %v", m)
+		}
+		u, n := decodeUpdate(m.Body())
+		if n != nil || len(u.advertised) != 1 {
+			t.Fatalf("Bad UPDATE: %v %v", u, n)
+		}
+		return u.attributes.Communities
+	}
+
+	if c := communities(); len(c) != 1 || c[0] != 0xfde80001 {
+		t.Fatal("Wrong initial communities:", c)
+	}
+
+	p.Communities = []Community{0xfde80002}
+	s.Configure(p)
+
+	if c := communities(); len(c) != 1 || c[0] != 0xfde80002 {
+		t.Fatal("Prefix should be re-advertised with new communities:", c)
+	}
+
+	// the function can't be compared, so is always re-applied
+	p.LocalPrefFunc = func(Route) uint32 { return 300 }
+	s.Configure(p)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	} else if u, _ := decodeUpdate(m.Body()); u.attributes.LocalPref != 300 {
+		t.Fatal("Prefix should be re-advertised with the new LOCAL_PREF:", u.attributes.LocalPref)
+	}
+
+	if st := s.Status(); st.State != ESTABLISHED || st.MessagesReceived.Open != 1 {
+		t.Error("Session should not have been reset:", st.State, st.MessagesReceived.Open)
+	}
+}
+
+func TestParametersDiff(t *testing.T) {
+
+	var a Parameters
+
+	for _, b := range []Parameters{
+		{AdvertiseSelfOnly: true},
+		{AdvertiseLearnedOnly: true},
+		{PeerType: PEER_TYPE_PEER},
+		{PeerRole: ROLE_CUSTOMER},
+		{LocalPrefFunc: func(Route) uint32 { return 0 }},
+	} {
+		if !a.Diff(b) {
+			t.Errorf("Change should be detected: %+v", b)
+		}
+	}
+
+	if a.Diff(Parameters{HoldTime: 30}) {
+		t.Error("Session level parameters don't affect attributes")
+	}
+}
+
+type withdrawnLog struct {
+	nul
+	prefixes chan []netip.Prefix
+}
+
+func (l *withdrawnLog) BGPWithdrawn(peer string, p []netip.Prefix) {
+	l.prefixes <- p
+}
+
+func TestWithdrawnConfirmation(t *testing.T) {
+
+	l := &withdrawnLog{prefixes: make(chan []netip.Prefix, 1)}
+
+	s, peer := newTestSession(t, Parameters{ASNumber: 65000}, []netip.Addr{ipv4_0, ipv4_1}, l)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	if err := s.Withdraw(hostRoute(ipv4_1)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case p := <-l.prefixes:
+		if !prefixSliceEqual(p, []netip.Prefix{hostRoute(ipv4_1)}) {
+			t.Error("Wrong prefixes confirmed:", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Withdrawal not confirmed")
+	}
+
+	// the pipe only completes a write once the peer has read it
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected withdrawal: %v", m)
+	} else if u, _ := decodeUpdate(m.Body()); !prefixSliceEqual(u.withdrawn, []netip.Prefix{hostRoute(ipv4_1)}) {
+		t.Error("Wrong prefixes withdrawn:", u.withdrawn)
+	}
+}
+
+func TestReset(t *testing.T) {
+
+	s, peer := newTestSession(t, Parameters{ASNumber: 65000}, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	s.Reset(CEASE, OTHER_CONFIGURATION_CHANGE, []byte("maintenance"), false)
+
+	m := peer.next(time.Second)
+
+	if m == nil || m.Type() != M_NOTIFICATION {
+		t.Fatalf("Expected NOTIFICATION: %v", m)
+	}
+
+	if n := m.(*notification); n.code != CEASE || n.sub != OTHER_CONFIGURATION_CHANGE || string(n.data) != "maintenance" {
+		t.Errorf("Wrong NOTIFICATION: %d %d %q", n.code, n.sub, n.data)
+	}
+
+	select {
+	case <-peer.done:
+	case <-time.After(time.Second):
+		t.Fatal("Session did not end")
+	}
+
+	if st := s.Status(); st.State != IDLE {
+		t.Error("Session should be idle:", st.State)
+	}
+}
+
+func TestPeerInfo(t *testing.T) {
+
+	s, peer := newTestSession(t, Parameters{ASNumber: 65000}, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	if _, ok := s.PeerInfo(); ok {
+		t.Error("No OPEN has been received yet")
+	}
+
+	peer.open(65001, mpCapability(IPV4_UNICAST))
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	i, ok := s.PeerInfo()
+
+	if !ok || i.ASNumber != 65001 || i.RouterID != (IP4{10, 0, 0, 2}) || i.HoldTime != 90 {
+		t.Fatalf("Wrong peer info: %v %v", i, ok)
+	}
+
+	if len(i.Capabilities) != 1 || i.Capabilities[0] != BGP4_MP {
+		t.Error("Wrong capabilities:", i.Capabilities)
+	}
+}
+
+func TestPeerOpenRaw(t *testing.T) {
+
+	s, peer := newTestSession(t, Parameters{ASNumber: 65000}, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	if raw := s.PeerOpenRaw(); raw != nil {
+		t.Error("No OPEN has been received yet:", raw)
+	}
+
+	// an unknown capability: code 200, length 2
+	peer.open(65001, mpCapability(IPV4_UNICAST), capability{code: 200, value: []byte{1, 2}})
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	// Capabilities parameter (2), length, capability code, length, value
+	expected := []byte{2, 6, BGP4_MP, 4, 0, 1, 0, 1, 2, 4, 200, 2, 1, 2}
+
+	raw := s.PeerOpenRaw()
+
+	if !bytes.Equal(raw, expected) {
+		t.Fatalf("Wrong optional parameters: %v", raw)
+	}
+
+	raw[0] = 0
+
+	if !bytes.Equal(s.PeerOpenRaw(), expected) {
+		t.Error("Optional parameters should be copied")
+	}
+}
+
+func TestKeepaliveOpenConfirm(t *testing.T) {
+
+	s, peer := newTestSession(t, Parameters{ASNumber: 65000}, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.send(&open{version: 4, asNumber: 65001, holdTime: 90, routerID: IP4{10, 0, 0, 2}})
+
+	// our KEEPALIVE confirming the OPEN, but no UPDATE until the peer's
+	select {
+	case m := <-peer.msgs:
+		if m == nil || m.Type() != M_KEEPALIVE {
+			t.Fatalf("Expected KEEPALIVE: %v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No KEEPALIVE")
+	}
+
+	if m := peer.next(100 * time.Millisecond); m != nil {
+		t.Fatalf("Nothing should be sent before the session is established: %v", m)
+	}
+
+	if st := s.Status().State; st != OPEN_CONFIRM {
+		t.Error("Expected OPEN_CONFIRM:", st)
+	}
+
+	peer.send(&keepalive{})
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	if st := s.Status().State; st != ESTABLISHED {
+		t.Error("Expected ESTABLISHED:", st)
+	}
+}
+
+func TestKeepaliveOpenSent(t *testing.T) {
+
+	_, peer := newTestSession(t, Parameters{ASNumber: 65000}, nil, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.send(&keepalive{})
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_NOTIFICATION {
+		t.Fatalf("Expected NOTIFICATION: %v", m)
+	} else if n := m.(*notification); n.code != FSM_ERROR {
+		t.Error("Expected FSM error:", n.code, n.sub)
+	}
+}
+
+func TestWithdrawAll(t *testing.T) {
+
+	p := Parameters{ASNumber: 65000, Multiprotocol: true, NextHop6: IP6{0xfd, 15: 1}}
+	rib := []netip.Addr{ipv4_0, ipv4_1, ipv6_0, ipv6_1}
+
+	s, peer := newTestSession(t, p, rib, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	s.WithdrawAll()
+
+	withdrawn := map[netip.Prefix]bool{}
+
+	for m := peer.next(time.Second); m != nil; m = peer.next(100 * time.Millisecond) {
+		d, _ := decodeUpdate(m.Body())
+		if len(d.advertised) > 0 {
+			t.Error("Nothing should be advertised:", d.advertised)
+		}
+		for _, p := range d.withdrawn {
+			withdrawn[p] = true
+		}
+	}
+
+	if len(withdrawn) != len(rib) {
+		t.Errorf("All prefixes should be withdrawn: %v", withdrawn)
+	}
+
+	if r := s.RIBOutStats(); r.IPv4+r.IPv6 != 0 {
+		t.Errorf("Adj-RIB-Out should be empty: %+v", r)
+	}
+
+	// the RIB is unchanged, so the next update advertises it again
+	s.Configure(p)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	} else if d, _ := decodeUpdate(m.Body()); len(d.advertised) != len(rib) {
+		t.Error("Prefixes should be re-advertised:", d.advertised)
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+// https://datatracker.ietf.org/doc/html/rfc8326 - Graceful BGP Session Shutdown
+// https://datatracker.ietf.org/doc/html/rfc9003 - Extended BGP Administrative Shutdown Communication
+
+import (
+	"context"
+	"strings"
+)
+
+const MAX_SHUTDOWN_COMMUNICATION = 255
+
+// Cease/Administrative Shutdown NOTIFICATION data: a length octet
+// followed by the UTF-8 encoded reason
+func shutdownCommunication(reason string) []byte {
+	if len(reason) > MAX_SHUTDOWN_COMMUNICATION {
+		reason = strings.ToValidUTF8(reason[:MAX_SHUTDOWN_COMMUNICATION], "")
+	}
+	return append([]byte{byte(len(reason))}, reason...)
+}
+
+// Re-advertise all routes with the GRACEFUL_SHUTDOWN community (see
+// Parameters.GracefulShutdown). Configure without the flag to undo.
+func (s *Session) Drain() {
+	s.drain(nil)
+}
+
+func (s *Session) drain(written func()) {
+	s.mutex.Lock()
+	s.p.GracefulShutdown = true
+	s.mutex.Unlock()
+
+	u := s.ribUpdate(nil)
+	u.written = written
+	s.c <- u
+}
+
+// Drain an established external peer for Parameters.ShutdownDrain,
+// and until it has sent Parameters.ShutdownDrainKeepalives KEEPALIVEs
+// after the re-advertisement was written (so that it has had the
+// chance to act on it), or until the context is done, then withdraw
+// all routes and close the session with a Cease/Administrative
+// Shutdown carrying the reason. Internal peers are not drained, and
+// KEEPALIVEs are not waited for if a zero hold time was negotiated.
+// The drain ends early if the session goes down. The session remains
+// down until Reset is called with down unset. Returns the context's
+// error if the drain was cut short.
+func (s *Session) Shutdown(ctx context.Context, reason string) (err error) {
+
+	s.mutex.Lock()
+	external := s.peerInfo != nil && s.peerInfo.ASNumber != s.p.ASNumber
+	established := s.status.State == ESTABLISHED
+	keepalives := s.p.ShutdownDrainKeepalives
+	if s.status.HoldTime == 0 {
+		keepalives = 0 // the peer sends none
+	}
+	s.mutex.Unlock()
+
+	if external && established {
+		w := s.awaitKeepalives(keepalives)
+		defer s.stopAwaiting(w)
+
+		s.drain(func() { s.arm(w) })
+
+		timer := s.clock().NewTimer(s.p.ShutdownDrain)
+		defer timer.Stop()
+
+		drain, counted := timer.C(), w.done
+
+		for err == nil && (drain != nil || counted != nil) {
+			select {
+			case <-drain:
+				drain = nil
+			case <-counted:
+				counted = nil
+			case <-w.down:
+				drain, counted = nil, nil
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+	}
+
+	s.WithdrawAll()
+	s.Reset(CEASE, ADMINISTRATIVE_SHUTDOWN, shutdownCommunication(reason), true)
+
+	return err
+}
+
+// Shut all sessions down concurrently
+func shutdown(ctx context.Context, sessions map[string]*Session, reason string) (err error) {
+
+	errs := make(chan error, len(sessions))
+
+	for _, session := range sessions {
+		go func(s *Session) { errs <- s.Shutdown(ctx, reason) }(session)
+	}
+
+	for range sessions {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// Closed once a number of KEEPALIVEs have been received, counting
+// from when it is armed
+type keepaliveWait struct {
+	n     int
+	armed bool
+	done  chan struct{}
+	down  chan struct{} // closed if the session goes down first
+}
+
+func (s *Session) awaitKeepalives(n int) *keepaliveWait {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	w := &keepaliveWait{n: n, done: make(chan struct{}), down: make(chan struct{})}
+
+	if n < 1 {
+		close(w.done)
+	}
+
+	s.keepalives = append(s.keepalives, w)
+
+	return w
+}
+
+// Start counting KEEPALIVEs
+func (s *Session) arm(w *keepaliveWait) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	w.armed = true
+}
+
+func (s *Session) stopAwaiting(w *keepaliveWait) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var keep []*keepaliveWait
+
+	for _, k := range s.keepalives {
+		if k != w {
+			keep = append(keep, k)
+		}
+	}
+
+	s.keepalives = keep
+}
+
+// A KEEPALIVE has been received - called with the mutex held
+func (s *Session) keepalive() {
+	for _, w := range s.keepalives {
+		if w.armed && w.n > 0 {
+			if w.n--; w.n == 0 {
+				close(w.done)
+			}
+		}
+	}
+}
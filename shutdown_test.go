@@ -0,0 +1,261 @@
+package bgp
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestShutdownCommunication(t *testing.T) {
+
+	if d := shutdownCommunication("maintenance"); d[0] != 11 || string(d[1:]) != "maintenance" {
+		t.Error("Bad shutdown communication:", d)
+	}
+
+	long := make([]byte, 300)
+	for i := range long {
+		long[i] = 'x'
+	}
+
+	if d := shutdownCommunication(string(long)); len(d) != 256 || d[0] != 255 {
+		t.Error("Shutdown communication should be truncated:", len(d))
+	}
+}
+
+func TestShutdown(t *testing.T) {
+
+	p := Parameters{ASNumber: 65000, ShutdownDrain: 200 * time.Millisecond}
+
+	sessions := map[string]*Session{}
+	peers := map[string]*testPeer{}
+
+	for _, name := range []string{"a", "b"} {
+		s, peer := newTestSession(t, p, []netip.Addr{ipv4_0}, nil)
+
+		if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+			t.Fatalf("Expected OPEN: %v", m)
+		}
+
+		peer.open(65001)
+
+		if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+			t.Fatalf("Expected UPDATE: %v", m)
+		}
+
+		sessions[name] = s
+		peers[name] = peer
+	}
+
+	done := make(chan error, 1)
+	start := time.Now()
+
+	go func() { done <- shutdown(context.Background(), sessions, "maintenance") }()
+
+	for name, peer := range peers {
+
+		// drain
+		if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+			t.Fatalf("%s: expected UPDATE: %v", name, m)
+		} else if d, _ := decodeUpdate(m.Body()); len(d.advertised) != 1 || !communityMatch([]Community{GRACEFUL_SHUTDOWN}, d.attributes.Communities) {
+			t.Errorf("%s: routes should be sent with GRACEFUL_SHUTDOWN: %v %v", name, d.advertised, d.attributes.Communities)
+		}
+
+		// withdraw
+		if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+			t.Fatalf("%s: expected UPDATE: %v", name, m)
+		} else if d, _ := decodeUpdate(m.Body()); len(d.withdrawn) != 1 {
+			t.Errorf("%s: routes should be withdrawn: %v", name, d.withdrawn)
+		}
+
+		if d := time.Now().Sub(start); d < 150*time.Millisecond {
+			t.Errorf("%s: routes withdrawn before the drain time elapsed: %v", name, d)
+		}
+
+		// cease
+		if m := peer.next(time.Second); m == nil || m.Type() != M_NOTIFICATION {
+			t.Fatalf("%s: expected NOTIFICATION: %v", name, m)
+		} else if n := m.(*notification); n.code != CEASE || n.sub != ADMINISTRATIVE_SHUTDOWN || string(n.data[1:]) != "maintenance" {
+			t.Errorf("%s: expected administrative shutdown: %d %d %q", name, n.code, n.sub, n.data)
+		}
+	}
+
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+
+	p := Parameters{ASNumber: 65000, ShutdownDrain: time.Hour}
+
+	s, peer := newTestSession(t, p, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := s.Shutdown(ctx, ""); err != context.DeadlineExceeded {
+		t.Error("Expected deadline to be exceeded:", err)
+	}
+
+	var ceased bool
+
+	for m := peer.next(time.Second); m != nil; m = peer.next(time.Second) {
+		if n, ok := m.(*notification); ok {
+			ceased = n.code == CEASE && n.sub == ADMINISTRATIVE_SHUTDOWN
+			break
+		}
+	}
+
+	if !ceased {
+		t.Error("Session should be closed with administrative shutdown")
+	}
+}
+
+func TestShutdownDrainKeepalives(t *testing.T) {
+
+	clock := newMockClock()
+
+	p := Parameters{ASNumber: 65000, HoldTime: 90, ShutdownDrain: time.Minute, ShutdownDrainKeepalives: 3}
+
+	s := NewConnSession(IP{10, 0, 0, 1}, p, []netip.Addr{ipv4_0}, nil)
+	s.timers = clock
+
+	peer := runTestSession(t, s)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	done := make(chan error, 1)
+
+	go func() { done <- s.Shutdown(context.Background(), "") }()
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	} else if d, _ := decodeUpdate(m.Body()); !communityMatch([]Community{GRACEFUL_SHUTDOWN}, d.attributes.Communities) {
+		t.Fatalf("Routes should be sent with GRACEFUL_SHUTDOWN: %v", d.attributes.Communities)
+	}
+
+	time.Sleep(50 * time.Millisecond) // KEEPALIVEs are counted once the UPDATE has been written
+	peer.send(&keepalive{})
+
+	time.Sleep(50 * time.Millisecond) // let Shutdown start the drain timer
+	clock.Advance(time.Minute)
+
+	// the drain time has elapsed, but routes are not withdrawn until
+	// the third KEEPALIVE
+	for i := 1; i < 3; i++ {
+		if m := peer.next(100 * time.Millisecond); m != nil {
+			t.Fatalf("Nothing should be sent after %d KEEPALIVEs: %v", i, m)
+		}
+
+		peer.send(&keepalive{})
+	}
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	} else if d, _ := decodeUpdate(m.Body()); len(d.withdrawn) != 1 {
+		t.Errorf("Routes should be withdrawn: %v", d.withdrawn)
+	}
+
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShutdownDrainEnds(t *testing.T) {
+
+	shutdown := func(s *Session) chan error {
+		done := make(chan error, 1)
+		go func() { done <- s.Shutdown(context.Background(), "") }()
+		return done
+	}
+
+	returns := func(what string, done chan error) {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(what, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal(what, "Shutdown should not wait for the drain")
+		}
+	}
+
+	p := Parameters{ASNumber: 65000, ShutdownDrain: time.Hour, ShutdownDrainKeepalives: 3}
+
+	// not established - the peer's OPEN has not been confirmed
+	s, peer := newTestSession(t, p, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.send(&open{version: 4, asNumber: 65001, holdTime: 90, routerID: IP4{10, 0, 0, 2}})
+
+	time.Sleep(50 * time.Millisecond)
+
+	if st := s.Status(); st.State != OPEN_CONFIRM {
+		t.Fatal("Expected OPEN_CONFIRM:", st.State)
+	}
+
+	returns("Not established:", shutdown(s))
+
+	// the peer goes away mid-drain
+	s, peer = newTestSession(t, p, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	done := shutdown(s)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	peer.send(&notification{code: CEASE, sub: ADMINISTRATIVE_SHUTDOWN})
+
+	returns("Session dropped:", done)
+
+	// zero hold time, so no KEEPALIVEs will be sent by the peer
+	p.ShutdownDrain = 100 * time.Millisecond
+
+	s, peer = newTestSession(t, p, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.send(&open{version: 4, asNumber: 65001, holdTime: 0, routerID: IP4{10, 0, 0, 2}})
+	peer.send(&keepalive{})
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	returns("Zero hold time:", shutdown(s))
+}
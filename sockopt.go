@@ -0,0 +1,163 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"syscall"
+)
+
+// Options applied to the session's socket before connecting
+type socketOptions struct {
+	keepAliveIdle     int // seconds
+	keepAliveInterval int // seconds
+	keepAliveCount    int
+	reuseAddress      bool
+	sourcePort        int         // 0 for an ephemeral port chosen by the OS
+	tlsConfig         *tls.Config // handshake once connected, if not nil
+	delay             bool        // Nagle's algorithm enabled (TCP_NODELAY cleared)
+	sendBuffer        int         // SO_SNDBUF, if non-zero
+	receiveBuffer     int         // SO_RCVBUF, if non-zero
+	mark              int         // SO_MARK, if non-zero
+	device            string      // SO_BINDTODEVICE, if not empty
+	dialer            Dialer      // replaces all of the above except tlsConfig, if not nil
+}
+
+func (p *Parameters) socketOptions() socketOptions {
+
+	port := int(p.SourcePort)
+
+	if p.RandomSourcePort {
+		port = 49152 + rand.Intn(16384) // IANA dynamic/private range
+	}
+
+	return socketOptions{
+		keepAliveIdle:     int(p.TCPKeepAliveIdle),
+		keepAliveInterval: int(p.TCPKeepAliveInterval),
+		keepAliveCount:    int(p.TCPKeepAliveCount),
+		reuseAddress:      p.ReuseAddress,
+		sourcePort:        port,
+		tlsConfig:         p.TLSConfig,
+		delay:             p.TCPDelay,
+		sendBuffer:        p.SendBuffer,
+		receiveBuffer:     p.ReceiveBuffer,
+		mark:              int(p.FwMark),
+		device:            p.BindToDevice,
+		dialer:            p.Dialer,
+	}
+}
+
+// TCP keepalive probes are managed by us rather than the net package
+func (o *socketOptions) keepAlive() bool {
+	return o.keepAliveIdle > 0 || o.keepAliveInterval > 0 || o.keepAliveCount > 0
+}
+
+type setsockopt func(level, opt, value int) error
+type setsockoptstr func(level, opt int, value string) error
+
+// Apply the options using the set function - the OS specific
+// implementation of which is in sockopt_*.go
+func (o *socketOptions) apply(set setsockopt) error {
+
+	if o.reuseAddress {
+		if err := set(syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			return err
+		}
+
+		if err := o.reusePort(set); err != nil {
+			return err
+		}
+	}
+
+	if o.keepAlive() {
+		if err := set(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1); err != nil {
+			return err
+		}
+
+		if err := o.keepAliveOptions(set); err != nil {
+			return err
+		}
+	}
+
+	if o.sendBuffer != 0 {
+		if err := set(syscall.SOL_SOCKET, syscall.SO_SNDBUF, o.sendBuffer); err != nil {
+			return fmt.Errorf("SO_SNDBUF %d: %s", o.sendBuffer, err)
+		}
+	}
+
+	if o.receiveBuffer != 0 {
+		if err := set(syscall.SOL_SOCKET, syscall.SO_RCVBUF, o.receiveBuffer); err != nil {
+			return fmt.Errorf("SO_RCVBUF %d: %s", o.receiveBuffer, err)
+		}
+	}
+
+	if o.mark != 0 {
+		if err := o.fwMark(set); err != nil {
+			return fmt.Errorf("SO_MARK %d: %s", o.mark, err)
+		}
+	}
+
+	// the net package sets TCP_NODELAY itself once connected, so this
+	// is also done in newConnection
+	if o.delay {
+		if err := set(syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Options with string values, applied as for apply()
+func (o *socketOptions) applyString(set setsockoptstr) error {
+
+	if o.device != "" {
+		if err := o.bindToDevice(set); err != nil {
+			return fmt.Errorf("SO_BINDTODEVICE %s: %s", o.device, err)
+		}
+	}
+
+	return nil
+}
+
+// Suitable for use as net.Dialer.Control
+func (o socketOptions) control(network, address string, c syscall.RawConn) error {
+
+	var err error
+
+	e := c.Control(func(fd uintptr) {
+		err = o.apply(func(level, opt, value int) error {
+			return setsockoptInt(fd, level, opt, value)
+		})
+
+		if err == nil {
+			err = o.applyString(func(level, opt int, value string) error {
+				return setsockoptString(fd, level, opt, value)
+			})
+		}
+	})
+
+	if e != nil {
+		return e
+	}
+
+	return err
+}
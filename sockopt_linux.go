@@ -0,0 +1,66 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"syscall"
+)
+
+func setsockoptInt(fd uintptr, level, opt, value int) error {
+	return syscall.SetsockoptInt(int(fd), level, opt, value)
+}
+
+func setsockoptString(fd uintptr, level, opt int, value string) error {
+	return syscall.SetsockoptString(int(fd), level, opt, value)
+}
+
+func (o *socketOptions) keepAliveOptions(set setsockopt) error {
+
+	if o.keepAliveIdle > 0 {
+		if err := set(syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, o.keepAliveIdle); err != nil {
+			return err
+		}
+	}
+
+	if o.keepAliveInterval > 0 {
+		if err := set(syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, o.keepAliveInterval); err != nil {
+			return err
+		}
+	}
+
+	if o.keepAliveCount > 0 {
+		if err := set(syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, o.keepAliveCount); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (o *socketOptions) reusePort(set setsockopt) error {
+	return set(syscall.SOL_SOCKET, SO_REUSEPORT, 1)
+}
+
+func (o *socketOptions) fwMark(set setsockopt) error {
+	return set(syscall.SOL_SOCKET, syscall.SO_MARK, o.mark)
+}
+
+func (o *socketOptions) bindToDevice(set setsockoptstr) error {
+	return set(syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, o.device)
+}
@@ -0,0 +1,213 @@
+package bgp
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+type sockopts map[[2]int]int
+
+func (s sockopts) set(level, opt, value int) error {
+	s[[2]int{level, opt}] = value
+	return nil
+}
+
+func TestTCPKeepAlive(t *testing.T) {
+
+	p := Parameters{TCPKeepAliveIdle: 30, TCPKeepAliveInterval: 5, TCPKeepAliveCount: 3}
+	o := p.socketOptions()
+	s := sockopts{}
+
+	if err := o.apply(s.set); err != nil {
+		t.Fatal(err)
+	}
+
+	want := sockopts{
+		{syscall.SOL_SOCKET, syscall.SO_KEEPALIVE}:   1,
+		{syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE}:  30,
+		{syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL}: 5,
+		{syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT}:   3,
+	}
+
+	if len(s) != len(want) {
+		t.Fatalf("Socket options incorrect: %v", s)
+	}
+
+	for k, v := range want {
+		if s[k] != v {
+			t.Fatalf("Socket option %v: expected %d, got %d", k, v, s[k])
+		}
+	}
+
+	s = sockopts{}
+	p = Parameters{}
+	o = p.socketOptions()
+
+	if err := o.apply(s.set); err != nil || len(s) != 0 {
+		t.Fatalf("No socket options should be set by default: %v", s)
+	}
+}
+
+func TestReuseAddress(t *testing.T) {
+
+	p := Parameters{ReuseAddress: true, SourcePort: 1179}
+	o := p.socketOptions()
+	s := sockopts{}
+
+	if err := o.apply(s.set); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s) != 2 || s[[2]int{syscall.SOL_SOCKET, syscall.SO_REUSEADDR}] != 1 || s[[2]int{syscall.SOL_SOCKET, SO_REUSEPORT}] != 1 {
+		t.Fatalf("Socket options incorrect: %v", s)
+	}
+
+	if o.sourcePort != 1179 {
+		t.Error("Source port should be fixed:", o.sourcePort)
+	}
+
+	p.RandomSourcePort = true
+
+	if o = p.socketOptions(); o.sourcePort < 49152 || o.sourcePort > 65535 {
+		t.Error("Random source port out of range:", o.sourcePort)
+	}
+
+	// options are applied to a real socket by the dialer hook
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	o = socketOptions{reuseAddress: true}
+	d := net.Dialer{Control: o.control}
+
+	c, err := d.Dial("tcp", l.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	raw, _ := c.(*net.TCPConn).SyscallConn()
+
+	var v int
+
+	raw.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, SO_REUSEPORT)
+	})
+
+	if err != nil || v == 0 {
+		t.Error("SO_REUSEPORT not set on socket:", v, err)
+	}
+}
+
+func TestSocketBuffers(t *testing.T) {
+
+	p := Parameters{TCPDelay: true, SendBuffer: 1 << 20, ReceiveBuffer: 1 << 19}
+	o := p.socketOptions()
+	s := sockopts{}
+
+	if err := o.apply(s.set); err != nil {
+		t.Fatal(err)
+	}
+
+	want := sockopts{
+		{syscall.SOL_SOCKET, syscall.SO_SNDBUF}:    1 << 20,
+		{syscall.SOL_SOCKET, syscall.SO_RCVBUF}:    1 << 19,
+		{syscall.IPPROTO_TCP, syscall.TCP_NODELAY}: 0,
+	}
+
+	if len(s) != len(want) {
+		t.Fatalf("Socket options incorrect: %v", s)
+	}
+
+	for k, v := range want {
+		if s[k] != v {
+			t.Fatalf("Socket option %v: expected %d, got %d", k, v, s[k])
+		}
+	}
+
+	// rejected values are reported
+	o = socketOptions{sendBuffer: 4096}
+	fail := func(level, opt, value int) error { return syscall.EINVAL }
+
+	if err := o.apply(fail); err == nil {
+		t.Error("Error from the OS should be returned")
+	}
+
+	// and applied to a real socket (Linux doubles the value for bookkeeping)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	o = socketOptions{receiveBuffer: 65536}
+	d := net.Dialer{Control: o.control}
+
+	c, err := d.Dial("tcp", l.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	raw, _ := c.(*net.TCPConn).SyscallConn()
+
+	var v, nodelay int
+
+	raw.Control(func(fd uintptr) {
+		v, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		nodelay, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	})
+
+	if v < 65536 {
+		t.Error("SO_RCVBUF not set on socket:", v)
+	}
+
+	if nodelay == 0 {
+		t.Error("TCP_NODELAY should be set by default")
+	}
+}
+
+func TestVRF(t *testing.T) {
+
+	p := Parameters{BindToDevice: "vrf-blue", FwMark: 42}
+	o := p.socketOptions()
+	s := sockopts{}
+
+	if err := o.apply(s.set); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s) != 1 || s[[2]int{syscall.SOL_SOCKET, syscall.SO_MARK}] != 42 {
+		t.Fatalf("Socket options incorrect: %v", s)
+	}
+
+	var device string
+
+	err := o.applyString(func(level, opt int, value string) error {
+		if level == syscall.SOL_SOCKET && opt == syscall.SO_BINDTODEVICE {
+			device = value
+		}
+		return nil
+	})
+
+	if err != nil || device != "vrf-blue" {
+		t.Errorf("Device should be bound: %q %v", device, err)
+	}
+
+	o = socketOptions{}
+
+	if err := o.applyString(func(int, int, string) error { return syscall.EPERM }); err != nil {
+		t.Error("No device should be bound by default:", err)
+	}
+}
@@ -0,0 +1,49 @@
+//go:build !linux
+
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"errors"
+)
+
+func setsockoptInt(fd uintptr, level, opt, value int) error {
+	return errors.New("Socket options not supported on this platform")
+}
+
+func setsockoptString(fd uintptr, level, opt int, value string) error {
+	return errors.New("Socket options not supported on this platform")
+}
+
+func (o *socketOptions) keepAliveOptions(set setsockopt) error {
+	return errors.New("TCP keepalive tuning not supported on this platform")
+}
+
+func (o *socketOptions) reusePort(set setsockopt) error {
+	return errors.New("SO_REUSEPORT not supported on this platform")
+}
+
+func (o *socketOptions) fwMark(set setsockopt) error {
+	return errors.New("SO_MARK not supported on this platform")
+}
+
+func (o *socketOptions) bindToDevice(set setsockoptstr) error {
+	return errors.New("SO_BINDTODEVICE not supported on this platform")
+}
@@ -0,0 +1,84 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"errors"
+	"net/netip"
+)
+
+const streamBatch = 1000 // prefixes per batch sent to the session
+
+// Replace the RIB with the routes returned by iter (until it returns
+// false), advertising them to the peer in batches as they are read
+// rather than computing the whole table first. onProgress, if not nil,
+// is called with the number of routes read after each batch. Prefixes
+// from the previous RIB which were not returned are withdrawn at the
+// end. Only host prefixes may be used - if any other is returned then
+// the previous RIB is restored and an error is returned.
+func (s *Session) SetRIBStreaming(iter func() (Route, bool), onProgress func(sent int)) error {
+
+	var rib []netip.Addr
+	var batch []netip.Addr
+
+	seen := map[netip.Addr]bool{}
+
+	flush := func() {
+		// rib is only ever appended to, so the update can share it
+		s.mutex.Lock()
+		u := _update{RIB: rib[:len(rib):len(rib)], Parameters: s.parameters(), add: batch}
+		s.mutex.Unlock()
+		s.c <- u
+		batch = nil
+		if onProgress != nil {
+			onProgress(len(rib))
+		}
+	}
+
+	for r, ok := iter(); ok; r, ok = iter() {
+
+		if !r.Prefix.IsValid() || !r.Prefix.IsSingleIP() {
+			s.c <- s.ribUpdate(nil)
+			return errors.New("Only host prefixes may be advertised: " + r.Prefix.String())
+		}
+
+		ip := r.Prefix.Addr().Unmap().WithZone("") // see _rib.dup()
+
+		if seen[ip] {
+			continue
+		}
+
+		seen[ip] = true
+		rib = append(rib, ip)
+		batch = append(batch, ip)
+
+		if len(batch) >= streamBatch {
+			flush()
+		}
+	}
+
+	if len(batch) > 0 {
+		flush()
+	}
+
+	// a full update to withdraw anything which is no longer present
+	s.c <- s.ribUpdate(func([]netip.Addr) []netip.Addr { return rib })
+
+	return nil
+}
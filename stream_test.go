@@ -0,0 +1,81 @@
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSetRIBStreaming(t *testing.T) {
+
+	const n = 2500
+
+	s, peer := newTestSession(t, Parameters{ASNumber: 65000}, []netip.Addr{ipv4_0}, nil)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	peer.open(65001)
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	var i int
+
+	iter := func() (Route, bool) {
+		if i >= n {
+			return Route{}, false
+		}
+		a := netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)})
+		i++
+		return Route{Prefix: hostRoute(a)}, true
+	}
+
+	var progress []int
+
+	go func() {
+		if err := s.SetRIBStreaming(iter, func(sent int) { progress = append(progress, sent) }); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	advertised := map[netip.Prefix]bool{}
+	withdrawn := map[netip.Prefix]bool{}
+
+	for len(advertised) < n || len(withdrawn) < 1 {
+		m := peer.next(time.Second)
+		if m == nil || m.Type() != M_UPDATE {
+			t.Fatalf("Expected UPDATE after %d prefixes: %v", len(advertised), m)
+		}
+		u, _ := decodeUpdate(m.Body())
+		for _, p := range u.advertised {
+			advertised[p] = true
+		}
+		for _, p := range u.withdrawn {
+			withdrawn[p] = true
+		}
+	}
+
+	if len(advertised) != n || advertised[hostRoute(ipv4_0)] {
+		t.Errorf("Wrong prefixes advertised: %d", len(advertised))
+	}
+
+	if len(withdrawn) != 1 || !withdrawn[hostRoute(ipv4_0)] {
+		t.Errorf("Previous RIB not withdrawn: %v", withdrawn)
+	}
+
+	if len(progress) != 3 || progress[0] != streamBatch || progress[2] != n {
+		t.Errorf("Unexpected progress: %v", progress)
+	}
+
+	// stats are updated after the messages are queued
+	for i := 0; i < 10 && s.Status().Prefixes != n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if p := s.Status().Prefixes; p != n {
+		t.Errorf("Wrong prefix count: %d", p)
+	}
+}
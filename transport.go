@@ -0,0 +1,136 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// A session which does not dial the peer, but is run over a connection
+// supplied by the caller - see RunConn
+func NewConnSession(id IP, p Parameters, r []netip.Addr, l BGPNotify) *Session {
+	c := make(chan _update, 10)
+	s := &Session{c: c, p: p, rib: _rib(r).dup(), logs: l, status: Status{State: IDLE}, defaults: DefaultParameters, id: id}
+	s.update = newupdate(s.parameters(), r)
+	s.stopIdle = s.idleUpdates()
+	return s
+}
+
+// Store the last update while RunConn is not running, as session()
+// does between connection attempts, so that callers don't block on a
+// full channel. The returned function stops this before a run.
+func (s *Session) idleUpdates() func() {
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			case u, ok := <-s.c:
+				if !ok {
+					return
+				}
+				s.update = u
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// Run the session over an already established connection (eg. TLS, or
+// a tunnel) rather than having the library dial the peer. Blocks until
+// the session ends, or the context is cancelled, and returns the
+// reason. The connection is closed on return. RIB and parameter
+// changes may be made from other goroutines as usual, and the session
+// may be run again over a new connection. If Parameters.TLSConfig is
+// set then the TLS handshake is performed over the connection first.
+func (s *Session) RunConn(ctx context.Context, conn net.Conn) error {
+
+	peer := conn.RemoteAddr().String()
+
+	if s.stopIdle != nil {
+		s.stopIdle()
+		defer func() { s.stopIdle = s.idleUpdates() }()
+	}
+
+	s.mutex.Lock()
+	s.peer = peer
+	s.mutex.Unlock()
+
+	dial := func(_ IP4, _ string, opts socketOptions) (*connection, error) {
+		c := conn
+		if opts.tlsConfig != nil {
+			host, _, err := net.SplitHostPort(peer)
+			if err != nil {
+				host = peer
+			}
+			if c, err = handshake(conn, host, opts.tlsConfig); err != nil {
+				return nil, err
+			}
+		}
+		return startConnection(c), nil
+	}
+
+	remote, n := s.try(s.id, peer, s.c, dial, ctx.Done())
+	e := s.ended(peer, remote, n)
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return errors.New(e)
+}
+
+// Perform the TLS client handshake on a newly established connection,
+// which is closed if the handshake fails (eg. the peer's certificate
+// could not be verified)
+func handshake(conn net.Conn, peer string, config *tls.Config) (net.Conn, error) {
+
+	config = config.Clone()
+
+	if config.ServerName == "" {
+		config.ServerName = peer
+	}
+
+	t := tls.Client(conn, config)
+
+	t.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if err := t.Handshake(); err != nil {
+		conn.Close()
+		return nil, errors.New("TLS handshake failed: " + err.Error())
+	}
+
+	t.SetDeadline(time.Time{})
+
+	return t, nil
+}
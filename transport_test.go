@@ -0,0 +1,100 @@
+package bgp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestTLSHandshake(t *testing.T) {
+
+	cert, pool := selfSigned(t)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.Write(addHeader(M_KEEPALIVE, nil))
+			}()
+		}
+	}()
+
+	dial := func(config *tls.Config) (net.Conn, error) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handshake(c, "127.0.0.1", config)
+	}
+
+	c, err := dial(&tls.Config{RootCAs: pool})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mtype, _, err := readFrame(c); err != nil || mtype != M_KEEPALIVE {
+		t.Error("Expected KEEPALIVE over TLS:", mtype, err)
+	}
+
+	c.Close()
+
+	// not signed by a trusted CA
+	if _, err = dial(&tls.Config{}); err == nil || !strings.Contains(err.Error(), "TLS handshake failed") {
+		t.Error("Expected certificate validation to fail:", err)
+	}
+}
@@ -19,12 +19,14 @@
 package bgp
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/netip"
 	"regexp"
 	"strconv"
+	"time"
 )
 
 type IP = [4]byte
@@ -98,6 +100,22 @@ func (i *IPNet) UnmarshalText(data []byte) error {
 
 type Community uint32
 
+// Well-known communities
+// https://www.iana.org/assignments/bgp-well-known-communities/bgp-well-known-communities.xhtml
+const (
+	ACCEPT_OWN   Community = 0xffff0001 // [RFC7611]
+	NO_EXPORT    Community = 0xffffff01 // [RFC1997]
+	NO_ADVERTISE Community = 0xffffff02 // [RFC1997]
+	NOPEER       Community = 0xffffff04 // [RFC3765]
+
+	GRACEFUL_SHUTDOWN Community = 0xffff0000 // [RFC8326]
+
+	// Long-lived graceful restart is not implemented, but routes may be
+	// tagged (eg. with Parameters.Communities) for peers which support it
+	LLGR_STALE Community = 0xffff0006 // [RFC9494]
+	NO_LLGR    Community = 0xffff0007 // [RFC9494]
+)
+
 func (c *Community) MarshalJSON() ([]byte, error) {
 	return []byte(`"` + fmt.Sprintf("%d:%d", (*c>>16), (*c&0xffff)) + `"`), nil
 }
@@ -130,6 +148,79 @@ func (c *Community) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// https://datatracker.ietf.org/doc/html/rfc4360 - BGP Extended Communities Attribute
+type ExtendedCommunity uint64
+
+func (c *ExtendedCommunity) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"0x%016x"`, uint64(*c))), nil
+}
+
+func (c *ExtendedCommunity) UnmarshalJSON(data []byte) error {
+	re := regexp.MustCompile(`^"0x([0-9a-fA-F]{1,16})"$`)
+
+	m := re.FindStringSubmatch(string(data))
+
+	if len(m) != 2 {
+		return errors.New("Badly formed extended community")
+	}
+
+	v, err := strconv.ParseUint(m[1], 16, 64)
+	if err != nil {
+		return err
+	}
+
+	*c = ExtendedCommunity(v)
+
+	return nil
+}
+
+// https://datatracker.ietf.org/doc/html/rfc9012#section-4.3 - Color Extended Community
+const (
+	EXT_TRANSITIVE_OPAQUE = 0x03
+	EXT_COLOR             = 0x0b
+)
+
+// The Color extended community, used to steer routes onto SR-TE
+// policies: type/sub-type, two octets of flags (zero) and the color
+func ColorExtendedCommunity(color uint32) ExtendedCommunity {
+	return ExtendedCommunity(EXT_TRANSITIVE_OPAQUE)<<56 | ExtendedCommunity(EXT_COLOR)<<48 | ExtendedCommunity(color)
+}
+
+// https://datatracker.ietf.org/doc/html/rfc8092 - BGP Large Communities Attribute
+type LargeCommunity struct {
+	GlobalAdministrator uint32
+	LocalData1          uint32
+	LocalData2          uint32
+}
+
+func (c *LargeCommunity) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%d:%d:%d"`, c.GlobalAdministrator, c.LocalData1, c.LocalData2)), nil
+}
+
+func (c *LargeCommunity) UnmarshalJSON(data []byte) error {
+	re := regexp.MustCompile(`^"(\d+):(\d+):(\d+)"$`)
+
+	m := re.FindStringSubmatch(string(data))
+
+	if len(m) != 4 {
+		return errors.New("Badly formed large community")
+	}
+
+	var v [3]uint32
+
+	for i := range v {
+		n, err := strconv.ParseUint(m[i+1], 10, 32)
+		if err != nil {
+			return errors.New("Badly formed large community")
+		}
+		v[i] = uint32(n)
+	}
+
+	*c = LargeCommunity{GlobalAdministrator: v[0], LocalData1: v[1], LocalData2: v[2]}
+
+	return nil
+}
+
 type Parameters struct {
 	// only used at session start
 	ASNumber uint16 `json:"as_number,omitempty"`
@@ -140,20 +231,263 @@ type Parameters struct {
 	NextHop6      IP6  `json:"next_hop_6,omitempty"`
 	Multiprotocol bool `json:"multiprotocol,omitempty"`
 
+	// Carry IPv4 prefixes in MP_REACH_NLRI (RFC 4760) rather than the
+	// UPDATE's NLRI field if the peer supports it, with a 4 octet next
+	// hop, or NextHop6 if NextHopLength4 is 16 and the peer supports
+	// the extended next hop encoding (RFC 8950) - other values are
+	// treated as 4
+	MultiprotocolIPv4 bool  `json:"multiprotocol_ipv4,omitempty"`
+	NextHopLength4    uint8 `json:"next_hop_length_4,omitempty"`
+
+	// per address family next hop handling - see NEXT_HOP_SELF, etc.
+	NextHopMode4 string `json:"next_hop_mode_4,omitempty"`
+	NextHopMode6 string `json:"next_hop_mode_6,omitempty"`
+
 	// can change during session
 	MED         uint32      `json:"med,omitempty"`
 	LocalPref   uint32      `json:"local_pref,omitempty"`
 	Communities []Community `json:"communities,omitempty"`
+	StripMED    bool        `json:"strip_med,omitempty"` // don't send MULTI_EXIT_DISC to external peers
+	Origin      string      `json:"origin,omitempty"`    // ORIGIN_IGP if not set
+
+	ExtendedCommunities []ExtendedCommunity `json:"extended_communities,omitempty"` // eg. ColorExtendedCommunity()
 
 	Accept []netip.Prefix `json:"accept,omitempty"`
 	Reject []netip.Prefix `json:"reject,omitempty"`
+
+	Import []PolicyRule `json:"import,omitempty"`
+	Export []PolicyRule `json:"export,omitempty"`
+
+	// If set, LOCAL_PREF for each prefix sent to an internal peer (eg.
+	// derived from an application weight) - zero leaves the default.
+	// Export policy is applied afterwards.
+	LocalPrefFunc func(Route) uint32 `json:"-"`
+
+	// Force LOCAL_PREF to be sent (true) or not (false) regardless of
+	// whether the peer is internal, for unusual peerings such as
+	// confederation sub-AS boundaries; nil follows RFC 4271
+	SendLocalPref *bool `json:"send_local_pref,omitempty"`
+
+	// Received routes with a longer AS_PATH (counted as for route
+	// selection, with an AS_SET as one) are dropped; 0 for unlimited
+	MaxASPathLength int `json:"max_as_path_length,omitempty"`
+
+	// If set, received routes with a next hop for which this returns
+	// false are handled according to UnreachableNextHop
+	NextHopReachable   func(netip.Addr) bool `json:"-"`
+	UnreachableNextHop string                `json:"unreachable_next_hop,omitempty"`
+
+	// Drop received routes with a next hop which is one of our own
+	// addresses (the local address of the connection, SourceIP,
+	// NextHop4 or NextHop6), which would otherwise blackhole traffic -
+	// routes tagged ACCEPT_OWN are exempt
+	RejectSelfNextHop bool `json:"reject_self_next_hop,omitempty"`
+
+	// Handling of UPDATEs with MP_REACH_NLRI/MP_UNREACH_NLRI for an
+	// AFI/SAFI which was not negotiated - see UNNEGOTIATED_IGNORE
+	UnnegotiatedAFIAction string `json:"unnegotiated_afi_action,omitempty"`
+
+	RetainRaw bool `json:"retain_raw,omitempty"` // include the received bytes in ReceivedMessage
+
+	// Advertise routes with this exact AS_PATH rather than one
+	// derived from our AS number - for injecting test routes
+	OriginateWithPath []uint32 `json:"originate_with_path,omitempty"`
+
+	// High-water mark for the number of messages waiting to be
+	// written to the peer (0 for unlimited), and what to do when it
+	// is reached - see QUEUE_BACKPRESSURE
+	QueueLimit  int    `json:"queue_limit,omitempty"`
+	QueuePolicy string `json:"queue_policy,omitempty"`
+
+	// Offer the route refresh capabilities, and re-send the routes in
+	// a family when the peer requests it (ROUTE_REFRESH_AUTO) or leave
+	// it to the application (ROUTE_REFRESH_MANUAL) - see BGPRefresh.
+	// Also needed for Session.RequestFullTable.
+	RouteRefresh string `json:"route_refresh,omitempty"`
+
+	// Maximum number of UPDATEs that a single change to the RIB may
+	// be split into (eg. if the path attributes are very large) before
+	// the session is closed - DEFAULT_MAX_FRAGMENTS if 0
+	MaxFragments int `json:"max_fragments,omitempty"`
+
+	// Maximum depth of nested structures in received NLRI, such as the
+	// MPLS label stack - routes exceeding it are treated as withdrawn;
+	// DEFAULT_MAX_DECODE_DEPTH if 0
+	MaxDecodeDepth int `json:"max_decode_depth,omitempty"`
+
+	// Re-send the whole Adj-RIB-Out at this interval, as a safeguard
+	// against the peer's view diverging from ours - 0 (the default)
+	// to disable; set at session start
+	RefreshInterval time.Duration `json:"refresh_interval,omitempty"`
+
+	// TCP keepalive probes, as a backstop to BGP KEEPALIVEs - enabled
+	// if any are non-zero (idle and interval are in seconds)
+	TCPKeepAliveIdle     uint16 `json:"tcp_keepalive_idle,omitempty"`
+	TCPKeepAliveInterval uint16 `json:"tcp_keepalive_interval,omitempty"`
+	TCPKeepAliveCount    uint8  `json:"tcp_keepalive_count,omitempty"`
+
+	// Nagle's algorithm is disabled (TCP_NODELAY), so that small
+	// messages such as KEEPALIVEs are sent immediately, unless TCPDelay
+	// is set. Socket buffer sizes may be raised for transferring large
+	// tables - 0 leaves the OS default. The OS may reject a value, in
+	// which case the connection fails.
+	TCPDelay      bool `json:"tcp_delay,omitempty"`
+	SendBuffer    int  `json:"send_buffer,omitempty"`
+	ReceiveBuffer int  `json:"receive_buffer,omitempty"`
+
+	// Bind the session's socket to a device, such as a VRF, and/or
+	// set its firewall mark to select a routing table (Linux only -
+	// the connection fails on other platforms)
+	BindToDevice string `json:"bind_to_device,omitempty"`
+	FwMark       uint32 `json:"fw_mark,omitempty"`
+
+	// Set SO_REUSEADDR/SO_REUSEPORT so that a lingering socket in
+	// TIME_WAIT does not prevent reconnecting from the same address,
+	// and use a fixed (or random, rather than ephemeral) source port
+	ReuseAddress     bool   `json:"reuse_address,omitempty"`
+	SourcePort       uint16 `json:"source_port,omitempty"`
+	RandomSourcePort bool   `json:"random_source_port,omitempty"`
+
+	// Advertise the graceful restart capability (RFC 4724) - the peer
+	// retains our routes for RestartTime seconds (default 120) after
+	// the session drops, and we refresh them when it is re-established.
+	// Likewise, routes from a restarting peer are retained as stale.
+	GracefulRestart bool   `json:"graceful_restart,omitempty"`
+	RestartTime     uint16 `json:"restart_time,omitempty"`
+
+	// Maximum number of paths per prefix to advertise to a peer which
+	// supports ADD-PATH (RFC 7911) - see Session.AddPaths
+	AddPathSendCount int `json:"add_path_send_count,omitempty"`
+
+	// Route targets for which we want to receive VPN routes, sent as
+	// RT membership NLRI (RFC 4684) if the peer supports the SAFI
+	RouteTargets []ExtendedCommunity `json:"route_targets,omitempty"`
+
+	// Time to wait after the session is established before sending the
+	// initial advertisement, to let the application populate the RIB
+	InitialAdvertDelay time.Duration `json:"initial_advert_delay,omitempty"`
+
+	// Attributes for prefixes advertised as a backup - see
+	// Session.SetBackup
+	Backup *Backup `json:"backup,omitempty"`
+
+	// A peer may propose a hold time of zero, which disables the hold
+	// timer and KEEPALIVEs (RFC 4271 4.2), unless RejectZeroHoldTime
+	// is set, in which case its OPEN is refused. If
+	// ZeroHoldTimeKeepalive is set then we send KEEPALIVEs at that
+	// interval anyway, for peers which misbehave without them.
+	RejectZeroHoldTime    bool          `json:"reject_zero_hold_time,omitempty"`
+	ZeroHoldTimeKeepalive time.Duration `json:"zero_hold_time_keepalive,omitempty"`
+
+	// Time a change reported by Session.SetHealth must persist before
+	// the prefix is advertised or withdrawn; 0 to apply immediately
+	HealthDebounce time.Duration `json:"health_debounce,omitempty"`
+
+	// Attach the GRACEFUL_SHUTDOWN community (RFC 8326) to all routes,
+	// with a LOCAL_PREF of 0 where LOCAL_PREF is sent, so that the peer
+	// moves traffic away before the session is closed - see Drain()
+	GracefulShutdown bool `json:"graceful_shutdown,omitempty"`
+
+	// Time to leave a drained external peer before withdrawing routes
+	// and closing the session, and the number of KEEPALIVEs which must
+	// also be received from it meanwhile - see Session.Shutdown
+	ShutdownDrain           time.Duration `json:"shutdown_drain,omitempty"`
+	ShutdownDrainKeepalives int           `json:"shutdown_drain_keepalives,omitempty"`
+
+	// Send only locally originated routes (the RIB) or only learned
+	// routes (see Session.AddPaths) to the peer, rather than both,
+	// without needing export policy
+	AdvertiseSelfOnly    bool `json:"advertise_self_only,omitempty"`
+	AdvertiseLearnedOnly bool `json:"advertise_learned_only,omitempty"`
+
+	// Maximum number of routes stored in the Adj-RIB-In (0 for no
+	// limit), eg. for a monitoring session with a full table. When it
+	// is full a new route is rejected, or the least recently updated
+	// route is evicted to make room - see EVICT_REJECT_NEW/EVICT_LRU
+	AdjRIBInLimit    int    `json:"adj_rib_in_limit,omitempty"`
+	AdjRIBInEviction string `json:"adj_rib_in_eviction,omitempty"`
+
+	// Report routes re-advertised by the peer with no changes (eg.
+	// after a route refresh) to the BGPImport - by default these are
+	// dropped so that only changes are reported
+	ReportDuplicates bool `json:"report_duplicates,omitempty"`
+
+	// LOCAL_PREF for received routes which don't carry one (ie. from
+	// external peers) - eg. 200 for customers, 50 for transit
+	DefaultLocalPref uint32 `json:"default_local_pref,omitempty"`
+
+	// Keep received routes before import policy is applied, so that
+	// policy changes can be applied with Session.SoftReconfigIn
+	SoftReconfigInbound bool `json:"soft_reconfig_inbound,omitempty"`
+
+	// Damp flapping prefixes in our advertisements - set at session start
+	Damping *Damping `json:"damping,omitempty"`
+
+	// Relationship with the neighbour - see PEER_TYPE_PEER
+	PeerType string `json:"peer_type,omitempty"`
+
+	// Our BGP Role (RFC 9234) on the session - see ROLE_PROVIDER. The
+	// capability is sent in the OPEN, and the Only to Customer (OTC)
+	// attribute is used to prevent route leaks.
+	PeerRole string `json:"peer_role,omitempty"`
+
+	// Run the session over TLS, completing the handshake before the
+	// OPEN is sent. ServerName defaults to the peer's address.
+	TLSConfig *tls.Config `json:"-"`
+
+	// Used to connect to the peer instead of the net package, in
+	// which case SourceIP, SourcePort and other socket options are
+	// the dialer's responsibility
+	Dialer Dialer `json:"-"`
+
+	// Sent to the peer in the Software Version capability, for
+	// inventory purposes - see Session.Negotiated
+	SoftwareVersion string `json:"software_version,omitempty"`
 }
 
+const (
+	PEER_TYPE_UNSPECIFIED = ""
+	PEER_TYPE_CUSTOMER    = "customer"
+	PEER_TYPE_PEER        = "peer"    // bilateral peer - routes tagged NOPEER are not advertised
+	PEER_TYPE_TRANSIT     = "transit" // upstream provider
+)
+
+const (
+	QUEUE_BACKPRESSURE = ""      // stop processing RIB updates until the queue drains
+	QUEUE_CEASE        = "cease" // tear down the session with a Cease NOTIFICATION
+)
+
+const (
+	NEXT_HOP_DEFAULT   = ""          // NextHop4/NextHop6 if set, otherwise the session's local address; export policy may override, and relayed paths keep the received next hop for internal peers only
+	NEXT_HOP_SELF      = "self"      // always the session's local address
+	NEXT_HOP_REWRITE   = "rewrite"   // always NextHop4/NextHop6 (or local address if not set)
+	NEXT_HOP_UNCHANGED = "unchanged" // as NEXT_HOP_DEFAULT, but relayed paths keep the received next hop for external peers too
+)
+
 func (a *Parameters) Diff(b Parameters) bool {
 
 	if a.LocalPref != b.LocalPref ||
 		a.MED != b.MED ||
-		len(a.Communities) != len(b.Communities) {
+		a.StripMED != b.StripMED ||
+		a.Origin != b.Origin ||
+		a.GracefulShutdown != b.GracefulShutdown ||
+		tristate(a.SendLocalPref) != tristate(b.SendLocalPref) ||
+		len(a.Communities) != len(b.Communities) ||
+		a.NextHopMode4 != b.NextHopMode4 ||
+		a.NextHopMode6 != b.NextHopMode6 ||
+		fmt.Sprint(a.OriginateWithPath) != fmt.Sprint(b.OriginateWithPath) ||
+		fmt.Sprint(a.ExtendedCommunities) != fmt.Sprint(b.ExtendedCommunities) ||
+		fmt.Sprint(a.Backup) != fmt.Sprint(b.Backup) ||
+		a.AdvertiseSelfOnly != b.AdvertiseSelfOnly ||
+		a.AdvertiseLearnedOnly != b.AdvertiseLearnedOnly ||
+		a.PeerType != b.PeerType ||
+		a.PeerRole != b.PeerRole ||
+		policyDiff(a.Export, b.Export) {
+		return true
+	}
+
+	// functions can't be compared, so assume that the result may differ
+	if a.LocalPrefFunc != nil || b.LocalPrefFunc != nil {
 		return true
 	}
 
@@ -168,6 +502,16 @@ func (a *Parameters) Diff(b Parameters) bool {
 	return false
 }
 
+func tristate(b *bool) int {
+	switch {
+	case b == nil:
+		return 0
+	case *b:
+		return 1
+	}
+	return -1
+}
+
 type IP4 [4]byte
 
 func (i *IP4) UnmarshalJSON(d []byte) error {
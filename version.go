@@ -0,0 +1,48 @@
+/*
+ * VC5 load balancer. Copyright (C) 2021-present David Coles
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package bgp
+
+import "unicode/utf8"
+
+const SOFTWARE_VERSION = 75
+
+// Software Version capability (draft-ietf-idr-software-version):
+// Version Length[1], Version[...] - UTF-8, up to 64 octets
+func softwareVersion(v string) capability {
+	if len(v) > 64 {
+		v = v[:64]
+	}
+	for !utf8.ValidString(v) {
+		v = v[:len(v)-1] // don't leave a truncated multi-byte character
+	}
+	return capability{code: SOFTWARE_VERSION, value: append([]byte{byte(len(v))}, v...)}
+}
+
+// The peer's software version, if sent - a malformed capability is
+// ignored as it is for information only
+func peerSoftwareVersion(caps []capability) string {
+	for _, c := range caps {
+		if c.code == SOFTWARE_VERSION && len(c.value) > 0 && int(c.value[0]) == len(c.value)-1 {
+			if v := string(c.value[1:]); utf8.ValidString(v) {
+				return v
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,47 @@
+package bgp
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSoftwareVersion(t *testing.T) {
+
+	p := Parameters{ASNumber: 65000, SoftwareVersion: "vc5/1.2.3"}
+
+	s, peer := newTestSession(t, p, []netip.Addr{ipv4_0}, nil)
+
+	m := peer.next(time.Second)
+
+	if m == nil || m.Type() != M_OPEN {
+		t.Fatalf("Expected OPEN: %v", m)
+	}
+
+	caps, _ := m.(*open).capabilities()
+
+	if v := peerSoftwareVersion(caps); v != "vc5/1.2.3" {
+		t.Error("Software version not sent:", v)
+	}
+
+	peer.open(65001, softwareVersion("FRRouting/9.1"), capability{code: SOFTWARE_VERSION, value: []byte{10, 'x'}})
+
+	if m := peer.next(time.Second); m == nil || m.Type() != M_UPDATE {
+		t.Fatalf("Expected UPDATE: %v", m)
+	}
+
+	if v := s.Negotiated().SoftwareVersion; v != "FRRouting/9.1" {
+		t.Error("Peer's software version not recorded:", v)
+	}
+
+	// malformed capabilities are ignored rather than resetting the session
+	if v := peerSoftwareVersion([]capability{{code: SOFTWARE_VERSION, value: []byte{10, 'x'}}}); v != "" {
+		t.Error("Malformed capability should be ignored:", v)
+	}
+
+	long := softwareVersion(string(make([]byte, 100)))
+
+	if len(long.value) != 65 || long.value[0] != 64 {
+		t.Error("Version should be truncated to 64 octets:", len(long.value))
+	}
+}